@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/dhcgn/mbox-to-imap/mbox"
+	"github.com/spf13/cobra"
+)
+
+var (
+	indexFormat      string
+	indexWorkers     int
+	indexHashMode    string
+	inspectPosition  int
+	inspectMessageID string
+)
+
+var indexCmd = &cobra.Command{
+	Use:   "index [mbox file]",
+	Short: "Write a sidecar index with the offset, length, Message-ID, date and hash of every message",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		mboxPath := args[0]
+
+		format, err := mbox.ParseFormat(indexFormat)
+		if err != nil {
+			return err
+		}
+		if indexWorkers <= 0 {
+			return fmt.Errorf("--workers must be positive")
+		}
+
+		fmt.Println("Indexing mbox file:", mboxPath)
+		started := time.Now()
+
+		index, err := mbox.BuildIndex(context.Background(), mboxPath, format, indexWorkers, indexHashMode)
+		if err != nil {
+			return fmt.Errorf("error indexing mbox file: %w", err)
+		}
+		if err := mbox.SaveIndex(mboxPath, index); err != nil {
+			return err
+		}
+
+		fmt.Printf("Indexed %d messages (%s, %d bytes) in %s\n", len(index.Entries), index.Format, index.Size, time.Since(started).Round(time.Millisecond))
+		fmt.Printf("Index saved to: %s\n", mbox.IndexPath(mboxPath))
+		return nil
+	},
+}
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect [mbox file]",
+	Short: "Print a single message of an indexed mbox file",
+	Long: "Print a single message of an indexed mbox file, selected by its position or Message-ID.\n" +
+		"The message is written to stdout as it would be uploaded, its index entry to stderr.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		mboxPath := args[0]
+
+		if cmd.Flags().Changed("message") == (inspectMessageID != "") {
+			return fmt.Errorf("exactly one of --message and --message-id is required")
+		}
+
+		index, err := mbox.LoadIndex(mboxPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("no index for %s, run the index command first", mboxPath)
+		}
+		if err != nil {
+			return fmt.Errorf("load index: %w", err)
+		}
+		if err := index.Validate(mboxPath); err != nil {
+			return fmt.Errorf("%w, run the index command again", err)
+		}
+
+		position := inspectPosition
+		if inspectMessageID != "" {
+			var ok bool
+			if position, ok = index.Find(inspectMessageID); !ok {
+				return fmt.Errorf("message id %q not in index", inspectMessageID)
+			}
+		}
+
+		raw, err := mbox.ReadIndexed(mboxPath, index, position)
+		if err != nil {
+			return err
+		}
+
+		entry := index.Entries[position]
+		fmt.Fprintf(os.Stderr, "Message:    %d\n", position)
+		fmt.Fprintf(os.Stderr, "Offset:     %d\n", entry.Offset)
+		fmt.Fprintf(os.Stderr, "Length:     %d\n", entry.Length)
+		fmt.Fprintf(os.Stderr, "Message-ID: %s\n", entry.MessageID)
+		if !entry.Date.IsZero() {
+			fmt.Fprintf(os.Stderr, "Date:       %s\n", entry.Date.Format(time.RFC3339))
+		}
+		fmt.Fprintf(os.Stderr, "Hash:       %s\n\n", entry.Hash)
+
+		_, err = os.Stdout.Write(raw)
+		return err
+	},
+}
+
+func init() {
+	indexCmd.Flags().StringVar(&indexFormat, "mbox-format", "auto", "Mbox variant: auto, mboxo, mboxrd, mboxcl, mboxcl2")
+	indexCmd.Flags().IntVar(&indexWorkers, "workers", runtime.NumCPU(), "Number of goroutines parsing byte ranges of the file")
+	indexCmd.Flags().StringVar(&indexHashMode, "hash-mode", "raw", "Hash mode of the entries, must match the importer's --hash-mode: raw or canonical")
+	rootCmd.AddCommand(indexCmd)
+
+	inspectCmd.Flags().IntVar(&inspectPosition, "message", 0, "Position of the message in the file, starting at 0")
+	inspectCmd.Flags().StringVar(&inspectMessageID, "message-id", "", "Message-ID of the message, without angle brackets")
+	rootCmd.AddCommand(inspectCmd)
+}
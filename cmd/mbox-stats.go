@@ -4,11 +4,14 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dhcgn/mbox-to-imap/filter"
 	"github.com/dhcgn/mbox-to-imap/mbox"
@@ -18,27 +21,54 @@ import (
 
 var (
 	reportDir     string
+	mboxFormat    string
 	topN          int
 	includeHeader []string
 	includeBody   []string
 	excludeHeader []string
 	excludeBody   []string
+	filterExpr    string
+	decodeBody    bool
+	bodyTypes     []string
+	sinceValue    string
+	untilValue    string
+	minSizeValue  string
+	maxSizeValue  string
+	includeLabels []string
+	excludeLabels []string
+	spamTrash     bool
+	rulesFile     string
+	sieveFile     string
+	threadClosure bool
+	explainFile   string
 )
 
 var mboxStatsCmd = &cobra.Command{
 	Use:   "mbox-stats [mbox file]",
 	Short: "Analyse the mbox file and show statistics",
 	Args:  cobra.ExactArgs(1),
-	RunE: func(cmd *cobra.Command, args []string) error {
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
 		mboxPath := args[0]
 
 		fmt.Println("Analyzing mbox file:", mboxPath)
 
-		// Validate filter flags
-		includeActive := len(includeHeader) > 0 || len(includeBody) > 0
-		excludeActive := len(excludeHeader) > 0 || len(excludeBody) > 0
-		if includeActive && excludeActive {
-			return fmt.Errorf("include and exclude flags are mutually exclusive")
+		format, err := mbox.ParseFormat(mboxFormat)
+		if err != nil {
+			return err
+		}
+
+		var explain *filter.ExplainWriter
+		if explainFile != "" {
+			writer, closeExplain, createErr := createExplainWriter(explainFile)
+			if createErr != nil {
+				return createErr
+			}
+			defer func() {
+				if closeErr := closeExplain(); err == nil {
+					err = closeErr
+				}
+			}()
+			explain = writer
 		}
 
 		// Create filter
@@ -47,12 +77,44 @@ var mboxStatsCmd = &cobra.Command{
 			IncludeBody:   includeBody,
 			ExcludeHeader: excludeHeader,
 			ExcludeBody:   excludeBody,
+			Expression:    filterExpr,
+			DecodeBody:    decodeBody,
+			BodyTypes:     bodyTypes,
+			IncludeLabels: includeLabels,
+			ExcludeLabels: excludeLabels,
+		}
+		if spamTrash {
+			filterOpts.ExcludeLabels = append(slices.Clone(excludeLabels), filter.SpamTrashLabels...)
+		}
+		if err := parseRangeFlags(&filterOpts); err != nil {
+			return err
+		}
+		if rulesFile != "" {
+			if filterOpts.Rules, err = filter.LoadRules(rulesFile); err != nil {
+				return fmt.Errorf("invalid --rules: %w", err)
+			}
+		}
+		if sieveFile != "" {
+			script, err := filter.LoadSieve(sieveFile)
+			if err != nil {
+				return fmt.Errorf("invalid --sieve: %w", err)
+			}
+			if script != nil {
+				filterOpts.Sieve = script.String()
+			}
 		}
 		f, err := filter.New(filterOpts)
 		if err != nil {
 			return fmt.Errorf("create filter: %w", err)
 		}
 
+		var threads *filter.ThreadSet
+		if threadClosure {
+			if threads, err = scanThreads(mboxPath, format, filterOpts); err != nil {
+				return err
+			}
+		}
+
 		counter := make(map[string]map[string]int)
 		headersToTrack := []string{"Delivered-To", "Subject", "From", "To"}
 		for _, h := range headersToTrack {
@@ -103,7 +165,59 @@ var mboxStatsCmd = &cobra.Command{
 				fmt.Println()
 			}
 
+			if len(filterStats.IncludeLabels) > 0 {
+				hasFilterStats = true
+				fmt.Println("Include Labels:")
+				printFilterHits(filterStats.IncludeLabels, filterStats.IncludeLabelHits)
+				fmt.Println()
+			}
+
+			if len(filterStats.ExcludeLabels) > 0 {
+				hasFilterStats = true
+				fmt.Println("Exclude Labels:")
+				printFilterHits(filterStats.ExcludeLabels, filterStats.ExcludeLabelHits)
+				fmt.Println()
+			}
+
+			if len(filterStats.Rules) > 0 {
+				hasFilterStats = true
+				fmt.Println("Rules:")
+				printRuleHits(filterStats)
+				fmt.Println()
+			}
+
+			if filterStats.Sieve {
+				hasFilterStats = true
+				fmt.Println("Sieve Script:")
+				printSieve(filterStats)
+				fmt.Println()
+			}
+
+			if threads != nil {
+				hasFilterStats = true
+				stats := threads.Stats()
+				fmt.Println("Thread Closure:")
+				fmt.Printf("  %d threads of %d messages, %d with a message passing the filters\n", stats.Threads, stats.Messages, stats.Selected)
+				fmt.Printf("  %d messages added for their thread\n", stats.Added)
+				fmt.Println()
+			}
+
+			if hasRanges(filterStats) {
+				hasFilterStats = true
+				fmt.Println("Date and Size Ranges:")
+				printRanges(filterStats)
+				fmt.Println()
+			}
+
+			if filterStats.Expression != "" {
+				hasFilterStats = true
+				fmt.Println("Filter Expression:")
+				fmt.Printf("  %s: %d matches\n", filterStats.Expression, filterStats.ExpressionMatches)
+				fmt.Println()
+			}
+
 			if hasFilterStats {
+				printFilterStages(filterStats)
 				fmt.Println("---")
 				fmt.Println()
 			}
@@ -115,13 +229,26 @@ var mboxStatsCmd = &cobra.Command{
 			}
 		}
 
-		err = mbox.Read(mboxPath, func(m *mbox.MboxMessage) error {
+		err = mbox.Read(mboxPath, format, func(m *mbox.MboxMessage) error {
 			// Apply filter
 			headerBytes, readErr := io.ReadAll(strings.NewReader(formatHeaders(m.Headers)))
 			if readErr != nil {
 				return readErr
 			}
-			if !f.Allows(headerBytes, m.Body) {
+			message := filter.Message{Header: headerBytes, Body: m.Body, Size: m.Size, Date: m.Date, Envelope: m.Envelope}
+			result, err := f.Evaluate(message)
+			if err != nil {
+				return err
+			}
+			if threads != nil {
+				if result, err = threads.Apply(message, result); err != nil {
+					return err
+				}
+			}
+			if explain != nil {
+				explain.Write(filter.Explain(m.Index, headerBytes, result))
+			}
+			if !result.Allowed {
 				skippedCount++
 				return nil
 			}
@@ -160,11 +287,26 @@ var mboxStatsCmd = &cobra.Command{
 
 func init() {
 	mboxStatsCmd.Flags().StringVarP(&reportDir, "output", "o", ".", "Output directory for CSV reports")
+	mboxStatsCmd.Flags().StringVar(&mboxFormat, "mbox-format", "auto", "Mbox variant: auto, mboxo, mboxrd, mboxcl, mboxcl2")
 	mboxStatsCmd.Flags().IntVarP(&topN, "top", "t", 10, "Number of top items to display in statistics")
-	mboxStatsCmd.Flags().StringArrayVar(&includeHeader, "include-header", nil, "Regex allow-list applied to message headers (mutually exclusive with exclude flags)")
-	mboxStatsCmd.Flags().StringArrayVar(&includeBody, "include-body", nil, "Regex allow-list applied to message bodies (mutually exclusive with exclude flags)")
-	mboxStatsCmd.Flags().StringArrayVar(&excludeHeader, "exclude-header", nil, "Regex block-list applied to message headers (mutually exclusive with include flags)")
-	mboxStatsCmd.Flags().StringArrayVar(&excludeBody, "exclude-body", nil, "Regex block-list applied to message bodies (mutually exclusive with include flags)")
+	mboxStatsCmd.Flags().StringArrayVar(&includeHeader, "include-header", nil, "Regex allow-list applied to message headers (applied before the exclude flags)")
+	mboxStatsCmd.Flags().StringArrayVar(&includeBody, "include-body", nil, "Regex allow-list applied to message bodies (applied before the exclude flags)")
+	mboxStatsCmd.Flags().StringArrayVar(&excludeHeader, "exclude-header", nil, "Regex block-list applied to message headers (applied after the include flags)")
+	mboxStatsCmd.Flags().StringArrayVar(&excludeBody, "exclude-body", nil, "Regex block-list applied to message bodies (applied after the include flags)")
+	mboxStatsCmd.Flags().StringVar(&filterExpr, "filter", "", "Filter expression, e.g. 'from ~ \"@corp\\.com$\" and size < 10MB' (see README)")
+	mboxStatsCmd.Flags().StringArrayVar(&includeLabels, "include-label", nil, "Only count messages carrying this Gmail label or one nested below it (X-Gmail-Labels)")
+	mboxStatsCmd.Flags().StringArrayVar(&excludeLabels, "exclude-label", nil, "Skip messages carrying this Gmail label or one nested below it (X-Gmail-Labels)")
+	mboxStatsCmd.Flags().BoolVar(&spamTrash, "exclude-spam-trash", true, "Skip messages labeled Spam or Trash (X-Gmail-Labels)")
+	mboxStatsCmd.Flags().StringVar(&sinceValue, "since", "", "Only count messages dated on or after this date (YYYY-MM-DD or RFC 3339)")
+	mboxStatsCmd.Flags().StringVar(&untilValue, "until", "", "Only count messages dated on or before this date (YYYY-MM-DD includes the whole day, or RFC 3339)")
+	mboxStatsCmd.Flags().StringVar(&minSizeValue, "min-size", "", "Only count messages of at least this size, e.g. 10KB")
+	mboxStatsCmd.Flags().StringVar(&maxSizeValue, "max-size", "", "Only count messages of at most this size, e.g. 25MB")
+	mboxStatsCmd.Flags().BoolVar(&decodeBody, "decode-body", false, "Match body filters against the decoded text parts instead of the raw body")
+	mboxStatsCmd.Flags().StringArrayVar(&bodyTypes, "body-content-type", nil, "Content type whose parts --decode-body matches, e.g. text/plain or text/* (default text/plain and text/html)")
+	mboxStatsCmd.Flags().StringVar(&rulesFile, "rules", "", "YAML file of named include, exclude and route rules (see README)")
+	mboxStatsCmd.Flags().BoolVar(&threadClosure, "thread-closure", false, "Count whole threads (by Message-ID, In-Reply-To and References) when any of their messages passes the filters; excludes, ranges and Sieve discard still drop single messages")
+	mboxStatsCmd.Flags().StringVar(&sieveFile, "sieve", "", "Sieve script (RFC 5228 subset) deciding which messages are counted (see README)")
+	mboxStatsCmd.Flags().StringVar(&explainFile, "explain-filters", "", "Write the filter decision about every message, with the rules that decided it, to this CSV file")
 	rootCmd.AddCommand(mboxStatsCmd)
 }
 
@@ -283,3 +425,139 @@ func printFilterHits(patterns []string, hits map[string]int) {
 		}
 	}
 }
+
+// parseRangeFlags sets the date and size ranges of opts from the flags.
+func parseRangeFlags(opts *filter.Options) error {
+	var err error
+	if opts.Since, err = filter.ParseDateBound(sinceValue, false); err != nil {
+		return fmt.Errorf("invalid --since: %w", err)
+	}
+	if opts.Until, err = filter.ParseDateBound(untilValue, true); err != nil {
+		return fmt.Errorf("invalid --until: %w", err)
+	}
+	if opts.MinSize, err = filter.ParseSizeBound(minSizeValue); err != nil {
+		return fmt.Errorf("invalid --min-size: %w", err)
+	}
+	if opts.MaxSize, err = filter.ParseSizeBound(maxSizeValue); err != nil {
+		return fmt.Errorf("invalid --max-size: %w", err)
+	}
+	return nil
+}
+
+func hasDateRange(stats filter.FilterStats) bool {
+	return !stats.Since.IsZero() || !stats.Until.IsZero()
+}
+
+func hasSizeRange(stats filter.FilterStats) bool {
+	return stats.MinSize > 0 || stats.MaxSize > 0
+}
+
+func hasRanges(stats filter.FilterStats) bool {
+	return hasDateRange(stats) || hasSizeRange(stats)
+}
+
+// printRanges prints the date and size ranges, "*" marking an open bound.
+func printRanges(stats filter.FilterStats) {
+	bound := func(set bool, value string) string {
+		if !set {
+			return "*"
+		}
+		return value
+	}
+	if hasDateRange(stats) {
+		fmt.Printf("  date: %s .. %s\n",
+			bound(!stats.Since.IsZero(), stats.Since.Format(time.RFC3339)),
+			bound(!stats.Until.IsZero(), stats.Until.Format(time.RFC3339)))
+	}
+	if hasSizeRange(stats) {
+		fmt.Printf("  size: %s .. %s\n",
+			bound(stats.MinSize > 0, fmt.Sprintf("%d bytes", stats.MinSize)),
+			bound(stats.MaxSize > 0, fmt.Sprintf("%d bytes", stats.MaxSize)))
+	}
+}
+
+// printRuleHits prints the hits of every rule in file order, the order
+// routes are tried in.
+func printRuleHits(stats filter.FilterStats) {
+	for _, rule := range stats.Rules {
+		action := rule.Action
+		if rule.Action == filter.RuleRoute {
+			action += " -> " + rule.Folder
+		}
+		fmt.Printf("  %s (%s %s): %d hits\n", rule.Name, rule.Type, action, stats.RuleHits[rule.Name])
+	}
+}
+
+// scanThreads reads the mbox file once to collect its threads for thread
+// closure, with a filter of its own so the statistics only count the second
+// pass.
+func scanThreads(path string, format mbox.Format, opts filter.Options) (*filter.ThreadSet, error) {
+	f, err := filter.New(opts)
+	if err != nil {
+		return nil, fmt.Errorf("create filter: %w", err)
+	}
+	threads, err := filter.NewThreadSet(opts)
+	if err != nil {
+		return nil, fmt.Errorf("create filter: %w", err)
+	}
+	err = mbox.Read(path, format, func(m *mbox.MboxMessage) error {
+		header := []byte(formatHeaders(m.Headers))
+		result, err := f.Evaluate(filter.Message{Header: header, Body: m.Body, Size: m.Size, Date: m.Date, Envelope: m.Envelope})
+		if err != nil {
+			return err
+		}
+		threads.Add(m.Index, header, result)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("thread pre-scan: %w", err)
+	}
+	threads.Finish()
+	return threads, nil
+}
+
+// printSieve prints the decisions of the Sieve script, the filed messages
+// by folder.
+func printSieve(stats filter.FilterStats) {
+	fmt.Printf("  keep: %d messages\n", stats.SieveKept)
+	for _, folder := range slices.Sorted(maps.Keys(stats.SieveFiled)) {
+		fmt.Printf("  fileinto %s: %d messages\n", folder, stats.SieveFiled[folder])
+	}
+	fmt.Printf("  discard: %d messages\n", stats.SieveDiscarded)
+}
+
+// printFilterStages prints which stage accepted or dropped the messages,
+// in the order the stages are applied.
+func printFilterStages(stats filter.FilterStats) {
+	fmt.Println("Filter Stages:")
+	stage := 0
+	line := func(format string, args ...any) {
+		stage++
+		fmt.Printf("  %d. "+format+"\n", append([]any{stage}, args...)...)
+	}
+	if hasDateRange(stats) {
+		line("date range: %d dropped", stats.DateDropped)
+	}
+	if hasSizeRange(stats) {
+		line("size range: %d dropped", stats.SizeDropped)
+	}
+	if len(stats.IncludeLabels) > 0 || len(stats.ExcludeLabels) > 0 {
+		line("labels: %d dropped", stats.LabelDropped)
+	}
+	if len(stats.IncludeHeaderPatterns) > 0 || len(stats.IncludeBodyPatterns) > 0 {
+		line("include: %d accepted, %d dropped", stats.IncludeAccepted, stats.IncludeDropped)
+	}
+	if len(stats.ExcludeHeaderPatterns) > 0 || len(stats.ExcludeBodyPatterns) > 0 {
+		line("exclude: %d dropped", stats.ExcludeDropped)
+	}
+	if slices.ContainsFunc(stats.Rules, func(r filter.Rule) bool { return r.Action != filter.RuleRoute }) {
+		line("rules: %d dropped", stats.RulesDropped)
+	}
+	if stats.Expression != "" {
+		line("expression: %d dropped", stats.ExpressionDropped)
+	}
+	if stats.Sieve {
+		line("sieve: %d discarded", stats.SieveDiscarded)
+	}
+	fmt.Println()
+}
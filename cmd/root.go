@@ -11,6 +11,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/dhcgn/mbox-to-imap/config"
+	"github.com/dhcgn/mbox-to-imap/filter"
 	"github.com/dhcgn/mbox-to-imap/imap"
 	"github.com/dhcgn/mbox-to-imap/mbox"
 	"github.com/dhcgn/mbox-to-imap/progress"
@@ -18,6 +19,9 @@ import (
 	"github.com/dhcgn/mbox-to-imap/stats"
 )
 
+// version is the build version, recorded in the X-Imported-By header.
+var version = "dev"
+
 var rootCmd = &cobra.Command{
 	Use:   "mbox-to-imap",
 	Short: "CLI tool for mbox file operations",
@@ -41,7 +45,7 @@ var importCmd = &cobra.Command{
 		}()
 
 		slog.SetDefault(logger)
-		logger.Info("starting mbox-to-imap", "mbox", cfg.MboxPath, "target", cfg.TargetFolder, "dryRun", cfg.DryRun)
+		logger.Info("starting mbox-to-imap", "source", cfg.SourceType, "path", cfg.SourcePath, "target", cfg.TargetFolder, "dryRun", cfg.DryRun)
 
 		return run(cfg, logger)
 	},
@@ -51,6 +55,11 @@ func Execute() error {
 	return rootCmd.Execute()
 }
 
+// SetVersion sets the build version reported by the commands.
+func SetVersion(v string) {
+	version = v
+}
+
 func init() {
 	rootCmd.AddCommand(importCmd)
 
@@ -60,28 +69,71 @@ func init() {
 	}
 }
 
-func run(cfg config.Config, logger *slog.Logger) error {
-	// Count total messages in mbox file first
-	logger.Debug("counting messages in mbox file", "path", cfg.MboxPath)
-
-	// Show progress when counting messages (info level only)
-	var countProgress *progress.CountProgress
-	var progressCallback func(int64, int64)
-	if cfg.LogLevel == "info" {
-		countProgress = progress.NewCountProgress()
-		progressCallback = countProgress.Update
+func run(cfg config.Config, logger *slog.Logger) (err error) {
+	// The values owned by the mbox and imap packages are validated by their
+	// parsers; config cannot import them.
+	dateOrder, err := mbox.ParseDateOrder(cfg.DateOrder)
+	if err != nil {
+		return fmt.Errorf("invalid --date-order: %w", err)
+	}
+	format, err := mbox.ParseFormat(cfg.MboxFormat)
+	if err != nil {
+		return fmt.Errorf("invalid --mbox-format: %w", err)
+	}
+	// The runner's state tracker reads the hash mode from cfg.
+	if cfg.HashMode, err = mbox.ParseHashMode(cfg.HashMode); err != nil {
+		return fmt.Errorf("invalid --hash-mode: %w", err)
+	}
+	dedupe, err := mbox.ParseDedupePolicy(cfg.MessageIDDedupe)
+	if err != nil {
+		return fmt.Errorf("invalid --message-id-dedupe: %w", err)
+	}
+	eightBit, err := imap.ParseEightBit(cfg.EightBit)
+	if err != nil {
+		return fmt.Errorf("invalid --eight-bit: %w", err)
 	}
 
-	totalMessages, err := mbox.CountMessages(cfg.MboxPath, progressCallback)
-
-	if countProgress != nil {
-		countProgress.Stop()
+	readerOpts := mbox.Options{
+		Type:            cfg.SourceType,
+		Path:            cfg.SourcePath,
+		Format:          string(format),
+		SpoolThreshold:  cfg.SpoolThreshold,
+		UseIndex:        cfg.UseIndex,
+		Workers:         cfg.Workers,
+		DateOrder:       dateOrder,
+		HashMode:        cfg.HashMode,
+		MessageIDDedupe: dedupe,
+		ConflictReport:  filepath.Join(cfg.StateDir, stats.ConflictReportName),
+		ThreadClosure:   cfg.ThreadClosure,
+		IncludeHeader:   cfg.IncludeHeader,
+		IncludeBody:     cfg.IncludeBody,
+		ExcludeHeader:   cfg.ExcludeHeader,
+		ExcludeBody:     cfg.ExcludeBody,
+		Filter:          cfg.Filter,
+		DecodeBody:      cfg.DecodeBody,
+		BodyTypes:       cfg.BodyContentTypes,
+		Since:           cfg.Since,
+		Until:           cfg.Until,
+		MinSize:         cfg.MinSize,
+		MaxSize:         cfg.MaxSize,
+		IncludeLabels:   cfg.IncludeLabels,
+		ExcludeLabels:   cfg.ExcludeLabels,
+		Rules:           cfg.Rules,
+		Sieve:           cfg.Sieve,
 	}
 
-	if err != nil {
-		return fmt.Errorf("count messages: %w", err)
+	if cfg.ExplainFilters != "" {
+		explain, closeExplain, createErr := createExplainWriter(cfg.ExplainFilters)
+		if createErr != nil {
+			return createErr
+		}
+		defer func() {
+			if closeErr := closeExplain(); err == nil {
+				err = closeErr
+			}
+		}()
+		readerOpts.Explain = explain.Write
 	}
-	logger.Debug("counted messages", "total", totalMessages)
 
 	r, err := runner.New(cfg, logger)
 	if err != nil {
@@ -95,7 +147,10 @@ func run(cfg config.Config, logger *slog.Logger) error {
 	// Create progress bar for info log level
 	var progressBar *progress.Bar
 	if cfg.LogLevel == "info" {
-		progressBar = progress.New(totalMessages, alreadyProcessed, cfg.LogLevel)
+		progressBar, err = newProgressBar(cfg, readerOpts, alreadyProcessed, logger)
+		if err != nil {
+			return err
+		}
 		defer progressBar.Stop()
 	}
 
@@ -106,14 +161,6 @@ func run(cfg config.Config, logger *slog.Logger) error {
 		stats.NewReporter(r, logger)
 	}
 
-	readerOpts := mbox.Options{
-		Path:          cfg.MboxPath,
-		IncludeHeader: cfg.IncludeHeader,
-		IncludeBody:   cfg.IncludeBody,
-		ExcludeHeader: cfg.ExcludeHeader,
-		ExcludeBody:   cfg.ExcludeBody,
-	}
-
 	if _, err := mbox.NewProducer(readerOpts, r, logger); err != nil {
 		return fmt.Errorf("mbox.NewProducer: %w", err)
 	}
@@ -126,6 +173,13 @@ func run(cfg config.Config, logger *slog.Logger) error {
 		UseTLS:             cfg.UseTLS,
 		InsecureSkipVerify: cfg.InsecureSkipVerify,
 		TargetFolder:       cfg.TargetFolder,
+		SpecialUseFolders:  cfg.SpecialUseFolders,
+		Normalize:          cfg.Normalize,
+		EightBit:           eightBit,
+		ReportPath:         filepath.Join(cfg.StateDir, "altered.csv"),
+		Provenance:         cfg.ProvenanceHeaders,
+		ReturnPath:         cfg.AddReturnPath,
+		Version:            version,
 		DryRun:             cfg.DryRun,
 	}
 
@@ -136,6 +190,51 @@ func run(cfg config.Config, logger *slog.Logger) error {
 	return r.Start()
 }
 
+// createExplainWriter creates the --explain-filters file at path. The
+// returned function flushes and closes it.
+func createExplainWriter(path string) (*filter.ExplainWriter, func() error, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create --explain-filters file: %w", err)
+	}
+	explain := filter.NewExplainWriter(file)
+	return explain, func() error {
+		err := explain.Flush()
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
+
+// newProgressBar sizes the progress bar. In byte mode sources made of mbox
+// files are followed by position, so they are read only once; other sources
+// and count mode count the messages upfront.
+func newProgressBar(cfg config.Config, readerOpts mbox.Options, alreadyProcessed int, logger *slog.Logger) (*progress.Bar, error) {
+	if cfg.ProgressMode == "bytes" {
+		size, ok, err := mbox.SourceSize(readerOpts)
+		if err != nil {
+			return nil, fmt.Errorf("source size: %w", err)
+		}
+		if ok {
+			logger.Debug("sized source", "bytes", size)
+			return progress.NewBytes(size, alreadyProcessed, cfg.LogLevel), nil
+		}
+	}
+
+	logger.Debug("counting messages in source", "source", cfg.SourceType, "path", cfg.SourcePath)
+
+	countProgress := progress.NewCountProgress()
+	totalMessages, err := mbox.Count(readerOpts, countProgress.Update)
+	countProgress.Stop()
+	if err != nil {
+		return nil, fmt.Errorf("count messages: %w", err)
+	}
+	logger.Debug("counted messages", "total", totalMessages)
+
+	return progress.New(totalMessages, alreadyProcessed, cfg.LogLevel), nil
+}
+
 func setupLogger(cfg config.Config) (*slog.Logger, func() error, error) {
 	level := new(slog.LevelVar)
 	level.Set(slog.LevelInfo)
@@ -4,14 +4,21 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+
+	"github.com/dhcgn/mbox-to-imap/filter"
 )
 
 // Config captures all command-line options required to run the importer.
 type Config struct {
 	MboxPath           string
+	SourceType         string
+	SourcePath         string
+	MboxFormat         string
 	IMAPHost           string
 	IMAPPort           int
 	IMAPUser           string
@@ -19,14 +26,50 @@ type Config struct {
 	UseTLS             bool
 	InsecureSkipVerify bool
 	TargetFolder       string
+	SpecialUseFolders  bool
+	Normalize          bool
+	EightBit           string
+	DateOrder          string
+	HashMode           string
+	MessageIDDedupe    string
+	ProvenanceHeaders  bool
+	AddReturnPath      bool
+	SpoolThreshold     int64
+	MemoryBudget       int64
 	StateDir           string
+	Checkpoint         bool
+	UseIndex           bool
+	Workers            int
 	DryRun             bool
 	LogLevel           string
 	LogDir             string
+	ProgressMode       string
 	IncludeHeader      []string
 	IncludeBody        []string
 	ExcludeHeader      []string
 	ExcludeBody        []string
+	Filter             string
+	DecodeBody         bool
+	BodyContentTypes   []string
+	Since              time.Time
+	Until              time.Time
+	MinSize            int64
+	MaxSize            int64
+	IncludeLabels      []string
+	// ExcludeLabels holds filter.SpamTrashLabels as well when
+	// ExcludeSpamTrash is set.
+	ExcludeLabels    []string
+	ExcludeSpamTrash bool
+	// Rules are the validated rules of the --rules file.
+	Rules []filter.Rule
+	// ThreadClosure imports a whole thread when any of its messages passes
+	// the filters.
+	ThreadClosure bool
+	// Sieve is the source of the validated --sieve script.
+	Sieve string
+	// ExplainFilters is the CSV file the filter decision about every
+	// message is written to, empty for none.
+	ExplainFilters string
 }
 
 // RegisterFlags attaches all CLI flags to the provided command.
@@ -38,6 +81,8 @@ func RegisterFlags(cmd *cobra.Command) error {
 
 	flags := cmd.Flags()
 	flags.String("mbox", "", "Path to the .mbox file to import")
+	flags.String("source", "", "Input source as <type>:<path>, type is one of: mbox, maildir, eml, thunderbird (alternative to --mbox)")
+	flags.String("mbox-format", "auto", "Mbox variant: auto, mboxo, mboxrd, mboxcl, mboxcl2")
 	flags.String("imap-host", "", "IMAP server hostname")
 	flags.Int("imap-port", 993, "IMAP server port")
 	flags.String("imap-user", "", "IMAP username")
@@ -45,18 +90,43 @@ func RegisterFlags(cmd *cobra.Command) error {
 	flags.Bool("use-tls", true, "Use TLS for the IMAP connection")
 	flags.Bool("insecure-skip-verify", false, "Skip TLS certificate verification (not recommended)")
 	flags.String("target-folder", "INBOX", "Target IMAP folder for imported mail")
+	flags.Bool("special-use-folders", true, "Upload Sent/Drafts/Trash source folders into the server's special-use mailboxes")
+	flags.Bool("normalize", true, "Convert messages to CRLF, drop NUL bytes and fold header lines over 998 octets before uploading")
+	flags.String("eight-bit", "auto", "Handling of 8-bit content: auto (always re-encode; UTF8=ACCEPT and BINARY are not used yet, only logged, as the IMAP library cannot send literal8) or keep (upload unchanged)")
+	flags.String("date-order", "date,received,from-line", "Precedence of the sources for a message's INTERNALDATE: date (Date header), received (earliest Received header), from-line (mbox separator line)")
+	flags.String("hash-mode", "raw", "Hash recorded in the state file: raw (message bytes) or canonical (stable headers and body with normalized line endings, survives re-exports)")
+	flags.String("message-id-dedupe", "off", "Which of several messages sharing a Message-ID but differing in content to import: off (all), first, largest or newest (pre-scans the source)")
+	flags.Bool("provenance-headers", false, "Add X-Envelope-From, X-Mbox-Source and X-Imported-By headers to every uploaded message")
+	flags.Bool("add-return-path", false, "Add a Return-Path from the mbox envelope sender to messages without one")
+	flags.String("spool-threshold", "8MiB", "Messages larger than this are spooled to temporary files instead of kept in memory (0 disables spooling)")
+	flags.String("memory-budget", "256MiB", "Upper bound for message bytes held in memory across the pipeline (0 for no bound)")
 	flags.String("state-dir", defaultStateDir, "Directory for incremental sync state files")
+	flags.Bool("checkpoint", true, "Resume mbox files from the byte offset of the last committed message")
+	flags.Bool("use-index", true, "Read mbox files through their sidecar index (see the index command) when it is up to date; already processed messages are then skipped unread, so they are not filtered or listed by --explain-filters")
+	flags.Int("workers", runtime.NumCPU(), "Number of goroutines parsing an indexed mbox file")
 	flags.Bool("dry-run", false, "Simulate the sync and emit stats without uploading")
 	flags.String("log-level", "info", "Logging level: debug, info, warn, error")
 	flags.String("log-dir", "", "Optional directory where log files will be written")
-	flags.StringArray("include-header", nil, "Regex allow-list applied to message headers (mutually exclusive with exclude flags)")
-	flags.StringArray("include-body", nil, "Regex allow-list applied to message bodies (mutually exclusive with exclude flags)")
-	flags.StringArray("exclude-header", nil, "Regex block-list applied to message headers (mutually exclusive with include flags)")
-	flags.StringArray("exclude-body", nil, "Regex block-list applied to message bodies (mutually exclusive with include flags)")
+	flags.String("progress", "bytes", "Progress display: bytes (follow the position in mbox files, single pass) or count (count messages upfront)")
+	flags.StringArray("include-header", nil, "Regex allow-list applied to message headers (applied before the exclude flags)")
+	flags.StringArray("include-body", nil, "Regex allow-list applied to message bodies (applied before the exclude flags)")
+	flags.StringArray("exclude-header", nil, "Regex block-list applied to message headers (applied after the include flags)")
+	flags.StringArray("exclude-body", nil, "Regex block-list applied to message bodies (applied after the include flags)")
+	flags.String("filter", "", "Filter expression, e.g. 'from ~ \"@corp\\.com$\" and size < 10MB' (see README)")
+	flags.StringArray("include-label", nil, "Only import messages carrying this Gmail label or one nested below it (X-Gmail-Labels)")
+	flags.StringArray("exclude-label", nil, "Skip messages carrying this Gmail label or one nested below it (X-Gmail-Labels)")
+	flags.Bool("exclude-spam-trash", true, "Skip messages labeled Spam or Trash (X-Gmail-Labels)")
+	flags.String("rules", "", "YAML file of named include, exclude and route rules (see README)")
+	flags.Bool("thread-closure", false, "Import whole threads (by Message-ID, In-Reply-To and References) when any of their messages passes the filters; excludes, ranges and Sieve discard still drop single messages (pre-scans the source)")
+	flags.String("sieve", "", "Sieve script (RFC 5228 subset) deciding which messages are imported, their folder and flags (see README)")
+	flags.String("explain-filters", "", "Write the filter decision about every message, with the rules that decided it, to this CSV file")
+	flags.String("since", "", "Only import messages dated on or after this date (YYYY-MM-DD or RFC 3339)")
+	flags.String("until", "", "Only import messages dated on or before this date (YYYY-MM-DD includes the whole day, or RFC 3339)")
+	flags.String("min-size", "", "Only import messages of at least this size, e.g. 10KB")
+	flags.String("max-size", "", "Only import messages of at most this size, e.g. 25MB")
+	flags.Bool("decode-body", false, "Match body filters against the decoded text parts instead of the raw body")
+	flags.StringArray("body-content-type", nil, "Content type whose parts --decode-body matches, e.g. text/plain or text/* (default text/plain and text/html)")
 
-	if err := cmd.MarkFlagRequired("mbox"); err != nil {
-		return err
-	}
 	if err := cmd.MarkFlagRequired("imap-host"); err != nil {
 		return err
 	}
@@ -75,6 +145,14 @@ func LoadConfig(cmd *cobra.Command) (Config, error) {
 	if err != nil {
 		return Config{}, err
 	}
+	source, err := flags.GetString("source")
+	if err != nil {
+		return Config{}, err
+	}
+	mboxFormat, err := flags.GetString("mbox-format")
+	if err != nil {
+		return Config{}, err
+	}
 	imapHost, err := flags.GetString("imap-host")
 	if err != nil {
 		return Config{}, err
@@ -103,10 +181,62 @@ func LoadConfig(cmd *cobra.Command) (Config, error) {
 	if err != nil {
 		return Config{}, err
 	}
+	specialUseFolders, err := flags.GetBool("special-use-folders")
+	if err != nil {
+		return Config{}, err
+	}
+	normalize, err := flags.GetBool("normalize")
+	if err != nil {
+		return Config{}, err
+	}
+	eightBit, err := flags.GetString("eight-bit")
+	if err != nil {
+		return Config{}, err
+	}
+	dateOrder, err := flags.GetString("date-order")
+	if err != nil {
+		return Config{}, err
+	}
+	hashMode, err := flags.GetString("hash-mode")
+	if err != nil {
+		return Config{}, err
+	}
+	messageIDDedupe, err := flags.GetString("message-id-dedupe")
+	if err != nil {
+		return Config{}, err
+	}
+	provenanceHeaders, err := flags.GetBool("provenance-headers")
+	if err != nil {
+		return Config{}, err
+	}
+	addReturnPath, err := flags.GetBool("add-return-path")
+	if err != nil {
+		return Config{}, err
+	}
+	spoolThresholdValue, err := flags.GetString("spool-threshold")
+	if err != nil {
+		return Config{}, err
+	}
+	memoryBudgetValue, err := flags.GetString("memory-budget")
+	if err != nil {
+		return Config{}, err
+	}
 	stateDir, err := flags.GetString("state-dir")
 	if err != nil {
 		return Config{}, err
 	}
+	checkpoint, err := flags.GetBool("checkpoint")
+	if err != nil {
+		return Config{}, err
+	}
+	useIndex, err := flags.GetBool("use-index")
+	if err != nil {
+		return Config{}, err
+	}
+	workers, err := flags.GetInt("workers")
+	if err != nil {
+		return Config{}, err
+	}
 	dryRun, err := flags.GetBool("dry-run")
 	if err != nil {
 		return Config{}, err
@@ -119,6 +249,10 @@ func LoadConfig(cmd *cobra.Command) (Config, error) {
 	if err != nil {
 		return Config{}, err
 	}
+	progressMode, err := flags.GetString("progress")
+	if err != nil {
+		return Config{}, err
+	}
 	includeHeader, err := flags.GetStringArray("include-header")
 	if err != nil {
 		return Config{}, err
@@ -135,6 +269,81 @@ func LoadConfig(cmd *cobra.Command) (Config, error) {
 	if err != nil {
 		return Config{}, err
 	}
+	filterExpr, err := flags.GetString("filter")
+	if err != nil {
+		return Config{}, err
+	}
+	includeLabels, err := flags.GetStringArray("include-label")
+	if err != nil {
+		return Config{}, err
+	}
+	excludeLabels, err := flags.GetStringArray("exclude-label")
+	if err != nil {
+		return Config{}, err
+	}
+	excludeSpamTrash, err := flags.GetBool("exclude-spam-trash")
+	if err != nil {
+		return Config{}, err
+	}
+	if excludeSpamTrash {
+		excludeLabels = append(excludeLabels, filter.SpamTrashLabels...)
+	}
+	rulesFile, err := flags.GetString("rules")
+	if err != nil {
+		return Config{}, err
+	}
+	var rules []filter.Rule
+	if rulesFile != "" {
+		if rules, err = filter.LoadRules(rulesFile); err != nil {
+			return Config{}, fmt.Errorf("invalid --rules: %w", err)
+		}
+	}
+	threadClosure, err := flags.GetBool("thread-closure")
+	if err != nil {
+		return Config{}, err
+	}
+	sieveFile, err := flags.GetString("sieve")
+	if err != nil {
+		return Config{}, err
+	}
+	var sieve string
+	if sieveFile != "" {
+		script, err := filter.LoadSieve(sieveFile)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid --sieve: %w", err)
+		}
+		if script != nil {
+			sieve = script.String()
+		}
+	}
+	explainFilters, err := flags.GetString("explain-filters")
+	if err != nil {
+		return Config{}, err
+	}
+	sinceValue, err := flags.GetString("since")
+	if err != nil {
+		return Config{}, err
+	}
+	untilValue, err := flags.GetString("until")
+	if err != nil {
+		return Config{}, err
+	}
+	minSizeValue, err := flags.GetString("min-size")
+	if err != nil {
+		return Config{}, err
+	}
+	maxSizeValue, err := flags.GetString("max-size")
+	if err != nil {
+		return Config{}, err
+	}
+	decodeBody, err := flags.GetBool("decode-body")
+	if err != nil {
+		return Config{}, err
+	}
+	bodyContentTypes, err := flags.GetStringArray("body-content-type")
+	if err != nil {
+		return Config{}, err
+	}
 
 	if imapPass == "" {
 		imapPass = os.Getenv("IMAP_PASS")
@@ -152,6 +361,36 @@ func LoadConfig(cmd *cobra.Command) (Config, error) {
 		logDir = filepath.Clean(logDir)
 	}
 
+	sourceType, sourcePath, err := parseSource(source, mboxPath)
+	if err != nil {
+		return Config{}, err
+	}
+
+	spoolThreshold, err := filter.ParseSize(spoolThresholdValue)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid --spool-threshold: %w", err)
+	}
+	memoryBudget, err := filter.ParseSize(memoryBudgetValue)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid --memory-budget: %w", err)
+	}
+	since, err := filter.ParseDateBound(sinceValue, false)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid --since: %w", err)
+	}
+	until, err := filter.ParseDateBound(untilValue, true)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid --until: %w", err)
+	}
+	minSize, err := filter.ParseSizeBound(minSizeValue)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid --min-size: %w", err)
+	}
+	maxSize, err := filter.ParseSizeBound(maxSizeValue)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid --max-size: %w", err)
+	}
+
 	logLevel = strings.ToLower(logLevel)
 	if logLevel == "warning" {
 		logLevel = "warn"
@@ -159,6 +398,9 @@ func LoadConfig(cmd *cobra.Command) (Config, error) {
 
 	cfg := Config{
 		MboxPath:           mboxPath,
+		SourceType:         sourceType,
+		SourcePath:         sourcePath,
+		MboxFormat:         mboxFormat,
 		IMAPHost:           imapHost,
 		IMAPPort:           imapPort,
 		IMAPUser:           imapUser,
@@ -166,14 +408,42 @@ func LoadConfig(cmd *cobra.Command) (Config, error) {
 		UseTLS:             useTLS,
 		InsecureSkipVerify: insecureSkipVerify,
 		TargetFolder:       targetFolder,
+		SpecialUseFolders:  specialUseFolders,
+		Normalize:          normalize,
+		EightBit:           eightBit,
+		DateOrder:          dateOrder,
+		HashMode:           hashMode,
+		MessageIDDedupe:    messageIDDedupe,
+		ProvenanceHeaders:  provenanceHeaders,
+		AddReturnPath:      addReturnPath,
+		SpoolThreshold:     spoolThreshold,
+		MemoryBudget:       memoryBudget,
 		StateDir:           filepath.Clean(stateDir),
+		Checkpoint:         checkpoint,
+		UseIndex:           useIndex,
+		Workers:            workers,
 		DryRun:             dryRun,
 		LogLevel:           logLevel,
 		LogDir:             logDir,
+		ProgressMode:       strings.ToLower(strings.TrimSpace(progressMode)),
 		IncludeHeader:      includeHeader,
 		IncludeBody:        includeBody,
 		ExcludeHeader:      excludeHeader,
 		ExcludeBody:        excludeBody,
+		Filter:             filterExpr,
+		DecodeBody:         decodeBody,
+		BodyContentTypes:   bodyContentTypes,
+		Since:              since,
+		Until:              until,
+		MinSize:            minSize,
+		MaxSize:            maxSize,
+		IncludeLabels:      includeLabels,
+		ExcludeLabels:      excludeLabels,
+		ExcludeSpamTrash:   excludeSpamTrash,
+		Rules:              rules,
+		ThreadClosure:      threadClosure,
+		Sieve:              sieve,
+		ExplainFilters:     explainFilters,
 	}
 
 	if err := validateConfig(cfg); err != nil {
@@ -184,8 +454,8 @@ func LoadConfig(cmd *cobra.Command) (Config, error) {
 }
 
 func validateConfig(cfg Config) error {
-	if cfg.MboxPath == "" {
-		return fmt.Errorf("--mbox is required")
+	if cfg.SourcePath == "" {
+		return fmt.Errorf("--mbox or --source is required")
 	}
 	if cfg.IMAPHost == "" {
 		return fmt.Errorf("--imap-host is required")
@@ -199,10 +469,27 @@ func validateConfig(cfg Config) error {
 	if cfg.IMAPPort <= 0 || cfg.IMAPPort > 65535 {
 		return fmt.Errorf("--imap-port must be between 1 and 65535")
 	}
-	includeActive := len(cfg.IncludeHeader) > 0 || len(cfg.IncludeBody) > 0
-	excludeActive := len(cfg.ExcludeHeader) > 0 || len(cfg.ExcludeBody) > 0
-	if includeActive && excludeActive {
-		return fmt.Errorf("include and exclude flags are mutually exclusive")
+	if _, err := filter.ParseExpression(cfg.Filter); err != nil {
+		return fmt.Errorf("invalid --filter: %w", err)
+	}
+	if err := filter.ValidateBodyTypes(cfg.BodyContentTypes); err != nil {
+		return fmt.Errorf("invalid --body-content-type: %w", err)
+	}
+	if !cfg.Since.IsZero() && !cfg.Until.IsZero() && cfg.Until.Before(cfg.Since) {
+		return fmt.Errorf("--until must not be before --since")
+	}
+	if cfg.MaxSize > 0 && cfg.MaxSize < cfg.MinSize {
+		return fmt.Errorf("--max-size must not be below --min-size")
+	}
+
+	if cfg.Workers <= 0 {
+		return fmt.Errorf("--workers must be positive")
+	}
+
+	switch cfg.ProgressMode {
+	case "bytes", "count":
+	default:
+		return fmt.Errorf("invalid --progress: %s", cfg.ProgressMode)
 	}
 
 	switch cfg.LogLevel {
@@ -214,6 +501,32 @@ func validateConfig(cfg Config) error {
 	return nil
 }
 
+// parseSource splits a --source value of the form <type>:<path>. Without
+// --source the --mbox path is used as an mbox source.
+func parseSource(source, mboxPath string) (string, string, error) {
+	source = strings.TrimSpace(source)
+	if source == "" {
+		return "mbox", mboxPath, nil
+	}
+	if mboxPath != "" {
+		return "", "", fmt.Errorf("--mbox and --source cannot be combined")
+	}
+
+	sourceType, sourcePath, ok := strings.Cut(source, ":")
+	if !ok || sourcePath == "" {
+		return "", "", fmt.Errorf("invalid --source %q: expected <type>:<path>", source)
+	}
+
+	sourceType = strings.ToLower(sourceType)
+	switch sourceType {
+	case "mbox", "maildir", "eml", "thunderbird":
+	default:
+		return "", "", fmt.Errorf("invalid --source type %q", sourceType)
+	}
+
+	return sourceType, sourcePath, nil
+}
+
 func defaultStateDir() (string, error) {
 	home, err := os.UserHomeDir()
 	if err != nil {
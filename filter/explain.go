@@ -0,0 +1,96 @@
+package filter
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Explanation is the filter decision about a message, a row of the
+// --explain-filters report.
+type Explanation struct {
+	// Index is the position of the message in its source.
+	Index int
+	// MessageID, Date, From and Subject are taken from the header to tell
+	// the message apart; Subject is decoded.
+	MessageID string
+	Date      string
+	From      string
+	Subject   string
+	Allowed   bool
+	// Rules are the Result.Rules of the decision.
+	Rules []string
+}
+
+// Explain returns the explanation of result for the message at index with
+// the header block header.
+func Explain(index int, header []byte, result Result) Explanation {
+	h := parseHeaderBlock(header)
+	return Explanation{
+		Index:     index,
+		MessageID: strings.Trim(h.Get("Message-Id"), " <>"),
+		Date:      strings.TrimSpace(h.Get("Date")),
+		From:      decodeHeader(h.Get("From")),
+		Subject:   decodeHeader(h.Get("Subject")),
+		Allowed:   result.Allowed,
+		Rules:     result.Rules,
+	}
+}
+
+// Decision returns "allowed" or "dropped".
+func (e Explanation) Decision() string {
+	if e.Allowed {
+		return "allowed"
+	}
+	return "dropped"
+}
+
+// Detail returns the rules joined by "; ".
+func (e Explanation) Detail() string {
+	return strings.Join(e.Rules, "; ")
+}
+
+// ExplainWriter writes explanations as CSV rows below a header row. It is
+// safe for concurrent use; rows are written in the order Write is called,
+// which for concurrent callers, like the --use-index workers, need not be
+// the order of Index.
+type ExplainWriter struct {
+	mu  sync.Mutex
+	w   *csv.Writer
+	err error
+}
+
+// NewExplainWriter returns an ExplainWriter writing to w.
+func NewExplainWriter(w io.Writer) *ExplainWriter {
+	e := &ExplainWriter{w: csv.NewWriter(w)}
+	e.err = e.w.Write([]string{"index", "message_id", "date", "from", "subject", "decision", "rules"})
+	return e
+}
+
+// Write writes the row of e. The first error is kept and returned by Flush.
+func (w *ExplainWriter) Write(e Explanation) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+	w.err = w.w.Write([]string{strconv.Itoa(e.Index), e.MessageID, e.Date, e.From, e.Subject, e.Decision(), e.Detail()})
+}
+
+// Flush writes the buffered rows and returns the first error of the
+// writer.
+func (w *ExplainWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.w.Flush()
+	if w.err == nil {
+		w.err = w.w.Error()
+	}
+	if w.err != nil {
+		return fmt.Errorf("write filter explanation: %w", w.err)
+	}
+	return nil
+}
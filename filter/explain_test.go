@@ -0,0 +1,90 @@
+package filter
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluate_Rules(t *testing.T) {
+	f, err := New(Options{
+		Since:         time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		ExcludeLabels: []string{"Spam"},
+		IncludeHeader: []string{`(?i)from: .*@corp\.com`, `(?i)from: boss@`},
+		ExcludeHeader: []string{`(?i)subject: .*newsletter`},
+		Rules: []Rule{
+			{Name: "no-lists", Type: RuleHeader, Field: "List-Id", Pattern: ".", Action: RuleExclude},
+			{Name: "invoices", Type: RuleHeader, Field: "Subject", Pattern: "(?i)invoice", Action: RuleRoute, Folder: "Invoices"},
+		},
+		Sieve: `if header :contains "subject" "spam" { discard; }`,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	date := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		header  string
+		date    time.Time
+		allowed bool
+		want    []string
+	}{
+		{"date range", "From: a@corp.com\r\n", time.Time{}, false, []string{"date-range"}},
+		{"label", "From: a@corp.com\r\nX-Gmail-Labels: Spam\r\n", date, false, []string{"exclude-label:Spam"}},
+		{"no include", "From: a@other.org\r\n", date, false, []string{"no include pattern"}},
+		{"exclude", "From: a@corp.com\r\nSubject: Newsletter\r\n", date, false, []string{`include-header:(?i)from: .*@corp\.com`, `exclude-header:(?i)subject: .*newsletter`}},
+		{"rule", "From: a@corp.com\r\nList-Id: <x>\r\n", date, false, []string{`include-header:(?i)from: .*@corp\.com`, "rule:no-lists"}},
+		{"sieve", "From: a@corp.com\r\nSubject: spam\r\n", date, false, []string{`include-header:(?i)from: .*@corp\.com`, "sieve:discard"}},
+		{"route", "From: boss@home.org\r\nSubject: Invoice\r\n", date, true, []string{"include-header:(?i)from: boss@", "rule:invoices"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := f.Evaluate(Message{Header: []byte(tt.header), Date: tt.date})
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if got.Allowed != tt.allowed || !reflect.DeepEqual(got.Rules, tt.want) {
+				t.Errorf("Evaluate() = %+v, want allowed %v, rules %q", got, tt.allowed, tt.want)
+			}
+		})
+	}
+}
+
+func TestExplainWriter(t *testing.T) {
+	header := []byte("Message-ID: <a@test>\r\n" +
+		"Date: Sat, 1 Mar 2025 10:00:00 +0000\r\n" +
+		"From: \"Alice, A.\" <alice@test>\r\n" +
+		"Subject: =?UTF-8?Q?Rechnung_f=C3=BCr_M=C3=A4rz?=\r\n")
+
+	var buf bytes.Buffer
+	w := NewExplainWriter(&buf)
+	w.Write(Explain(0, header, Result{Rules: []string{"rule:no-lists", "sieve:discard"}}))
+	w.Write(Explain(1, []byte("Subject: plain\r\n"), Result{Allowed: true}))
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	want := "index,message_id,date,from,subject,decision,rules\n" +
+		"0,a@test,\"Sat, 1 Mar 2025 10:00:00 +0000\",\"\"\"Alice, A.\"\" <alice@test>\",Rechnung für März,dropped,rule:no-lists; sieve:discard\n" +
+		"1,,,,plain,allowed,\n"
+	if got := buf.String(); got != want {
+		t.Errorf("report =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestExplainWriter_Error(t *testing.T) {
+	w := NewExplainWriter(failingWriter{})
+	w.Write(Explanation{})
+	if err := w.Flush(); err == nil || !strings.HasPrefix(err.Error(), "write filter explanation: ") {
+		t.Errorf("Flush() error = %v", err)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, bytes.ErrTooLarge
+}
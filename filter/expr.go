@@ -0,0 +1,651 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Fields with a meaning of their own in an expression. Any other field
+// names a header field.
+const (
+	fieldSize   = "size"
+	fieldDate   = "date"
+	fieldBody   = "body"
+	fieldHeader = "header"
+
+	// fieldAttachment is only used with exists, the attachment.* fields
+	// compare the attachments found by walking the MIME tree.
+	fieldAttachment     = "attachment"
+	fieldAttachmentName = "attachment.name"
+	fieldAttachmentType = "attachment.type"
+	fieldAttachmentSize = "attachment.size"
+)
+
+// addressFields are matched against each of their addresses as well as
+// against the whole value, so "from ~ \"@corp\\.com$\"" works for
+// "Alice <alice@corp.com>".
+var addressFields = map[string]bool{
+	"from":          true,
+	"sender":        true,
+	"reply-to":      true,
+	"to":            true,
+	"cc":            true,
+	"bcc":           true,
+	"delivered-to":  true,
+	"return-path":   true,
+	"x-original-to": true,
+}
+
+// dateLayouts are the accepted date literals. The first one has no time of
+// day and compares whole days.
+var dateLayouts = []string{"2006-01-02", time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04"}
+
+// Expression is a compiled filter expression such as
+//
+//	from ~ "@corp\.com$" and not subject ~ "(?i)newsletter" and date >= 2015-01-01 and size < 10MB
+//
+// A comparison is a field, an operator and a value. Fields are header names
+// (matched against every occurrence, RFC 2047 decoded), "header" (the whole
+// header block), "body", "date" (the parsed Date header), "size" and the
+// attachment fields "attachment.name", "attachment.type" (any attachment
+// matches) and "attachment.size" (all attachments together). The operators
+// are ~ and !~ (regular expression), = and != (case-insensitive equality,
+// a glob for the attachment names and types) and <, <=, >, >= for dates and
+// sizes. "exists <field>" tests for a header field, "exists attachment" for
+// an attachment. Comparisons are combined with and, or, not (also &&, ||, !)
+// and parentheses.
+type Expression struct {
+	source string
+	root   exprNode
+	// usesBody is set when a comparison looks at the body.
+	usesBody bool
+}
+
+// ParseExpression compiles an expression. An empty expression returns nil,
+// which matches every message.
+func ParseExpression(source string) (*Expression, error) {
+	if strings.TrimSpace(source) == "" {
+		return nil, nil
+	}
+	p := &exprParser{lexer: exprLexer{input: source}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokenEOF {
+		return nil, p.unexpected()
+	}
+	return &Expression{source: source, root: root, usesBody: p.usesBody}, nil
+}
+
+// String returns the expression as written.
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Match reports whether msg satisfies the expression.
+func (e *Expression) Match(msg Message) (bool, error) {
+	return e.root.eval(&exprMessage{msg: msg})
+}
+
+type exprNode interface {
+	eval(m *exprMessage) (bool, error)
+}
+
+type andNode struct{ left, right exprNode }
+
+func (n andNode) eval(m *exprMessage) (bool, error) {
+	ok, err := n.left.eval(m)
+	if err != nil || !ok {
+		return false, err
+	}
+	return n.right.eval(m)
+}
+
+type orNode struct{ left, right exprNode }
+
+func (n orNode) eval(m *exprMessage) (bool, error) {
+	ok, err := n.left.eval(m)
+	if err != nil || ok {
+		return ok, err
+	}
+	return n.right.eval(m)
+}
+
+type notNode struct{ operand exprNode }
+
+func (n notNode) eval(m *exprMessage) (bool, error) {
+	ok, err := n.operand.eval(m)
+	return !ok, err
+}
+
+type existsNode struct{ field string }
+
+func (n existsNode) eval(m *exprMessage) (bool, error) {
+	if n.field == fieldAttachment {
+		attachments, err := m.attachments()
+		return len(attachments) > 0, err
+	}
+	return len(m.header().Values(n.field)) > 0, nil
+}
+
+// compareNode is a single comparison. The negated operators != and !~ are
+// stored as their positive form with negate set.
+type compareNode struct {
+	field  string
+	op     string
+	negate bool
+
+	re   *regexp.Regexp
+	text string
+	size int64
+	date time.Time
+	// day marks a date literal without time of day, which stands for the
+	// whole day.
+	day bool
+}
+
+func (n compareNode) eval(m *exprMessage) (bool, error) {
+	ok, err := n.match(m)
+	return ok != n.negate, err
+}
+
+func (n compareNode) match(m *exprMessage) (bool, error) {
+	switch {
+	case n.field == fieldSize:
+		return compareOrdered(n.op, m.msg.Size, n.size), nil
+	case n.field == fieldBody:
+		return m.matchBody(n.re)
+	case n.field == fieldHeader:
+		return n.re.Match(m.msg.Header), nil
+	case n.field == fieldDate && !n.date.IsZero():
+		date, ok := m.date()
+		return ok && n.compareDate(date), nil
+	case n.field == fieldAttachmentSize:
+		attachments, err := m.attachments()
+		var total int64
+		for _, a := range attachments {
+			total += a.size
+		}
+		return compareOrdered(n.op, total, n.size), err
+	case n.field == fieldAttachmentName || n.field == fieldAttachmentType:
+		attachments, err := m.attachments()
+		for _, a := range attachments {
+			value := a.name
+			if n.field == fieldAttachmentType {
+				value = a.mediaType
+			}
+			if n.op == "~" && n.re.MatchString(value) || n.op == "=" && matchGlob(n.text, value) {
+				return true, err
+			}
+		}
+		return false, err
+	}
+
+	for _, value := range m.values(n.field) {
+		if n.op == "~" && n.re.MatchString(value) || n.op == "=" && strings.EqualFold(strings.TrimSpace(value), n.text) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// compareDate compares date with the literal. A whole day literal is
+// inclusive: "date <= 2015-01-01" includes that day.
+func (n compareNode) compareDate(date time.Time) bool {
+	start, end := n.date, n.date
+	if n.day {
+		end = start.AddDate(0, 0, 1)
+	}
+	switch n.op {
+	case "=":
+		if n.day {
+			return !date.Before(start) && date.Before(end)
+		}
+		return date.Equal(start)
+	case "<":
+		return date.Before(start)
+	case "<=":
+		if n.day {
+			return date.Before(end)
+		}
+		return !date.After(start)
+	case ">":
+		if n.day {
+			return !date.Before(end)
+		}
+		return date.After(start)
+	case ">=":
+		return !date.Before(start)
+	}
+	return false
+}
+
+func compareOrdered(op string, a, b int64) bool {
+	switch op {
+	case "=":
+		return a == b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+// exprMessage is a message being evaluated. The header and the
+// attachments are parsed on first use.
+type exprMessage struct {
+	msg Message
+	// decoded, if set, is the text body comparisons look at.
+	decoded []byte
+	parsed  textproto.MIMEHeader
+
+	attachmentList  []attachment
+	attachmentErr   error
+	attachmentsRead bool
+}
+
+func (m *exprMessage) header() textproto.MIMEHeader {
+	if m.parsed == nil {
+		m.parsed = parseHeaderBlock(m.msg.Header)
+	}
+	return m.parsed
+}
+
+// parseHeaderBlock parses a header block as far as it is well-formed.
+func parseHeaderBlock(block []byte) textproto.MIMEHeader {
+	block = slices.Concat(bytes.TrimRight(block, "\r\n"), []byte("\r\n\r\n"))
+	header, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(block))).ReadMIMEHeader()
+	if header == nil {
+		header = textproto.MIMEHeader{}
+	}
+	return header
+}
+
+// values returns the decoded values of field and, for address fields, each
+// address on its own.
+func (m *exprMessage) values(field string) []string {
+	var values []string
+	for _, raw := range m.header().Values(field) {
+		values = append(values, decodeHeader(raw))
+		if addressFields[field] {
+			if list, err := mail.ParseAddressList(raw); err == nil {
+				for _, addr := range list {
+					values = append(values, addr.Address)
+				}
+			}
+		}
+	}
+	return values
+}
+
+// date returns Message.Date, the date the date range is checked against,
+// or, when it is zero, the Date field.
+func (m *exprMessage) date() (time.Time, bool) {
+	if !m.msg.Date.IsZero() {
+		return m.msg.Date, true
+	}
+	date, err := mail.ParseDate(m.header().Get("Date"))
+	return date, err == nil
+}
+
+func (m *exprMessage) attachments() ([]attachment, error) {
+	if !m.attachmentsRead {
+		m.attachmentList, m.attachmentErr = attachments(m.msg)
+		m.attachmentsRead = true
+	}
+	return m.attachmentList, m.attachmentErr
+}
+
+func (m *exprMessage) matchBody(re *regexp.Regexp) (bool, error) {
+	if m.decoded != nil {
+		return re.Match(m.decoded), nil
+	}
+	if m.msg.OpenBody == nil {
+		return re.Match(m.msg.Body), nil
+	}
+	body, err := m.msg.OpenBody()
+	if err != nil {
+		return false, fmt.Errorf("read body: %w", err)
+	}
+	defer body.Close()
+	return re.MatchReader(bufio.NewReader(body)), nil
+}
+
+var headerDecoder = mime.WordDecoder{}
+
+// decodeHeader decodes RFC 2047 encoded words, keeping value when it cannot
+// be decoded.
+func decodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenLiteral
+	tokenOp
+	tokenLParen
+	tokenRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// exprLexer splits an expression into tokens. In strings only \" and \\
+// are escapes, other backslashes are kept for the regular expression.
+type exprLexer struct {
+	input string
+	pos   int
+}
+
+func (l *exprLexer) next() (token, error) {
+	for l.pos < len(l.input) && unicode.IsSpace(rune(l.input[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return token{kind: tokenEOF, pos: start}, nil
+	}
+
+	c := l.input[l.pos]
+	switch {
+	case c == '(':
+		l.pos++
+		return token{kind: tokenLParen, text: "(", pos: start}, nil
+	case c == ')':
+		l.pos++
+		return token{kind: tokenRParen, text: ")", pos: start}, nil
+	case c == '"':
+		return l.string()
+	case strings.ContainsRune("~=!<>&|", rune(c)):
+		for _, op := range []string{"!~", "!=", "==", "<=", ">=", "&&", "||", "~", "=", "!", "<", ">"} {
+			if strings.HasPrefix(l.input[l.pos:], op) {
+				l.pos += len(op)
+				return token{kind: tokenOp, text: op, pos: start}, nil
+			}
+		}
+		return token{}, fmt.Errorf("unexpected %q at position %d", c, start)
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.input) && isLiteralByte(l.input[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokenLiteral, text: l.input[start:l.pos], pos: start}, nil
+	case isIdentByte(c):
+		for l.pos < len(l.input) && isIdentByte(l.input[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokenIdent, text: l.input[start:l.pos], pos: start}, nil
+	}
+	return token{}, fmt.Errorf("unexpected %q at position %d", c, start)
+}
+
+func (l *exprLexer) string() (token, error) {
+	start := l.pos
+	var sb strings.Builder
+	for l.pos++; l.pos < len(l.input); l.pos++ {
+		c := l.input[l.pos]
+		switch {
+		case c == '"':
+			l.pos++
+			return token{kind: tokenString, text: sb.String(), pos: start}, nil
+		case c == '\\' && l.pos+1 < len(l.input) && (l.input[l.pos+1] == '"' || l.input[l.pos+1] == '\\'):
+			l.pos++
+			sb.WriteByte(l.input[l.pos])
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return token{}, fmt.Errorf("unterminated string at position %d", start)
+}
+
+func isIdentByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.'
+}
+
+func isLiteralByte(c byte) bool {
+	return isIdentByte(c) || c == ':' || c == '+'
+}
+
+// exprParser is a recursive descent parser for
+//
+//	or      = and { ("or" | "||") and }
+//	and     = unary { ("and" | "&&") unary }
+//	unary   = ("not" | "!") unary | "(" or ")" | "exists" field | field op value
+type exprParser struct {
+	lexer    exprLexer
+	tok      token
+	usesBody bool
+}
+
+func (p *exprParser) advance() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+// keyword reports whether the current token is one of words, which may be
+// written in any case.
+func (p *exprParser) keyword(words ...string) bool {
+	for _, word := range words {
+		if p.tok.kind == tokenIdent && strings.EqualFold(p.tok.text, word) || p.tok.kind == tokenOp && p.tok.text == word {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) unexpected() error {
+	if p.tok.kind == tokenEOF {
+		return fmt.Errorf("unexpected end of expression")
+	}
+	return fmt.Errorf("unexpected %q at position %d", p.tok.text, p.tok.pos)
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or", "||") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and", "&&") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	switch {
+	case p.keyword("not", "!"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	case p.tok.kind == tokenLParen:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokenRParen {
+			return nil, p.unexpected()
+		}
+		return node, p.advance()
+	case p.keyword("exists"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokenIdent {
+			return nil, p.unexpected()
+		}
+		field := strings.ToLower(p.tok.text)
+		if strings.HasPrefix(field, fieldAttachment+".") {
+			return nil, fmt.Errorf("position %d: use \"exists attachment\" to test for attachments", p.tok.pos)
+		}
+		return existsNode{field}, p.advance()
+	case p.tok.kind == tokenIdent:
+		return p.parseComparison()
+	}
+	return nil, p.unexpected()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	field := strings.ToLower(p.tok.text)
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokenOp || p.keyword("!", "&&", "||") {
+		return nil, p.unexpected()
+	}
+	opTok := p.tok
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokenString && p.tok.kind != tokenLiteral && p.tok.kind != tokenIdent {
+		return nil, p.unexpected()
+	}
+	value := p.tok
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	n := compareNode{field: field, op: opTok.text}
+	switch n.op {
+	case "!~":
+		n.op, n.negate = "~", true
+	case "!=":
+		n.op, n.negate = "=", true
+	case "==":
+		n.op = "="
+	}
+	ordered := n.op != "~" && n.op != "="
+
+	switch {
+	case field == fieldAttachment:
+		return nil, fmt.Errorf("position %d: use \"exists attachment\" or an attachment.name, attachment.type or attachment.size comparison", opTok.pos)
+	case field == fieldSize || field == fieldAttachmentSize:
+		if n.op == "~" {
+			return nil, fmt.Errorf("operator %q at position %d does not apply to %s", opTok.text, opTok.pos, field)
+		}
+		size, err := ParseSize(value.text)
+		if err != nil {
+			return nil, fmt.Errorf("position %d: %w", value.pos, err)
+		}
+		n.size = size
+		return n, nil
+	case field == fieldDate && n.op != "~":
+		date, day, err := parseDateLiteral(value.text)
+		if err != nil {
+			if ordered || value.kind != tokenString {
+				return nil, fmt.Errorf("position %d: %w", value.pos, err)
+			}
+			// date = "..." compares the header text.
+			n.text = value.text
+			return n, nil
+		}
+		n.date, n.day = date, day
+		return n, nil
+	case ordered:
+		return nil, fmt.Errorf("operator %q at position %d only applies to date and size", opTok.text, opTok.pos)
+	case (field == fieldBody || field == fieldHeader) && n.op != "~":
+		return nil, fmt.Errorf("operator %q at position %d does not apply to %s", opTok.text, opTok.pos, field)
+	}
+
+	if field == fieldBody {
+		p.usesBody = true
+	}
+	if n.op == "~" {
+		re, err := regexp.Compile(value.text)
+		if err != nil {
+			return nil, fmt.Errorf("compile %q: %w", value.text, err)
+		}
+		n.re = re
+	} else if field == fieldAttachmentName || field == fieldAttachmentType {
+		n.text = strings.ToLower(strings.TrimSpace(value.text))
+		if _, err := path.Match(n.text, ""); err != nil {
+			return nil, fmt.Errorf("position %d: invalid glob %q", value.pos, value.text)
+		}
+	} else {
+		n.text = strings.TrimSpace(value.text)
+	}
+	return n, nil
+}
+
+// matchGlob reports whether value matches the lower case glob pattern,
+// ignoring case.
+func matchGlob(pattern, value string) bool {
+	ok, _ := path.Match(pattern, strings.ToLower(value))
+	return ok
+}
+
+// parseDateLiteral parses a date literal, reporting whether it is a whole
+// day. Literals without zone are UTC.
+func parseDateLiteral(value string) (time.Time, bool, error) {
+	for i, layout := range dateLayouts {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date, i == 0, nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("%q is not a date (use YYYY-MM-DD or RFC 3339)", value)
+}
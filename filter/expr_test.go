@@ -0,0 +1,162 @@
+package filter
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpression_Match(t *testing.T) {
+	msg := Message{
+		Header: []byte("From: Alice <alice@corp.com>\r\n" +
+			"To: bob@example.com,\r\n carol@example.com\r\n" +
+			"Subject: =?utf-8?q?Quarterly_Newsletter?=\r\n" +
+			"Date: Mon, 1 Jan 2018 23:30:00 -0200\r\n" +
+			"List-Id: <news.corp.com>\r\n"),
+		Body: []byte("Hello world\r\n"),
+		Size: 5 << 20,
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`from ~ "@corp\.com$"`, true},
+		{`from ~ "^Alice"`, true},
+		{`from = "alice@CORP.com"`, true},
+		{`from != "alice@corp.com"`, false},
+		{`to ~ "^carol@"`, true},
+		{`subject ~ "(?i)newsletter"`, true},
+		{`not subject ~ "(?i)newsletter"`, false},
+		{`subject !~ "(?i)newsletter"`, false},
+		{`cc ~ "."`, false},
+		{`exists list-id`, true},
+		{`exists List-Unsubscribe`, false},
+		{`header ~ "(?m)^List-Id:"`, true},
+		{`body ~ "world"`, true},
+		{`body !~ "world"`, false},
+		{`size < 10MB`, true},
+		{`size >= 6MiB`, false},
+		{`size = 5MiB`, true},
+		// 2018-01-02 01:30 UTC.
+		{`date >= 2018-01-02`, true},
+		{`date <= 2018-01-02`, true},
+		{`date < 2018-01-02`, false},
+		{`date > 2018-01-01`, true},
+		{`date = 2018-01-02`, true},
+		{`date < 2018-01-02T02:00:00Z`, true},
+		{`date ~ "Jan 2018"`, true},
+		{`from ~ "@corp\.com$" and not subject ~ "(?i)newsletter" and date >= 2015-01-01 and size < 10MB`, false},
+		{`from ~ "@other\.com$" or subject ~ "Newsletter"`, true},
+		{`(from ~ "@other\.com$" || subject ~ "Newsletter") && !exists x-spam`, true},
+		{`not (size > 1MB and date < 2000-01-01)`, true},
+		{`FROM ~ "alice" AND NOT body ~ "bye"`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			expr, err := ParseExpression(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseExpression() error = %v", err)
+			}
+			got, err := expr.Match(msg)
+			if err != nil {
+				t.Fatalf("Match() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpression_MissingDate(t *testing.T) {
+	expr, err := ParseExpression(`date >= 2015-01-01 or date != 2015-01-01`)
+	if err != nil {
+		t.Fatalf("ParseExpression() error = %v", err)
+	}
+	got, _ := expr.Match(Message{Header: []byte("Subject: no date\r\n")})
+	if !got {
+		t.Error("date != should match a message without date")
+	}
+}
+
+func TestExpression_MessageDate(t *testing.T) {
+	expr, err := ParseExpression(`date >= 2020-01-01`)
+	if err != nil {
+		t.Fatalf("ParseExpression() error = %v", err)
+	}
+	header := []byte("Date: Mon, 1 Jan 2018 10:00:00 +0000\r\n")
+	if got, _ := expr.Match(Message{Header: header}); got {
+		t.Error("Match() = true for the Date field of 2018")
+	}
+	// The date picked by --date-order, e.g. from Received, takes precedence.
+	if got, _ := expr.Match(Message{Header: header, Date: time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)}); !got {
+		t.Error("Match() = false for a message date of 2021")
+	}
+}
+
+func TestExpression_BodyReader(t *testing.T) {
+	expr, err := ParseExpression(`body ~ "needle"`)
+	if err != nil {
+		t.Fatalf("ParseExpression() error = %v", err)
+	}
+	msg := Message{
+		Header: []byte("Subject: large\r\n"),
+		OpenBody: func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(strings.Repeat("hay ", 10000) + "needle")), nil
+		},
+	}
+	if got, err := expr.Match(msg); err != nil || !got {
+		t.Errorf("Match() = %v, %v, want true", got, err)
+	}
+}
+
+func TestParseExpression_Errors(t *testing.T) {
+	for _, expr := range []string{
+		`from`,
+		`from ~`,
+		`from ~ "unterminated`,
+		`from ~ "("`,
+		`(from ~ "a"`,
+		`from ~ "a" and`,
+		`from < "a"`,
+		`size ~ "1"`,
+		`size < lots`,
+		`date >= yesterday`,
+		`body = "x"`,
+		`from ~ "a" subject ~ "b"`,
+		`from # "a"`,
+		`attachment = "x"`,
+		`attachment.size ~ "1"`,
+		`attachment.name < "a"`,
+		`attachment.name = "[a"`,
+		`exists attachment.name`,
+	} {
+		if _, err := ParseExpression(expr); err == nil {
+			t.Errorf("ParseExpression(%q) succeeded", expr)
+		}
+	}
+	if expr, err := ParseExpression("  "); expr != nil || err != nil {
+		t.Errorf("ParseExpression(\"  \") = %v, %v, want nil", expr, err)
+	}
+}
+
+func TestFilter_Expression(t *testing.T) {
+	f, err := New(Options{ExcludeHeader: []string{"Subject: spam"}, Expression: `from ~ "@corp\.com$"`})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if !f.Allows([]byte("From: a@corp.com\nSubject: hi\n"), nil) {
+		t.Error("expected message matching the expression to be allowed")
+	}
+	if f.Allows([]byte("From: a@corp.com\nSubject: spam\n"), nil) {
+		t.Error("expected excluded message to be filtered out")
+	}
+	if f.Allows([]byte("From: a@other.com\nSubject: hi\n"), nil) {
+		t.Error("expected message not matching the expression to be filtered out")
+	}
+	if stats := f.GetStats(); stats.Expression == "" || stats.ExpressionMatches != 1 {
+		t.Errorf("GetStats() expression = %q, %d matches", stats.Expression, stats.ExpressionMatches)
+	}
+}
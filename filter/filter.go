@@ -1,10 +1,16 @@
 package filter
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
+	"maps"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Options captures the filtering configuration.
@@ -13,23 +19,117 @@ type Options struct {
 	IncludeBody   []string
 	ExcludeHeader []string
 	ExcludeBody   []string
+	// Expression is a filter expression, see ParseExpression. A message
+	// must pass both the regex lists and the expression.
+	Expression string
+	// DecodeBody matches body patterns against the decoded text of the
+	// message parts whose content type is one of BodyTypes (DefaultBodyTypes
+	// when empty) instead of the raw body, see decodedText.
+	DecodeBody bool
+	BodyTypes  []string
+	// Since and Until bound the message date, both inclusive, see
+	// ParseDateBound. MinSize and MaxSize bound the message size in bytes.
+	// Zero values leave the bound open. These are checked before the
+	// regex lists.
+	Since   time.Time
+	Until   time.Time
+	MinSize int64
+	MaxSize int64
+	// IncludeLabels and ExcludeLabels select messages by their Gmail labels,
+	// see ParseLabels. A label also selects the labels nested below it.
+	// They are checked after the ranges and before the regex lists.
+	IncludeLabels []string
+	ExcludeLabels []string
+	// Rules are named include, exclude and route rules, see LoadRules. The
+	// include and exclude rules are checked after the regex lists.
+	Rules []Rule
+	// Sieve is the source of a Sieve script, see SieveScript. It runs after
+	// the expression and may discard a message, file it into a folder and
+	// set its flags.
+	Sieve string
+}
+
+// Message is a message as seen by Filter.Match. The body is either held in
+// Body or, for messages too large to keep in memory, read through OpenBody,
+// which must return it from its start on every call.
+type Message struct {
+	Header   []byte
+	Body     []byte
+	OpenBody func() (io.ReadCloser, error)
+	Size     int64
+	// Date is the message date the date range is checked against, zero
+	// when the message has none.
+	Date time.Time
+	// Envelope is the envelope of the mbox "From " separator line, the
+	// sender for the Sieve envelope test. It is empty for other sources.
+	Envelope string
 }
 
 // Filter holds compiled regex patterns for filtering messages.
 type Filter struct {
-	includeMode    bool
-	excludeMode    bool
-	includeHeader  []*regexp.Regexp
-	includeBody    []*regexp.Regexp
-	excludeHeader  []*regexp.Regexp
-	excludeBody    []*regexp.Regexp
-	needHeaderText bool
-	needBodyText   bool
-	// Tracking
+	includeMode   bool
+	excludeMode   bool
+	includeHeader []*regexp.Regexp
+	includeBody   []*regexp.Regexp
+	excludeHeader []*regexp.Regexp
+	excludeBody   []*regexp.Regexp
+	expression    *Expression
+	needBodyText  bool
+	decodeBody    bool
+	bodyTypes     []string
+	ranges        rangeStage
+	labels        labelStage
+	rules         []compiledRule
+	includeRules  bool
+	rulesUseBody  bool
+	sieve         *SieveScript
+
+	// The literal prefilters of the pattern lists, nil for short lists.
+	includeHeaderLiterals *literalFilter
+	includeBodyLiterals   *literalFilter
+	excludeHeaderLiterals *literalFilter
+	excludeBodyLiterals   *literalFilter
+
+	// Tracking, guarded by mu as messages may be filtered concurrently.
+	mu                sync.Mutex
 	includeHeaderHits map[string]int
 	includeBodyHits   map[string]int
 	excludeHeaderHits map[string]int
 	excludeBodyHits   map[string]int
+	expressionMatches int
+	includeLabelHits  map[string]int
+	excludeLabelHits  map[string]int
+	ruleHits          map[string]int
+	sieveKept         int
+	sieveFiled        map[string]int
+	// Decisions per stage, see FilterStats.
+	dateDropped       int
+	sizeDropped       int
+	labelDropped      int
+	includeAccepted   int
+	includeDropped    int
+	excludeDropped    int
+	rulesDropped      int
+	expressionDropped int
+	sieveDiscarded    int
+}
+
+// Result is the decision of Filter.Evaluate about a message.
+type Result struct {
+	Allowed bool
+	// Folder is the folder of the route rule Route or, when no route rule
+	// matched, of the Sieve fileinto action. It is empty when neither
+	// picked one.
+	Folder string
+	Route  string
+	// Flags are the IMAP flags the Sieve script set.
+	Flags []string
+	// Rules names what decided about the message, for Explain: the
+	// patterns, labels and rules it matched as stage:pattern, such as
+	// "exclude-header:^List-Id:" or "rule:invoices", and the stages that
+	// dropped it without a match, such as "date-range" or
+	// "no include pattern".
+	Rules []string
 }
 
 // New creates a new Filter from the provided options.
@@ -51,10 +151,37 @@ func New(opts Options) (*Filter, error) {
 		return nil, fmt.Errorf("compile exclude-body pattern: %w", err)
 	}
 
+	expression, err := ParseExpression(opts.Expression)
+	if err != nil {
+		return nil, fmt.Errorf("parse filter expression: %w", err)
+	}
+
 	includeActive := len(includeHeader) > 0 || len(includeBody) > 0
 	excludeActive := len(excludeHeader) > 0 || len(excludeBody) > 0
-	if includeActive && excludeActive {
-		return nil, fmt.Errorf("include and exclude filters are mutually exclusive")
+
+	bodyTypes := opts.BodyTypes
+	if len(bodyTypes) == 0 {
+		bodyTypes = DefaultBodyTypes
+	}
+	if err := ValidateBodyTypes(bodyTypes); err != nil {
+		return nil, err
+	}
+	ranges, err := newRangeStage(opts)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := compileRules(opts.Rules)
+	if err != nil {
+		return nil, err
+	}
+	sieve, err := ParseSieve(opts.Sieve)
+	if err != nil {
+		return nil, fmt.Errorf("parse sieve script: %w", err)
+	}
+	includeRules, rulesUseBody := false, false
+	for _, rule := range rules {
+		includeRules = includeRules || rule.Action == RuleInclude
+		rulesUseBody = rulesUseBody || rule.usesBody()
 	}
 
 	return &Filter{
@@ -64,51 +191,326 @@ func New(opts Options) (*Filter, error) {
 		includeBody:       includeBody,
 		excludeHeader:     excludeHeader,
 		excludeBody:       excludeBody,
-		needHeaderText:    len(includeHeader) > 0 || len(excludeHeader) > 0,
+		expression:        expression,
 		needBodyText:      len(includeBody) > 0 || len(excludeBody) > 0,
+		decodeBody:        opts.DecodeBody,
+		bodyTypes:         bodyTypes,
+		ranges:            ranges,
+		labels:            newLabelStage(opts.IncludeLabels, opts.ExcludeLabels),
+		rules:             rules,
+		includeRules:      includeRules,
+		rulesUseBody:      rulesUseBody,
+		ruleHits:          make(map[string]int),
+		sieve:             sieve,
+		sieveFiled:        make(map[string]int),
+		includeLabelHits:  make(map[string]int),
+		excludeLabelHits:  make(map[string]int),
 		includeHeaderHits: make(map[string]int),
 		includeBodyHits:   make(map[string]int),
 		excludeHeaderHits: make(map[string]int),
 		excludeBodyHits:   make(map[string]int),
+
+		includeHeaderLiterals: newLiteralFilter(includeHeader),
+		includeBodyLiterals:   newLiteralFilter(includeBody),
+		excludeHeaderLiterals: newLiteralFilter(excludeHeader),
+		excludeBodyLiterals:   newLiteralFilter(excludeBody),
 	}, nil
 }
 
-// Allows returns true if the message passes the filter criteria.
+// Allows returns true if the message passes the filter criteria. The size
+// of the message is taken to be that of header and body; as it has no date,
+// a date range drops it.
 func (f *Filter) Allows(header, body []byte) bool {
-	var headerText, bodyText string
-	if f.needHeaderText {
-		headerText = string(header)
+	allowed, _ := f.Match(Message{Header: header, Body: body, Size: int64(len(header) + len(body))})
+	return allowed
+}
+
+// AllowsReader is like Allows for messages whose body is too large to hold
+// in memory. openBody is called once per body pattern and must return the
+// body from its start.
+func (f *Filter) AllowsReader(header []byte, openBody func() (io.ReadCloser, error)) (bool, error) {
+	return f.Match(Message{Header: header, OpenBody: openBody})
+}
+
+// Match reports whether msg passes the date and size ranges, the labels,
+// the regex lists, the rules, the expression and the Sieve script. An error
+// is only returned when the body could not be read.
+func (f *Filter) Match(msg Message) (bool, error) {
+	result, err := f.Evaluate(msg)
+	return result.Allowed, err
+}
+
+// Evaluate is Match, also picking the folder and the flags of an allowed
+// message.
+func (f *Filter) Evaluate(msg Message) (Result, error) {
+	if !f.ranges.dateAllowed(msg.Date) {
+		f.count(&f.dateDropped)
+		return Result{Rules: []string{"date-range"}}, nil
 	}
-	if f.needBodyText {
-		bodyText = string(body)
+	if !f.ranges.sizeAllowed(msg.Size) {
+		f.count(&f.sizeDropped)
+		return Result{Rules: []string{"size-range"}}, nil
+	}
+	var rules []string
+	if f.labels.active() {
+		allowed, matched := f.labelsAllowed(msg.Header)
+		rules = matched
+		if !allowed {
+			f.count(&f.labelDropped)
+			return Result{Rules: rules}, nil
+		}
 	}
 
+	// The rules and the expression walk the raw message for attachments.
+	raw := msg
+	var decoded []byte
+	if f.decodeBody && (f.needBodyText || f.rulesUseBody || f.expression != nil && f.expression.usesBody) {
+		text, err := decodedText(msg, f.bodyTypes)
+		if err != nil {
+			return Result{}, err
+		}
+		decoded = []byte(text)
+		msg.Body, msg.OpenBody = decoded, nil
+	}
+
+	// A body too large to hold in memory is read once per pattern.
+	var bodyErr error
+	var readBody func(re *regexp.Regexp) bool
+	if msg.OpenBody != nil {
+		readBody = func(re *regexp.Regexp) bool {
+			if bodyErr != nil {
+				return false
+			}
+			body, err := msg.OpenBody()
+			if err != nil {
+				bodyErr = err
+				return false
+			}
+			defer body.Close()
+			return re.MatchReader(bufio.NewReader(body))
+		}
+	}
+
+	allowed, matched := f.allows(msg.Header, msg.Body, readBody)
+	if bodyErr != nil {
+		return Result{}, fmt.Errorf("read body: %w", bodyErr)
+	}
+	rules = append(rules, matched...)
+	if !allowed {
+		return Result{Rules: rules}, nil
+	}
+
+	// The rules and the expression share the parsed header and attachments.
+	m := &exprMessage{msg: raw, decoded: decoded}
+	if len(f.rules) > 0 {
+		allowed, matched, err := f.rulesAllow(m)
+		if err != nil {
+			return Result{}, err
+		}
+		rules = append(rules, matched...)
+		if !allowed {
+			f.count(&f.rulesDropped)
+			return Result{Rules: rules}, nil
+		}
+	}
+
+	if f.expression != nil {
+		matched, err := f.expression.root.eval(m)
+		if err != nil {
+			return Result{}, err
+		}
+		rules = append(rules, "expression")
+		if !matched {
+			f.count(&f.expressionDropped)
+			return Result{Rules: rules}, nil
+		}
+		f.count(&f.expressionMatches)
+	}
+
+	var outcome sieveOutcome
+	if f.sieve != nil {
+		outcome = f.sieve.run(m)
+		if outcome.discarded() {
+			f.count(&f.sieveDiscarded)
+			return Result{Rules: append(rules, "sieve:discard")}, nil
+		}
+		f.mu.Lock()
+		if outcome.folder != "" {
+			f.sieveFiled[outcome.folder]++
+			rules = append(rules, "sieve:fileinto "+outcome.folder)
+		} else {
+			f.sieveKept++
+		}
+		f.mu.Unlock()
+	}
+
+	result, err := f.route(m)
+	if err != nil {
+		return Result{}, err
+	}
+	if result.Route != "" {
+		rules = append(rules, "rule:"+result.Route)
+	}
+	if result.Folder == "" {
+		result.Folder = outcome.folder
+	}
+	result.Flags = outcome.flags
+	result.Rules = rules
+	return result, nil
+}
+
+// rulesAllow applies the include and exclude rules: a message must match an
+// include rule, if there are any, and no exclude rule. Every matching rule
+// counts a hit and is returned for Result.Rules.
+func (f *Filter) rulesAllow(m *exprMessage) (bool, []string, error) {
+	included, excluded := !f.includeRules, false
+	var matched []string
+	for _, rule := range f.rules {
+		if rule.Action == RuleRoute {
+			continue
+		}
+		ok, err := rule.match(m)
+		if err != nil {
+			return false, nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		if !ok {
+			continue
+		}
+		f.hit(rule.Name)
+		matched = append(matched, "rule:"+rule.Name)
+		if rule.Action == RuleInclude {
+			included = true
+		} else {
+			excluded = true
+		}
+	}
+	if !included {
+		matched = append(matched, "no include rule")
+	}
+	return included && !excluded, matched, nil
+}
+
+// route returns the allowed result for m with the folder of the first
+// matching route rule.
+func (f *Filter) route(m *exprMessage) (Result, error) {
+	for _, rule := range f.rules {
+		if rule.Action != RuleRoute {
+			continue
+		}
+		ok, err := rule.match(m)
+		if err != nil {
+			return Result{}, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		if ok {
+			f.hit(rule.Name)
+			return Result{Allowed: true, Folder: rule.Folder, Route: rule.Name}, nil
+		}
+	}
+	return Result{Allowed: true}, nil
+}
+
+// hit counts a match of the rule name.
+func (f *Filter) hit(name string) {
+	f.mu.Lock()
+	f.ruleHits[name]++
+	f.mu.Unlock()
+}
+
+// allows applies the include stage and then the exclude stage: a message
+// must match an include rule, if there are any, and no exclude rule. It also
+// returns the matching patterns for Result.Rules. The body patterns are
+// matched with readBody when it is set, against body otherwise.
+func (f *Filter) allows(header, body []byte, readBody func(*regexp.Regexp) bool) (bool, []string) {
+	var matched []string
 	if f.includeMode {
-		matched := f.matchAnyWithTracking(f.includeHeader, headerText, f.includeHeaderHits) ||
-			f.matchAnyWithTracking(f.includeBody, bodyText, f.includeBodyHits)
-		return matched
+		matched = f.matchAnyWithTracking(f.includeHeader, f.includeHeaderLiterals, header, nil, f.includeHeaderHits, "include-header")
+		if len(matched) == 0 {
+			matched = f.matchAnyWithTracking(f.includeBody, f.includeBodyLiterals, body, readBody, f.includeBodyHits, "include-body")
+		}
+		if len(matched) == 0 {
+			f.count(&f.includeDropped)
+			return false, []string{"no include pattern"}
+		}
+		f.count(&f.includeAccepted)
 	}
 
 	if f.excludeMode {
-		if f.matchAnyWithTracking(f.excludeHeader, headerText, f.excludeHeaderHits) ||
-			f.matchAnyWithTracking(f.excludeBody, bodyText, f.excludeBodyHits) {
-			return false
+		excluded := f.matchAnyWithTracking(f.excludeHeader, f.excludeHeaderLiterals, header, nil, f.excludeHeaderHits, "exclude-header")
+		if len(excluded) == 0 {
+			excluded = f.matchAnyWithTracking(f.excludeBody, f.excludeBodyLiterals, body, readBody, f.excludeBodyHits, "exclude-body")
+		}
+		if len(excluded) > 0 {
+			f.count(&f.excludeDropped)
+			return false, append(matched, excluded...)
+		}
+	}
+
+	return true, matched
+}
+
+// labelsAllowed applies the label stage to the labels in header. It also
+// returns the matching label rules for Result.Rules.
+func (f *Filter) labelsAllowed(header []byte) (bool, []string) {
+	var labels []string
+	for _, value := range parseHeaderBlock(header).Values(LabelsHeader) {
+		labels = append(labels, ParseLabels(value)...)
+	}
+
+	var matched []string
+	if len(f.labels.include) > 0 {
+		rule, ok := firstMatch(f.labels.include, labels)
+		if !ok {
+			return false, []string{"no include label"}
 		}
+		f.mu.Lock()
+		f.includeLabelHits[rule]++
+		f.mu.Unlock()
+		matched = append(matched, "include-label:"+rule)
+	}
+	if rule, ok := firstMatch(f.labels.exclude, labels); ok {
+		f.mu.Lock()
+		f.excludeLabelHits[rule]++
+		f.mu.Unlock()
+		return false, append(matched, "exclude-label:"+rule)
 	}
+	return true, matched
+}
 
-	return true
+// count increments a decision counter.
+func (f *Filter) count(counter *int) {
+	f.mu.Lock()
+	*counter++
+	f.mu.Unlock()
 }
 
-// matchAnyWithTracking checks if any pattern matches and tracks which ones hit.
-func (f *Filter) matchAnyWithTracking(patterns []*regexp.Regexp, text string, hitCounter map[string]int) bool {
+// matchAnyWithTracking returns the patterns that match text, each as
+// stage:pattern, and tracks which ones hit. The patterns literals rules out
+// are skipped. When read is set it matches a pattern instead, without the
+// prefilter.
+func (f *Filter) matchAnyWithTracking(patterns []*regexp.Regexp, literals *literalFilter, text []byte, read func(*regexp.Regexp) bool, hitCounter map[string]int, stage string) []string {
 	if len(patterns) == 0 {
-		return false
+		return nil
 	}
-	matched := false
-	for _, re := range patterns {
-		if re.MatchString(text) {
+	var candidates []bool
+	if read == nil {
+		candidates = literals.candidates(text)
+	}
+	var matched []string
+	for i, re := range patterns {
+		if candidates != nil && !candidates[i] {
+			continue
+		}
+		var ok bool
+		if read != nil {
+			ok = read(re)
+		} else {
+			ok = re.Match(text)
+		}
+		if ok {
+			f.mu.Lock()
 			hitCounter[re.String()]++
-			matched = true
+			f.mu.Unlock()
+			matched = append(matched, stage+":"+re.String())
 		}
 	}
 	return matched
@@ -124,14 +526,84 @@ type FilterStats struct {
 	IncludeBodyHits       map[string]int
 	ExcludeHeaderHits     map[string]int
 	ExcludeBodyHits       map[string]int
+	// Expression is the filter expression, empty when none is set, and
+	// ExpressionMatches the number of messages it matched.
+	Expression        string
+	ExpressionMatches int
+	// Since, Until, MinSize and MaxSize are the date and size ranges, zero
+	// when open.
+	Since   time.Time
+	Until   time.Time
+	MinSize int64
+	MaxSize int64
+	// IncludeLabels and ExcludeLabels are the label rules, the hits count
+	// the messages each rule selected or dropped.
+	IncludeLabels    []string
+	ExcludeLabels    []string
+	IncludeLabelHits map[string]int
+	ExcludeLabelHits map[string]int
+	// Rules are the rules in their order, RuleHits counts the messages each
+	// rule, by name, matched. A route rule only counts the messages it
+	// routed.
+	Rules    []Rule
+	RuleHits map[string]int
+	// Sieve reports whether a Sieve script is set. SieveKept counts the
+	// messages it kept, SieveFiled those it filed, by folder.
+	Sieve      bool
+	SieveKept  int
+	SieveFiled map[string]int
+	// The stages are applied in order: date range, size range, labels,
+	// include patterns, exclude patterns, rules, the expression, the Sieve
+	// script. IncludeAccepted and IncludeDropped count the messages that
+	// matched or missed the include rules, the other counters those dropped
+	// by each stage.
+	DateDropped       int
+	SizeDropped       int
+	LabelDropped      int
+	IncludeAccepted   int
+	IncludeDropped    int
+	ExcludeDropped    int
+	RulesDropped      int
+	ExpressionDropped int
+	SieveDiscarded    int
 }
 
 func (f *Filter) GetStats() FilterStats {
+	f.mu.Lock()
 	stats := FilterStats{
-		IncludeHeaderHits: f.includeHeaderHits,
-		IncludeBodyHits:   f.includeBodyHits,
-		ExcludeHeaderHits: f.excludeHeaderHits,
-		ExcludeBodyHits:   f.excludeBodyHits,
+		IncludeHeaderHits: maps.Clone(f.includeHeaderHits),
+		IncludeBodyHits:   maps.Clone(f.includeBodyHits),
+		ExcludeHeaderHits: maps.Clone(f.excludeHeaderHits),
+		ExcludeBodyHits:   maps.Clone(f.excludeBodyHits),
+		ExpressionMatches: f.expressionMatches,
+		Since:             f.ranges.since,
+		Until:             f.ranges.until,
+		MinSize:           f.ranges.minSize,
+		MaxSize:           f.ranges.maxSize,
+		IncludeLabels:     slices.Clone(f.labels.include),
+		ExcludeLabels:     slices.Clone(f.labels.exclude),
+		IncludeLabelHits:  maps.Clone(f.includeLabelHits),
+		ExcludeLabelHits:  maps.Clone(f.excludeLabelHits),
+		RuleHits:          maps.Clone(f.ruleHits),
+		Sieve:             f.sieve != nil,
+		SieveKept:         f.sieveKept,
+		SieveFiled:        maps.Clone(f.sieveFiled),
+		DateDropped:       f.dateDropped,
+		SizeDropped:       f.sizeDropped,
+		LabelDropped:      f.labelDropped,
+		IncludeAccepted:   f.includeAccepted,
+		IncludeDropped:    f.includeDropped,
+		ExcludeDropped:    f.excludeDropped,
+		RulesDropped:      f.rulesDropped,
+		ExpressionDropped: f.expressionDropped,
+		SieveDiscarded:    f.sieveDiscarded,
+	}
+	f.mu.Unlock()
+	if f.expression != nil {
+		stats.Expression = f.expression.String()
+	}
+	for _, rule := range f.rules {
+		stats.Rules = append(stats.Rules, rule.Rule)
 	}
 
 	// Collect all patterns
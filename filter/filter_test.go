@@ -1,6 +1,11 @@
 package filter
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -48,14 +53,39 @@ func TestFilter_Allows_ExcludeMode(t *testing.T) {
 	}
 }
 
-func TestFilter_MutuallyExclusive(t *testing.T) {
+func TestFilter_IncludeThenExclude(t *testing.T) {
 	opts := Options{
-		IncludeHeader: []string{"test"},
-		ExcludeHeader: []string{"spam"},
+		IncludeHeader: []string{`From: .*@corp\.com`},
+		ExcludeHeader: []string{`Subject: \[alert\]`},
+	}
+	f, err := New(opts)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"From: alice@corp.com\nSubject: lunch\n", true},
+		{"From: monitor@corp.com\nSubject: [alert] disk full\n", false},
+		{"From: bob@example.com\nSubject: lunch\n", false},
+		{"From: bob@example.com\nSubject: [alert] spam\n", false},
+	}
+	for _, tt := range tests {
+		if got := f.Allows([]byte(tt.header), nil); got != tt.want {
+			t.Errorf("Allows(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+
+	stats := f.GetStats()
+	if stats.IncludeAccepted != 2 || stats.IncludeDropped != 2 || stats.ExcludeDropped != 1 {
+		t.Errorf("stages = %d accepted, %d dropped by include, %d dropped by exclude, want 2, 2, 1",
+			stats.IncludeAccepted, stats.IncludeDropped, stats.ExcludeDropped)
 	}
-	_, err := New(opts)
-	if err == nil {
-		t.Error("Expected error when both include and exclude are specified")
+	// Messages dropped by the include stage never reach the exclude rules.
+	if hits := stats.ExcludeHeaderHits[`Subject: \[alert\]`]; hits != 1 {
+		t.Errorf("exclude hits = %d, want 1", hits)
 	}
 }
 
@@ -96,6 +126,45 @@ func TestFilter_BodyFiltering(t *testing.T) {
 	}
 }
 
+func TestFilter_AllowsReader(t *testing.T) {
+	opts := Options{
+		ExcludeBody: []string{"unsubscribe", "(?m)^-- $"},
+	}
+	f, err := New(opts)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	opened := 0
+	open := func(body string) func() (io.ReadCloser, error) {
+		return func() (io.ReadCloser, error) {
+			opened++
+			return io.NopCloser(strings.NewReader(body)), nil
+		}
+	}
+
+	allowed, err := f.AllowsReader([]byte("Subject: Message\n"), open("Hello\n-- \nsignature\n"))
+	if err != nil {
+		t.Fatalf("AllowsReader() error = %v", err)
+	}
+	if allowed {
+		t.Error("Expected message to be filtered out (body matches)")
+	}
+	if opened != 2 {
+		t.Errorf("body opened %d times, want once per pattern", opened)
+	}
+
+	allowed, err = f.AllowsReader([]byte("Subject: Message\n"), open("Hello\n"))
+	if err != nil || !allowed {
+		t.Errorf("AllowsReader() = %v, %v; want allowed", allowed, err)
+	}
+
+	failing := func() (io.ReadCloser, error) { return nil, errors.New("gone") }
+	if _, err := f.AllowsReader([]byte("Subject: Message\n"), failing); err == nil {
+		t.Error("Expected error when the body cannot be read")
+	}
+}
+
 func TestSplitRawMessage(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -141,3 +210,113 @@ func TestSplitRawMessage(t *testing.T) {
 		})
 	}
 }
+
+// blocklist returns n exclude-header patterns for sender domains, the way a
+// domain blocklist is written.
+func blocklist(n int) []string {
+	patterns := make([]string, n)
+	for i := range patterns {
+		patterns[i] = fmt.Sprintf(`(?im)^From:.*@(mail\.)?spam%03d\.example\.com>?\r?$`, i)
+	}
+	return patterns
+}
+
+var blocklistMessage = Message{
+	Header: []byte(strings.Repeat("Received: from mx.example.org (mx.example.org [192.0.2.1]) by mail.example.net\r\n", 8) +
+		"From: \"Alice\" <alice@corp.example.com>\r\n" +
+		"To: bob@example.org\r\n" +
+		"Subject: Quarterly report\r\n" +
+		"Message-ID: <a@corp.example.com>\r\n"),
+	Body: []byte(strings.Repeat("The numbers for the quarter are in the attached report.\r\n", 40)),
+}
+
+func TestFilter_Blocklist(t *testing.T) {
+	f, err := New(Options{ExcludeHeader: blocklist(200), ExcludeBody: []string{"unsubscribe", "viagra", "lottery", "(?i)winner", "^.{0,3}$"}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if f.excludeHeaderLiterals == nil || f.excludeBodyLiterals == nil {
+		t.Fatal("New() did not prefilter the pattern lists")
+	}
+	plain, err := New(Options{ExcludeHeader: blocklist(200), ExcludeBody: []string{"unsubscribe", "viagra", "lottery", "(?i)winner", "^.{0,3}$"}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	plain.excludeHeaderLiterals, plain.excludeBodyLiterals = nil, nil
+
+	messages := []Message{
+		blocklistMessage,
+		{Header: []byte("From: x@SPAM042.example.com\r\n"), Body: []byte("hello")},
+		{Header: []byte("From: x@mail.spam199.example.com>\r\n"), Body: []byte("hello")},
+		{Header: []byte("From: x@spam200.example.com\r\n"), Body: []byte("hello")},
+		{Header: []byte("From: x@corp.example.com\r\n"), Body: []byte("You are a WINNER")},
+		{Header: []byte("From: x@corp.example.com\r\n"), Body: []byte("ok")},
+	}
+	for i, msg := range messages {
+		want, err := plain.Evaluate(msg)
+		if err != nil {
+			t.Fatalf("Evaluate() error = %v", err)
+		}
+		got, err := f.Evaluate(msg)
+		if err != nil {
+			t.Fatalf("Evaluate() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("message %d: Evaluate() = %+v, without prefilter %+v", i, got, want)
+		}
+	}
+	if got, want := f.GetStats(), plain.GetStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetStats() = %+v, without prefilter %+v", got, want)
+	}
+}
+
+func BenchmarkFilter_Blocklist(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		for _, prefilter := range []bool{false, true} {
+			name := fmt.Sprintf("patterns=%d/regexp", n)
+			if prefilter {
+				name = fmt.Sprintf("patterns=%d/prefilter", n)
+			}
+			b.Run(name, func(b *testing.B) {
+				f, err := New(Options{ExcludeHeader: blocklist(n)})
+				if err != nil {
+					b.Fatalf("New() error = %v", err)
+				}
+				if !prefilter {
+					f.excludeHeaderLiterals = nil
+				}
+				b.SetBytes(int64(len(blocklistMessage.Header)))
+				for b.Loop() {
+					if _, err := f.Evaluate(blocklistMessage); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkFilter_BodyKeywords(b *testing.B) {
+	keywords := []string{"unsubscribe", "viagra", "lottery", "(?i)winner", "casino", "bitcoin", "(?i)free money", "crypto", "pharmacy", "act now"}
+	for _, prefilter := range []bool{false, true} {
+		name := "regexp"
+		if prefilter {
+			name = "prefilter"
+		}
+		b.Run(name, func(b *testing.B) {
+			f, err := New(Options{ExcludeBody: keywords})
+			if err != nil {
+				b.Fatalf("New() error = %v", err)
+			}
+			if !prefilter {
+				f.excludeBodyLiterals = nil
+			}
+			b.SetBytes(int64(len(blocklistMessage.Body)))
+			for b.Loop() {
+				if _, err := f.Evaluate(blocklistMessage); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package filter
+
+import (
+	"strings"
+)
+
+// LabelsHeader is the header field Gmail Takeout records the labels of a
+// message in.
+const LabelsHeader = "X-Gmail-Labels"
+
+// SpamTrashLabels are the labels excluded by the Spam and Trash preset,
+// Takeout's "All mail Including Spam and Trash" export carries both.
+var SpamTrashLabels = []string{"Spam", "Trash"}
+
+// ParseLabels splits the value of an X-Gmail-Labels field into its labels.
+// Labels are separated by commas; a label containing a comma is quoted, with
+// \" and \\ escaping inside the quotes. RFC 2047 encoded words are decoded
+// first. Empty labels are dropped.
+func ParseLabels(value string) []string {
+	value = decodeHeader(value)
+
+	var (
+		labels  []string
+		current strings.Builder
+		quoted  bool
+	)
+	flush := func() {
+		if label := strings.TrimSpace(current.String()); label != "" {
+			labels = append(labels, label)
+		}
+		current.Reset()
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && quoted && i+1 < len(value):
+			i++
+			current.WriteByte(value[i])
+		case c == ',' && !quoted:
+			flush()
+		case c == '\r' || c == '\n':
+			// Left over from a folded field.
+			current.WriteByte(' ')
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+	return labels
+}
+
+// labelMatches reports whether label is rule or nested below it, ignoring
+// case: the rule "Work" matches "Work" and "Work/Projects", but not
+// "Workshop".
+func labelMatches(rule, label string) bool {
+	rule = strings.Trim(strings.TrimSpace(rule), "/")
+	if len(label) < len(rule) || !strings.EqualFold(label[:len(rule)], rule) {
+		return false
+	}
+	return len(label) == len(rule) || label[len(rule)] == '/'
+}
+
+// labelStage is the filter stage for Gmail labels: a message with labels
+// must carry one of the include labels, if there are any, and none of the
+// exclude labels. Messages without an X-Gmail-Labels field only pass when
+// there are no include labels.
+type labelStage struct {
+	include []string
+	exclude []string
+}
+
+func newLabelStage(include, exclude []string) labelStage {
+	clean := func(labels []string) []string {
+		var out []string
+		for _, label := range labels {
+			if label = strings.Trim(strings.TrimSpace(label), "/"); label != "" {
+				out = append(out, label)
+			}
+		}
+		return out
+	}
+	return labelStage{include: clean(include), exclude: clean(exclude)}
+}
+
+func (s labelStage) active() bool {
+	return len(s.include) > 0 || len(s.exclude) > 0
+}
+
+// firstMatch returns the first of rules that matches one of labels.
+func firstMatch(rules, labels []string) (string, bool) {
+	for _, rule := range rules {
+		for _, label := range labels {
+			if labelMatches(rule, label) {
+				return rule, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,87 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"Inbox,Opened", []string{"Inbox", "Opened"}},
+		{" Inbox , Category Updates ,", []string{"Inbox", "Category Updates"}},
+		{`Inbox,"Clients, Old",Work/Projects`, []string{"Inbox", "Clients, Old", "Work/Projects"}},
+		{`"say \"hi\"",Spam`, []string{`say "hi"`, "Spam"}},
+		{"=?UTF-8?Q?Gesch=C3=A4ftlich/Rechnungen?=,Archived", []string{"Geschäftlich/Rechnungen", "Archived"}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := ParseLabels(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseLabels(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLabelMatches(t *testing.T) {
+	tests := []struct {
+		rule, label string
+		want        bool
+	}{
+		{"Work", "Work", true},
+		{"work", "Work/Projects/2020", true},
+		{"Work/", "Work/Projects", true},
+		{"Work/Projects", "Work", false},
+		{"Work", "Workshop", false},
+		{"Spam", "Inbox", false},
+	}
+	for _, tt := range tests {
+		if got := labelMatches(tt.rule, tt.label); got != tt.want {
+			t.Errorf("labelMatches(%q, %q) = %v, want %v", tt.rule, tt.label, got, tt.want)
+		}
+	}
+}
+
+func TestFilter_Labels(t *testing.T) {
+	f, err := New(Options{
+		IncludeLabels: []string{"Work", "Clients, Old"},
+		ExcludeLabels: append([]string{"Work/Private"}, SpamTrashLabels...),
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"X-Gmail-Labels: Inbox,Work/Projects\r\n", true},
+		{"X-Gmail-Labels: \"Clients, Old\"\r\n", true},
+		{"X-Gmail-Labels: Inbox,Opened\r\n", false},
+		{"X-Gmail-Labels: Work,Work/Private\r\n", false},
+		{"X-Gmail-Labels: Work,\r\n Trash\r\n", false},
+		{"Subject: no labels\r\n", false},
+	}
+	for _, tt := range tests {
+		if got := f.Allows([]byte(tt.header), nil); got != tt.want {
+			t.Errorf("Allows(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+
+	stats := f.GetStats()
+	if stats.LabelDropped != 4 || stats.IncludeLabelHits["Work"] != 3 || stats.ExcludeLabelHits["Trash"] != 1 {
+		t.Errorf("GetStats() = %+v", stats)
+	}
+
+	spamTrash, err := New(Options{ExcludeLabels: SpamTrashLabels})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if !spamTrash.Allows([]byte("Subject: not from Gmail\r\n"), nil) {
+		t.Error("expected a message without labels to pass the Spam and Trash preset")
+	}
+	if spamTrash.Allows([]byte("X-Gmail-Labels: spam\r\n"), nil) {
+		t.Error("expected a message labeled spam to be dropped")
+	}
+}
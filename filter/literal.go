@@ -0,0 +1,254 @@
+package filter
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// minLiteralPatterns is the number of patterns with literals from which a
+// pattern list is prefiltered. Below it running the patterns is as fast as
+// the extra pass over the text.
+const minLiteralPatterns = 4
+
+// maxAlternateLiterals bounds the literals taken from an alternation.
+const maxAlternateLiterals = 32
+
+// literalFilter is the prefilter of a pattern list. Most patterns can only
+// match text containing one of a few literal substrings, e.g. "@spam.com"
+// for `From: .*@spam\.com`; a single Aho-Corasick pass over the text finds
+// those literals, and the patterns whose literals are missing are not run.
+// Patterns without such literals, like `^.`, are always run.
+//
+// The literals and the text are folded the same way, ASCII letters to lower
+// case and the Kelvin sign and long s to k and s, so case-insensitive
+// patterns are prefiltered as well. Folding only finds more candidates.
+type literalFilter struct {
+	patterns int
+	// always marks the patterns without literals.
+	always []bool
+	// classes maps each folded byte to its column of next, the bytes that
+	// occur in no literal to column 0. Upper case ASCII letters share the
+	// column of their lower case letter.
+	classes [256]int32
+	columns int
+	// next is the automaton: next[row+class] is the row of the state after
+	// reading a byte of class in the state at row, state*columns. The row is
+	// negated for states in which a literal ends; out lists the patterns of
+	// those literals by state.
+	next []int32
+	out  [][]int
+}
+
+// newLiteralFilter returns the prefilter of patterns, or nil when too few
+// of them have literals to make it worthwhile.
+func newLiteralFilter(patterns []*regexp.Regexp) *literalFilter {
+	literals := make([][]string, len(patterns))
+	count := 0
+	for i, re := range patterns {
+		parsed, err := syntax.Parse(re.String(), syntax.Perl)
+		if err != nil {
+			continue
+		}
+		if lits, ok := requiredLiterals(parsed.Simplify()); ok {
+			literals[i] = lits
+			count++
+		}
+	}
+	if count < minLiteralPatterns {
+		return nil
+	}
+
+	l := &literalFilter{patterns: len(patterns), always: make([]bool, len(patterns))}
+	for i, lits := range literals {
+		if lits == nil {
+			l.always[i] = true
+			continue
+		}
+		for _, lit := range lits {
+			for _, b := range []byte(lit) {
+				if l.classes[b] == 0 {
+					l.columns++
+					l.classes[b] = int32(l.columns)
+				}
+			}
+		}
+	}
+	l.columns++
+	for b := 'A'; b <= 'Z'; b++ {
+		l.classes[b] = l.classes[b+'a'-'A']
+	}
+	l.build(literals)
+	return l
+}
+
+// build fills the automaton with the literals of every pattern: first the
+// trie of the literals, then the failure transitions, breadth first.
+func (l *literalFilter) build(literals [][]string) {
+	l.next = make([]int32, l.columns)
+	l.out = [][]int{nil}
+	for i, lits := range literals {
+		for _, lit := range lits {
+			state := int32(0)
+			for _, b := range []byte(lit) {
+				slot := int(state)*l.columns + int(l.classes[b])
+				if l.next[slot] == 0 {
+					l.next[slot] = int32(len(l.out))
+					l.next = append(l.next, make([]int32, l.columns)...)
+					l.out = append(l.out, nil)
+				}
+				state = l.next[slot]
+			}
+			l.out[state] = append(l.out[state], i)
+		}
+	}
+
+	// The root keeps its transitions; a missing one stays at the root.
+	fail := make([]int32, len(l.out))
+	var queue []int32
+	for c := 0; c < l.columns; c++ {
+		if child := l.next[c]; child != 0 {
+			queue = append(queue, child)
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		l.out[state] = append(l.out[state], l.out[fail[state]]...)
+		for c := 0; c < l.columns; c++ {
+			slot := int(state)*l.columns + c
+			target := l.next[int(fail[state])*l.columns+c]
+			if child := l.next[slot]; child != 0 {
+				fail[child] = target
+				queue = append(queue, child)
+			} else {
+				l.next[slot] = target
+			}
+		}
+	}
+
+	for i, target := range l.next {
+		row := target * int32(l.columns)
+		if len(l.out[target]) > 0 {
+			row = -row
+		}
+		l.next[i] = row
+	}
+}
+
+// candidates returns which patterns may match text. A nil prefilter
+// returns nil: every pattern may match.
+func (l *literalFilter) candidates(text []byte) []bool {
+	if l == nil {
+		return nil
+	}
+	found := make([]bool, l.patterns)
+	copy(found, l.always)
+	row := int32(0)
+	for i := 0; i < len(text); i++ {
+		b := text[i]
+		if b == 0xe2 || b == 0xc5 {
+			var size int
+			b, size = foldByte(text[i:])
+			i += size - 1
+		}
+		row = l.next[row+l.classes[b]]
+		if row < 0 {
+			row = -row
+			for _, pattern := range l.out[row/int32(l.columns)] {
+				found[pattern] = true
+			}
+		}
+	}
+	return found
+}
+
+// foldByte returns the folded first character of text and the number of
+// bytes it takes.
+func foldByte(text []byte) (byte, int) {
+	b := text[0]
+	switch {
+	case 'A' <= b && b <= 'Z':
+		return b + 'a' - 'A', 1
+	case b == 0xe2 && len(text) >= 3 && text[1] == 0x84 && text[2] == 0xaa: // U+212A KELVIN SIGN
+		return 'k', 3
+	case b == 0xc5 && len(text) >= 2 && text[1] == 0xbf: // U+017F LATIN SMALL LETTER LONG S
+		return 's', 2
+	}
+	return b, 1
+}
+
+// fold folds s like foldByte.
+func fold(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); {
+		b, size := foldByte([]byte(s[i:]))
+		sb.WriteByte(b)
+		i += size
+	}
+	return sb.String()
+}
+
+// requiredLiterals returns folded literals one of which every match of re
+// contains, false when there are none.
+func requiredLiterals(re *syntax.Regexp) ([]string, bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return literalOf(re)
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return requiredLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		// The longest literals are the rarest, a single one is rarer than
+		// several.
+		var best []string
+		for _, sub := range re.Sub {
+			lits, ok := requiredLiterals(sub)
+			if !ok {
+				continue
+			}
+			if best == nil || shortest(lits) > shortest(best) || shortest(lits) == shortest(best) && len(lits) < len(best) {
+				best = lits
+			}
+		}
+		return best, best != nil
+	case syntax.OpAlternate:
+		var all []string
+		for _, sub := range re.Sub {
+			lits, ok := requiredLiterals(sub)
+			if !ok {
+				return nil, false
+			}
+			all = append(all, lits...)
+		}
+		return all, len(all) <= maxAlternateLiterals
+	}
+	return nil, false
+}
+
+// literalOf returns the folded literal of re. Literals the prefilter cannot
+// fold like the regexp does, case-insensitive ones with letters beyond
+// ASCII, and those matching invalid UTF-8 are left out.
+func literalOf(re *syntax.Regexp) ([]string, bool) {
+	foldCase := re.Flags&syntax.FoldCase != 0
+	for _, r := range re.Rune {
+		if r == utf8.RuneError || foldCase && r >= utf8.RuneSelf && unicode.SimpleFold(r) != r {
+			return nil, false
+		}
+	}
+	return []string{fold(string(re.Rune))}, true
+}
+
+// shortest returns the length of the shortest of lits.
+func shortest(lits []string) int {
+	n := len(lits[0])
+	for _, lit := range lits[1:] {
+		n = min(n, len(lit))
+	}
+	return n
+}
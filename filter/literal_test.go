@@ -0,0 +1,93 @@
+package filter
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"regexp/syntax"
+	"testing"
+)
+
+func TestRequiredLiterals(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{`From: .*@spam\.com`, []string{"@spam.com"}},
+		{`@spam\.example\.com>?$`, []string{"@spam.example.com"}},
+		{`(?i)Newsletter`, []string{"newsletter"}},
+		{`(?i)unsubscribe|opt[- ]out`, []string{"unsubscribe", "opt"}},
+		{`(foo|bar)+baz`, []string{"baz"}},
+		{`(?:ab){2,}`, []string{"ab"}},
+		{`Subject: \[alert\]`, []string{"subject: [alert]"}},
+		{`(?i)straße`, nil},
+		{`Größe`, []string{"größe"}},
+		{`.`, nil},
+		{`^x?$`, nil},
+		{`(a|.)bc?`, []string{"b"}},
+		{`[ab]c*`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			re, err := syntax.Parse(tt.pattern, syntax.Perl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := requiredLiterals(re.Simplify())
+			if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("requiredLiterals() = %q, %v, want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestLiteralFilter(t *testing.T) {
+	patterns := []string{
+		`@spam\.com`,
+		`(?i)newsletter`,
+		`(?i)kiosk`,
+		`Subject: (offer|deal)s?`,
+		`^X-Mailer:`,
+		`he|she|his|hers`,
+	}
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		compiled = append(compiled, regexp.MustCompile(pattern))
+	}
+	l := newLiteralFilter(compiled)
+	if l == nil {
+		t.Fatal("newLiteralFilter() = nil")
+	}
+
+	texts := []string{
+		"",
+		"From: a@spam.com",
+		"From: a@SPAM.com",
+		"Subject: NEWSLETTER #3",
+		"Subject: Kiosk opening",
+		"Subject: Deals",
+		"Subject: deals",
+		"X-Mailer: x",
+		"ushers",
+		"\xe2\x84 broken \xc5",
+		"Subject: \u212aiosk and New\u017fletter",
+		"Subject: \u212aIOSK",
+	}
+	for _, text := range texts {
+		candidates := l.candidates([]byte(text))
+		for i, re := range compiled {
+			if re.MatchString(text) && !candidates[i] {
+				t.Errorf("candidates(%q) ruled out %q, which matches", text, re)
+			}
+		}
+	}
+
+	got := fmt.Sprint(l.candidates([]byte("ushers")))
+	if want := "[false false false false false true]"; got != want {
+		t.Errorf("candidates(ushers) = %s, want %s", got, want)
+	}
+
+	if newLiteralFilter(compiled[:3]) != nil {
+		t.Error("newLiteralFilter() prefilters a short list")
+	}
+}
@@ -0,0 +1,256 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/emersion/go-message"
+	// Registers the charsets message.Read decodes to UTF-8.
+	_ "github.com/emersion/go-message/charset"
+)
+
+// DefaultBodyTypes are the content types whose text decoded body matching
+// looks at when Options.BodyTypes is empty.
+var DefaultBodyTypes = []string{"text/plain", "text/html"}
+
+// maxDecodedText caps the decoded text kept per message, the rest of a
+// message is not matched.
+const maxDecodedText = 16 << 20
+
+// mimePart is a leaf part of a message's MIME tree. Body is decoded from
+// its transfer encoding and, for text parts, converted to UTF-8.
+type mimePart struct {
+	mediaType   string
+	disposition string
+	filename    string
+	body        io.Reader
+}
+
+// walkParts calls fn for every leaf part of msg. Parts that cannot be
+// decoded are passed on as they are; a malformed MIME structure ends the
+// walk without an error, as the parts seen so far are all there is to see.
+func walkParts(msg Message, fn func(part *mimePart) error) error {
+	body := io.Reader(bytes.NewReader(msg.Body))
+	if msg.OpenBody != nil {
+		rc, err := msg.OpenBody()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		body = rc
+	}
+	header := bytes.TrimRight(msg.Header, "\r\n")
+	r := io.MultiReader(bytes.NewReader(header), strings.NewReader("\r\n\r\n"), body)
+
+	entity, err := message.Read(r)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return nil
+	}
+
+	var fnErr error
+	_ = entity.Walk(func(path []int, part *message.Entity, err error) error {
+		mediaType, _, _ := part.Header.ContentType()
+		if strings.HasPrefix(mediaType, "multipart/") {
+			return nil
+		}
+		if mediaType == "" {
+			mediaType = "text/plain"
+		}
+		disposition, params, _ := part.Header.ContentDisposition()
+		filename := params["filename"]
+		if filename == "" {
+			_, typeParams, _ := part.Header.ContentType()
+			filename = typeParams["name"]
+		}
+		fnErr = fn(&mimePart{
+			mediaType:   strings.ToLower(mediaType),
+			disposition: strings.ToLower(disposition),
+			filename:    filename,
+			body:        part.Body,
+		})
+		return fnErr
+	})
+	return fnErr
+}
+
+// attachment is a part of a message that is an attachment: one with an
+// attachment disposition or a file name.
+type attachment struct {
+	name      string
+	mediaType string
+	// size is the decoded size in bytes.
+	size int64
+}
+
+// attachments returns the attachments of msg in the order of its MIME tree.
+func attachments(msg Message) ([]attachment, error) {
+	var list []attachment
+	err := walkParts(msg, func(part *mimePart) error {
+		if part.disposition != "attachment" && part.filename == "" {
+			return nil
+		}
+		// A body that cannot be decoded counts with the bytes read.
+		size, _ := io.Copy(io.Discard, part.body)
+		list = append(list, attachment{
+			name:      baseName(part.filename),
+			mediaType: part.mediaType,
+			size:      size,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read attachments: %w", err)
+	}
+	return list, nil
+}
+
+// baseName strips the directories some mailers leave in file names.
+func baseName(filename string) string {
+	if i := strings.LastIndexAny(filename, "/\\"); i >= 0 {
+		return filename[i+1:]
+	}
+	return filename
+}
+
+// decodedText returns the decoded text of the parts of msg whose content
+// type is one of types, with HTML rendered as text. Attachments are left
+// out.
+func decodedText(msg Message, types []string) (string, error) {
+	var sb strings.Builder
+	err := walkParts(msg, func(part *mimePart) error {
+		if part.disposition == "attachment" || !matchMediaType(types, part.mediaType) {
+			return nil
+		}
+		remaining := int64(maxDecodedText - sb.Len())
+		if remaining <= 0 {
+			return nil
+		}
+		data, err := io.ReadAll(io.LimitReader(part.body, remaining))
+		if err != nil && len(data) == 0 {
+			// An undecodable part has no text to match.
+			return nil
+		}
+		text := string(data)
+		if part.mediaType == "text/html" {
+			text = htmlText(text)
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte('\n')
+		}
+		sb.WriteString(text)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("read body: %w", err)
+	}
+	return sb.String(), nil
+}
+
+// ValidateBodyTypes checks that every entry of types is a "type/subtype"
+// content type or a "type/*" wildcard.
+func ValidateBodyTypes(types []string) error {
+	for _, t := range types {
+		major, minor, ok := strings.Cut(strings.TrimSpace(t), "/")
+		if !ok || major == "" || minor == "" || major == "*" || strings.ContainsAny(minor, "/ ;") {
+			return fmt.Errorf("invalid body content type %q", t)
+		}
+	}
+	return nil
+}
+
+// matchMediaType reports whether mediaType is one of types, which may use
+// "type/*" wildcards.
+func matchMediaType(types []string, mediaType string) bool {
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == mediaType || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// htmlBlockTags end a line when rendering HTML as text.
+var htmlBlockTags = map[string]bool{
+	"br": true, "p": true, "div": true, "li": true, "tr": true, "table": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"blockquote": true, "pre": true, "hr": true, "ul": true, "ol": true,
+}
+
+// htmlText renders an HTML document as plain text: tags are dropped, block
+// elements end lines, scripts, styles and comments are skipped, entities
+// are decoded and whitespace is collapsed.
+func htmlText(doc string) string {
+	var out strings.Builder
+	// space is set when whitespace separates the text written last from
+	// the next, inline tags alone do not separate words.
+	space := false
+	text := func(s string) {
+		s = html.UnescapeString(s)
+		words := strings.Fields(s)
+		if len(words) == 0 {
+			space = space || s != ""
+			return
+		}
+		first, _ := utf8.DecodeRuneInString(s)
+		if (space || unicode.IsSpace(first)) && out.Len() > 0 && !strings.HasSuffix(out.String(), "\n") {
+			out.WriteByte(' ')
+		}
+		out.WriteString(strings.Join(words, " "))
+		last, _ := utf8.DecodeLastRuneInString(s)
+		space = unicode.IsSpace(last)
+	}
+	newline := func() {
+		if out.Len() > 0 && !strings.HasSuffix(out.String(), "\n") {
+			out.WriteByte('\n')
+		}
+		space = false
+	}
+
+	for len(doc) > 0 {
+		lt := strings.IndexByte(doc, '<')
+		if lt < 0 {
+			text(doc)
+			break
+		}
+		text(doc[:lt])
+		doc = doc[lt:]
+
+		if strings.HasPrefix(doc, "<!--") {
+			end := strings.Index(doc, "-->")
+			if end < 0 {
+				break
+			}
+			doc = doc[end+3:]
+			continue
+		}
+		gt := strings.IndexByte(doc, '>')
+		if gt < 0 {
+			break
+		}
+		closing := strings.HasPrefix(doc, "</")
+		name := strings.ToLower(strings.TrimLeft(doc[1:gt], "/"))
+		if i := strings.IndexAny(name, " \t\r\n/"); i >= 0 {
+			name = name[:i]
+		}
+		doc = doc[gt+1:]
+
+		switch {
+		case !closing && (name == "script" || name == "style" || name == "head"):
+			end := strings.Index(strings.ToLower(doc), "</"+name)
+			if end < 0 {
+				doc = ""
+				continue
+			}
+			doc = doc[end:]
+		case htmlBlockTags[name]:
+			newline()
+		}
+	}
+	return strings.TrimSpace(out.String())
+}
@@ -0,0 +1,226 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+const multipartMessage = "From: a@example.com\r\n" +
+	"Subject: decoded\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n"
+
+const multipartBody = "--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Gr=FC=DFe aus M=FCnchen, die Rechnung ist=\r\n" +
+	" bezahlt.\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	// <p>Invoice&nbsp;<b>paid</b></p><script>var secret</script>
+	"PHA+SW52b2ljZSZuYnNwOzxiPnBhaWQ8L2I+PC9wPjxzY3JpcHQ+dmFyIHNlY3JldDwvc2NyaXB0Pg==\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain; name=notes.txt\r\n" +
+	"Content-Disposition: attachment; filename=notes.txt\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"YXR0YWNobWVudCBzZWNyZXQ=\r\n" +
+	"--outer--\r\n"
+
+func TestDecodedText(t *testing.T) {
+	msg := Message{Header: []byte(multipartMessage), Body: []byte(multipartBody)}
+
+	text, err := decodedText(msg, DefaultBodyTypes)
+	if err != nil {
+		t.Fatalf("decodedText() error = %v", err)
+	}
+	want := "Grüße aus München, die Rechnung ist bezahlt.\nInvoice paid"
+	if text != want {
+		t.Errorf("decodedText() = %q, want %q", text, want)
+	}
+
+	text, err = decodedText(msg, []string{"text/html"})
+	if err != nil {
+		t.Fatalf("decodedText() error = %v", err)
+	}
+	if text != "Invoice paid" {
+		t.Errorf("decodedText(text/html) = %q", text)
+	}
+}
+
+func TestDecodedText_SinglePart(t *testing.T) {
+	msg := Message{
+		Header: []byte("Content-Type: text/html\r\nContent-Transfer-Encoding: base64\r\n"),
+		// <div>Hello <i>wor</i>ld</div>
+		Body: []byte("PGRpdj5IZWxsbyA8aT53b3I8L2k+bGQ8L2Rpdj4=\r\n"),
+	}
+	if text, err := decodedText(msg, []string{"text/*"}); err != nil || text != "Hello world" {
+		t.Errorf("decodedText() = %q, %v", text, err)
+	}
+
+	msg = Message{Header: []byte("Subject: no mime\r\n"), Body: []byte("plain text\r\n")}
+	if text, err := decodedText(msg, DefaultBodyTypes); err != nil || text != "plain text\r\n" {
+		t.Errorf("decodedText() = %q, %v", text, err)
+	}
+}
+
+func TestFilter_DecodeBody(t *testing.T) {
+	header, body := []byte(multipartMessage), []byte(multipartBody)
+
+	tests := []struct {
+		name string
+		opts Options
+		want bool
+	}{
+		{"raw body misses encoded text", Options{IncludeBody: []string{"München"}}, false},
+		{"decoded plain text", Options{IncludeBody: []string{"München"}, DecodeBody: true}, true},
+		{"decoded html", Options{IncludeBody: []string{`Invoice\s+paid`}, DecodeBody: true}, true},
+		{"script is skipped", Options{ExcludeBody: []string{"secret"}, DecodeBody: true}, true},
+		{"restricted to html", Options{IncludeBody: []string{"München"}, DecodeBody: true, BodyTypes: []string{"text/html"}}, false},
+		{"expression", Options{Expression: `body ~ "Rechnung ist bezahlt"`, DecodeBody: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := New(tt.opts)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			if got := f.Allows(header, body); got != tt.want {
+				t.Errorf("Allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := New(Options{DecodeBody: true, BodyTypes: []string{"html"}}); err == nil {
+		t.Error("New() accepted an invalid body content type")
+	}
+}
+
+func TestHTMLText(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want string
+	}{
+		{"<p>one</p><p>two</p>", "one\ntwo"},
+		{"a<br>b<br/>c", "a\nb\nc"},
+		{"<b>bo</b>ld and <i>italic</i>", "bold and italic"},
+		{"<head><title>t</title></head><body>x &amp; y</body>", "x & y"},
+		{"<style>p{}</style>a<!-- comment -->b<SCRIPT>c</SCRIPT>d", "abd"},
+		{"  spread \n  over\tlines  ", "spread over lines"},
+	}
+	for _, tt := range tests {
+		if got := htmlText(tt.doc); got != tt.want {
+			t.Errorf("htmlText(%q) = %q, want %q", tt.doc, got, tt.want)
+		}
+	}
+	if got := htmlText(strings.Repeat("<div>x</div>", 3)); got != "x\nx\nx" {
+		t.Errorf("htmlText(divs) = %q", got)
+	}
+}
+
+const attachmentBody = "--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"see attached\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/pdf; name=\"Report.PDF\"\r\n" +
+	"Content-Disposition: attachment\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQK\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=\"C:\\\\temp\\\\setup.exe\"\r\n" +
+	"\r\n" +
+	"MZ\r\n" +
+	"--b\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-Disposition: inline; filename=logo.png\r\n" +
+	"\r\n" +
+	"png\r\n" +
+	"--b--\r\n"
+
+func TestAttachments(t *testing.T) {
+	msg := Message{
+		Header: []byte("Content-Type: multipart/mixed; boundary=b\r\n"),
+		Body:   []byte(attachmentBody),
+	}
+	list, err := attachments(msg)
+	if err != nil {
+		t.Fatalf("attachments() error = %v", err)
+	}
+	want := []attachment{
+		{name: "Report.PDF", mediaType: "application/pdf", size: 9},
+		{name: "setup.exe", mediaType: "application/octet-stream", size: 2},
+		{name: "logo.png", mediaType: "image/png", size: 3},
+	}
+	if len(list) != len(want) {
+		t.Fatalf("attachments() = %+v, want %+v", list, want)
+	}
+	for i := range want {
+		if list[i] != want[i] {
+			t.Errorf("attachment %d = %+v, want %+v", i, list[i], want[i])
+		}
+	}
+
+	list, err = attachments(Message{Header: []byte("Subject: plain\r\n"), Body: []byte("no parts\r\n")})
+	if err != nil || len(list) != 0 {
+		t.Errorf("attachments(plain) = %+v, %v", list, err)
+	}
+}
+
+func TestExpression_Attachments(t *testing.T) {
+	msg := Message{
+		Header: []byte("Content-Type: multipart/mixed; boundary=b\r\n"),
+		Body:   []byte(attachmentBody),
+	}
+	plain := Message{Header: []byte("Subject: plain\r\n"), Body: []byte("no parts\r\n")}
+
+	tests := []struct {
+		expr      string
+		want      bool
+		wantPlain bool
+	}{
+		{`exists attachment`, true, false},
+		{`not exists attachment`, false, true},
+		{`attachment.name = "*.pdf"`, true, false},
+		{`attachment.name = "*.zip"`, false, false},
+		{`attachment.name != "*.exe" and attachment.name != "*.zip"`, false, true},
+		{`attachment.name ~ "(?i)\.(exe|zip)$"`, true, false},
+		{`attachment.type = "application/pdf"`, true, false},
+		{`attachment.type = "image/*"`, true, false},
+		{`attachment.type ~ "^video/"`, false, false},
+		{`attachment.size > 10`, true, false},
+		{`attachment.size < 1KB`, true, true},
+		{`attachment.size = 0`, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			expr, err := ParseExpression(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseExpression() error = %v", err)
+			}
+			if got, err := expr.Match(msg); err != nil || got != tt.want {
+				t.Errorf("Match() = %v, %v, want %v", got, err, tt.want)
+			}
+			if got, err := expr.Match(plain); err != nil || got != tt.wantPlain {
+				t.Errorf("Match(plain) = %v, %v, want %v", got, err, tt.wantPlain)
+			}
+		})
+	}
+
+	f, err := New(Options{Expression: `not attachment.name = "*.exe"`, IncludeBody: []string{"see attached"}, DecodeBody: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if f.Allows(msg.Header, msg.Body) {
+		t.Error("expected the decoded body not to hide the attachments from the expression")
+	}
+}
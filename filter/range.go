@@ -0,0 +1,81 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ParseDateBound parses the bound of a date range, a YYYY-MM-DD date or an
+// RFC 3339 time. A date without time of day covers the whole day, so an
+// upper bound of 2015-12-31 includes that day. An empty value returns the
+// zero time, an open bound.
+func ParseDateBound(value string, upper bool) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	date, day, err := parseDateLiteral(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if day && upper {
+		date = date.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return date, nil
+}
+
+// ParseSizeBound is ParseSize for the bound of a size range. An empty value
+// returns 0, an open bound.
+func ParseSizeBound(value string) (int64, error) {
+	if strings.TrimSpace(value) == "" {
+		return 0, nil
+	}
+	return ParseSize(value)
+}
+
+// rangeStage is the first filter stage, it drops messages dated outside
+// [since, until] and messages whose size is outside [minSize, maxSize].
+// Zero bounds are not checked.
+type rangeStage struct {
+	since, until     time.Time
+	minSize, maxSize int64
+}
+
+func newRangeStage(opts Options) (rangeStage, error) {
+	r := rangeStage{since: opts.Since, until: opts.Until, minSize: opts.MinSize, maxSize: opts.MaxSize}
+	if !r.since.IsZero() && !r.until.IsZero() && r.until.Before(r.since) {
+		return rangeStage{}, fmt.Errorf("date range ends (%s) before it starts (%s)", r.until.Format(time.RFC3339), r.since.Format(time.RFC3339))
+	}
+	if r.minSize < 0 || r.maxSize < 0 {
+		return rangeStage{}, fmt.Errorf("size bounds must not be negative")
+	}
+	if r.maxSize > 0 && r.maxSize < r.minSize {
+		return rangeStage{}, fmt.Errorf("maximum size %d is below the minimum size %d", r.maxSize, r.minSize)
+	}
+	return r, nil
+}
+
+func (r rangeStage) hasDate() bool {
+	return !r.since.IsZero() || !r.until.IsZero()
+}
+
+func (r rangeStage) hasSize() bool {
+	return r.minSize > 0 || r.maxSize > 0
+}
+
+// dateAllowed reports whether date is within the date range. A message
+// without a date is outside of any range.
+func (r rangeStage) dateAllowed(date time.Time) bool {
+	if !r.hasDate() {
+		return true
+	}
+	if date.IsZero() {
+		return false
+	}
+	return (r.since.IsZero() || !date.Before(r.since)) && (r.until.IsZero() || !date.After(r.until))
+}
+
+func (r rangeStage) sizeAllowed(size int64) bool {
+	return size >= r.minSize && (r.maxSize == 0 || size <= r.maxSize)
+}
@@ -0,0 +1,84 @@
+package filter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDateBound(t *testing.T) {
+	tests := []struct {
+		value string
+		upper bool
+		want  time.Time
+	}{
+		{"", false, time.Time{}},
+		{"2015-01-01", false, time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"2015-12-31", true, time.Date(2015, 12, 31, 23, 59, 59, 999999999, time.UTC)},
+		{"2015-12-31T18:00:00+01:00", true, time.Date(2015, 12, 31, 17, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := ParseDateBound(tt.value, tt.upper)
+		if err != nil {
+			t.Fatalf("ParseDateBound(%q) error = %v", tt.value, err)
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("ParseDateBound(%q, %v) = %v, want %v", tt.value, tt.upper, got, tt.want)
+		}
+	}
+	if _, err := ParseDateBound("last year", false); err == nil {
+		t.Error("ParseDateBound(\"last year\") succeeded")
+	}
+}
+
+func TestFilter_Ranges(t *testing.T) {
+	since, _ := ParseDateBound("2015-01-01", false)
+	until, _ := ParseDateBound("2019-12-31", true)
+	f, err := New(Options{Since: since, Until: until, MinSize: 100, MaxSize: 1000, ExcludeHeader: []string{"spam"}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	header := []byte("Subject: hi\r\n")
+	tests := []struct {
+		name string
+		date time.Time
+		size int64
+		want bool
+	}{
+		{"inside", time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC), 500, true},
+		{"first day", since, 100, true},
+		{"last day", time.Date(2019, 12, 31, 23, 0, 0, 0, time.UTC), 1000, true},
+		{"too old", time.Date(2014, 12, 31, 23, 59, 0, 0, time.UTC), 500, false},
+		{"too new", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), 500, false},
+		{"no date", time.Time{}, 500, false},
+		{"too small", time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC), 99, false},
+		{"too large", time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC), 1001, false},
+	}
+	for _, tt := range tests {
+		got, err := f.Match(Message{Header: header, Size: tt.size, Date: tt.date})
+		if err != nil {
+			t.Fatalf("%s: Match() error = %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: Match() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	stats := f.GetStats()
+	if stats.DateDropped != 3 || stats.SizeDropped != 2 || !stats.Since.Equal(since) || stats.MaxSize != 1000 {
+		t.Errorf("GetStats() = %+v", stats)
+	}
+}
+
+func TestFilter_InvalidRanges(t *testing.T) {
+	since := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, opts := range []Options{
+		{Since: since, Until: since.Add(-time.Second)},
+		{MinSize: 10, MaxSize: 5},
+		{MinSize: -1},
+	} {
+		if _, err := New(opts); err == nil {
+			t.Errorf("New(%+v) succeeded", opts)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule types.
+const (
+	// RuleHeader matches Pattern against the header field Field, every
+	// occurrence RFC 2047 decoded, or against the whole header block when
+	// Field is empty.
+	RuleHeader = "header"
+	// RuleBody matches Pattern against the body, decoded with
+	// Options.DecodeBody.
+	RuleBody = "body"
+	// RuleLabel matches the Gmail label Pattern, see ParseLabels.
+	RuleLabel = "label"
+	// RuleExpression matches the filter expression Pattern, see
+	// ParseExpression.
+	RuleExpression = "expression"
+)
+
+// Rule actions.
+const (
+	// RuleInclude rules form an allow list: a message must match one of
+	// them, if there are any.
+	RuleInclude = "include"
+	// RuleExclude drops the messages the rule matches.
+	RuleExclude = "exclude"
+	// RuleRoute uploads the messages the rule matches into Folder, below
+	// the target folder. The first matching route wins.
+	RuleRoute = "route"
+)
+
+// Rule is a named filter or routing rule, usually read from a rules file
+// with LoadRules.
+type Rule struct {
+	Name    string
+	Type    string
+	Field   string `json:",omitempty"`
+	Pattern string
+	Action  string
+	Folder  string `json:",omitempty"`
+	Comment string `json:"-"`
+	// Line is the line of the rule in its file, zero if it has none.
+	Line int `json:"-"`
+}
+
+// LoadRules reads and validates a rules file:
+//
+//	rules:
+//	  - name: no-newsletters
+//	    type: header
+//	    field: List-Id
+//	    pattern: "."
+//	    action: exclude
+//	    comment: Mailing lists are archived elsewhere.
+//	  - name: invoices
+//	    type: body
+//	    pattern: "(?i)invoice"
+//	    action: route
+//	    folder: Finance/Invoices
+//
+// Errors name the file and line.
+func LoadRules(file string) ([]Rule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read rules: %w", err)
+	}
+	rules, err := ParseRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", file, err)
+	}
+	return rules, nil
+}
+
+// ParseRules parses and validates the content of a rules file. Errors start
+// with the line number.
+func ParseRules(data []byte) ([]Rule, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s", strings.TrimPrefix(err.Error(), "yaml: line "))
+	}
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("1: no rules")
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%d: expected a mapping with a rules list", root.Line)
+	}
+
+	var list *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if key.Value != "rules" {
+			return nil, fmt.Errorf("%d: unknown key %q", key.Line, key.Value)
+		}
+		list = value
+	}
+	if list == nil || list.Kind != yaml.SequenceNode || len(list.Content) == 0 {
+		return nil, fmt.Errorf("%d: no rules", root.Line)
+	}
+
+	var rules []Rule
+	seen := make(map[string]int)
+	for _, node := range list.Content {
+		rule, err := parseRuleNode(node)
+		if err != nil {
+			return nil, err
+		}
+		if line, ok := seen[strings.ToLower(rule.Name)]; ok {
+			return nil, fmt.Errorf("%d: rule %q: name already used on line %d", rule.Line, rule.Name, line)
+		}
+		seen[strings.ToLower(rule.Name)] = rule.Line
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseRuleNode(node *yaml.Node) (Rule, error) {
+	if node.Kind != yaml.MappingNode {
+		return Rule{}, fmt.Errorf("%d: expected a rule with name, type, pattern and action", node.Line)
+	}
+
+	rule := Rule{Line: node.Line}
+	lines := make(map[string]int)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if value.Kind != yaml.ScalarNode {
+			return Rule{}, fmt.Errorf("%d: %s must be a string", value.Line, key.Value)
+		}
+		var target *string
+		switch key.Value {
+		case "name":
+			target = &rule.Name
+		case "type":
+			target = &rule.Type
+		case "field":
+			target = &rule.Field
+		case "pattern":
+			target = &rule.Pattern
+		case "action":
+			target = &rule.Action
+		case "folder":
+			target = &rule.Folder
+		case "comment":
+			target = &rule.Comment
+		default:
+			return Rule{}, fmt.Errorf("%d: unknown key %q", key.Line, key.Value)
+		}
+		*target = value.Value
+		lines[key.Value] = value.Line
+	}
+
+	line := func(key string) int {
+		if l, ok := lines[key]; ok {
+			return l
+		}
+		return rule.Line
+	}
+	if strings.TrimSpace(rule.Name) == "" {
+		return Rule{}, fmt.Errorf("%d: rule without name", rule.Line)
+	}
+	if _, err := compileRule(rule); err != nil {
+		key := ""
+		var ruleErr *ruleError
+		if errors.As(err, &ruleErr) {
+			key, err = ruleErr.key, ruleErr.err
+		}
+		return Rule{}, fmt.Errorf("%d: rule %q: %w", line(key), rule.Name, err)
+	}
+	return rule, nil
+}
+
+// ruleError is a validation error of a rule and the key it is about.
+type ruleError struct {
+	key string
+	err error
+}
+
+func (e *ruleError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ruleError) Unwrap() error {
+	return e.err
+}
+
+// compiledRule is a validated rule with its pattern compiled.
+type compiledRule struct {
+	Rule
+	re    *regexp.Regexp
+	expr  *Expression
+	field string
+}
+
+func compileRule(rule Rule) (compiledRule, error) {
+	fail := func(key, format string, args ...any) (compiledRule, error) {
+		return compiledRule{}, &ruleError{key: key, err: fmt.Errorf(format, args...)}
+	}
+
+	c := compiledRule{Rule: rule, field: strings.ToLower(strings.TrimSpace(rule.Field))}
+	switch rule.Action {
+	case RuleInclude, RuleExclude:
+		if rule.Folder != "" {
+			return fail("folder", "folder only applies to route rules")
+		}
+	case RuleRoute:
+		folder := strings.Trim(strings.TrimSpace(rule.Folder), "/")
+		if folder == "" {
+			return fail("action", "route rules need a folder")
+		}
+		if path.Clean(folder) != folder || strings.HasPrefix(folder, "..") {
+			return fail("folder", "invalid folder %q", rule.Folder)
+		}
+		c.Folder = folder
+	case "":
+		return fail("action", "missing action (include, exclude or route)")
+	default:
+		return fail("action", "unknown action %q (include, exclude or route)", rule.Action)
+	}
+
+	if rule.Pattern == "" {
+		return fail("pattern", "missing pattern")
+	}
+	if rule.Field != "" && rule.Type != RuleHeader {
+		return fail("field", "field only applies to header rules")
+	}
+	switch rule.Type {
+	case RuleHeader, RuleBody:
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fail("pattern", "compile %q: %w", rule.Pattern, err)
+		}
+		c.re = re
+	case RuleLabel:
+		c.Pattern = strings.Trim(strings.TrimSpace(rule.Pattern), "/")
+	case RuleExpression:
+		expr, err := ParseExpression(rule.Pattern)
+		if err != nil {
+			return fail("pattern", "%w", err)
+		}
+		c.expr = expr
+	case "":
+		return fail("type", "missing type (header, body, label or expression)")
+	default:
+		return fail("type", "unknown type %q (header, body, label or expression)", rule.Type)
+	}
+	return c, nil
+}
+
+func compileRules(rules []Rule) ([]compiledRule, error) {
+	compiled := make([]compiledRule, 0, len(rules))
+	for _, rule := range rules {
+		c, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// usesBody reports whether the rule looks at the body.
+func (r compiledRule) usesBody() bool {
+	return r.Type == RuleBody || r.expr != nil && r.expr.usesBody
+}
+
+// match reports whether the rule matches m.
+func (r compiledRule) match(m *exprMessage) (bool, error) {
+	switch r.Type {
+	case RuleHeader:
+		if r.field == "" {
+			return r.re.Match(m.msg.Header), nil
+		}
+		for _, value := range m.values(r.field) {
+			if r.re.MatchString(value) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case RuleBody:
+		return m.matchBody(r.re)
+	case RuleLabel:
+		for _, value := range m.header().Values(LabelsHeader) {
+			for _, label := range ParseLabels(value) {
+				if labelMatches(r.Pattern, label) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case RuleExpression:
+		return r.expr.root.eval(m)
+	}
+	return false, nil
+}
@@ -0,0 +1,178 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const rulesFile = `rules:
+  - name: no-lists
+    type: header
+    field: List-Id
+    pattern: "."
+    action: exclude
+    comment: Mailing lists are archived elsewhere.
+  - name: invoices
+    type: body
+    pattern: "(?i)invoice"
+    action: route
+    folder: /Finance/Invoices/
+  - name: work
+    type: label
+    pattern: Work
+    action: route
+    folder: Work
+  - name: large
+    type: expression
+    pattern: size > 1KB
+    action: exclude
+`
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules([]byte(rulesFile))
+	if err != nil {
+		t.Fatalf("ParseRules() error = %v", err)
+	}
+	if len(rules) != 4 {
+		t.Fatalf("ParseRules() = %d rules, want 4", len(rules))
+	}
+	first := rules[0]
+	if first.Name != "no-lists" || first.Type != RuleHeader || first.Field != "List-Id" || first.Action != RuleExclude || first.Line != 2 {
+		t.Errorf("rule 0 = %+v", first)
+	}
+	if first.Comment != "Mailing lists are archived elsewhere." {
+		t.Errorf("rule 0 comment = %q", first.Comment)
+	}
+	if rules[3].Line != 18 {
+		t.Errorf("rule 3 line = %d, want 18", rules[3].Line)
+	}
+}
+
+func TestParseRules_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"empty", "", "1: no rules"},
+		{"not a list", "rules: x\n", "1: no rules"},
+		{"unknown top-level key", "filters: []\n", `1: unknown key "filters"`},
+		{"unknown key", "rules:\n  - name: a\n    type: body\n    patern: x\n    action: exclude\n", `4: unknown key "patern"`},
+		{"missing name", "rules:\n  - type: body\n    pattern: x\n    action: exclude\n", "2: rule without name"},
+		{"bad regex", "rules:\n  - name: a\n    type: body\n    pattern: \"(\"\n    action: exclude\n", `4: rule "a": compile "("`},
+		{"bad expression", "rules:\n  - name: a\n    type: expression\n    pattern: size >\n    action: exclude\n", `4: rule "a":`},
+		{"unknown type", "rules:\n  - name: a\n    type: subject\n    pattern: x\n    action: exclude\n", `3: rule "a": unknown type "subject"`},
+		{"unknown action", "rules:\n  - name: a\n    type: body\n    pattern: x\n    action: drop\n", `5: rule "a": unknown action "drop"`},
+		{"route without folder", "rules:\n  - name: a\n    type: body\n    pattern: x\n    action: route\n", `5: rule "a": route rules need a folder`},
+		{"folder escapes", "rules:\n  - name: a\n    type: body\n    pattern: x\n    action: route\n    folder: ../x\n", `6: rule "a": invalid folder "../x"`},
+		{"folder on exclude", "rules:\n  - name: a\n    type: body\n    pattern: x\n    action: exclude\n    folder: x\n", `6: rule "a": folder only applies to route rules`},
+		{"field on body", "rules:\n  - name: a\n    type: body\n    field: Subject\n    pattern: x\n    action: exclude\n", `4: rule "a": field only applies to header rules`},
+		{"duplicate name", "rules:\n  - name: a\n    type: body\n    pattern: x\n    action: exclude\n  - name: A\n    type: body\n    pattern: y\n    action: exclude\n", `6: rule "A": name already used on line 2`},
+		{"invalid yaml", "rules:\n  - name: [\n", "2:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRules([]byte(tt.data))
+			if err == nil {
+				t.Fatal("ParseRules() error = nil")
+			}
+			if !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("ParseRules() error = %q, want prefix %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(file, []byte("rules:\n  - name: a\n    type: body\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadRules(file)
+	if err == nil || !strings.HasPrefix(err.Error(), file+":2: ") {
+		t.Errorf("LoadRules() error = %v, want it to start with %s:2", err, file)
+	}
+}
+
+func TestFilter_Rules(t *testing.T) {
+	rules, err := ParseRules([]byte(rulesFile))
+	if err != nil {
+		t.Fatalf("ParseRules() error = %v", err)
+	}
+	f, err := New(Options{Rules: rules})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		header     string
+		body       string
+		allowed    bool
+		wantFolder string
+	}{
+		{"list is excluded", "List-Id: <news.example.com>\r\n", "invoice\r\n", false, ""},
+		{"invoice is routed", "Subject: March\r\n", "Your Invoice\r\n", true, "Finance/Invoices"},
+		{"first route wins", "X-Gmail-Labels: Work/Projects\r\n", "invoice\r\n", true, "Finance/Invoices"},
+		{"label route", "X-Gmail-Labels: Work/Projects\r\n", "hello\r\n", true, "Work"},
+		{"no route", "Subject: hello\r\n", "hello\r\n", true, ""},
+		{"large is excluded", "Subject: big\r\n", strings.Repeat("x", 2048), false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := Message{Header: []byte(tt.header), Body: []byte(tt.body)}
+			msg.Size = int64(len(msg.Header) + len(msg.Body))
+			got, err := f.Evaluate(msg)
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if got.Allowed != tt.allowed || got.Folder != tt.wantFolder {
+				t.Errorf("Evaluate() = %+v, want allowed %v, folder %q", got, tt.allowed, tt.wantFolder)
+			}
+		})
+	}
+
+	stats := f.GetStats()
+	wantHits := map[string]int{"no-lists": 1, "invoices": 2, "work": 1, "large": 1}
+	for name, want := range wantHits {
+		if stats.RuleHits[name] != want {
+			t.Errorf("RuleHits[%q] = %d, want %d", name, stats.RuleHits[name], want)
+		}
+	}
+	if stats.RulesDropped != 2 {
+		t.Errorf("RulesDropped = %d, want 2", stats.RulesDropped)
+	}
+	if len(stats.Rules) != 4 || stats.Rules[1].Folder != "Finance/Invoices" {
+		t.Errorf("Rules = %+v", stats.Rules)
+	}
+}
+
+func TestFilter_IncludeRules(t *testing.T) {
+	f, err := New(Options{Rules: []Rule{
+		{Name: "from-corp", Type: RuleHeader, Field: "From", Pattern: `@corp\.com>?$`, Action: RuleInclude},
+		{Name: "from-boss", Type: RuleHeader, Field: "From", Pattern: `^boss@`, Action: RuleInclude},
+	}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"From: a@corp.com\r\n", true},
+		{"From: boss@home.org\r\n", true},
+		{"From: a@other.org\r\n", false},
+		{"Subject: no from\r\n", false},
+	}
+	for _, tt := range tests {
+		if got := f.Allows([]byte(tt.header), nil); got != tt.want {
+			t.Errorf("Allows(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+
+	if _, err := New(Options{Rules: []Rule{{Name: "x", Type: RuleBody, Pattern: "(", Action: RuleExclude}}}); err == nil {
+		t.Error("New() accepted an invalid rule")
+	}
+}
@@ -0,0 +1,1106 @@
+package filter
+
+import (
+	"fmt"
+	"net/mail"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// sieveExtensions are the extensions a Sieve script may require. The two
+// comparators are built in and only listed so requiring them is no error.
+var sieveExtensions = map[string]bool{
+	"fileinto":                   true,
+	"envelope":                   true,
+	"imap4flags":                 true,
+	"comparator-i;octet":         true,
+	"comparator-i;ascii-casemap": true,
+}
+
+// SieveScript is a compiled Sieve (RFC 5228) script. The supported subset
+// is:
+//
+//   - the control commands require, if, elsif, else and stop;
+//   - the tests header, address, envelope ("from" is the sender of the mbox
+//     separator line, "to" the Delivered-To or X-Original-To field), size,
+//     exists, allof, anyof, not, true and false, with the match types :is,
+//     :contains and :matches and the comparators "i;ascii-casemap" (the
+//     default) and "i;octet";
+//   - the actions keep, discard, fileinto (RFC 5228) and addflag, setflag
+//     and removeflag on the internal flag variable (RFC 5232).
+//
+// A message is imported unless the script discards it or ends without keep
+// while the implicit keep is cancelled.
+type SieveScript struct {
+	source   string
+	commands []sieveCommand
+}
+
+// LoadSieve reads and compiles a Sieve script. Errors name the file and
+// line.
+func LoadSieve(file string) (*SieveScript, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read sieve script: %w", err)
+	}
+	script, err := ParseSieve(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", file, err)
+	}
+	return script, nil
+}
+
+// ParseSieve compiles the source of a Sieve script. Errors start with the
+// line number. An empty script returns nil, which keeps every message.
+func ParseSieve(source string) (*SieveScript, error) {
+	p := &sieveParser{lexer: sieveLexer{src: source, line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	nodes, err := p.parseCommands()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != sieveEOF {
+		return nil, p.unexpected()
+	}
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+
+	c := &sieveCompiler{required: make(map[string]bool)}
+	commands, err := c.commands(nodes, true)
+	if err != nil {
+		return nil, err
+	}
+	return &SieveScript{source: source, commands: commands}, nil
+}
+
+// String returns the source of the script.
+func (s *SieveScript) String() string {
+	return s.source
+}
+
+// sieveOutcome is what a script decided about a message.
+type sieveOutcome struct {
+	// keep is set by keep and by the implicit keep, folder by the first
+	// fileinto. A message neither kept nor filed is discarded.
+	keep   bool
+	folder string
+	flags  []string
+}
+
+func (o sieveOutcome) discarded() bool {
+	return !o.keep && o.folder == ""
+}
+
+// run executes the script against m.
+func (s *SieveScript) run(m *exprMessage) sieveOutcome {
+	r := &sieveRun{m: m, implicitKeep: true}
+	runSieve(s.commands, r)
+
+	outcome := sieveOutcome{keep: r.keep || r.implicitKeep, flags: r.flags}
+	if len(r.folders) > 0 {
+		// A single copy is imported, so the first fileinto wins.
+		outcome.folder = r.folders[0]
+		outcome.keep = false
+	}
+	return outcome
+}
+
+// sieveRun is the state of a script run.
+type sieveRun struct {
+	m            *exprMessage
+	keep         bool
+	implicitKeep bool
+	folders      []string
+	flags        []string
+}
+
+// sieveCommand is a compiled command. run reports whether the script
+// stops.
+type sieveCommand interface {
+	run(r *sieveRun) bool
+}
+
+func runSieve(commands []sieveCommand, r *sieveRun) bool {
+	for _, command := range commands {
+		if command.run(r) {
+			return true
+		}
+	}
+	return false
+}
+
+type sieveBranch struct {
+	test  sieveTest
+	block []sieveCommand
+}
+
+// sieveIf is an if command with its elsif branches; a final else has a nil
+// test.
+type sieveIf struct {
+	branches []sieveBranch
+}
+
+func (c sieveIf) run(r *sieveRun) bool {
+	for _, branch := range c.branches {
+		if branch.test == nil || branch.test.eval(r.m) {
+			return runSieve(branch.block, r)
+		}
+	}
+	return false
+}
+
+type sieveStop struct{}
+
+func (sieveStop) run(*sieveRun) bool { return true }
+
+type sieveKeep struct{}
+
+func (sieveKeep) run(r *sieveRun) bool {
+	r.keep = true
+	return false
+}
+
+type sieveDiscard struct{}
+
+func (sieveDiscard) run(r *sieveRun) bool {
+	r.implicitKeep = false
+	return false
+}
+
+type sieveFileinto struct {
+	folder string
+}
+
+func (c sieveFileinto) run(r *sieveRun) bool {
+	r.implicitKeep = false
+	if c.folder == "" {
+		// fileinto "INBOX" files into the target folder itself.
+		r.keep = true
+	} else if !slices.Contains(r.folders, c.folder) {
+		r.folders = append(r.folders, c.folder)
+	}
+	return false
+}
+
+// sieveFlags is addflag, setflag or removeflag.
+type sieveFlags struct {
+	op    string
+	flags []string
+}
+
+func (c sieveFlags) run(r *sieveRun) bool {
+	if c.op == "setflag" {
+		r.flags = nil
+	}
+	for _, flag := range c.flags {
+		i := slices.IndexFunc(r.flags, func(f string) bool { return strings.EqualFold(f, flag) })
+		switch {
+		case c.op == "removeflag" && i >= 0:
+			r.flags = slices.Delete(r.flags, i, i+1)
+		case c.op != "removeflag" && i < 0:
+			r.flags = append(r.flags, flag)
+		}
+	}
+	return false
+}
+
+// sieveTest is a compiled test.
+type sieveTest interface {
+	eval(m *exprMessage) bool
+}
+
+type sieveConst bool
+
+func (t sieveConst) eval(*exprMessage) bool { return bool(t) }
+
+type sieveNot struct{ test sieveTest }
+
+func (t sieveNot) eval(m *exprMessage) bool { return !t.test.eval(m) }
+
+// sieveAllOf is allof, or anyof with any set.
+type sieveAllOf struct {
+	tests []sieveTest
+	any   bool
+}
+
+func (t sieveAllOf) eval(m *exprMessage) bool {
+	for _, test := range t.tests {
+		if test.eval(m) == t.any {
+			return t.any
+		}
+	}
+	return !t.any
+}
+
+type sieveExists struct{ names []string }
+
+func (t sieveExists) eval(m *exprMessage) bool {
+	for _, name := range t.names {
+		if len(m.header().Values(name)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type sieveSize struct {
+	over  bool
+	limit int64
+}
+
+func (t sieveSize) eval(m *exprMessage) bool {
+	if t.over {
+		return m.msg.Size > t.limit
+	}
+	return m.msg.Size < t.limit
+}
+
+// sieveHeader is the header, address and envelope test. part is empty for
+// the header test.
+type sieveHeader struct {
+	kind    string
+	names   []string
+	part    string
+	matcher sieveMatcher
+}
+
+func (t sieveHeader) eval(m *exprMessage) bool {
+	for _, value := range t.values(m) {
+		if t.matcher.match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t sieveHeader) values(m *exprMessage) []string {
+	var values []string
+	for _, name := range t.names {
+		switch t.kind {
+		case "header":
+			for _, raw := range m.header().Values(name) {
+				values = append(values, decodeHeader(raw))
+			}
+		case "address":
+			for _, raw := range m.header().Values(name) {
+				for _, addr := range sieveAddresses(raw) {
+					values = append(values, addressPart(addr, t.part))
+				}
+			}
+		case "envelope":
+			for _, addr := range envelopeAddresses(m, name) {
+				values = append(values, addressPart(addr, t.part))
+			}
+		}
+	}
+	return values
+}
+
+// sieveAddresses returns the addresses of an address field, or the decoded
+// value when it is not a valid address list.
+func sieveAddresses(raw string) []string {
+	list, err := mail.ParseAddressList(raw)
+	if err != nil {
+		return []string{strings.TrimSpace(decodeHeader(raw))}
+	}
+	addrs := make([]string, 0, len(list))
+	for _, addr := range list {
+		addrs = append(addrs, addr.Address)
+	}
+	return addrs
+}
+
+// envelopeAddresses returns the envelope part ("from" or "to") of m. An
+// archive has no SMTP envelope, so the sender is taken from the mbox
+// separator line, empty for a bounce or a message without one, and the
+// recipient from the delivery fields.
+func envelopeAddresses(m *exprMessage, part string) []string {
+	if part == "from" {
+		sender, _, _ := strings.Cut(strings.TrimSpace(m.msg.Envelope), " ")
+		sender = strings.Trim(sender, "<>")
+		if strings.EqualFold(sender, "MAILER-DAEMON") {
+			// The null reverse path of a bounce compares as "".
+			sender = ""
+		}
+		return []string{sender}
+	}
+	for _, field := range []string{"Delivered-To", "X-Original-To"} {
+		var addrs []string
+		for _, raw := range m.header().Values(field) {
+			addrs = append(addrs, sieveAddresses(raw)...)
+		}
+		if len(addrs) > 0 {
+			return addrs
+		}
+	}
+	return nil
+}
+
+// addressPart returns the :localpart or :domain of addr, or addr itself.
+func addressPart(addr, part string) string {
+	at := strings.LastIndexByte(addr, '@')
+	switch {
+	case part == "localpart" && at >= 0:
+		return addr[:at]
+	case part == "domain":
+		if at < 0 {
+			return ""
+		}
+		return addr[at+1:]
+	}
+	return addr
+}
+
+// sieveMatcher matches a value against a key list with a match type and a
+// comparator.
+type sieveMatcher struct {
+	matchType string
+	fold      bool
+	keys      []string
+	patterns  []*regexp.Regexp
+}
+
+func newSieveMatcher(matchType, comparator string, keys []string) sieveMatcher {
+	m := sieveMatcher{matchType: matchType, fold: comparator != "i;octet"}
+	for _, key := range keys {
+		if m.fold {
+			key = asciiLower(key)
+		}
+		m.keys = append(m.keys, key)
+		if matchType == "matches" {
+			m.patterns = append(m.patterns, sieveGlob(key))
+		}
+	}
+	return m
+}
+
+func (m sieveMatcher) match(value string) bool {
+	if m.fold {
+		value = asciiLower(value)
+	}
+	for i, key := range m.keys {
+		var ok bool
+		switch m.matchType {
+		case "is":
+			ok = value == key
+		case "contains":
+			ok = strings.Contains(value, key)
+		case "matches":
+			ok = m.patterns[i].MatchString(value)
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sieveGlob compiles a :matches key: * matches any sequence, ? a single
+// character and \ escapes the next character.
+func sieveGlob(key string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString(`(?s)^`)
+	runes := []rune(key)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case r == '*':
+			b.WriteString(`.*`)
+		case r == '?':
+			b.WriteString(`.`)
+		case r == '\\' && i+1 < len(runes):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(runes[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString(`$`)
+	return regexp.MustCompile(b.String())
+}
+
+// asciiLower lowers the ASCII letters of s, the i;ascii-casemap comparator.
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+type sieveTokenKind int
+
+const (
+	sieveEOF sieveTokenKind = iota
+	sieveIdent
+	sieveTag
+	sieveNumber
+	sieveString
+	sievePunct
+)
+
+type sieveToken struct {
+	kind sieveTokenKind
+	text string
+	num  int64
+	line int
+}
+
+// sieveLexer splits a script into tokens. Identifiers and tags are lower
+// cased as they are case-insensitive.
+type sieveLexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *sieveLexer) next() (sieveToken, error) {
+	if err := l.skipSpace(); err != nil {
+		return sieveToken{}, err
+	}
+	if l.pos >= len(l.src) {
+		return sieveToken{kind: sieveEOF, line: l.line}, nil
+	}
+	line := l.line
+	c := l.src[l.pos]
+	switch {
+	case strings.IndexByte("[](),;{}", c) >= 0:
+		l.pos++
+		return sieveToken{kind: sievePunct, text: string(c), line: line}, nil
+	case c == '"':
+		return l.quoted()
+	case c == ':':
+		l.pos++
+		name := l.ident()
+		if name == "" {
+			return sieveToken{}, fmt.Errorf("%d: expected a tag name after \":\"", line)
+		}
+		return sieveToken{kind: sieveTag, text: name, line: line}, nil
+	case c >= '0' && c <= '9':
+		return l.number()
+	case isSieveIdentStart(c):
+		name := l.ident()
+		if name == "text" && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			return l.multiline(line)
+		}
+		return sieveToken{kind: sieveIdent, text: name, line: line}, nil
+	}
+	return sieveToken{}, fmt.Errorf("%d: unexpected character %q", line, c)
+}
+
+// skipSpace skips white space, # comments and /* */ comments.
+func (l *sieveLexer) skipSpace() error {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			line := l.line
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return fmt.Errorf("%d: unterminated comment", line)
+			}
+			comment := l.src[l.pos : l.pos+2+end+2]
+			l.line += strings.Count(comment, "\n")
+			l.pos += len(comment)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *sieveLexer) ident() string {
+	start := l.pos
+	for l.pos < len(l.src) && (isSieveIdentStart(l.src[l.pos]) || l.src[l.pos] >= '0' && l.src[l.pos] <= '9') {
+		l.pos++
+	}
+	return strings.ToLower(l.src[start:l.pos])
+}
+
+func isSieveIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// quoted reads a quoted string, in which a backslash escapes the next
+// character.
+func (l *sieveLexer) quoted() (sieveToken, error) {
+	line := l.line
+	var b strings.Builder
+	for l.pos++; l.pos < len(l.src); l.pos++ {
+		c := l.src[l.pos]
+		switch {
+		case c == '"':
+			l.pos++
+			return sieveToken{kind: sieveString, text: b.String(), line: line}, nil
+		case c == '\\' && l.pos+1 < len(l.src):
+			l.pos++
+			c = l.src[l.pos]
+		}
+		if c == '\n' {
+			l.line++
+		}
+		b.WriteByte(c)
+	}
+	return sieveToken{}, fmt.Errorf("%d: unterminated string", line)
+}
+
+// multiline reads the lines of a text: string up to the line holding a
+// single dot. A leading dot is doubled in the source.
+func (l *sieveLexer) multiline(line int) (sieveToken, error) {
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '#' {
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos >= len(l.src) || l.src[l.pos] != '\n' {
+		return sieveToken{}, fmt.Errorf("%d: expected a line break after text:", line)
+	}
+	l.pos++
+	l.line++
+
+	var lines []string
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		if end < 0 {
+			end = len(l.src) - l.pos
+		}
+		text := strings.TrimSuffix(l.src[l.pos:l.pos+end], "\r")
+		l.pos = min(l.pos+end+1, len(l.src))
+		l.line++
+		if text == "." {
+			return sieveToken{kind: sieveString, text: strings.Join(lines, "\r\n"), line: line}, nil
+		}
+		lines = append(lines, strings.TrimPrefix(text, "."))
+	}
+	return sieveToken{}, fmt.Errorf("%d: unterminated text: string", line)
+}
+
+// number reads a number with an optional K, M or G quantifier.
+func (l *sieveLexer) number() (sieveToken, error) {
+	line := l.line
+	start := l.pos
+	var n int64
+	for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+		n = n*10 + int64(l.src[l.pos]-'0')
+		if n > 1<<40 {
+			return sieveToken{}, fmt.Errorf("%d: number %s... is too large", line, l.src[start:l.pos])
+		}
+		l.pos++
+	}
+	if l.pos < len(l.src) {
+		shift := strings.IndexByte("KMG", l.src[l.pos]&^0x20)
+		if shift >= 0 {
+			l.pos++
+			if n > 1<<40>>(10*(shift+1)) {
+				return sieveToken{}, fmt.Errorf("%d: number %s is too large", line, l.src[start:l.pos])
+			}
+			n <<= 10 * (shift + 1)
+		}
+	}
+	return sieveToken{kind: sieveNumber, text: l.src[start:l.pos], num: n, line: line}, nil
+}
+
+// sieveNode is a command or test as written: an identifier with its
+// arguments, tests and block.
+type sieveNode struct {
+	name     string
+	line     int
+	args     []sieveArg
+	tests    []*sieveNode
+	block    []*sieveNode
+	hasBlock bool
+}
+
+// sieveArg is a tag, a number or a string list; a single string is a list
+// of one.
+type sieveArg struct {
+	kind    sieveTokenKind
+	tag     string
+	num     int64
+	strings []string
+	line    int
+}
+
+// sieveParser is a recursive descent parser for the RFC 5228 grammar:
+//
+//	commands  = *command
+//	command   = identifier arguments (";" / block)
+//	block     = "{" commands "}"
+//	arguments = *argument [test / test-list]
+//	argument  = string-list / number / tag
+//	test      = identifier arguments
+//	test-list = "(" test *("," test) ")"
+type sieveParser struct {
+	lexer sieveLexer
+	tok   sieveToken
+}
+
+func (p *sieveParser) advance() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *sieveParser) punct(c string) bool {
+	return p.tok.kind == sievePunct && p.tok.text == c
+}
+
+func (p *sieveParser) unexpected() error {
+	switch p.tok.kind {
+	case sieveEOF:
+		return fmt.Errorf("%d: unexpected end of script", p.tok.line)
+	case sieveString:
+		return fmt.Errorf("%d: unexpected string %q", p.tok.line, p.tok.text)
+	case sieveTag:
+		return fmt.Errorf("%d: unexpected :%s", p.tok.line, p.tok.text)
+	}
+	return fmt.Errorf("%d: unexpected %q", p.tok.line, p.tok.text)
+}
+
+func (p *sieveParser) expect(c string) error {
+	if !p.punct(c) {
+		return p.unexpected()
+	}
+	return p.advance()
+}
+
+func (p *sieveParser) parseCommands() ([]*sieveNode, error) {
+	var nodes []*sieveNode
+	for p.tok.kind == sieveIdent {
+		node, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func (p *sieveParser) parseCommand() (*sieveNode, error) {
+	node := &sieveNode{name: p.tok.text, line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if err := p.parseArguments(node); err != nil {
+		return nil, err
+	}
+	if p.punct(";") {
+		return node, p.advance()
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	block, err := p.parseCommands()
+	if err != nil {
+		return nil, err
+	}
+	node.block, node.hasBlock = block, true
+	return node, p.expect("}")
+}
+
+func (p *sieveParser) parseTest() (*sieveNode, error) {
+	if p.tok.kind != sieveIdent {
+		return nil, p.unexpected()
+	}
+	node := &sieveNode{name: p.tok.text, line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	return node, p.parseArguments(node)
+}
+
+func (p *sieveParser) parseArguments(node *sieveNode) error {
+	for {
+		arg := sieveArg{kind: p.tok.kind, line: p.tok.line}
+		switch {
+		case p.tok.kind == sieveTag:
+			arg.tag = p.tok.text
+		case p.tok.kind == sieveNumber:
+			arg.num = p.tok.num
+		case p.tok.kind == sieveString:
+			arg.strings = []string{p.tok.text}
+		case p.punct("["):
+			list, err := p.parseStringList()
+			if err != nil {
+				return err
+			}
+			arg.kind, arg.strings = sieveString, list
+			node.args = append(node.args, arg)
+			continue
+		default:
+			return p.parseTests(node)
+		}
+		node.args = append(node.args, arg)
+		if err := p.advance(); err != nil {
+			return err
+		}
+	}
+}
+
+// parseStringList parses "[" string *("," string) "]".
+func (p *sieveParser) parseStringList() ([]string, error) {
+	var list []string
+	for {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != sieveString {
+			return nil, p.unexpected()
+		}
+		list = append(list, p.tok.text)
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.punct("]") {
+			return list, p.advance()
+		}
+		if !p.punct(",") {
+			return nil, p.unexpected()
+		}
+	}
+}
+
+// parseTests parses the optional test or test list after the arguments.
+func (p *sieveParser) parseTests(node *sieveNode) error {
+	if p.tok.kind == sieveIdent {
+		test, err := p.parseTest()
+		if err != nil {
+			return err
+		}
+		node.tests = []*sieveNode{test}
+		return nil
+	}
+	if !p.punct("(") {
+		return nil
+	}
+	for {
+		if err := p.advance(); err != nil {
+			return err
+		}
+		test, err := p.parseTest()
+		if err != nil {
+			return err
+		}
+		node.tests = append(node.tests, test)
+		if p.punct(")") {
+			return p.advance()
+		}
+		if !p.punct(",") {
+			return p.unexpected()
+		}
+	}
+}
+
+// sieveCompiler validates the parsed nodes and compiles them.
+type sieveCompiler struct {
+	required map[string]bool
+}
+
+func (c *sieveCompiler) commands(nodes []*sieveNode, top bool) ([]sieveCommand, error) {
+	var commands []sieveCommand
+	requireAllowed := top
+	for i := 0; i < len(nodes); i++ {
+		node := nodes[i]
+		if node.name == "require" {
+			if !requireAllowed {
+				return nil, fmt.Errorf("%d: require must come before the other commands", node.line)
+			}
+			if err := c.require(node); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		requireAllowed = false
+
+		if node.name == "elsif" || node.name == "else" {
+			return nil, fmt.Errorf("%d: %s without if", node.line, node.name)
+		}
+		if node.name != "if" {
+			command, err := c.command(node)
+			if err != nil {
+				return nil, err
+			}
+			commands = append(commands, command)
+			continue
+		}
+
+		var command sieveIf
+		for {
+			branch, err := c.branch(node)
+			if err != nil {
+				return nil, err
+			}
+			command.branches = append(command.branches, branch)
+			if node.name == "else" || i+1 == len(nodes) || nodes[i+1].name != "elsif" && nodes[i+1].name != "else" {
+				break
+			}
+			i++
+			node = nodes[i]
+		}
+		commands = append(commands, command)
+	}
+	return commands, nil
+}
+
+func (c *sieveCompiler) require(node *sieveNode) error {
+	if len(node.args) != 1 || node.args[0].kind != sieveString || len(node.tests) > 0 || node.hasBlock {
+		return fmt.Errorf("%d: require expects a list of extensions", node.line)
+	}
+	for _, ext := range node.args[0].strings {
+		if !sieveExtensions[ext] {
+			return fmt.Errorf("%d: unsupported extension %q", node.line, ext)
+		}
+		c.required[ext] = true
+	}
+	return nil
+}
+
+// branch compiles an if, elsif or else command.
+func (c *sieveCompiler) branch(node *sieveNode) (sieveBranch, error) {
+	var branch sieveBranch
+	if !node.hasBlock {
+		return branch, fmt.Errorf("%d: %s needs a block", node.line, node.name)
+	}
+	if len(node.args) > 0 {
+		return branch, fmt.Errorf("%d: %s takes no arguments", node.line, node.name)
+	}
+	if node.name == "else" {
+		if len(node.tests) > 0 {
+			return branch, fmt.Errorf("%d: else takes no test", node.line)
+		}
+	} else {
+		if len(node.tests) != 1 {
+			return branch, fmt.Errorf("%d: %s needs a single test", node.line, node.name)
+		}
+		test, err := c.test(node.tests[0])
+		if err != nil {
+			return branch, err
+		}
+		branch.test = test
+	}
+	block, err := c.commands(node.block, false)
+	if err != nil {
+		return branch, err
+	}
+	branch.block = block
+	return branch, nil
+}
+
+// command compiles an action or stop.
+func (c *sieveCompiler) command(node *sieveNode) (sieveCommand, error) {
+	if node.hasBlock || len(node.tests) > 0 {
+		return nil, fmt.Errorf("%d: %s takes no test or block", node.line, node.name)
+	}
+	noArgs := func(command sieveCommand) (sieveCommand, error) {
+		if len(node.args) > 0 {
+			return nil, fmt.Errorf("%d: %s takes no arguments", node.line, node.name)
+		}
+		return command, nil
+	}
+	switch node.name {
+	case "stop":
+		return noArgs(sieveStop{})
+	case "keep":
+		return noArgs(sieveKeep{})
+	case "discard":
+		return noArgs(sieveDiscard{})
+	case "fileinto":
+		if err := c.needs(node, "fileinto"); err != nil {
+			return nil, err
+		}
+		if len(node.args) != 1 || node.args[0].kind != sieveString || len(node.args[0].strings) != 1 {
+			return nil, fmt.Errorf("%d: fileinto expects a single folder", node.line)
+		}
+		folder := strings.Trim(strings.TrimSpace(node.args[0].strings[0]), "/")
+		if folder == "" || path.Clean(folder) != folder || strings.HasPrefix(folder, "..") {
+			return nil, fmt.Errorf("%d: invalid folder %q", node.line, node.args[0].strings[0])
+		}
+		if strings.EqualFold(folder, "INBOX") {
+			folder = ""
+		}
+		return sieveFileinto{folder: folder}, nil
+	case "addflag", "setflag", "removeflag":
+		if err := c.needs(node, "imap4flags"); err != nil {
+			return nil, err
+		}
+		if len(node.args) != 1 || node.args[0].kind != sieveString {
+			return nil, fmt.Errorf("%d: %s expects a list of flags, variables are not supported", node.line, node.name)
+		}
+		var flags []string
+		for _, value := range node.args[0].strings {
+			for _, flag := range strings.Fields(value) {
+				if !validFlag(flag) {
+					return nil, fmt.Errorf("%d: invalid flag %q", node.line, flag)
+				}
+				flags = append(flags, flag)
+			}
+		}
+		return sieveFlags{op: node.name, flags: flags}, nil
+	}
+	return nil, fmt.Errorf("%d: unsupported command %q", node.line, node.name)
+}
+
+// needs reports an error unless ext was required.
+func (c *sieveCompiler) needs(node *sieveNode, ext string) error {
+	if !c.required[ext] {
+		return fmt.Errorf("%d: %s needs require %q", node.line, node.name, ext)
+	}
+	return nil
+}
+
+// validFlag reports whether flag is an IMAP flag: an atom, optionally
+// preceded by a backslash.
+func validFlag(flag string) bool {
+	flag = strings.TrimPrefix(flag, `\`)
+	if flag == "" {
+		return false
+	}
+	for i := 0; i < len(flag); i++ {
+		if c := flag[i]; c <= ' ' || c >= 0x7f || strings.IndexByte(`(){%*"\]`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *sieveCompiler) test(node *sieveNode) (sieveTest, error) {
+	switch node.name {
+	case "true", "false":
+		if len(node.args) > 0 || len(node.tests) > 0 {
+			return nil, fmt.Errorf("%d: %s takes no arguments", node.line, node.name)
+		}
+		return sieveConst(node.name == "true"), nil
+	case "not":
+		if len(node.args) > 0 || len(node.tests) != 1 {
+			return nil, fmt.Errorf("%d: not needs a single test", node.line)
+		}
+		test, err := c.test(node.tests[0])
+		if err != nil {
+			return nil, err
+		}
+		return sieveNot{test: test}, nil
+	case "allof", "anyof":
+		if len(node.args) > 0 || len(node.tests) == 0 {
+			return nil, fmt.Errorf("%d: %s needs a list of tests", node.line, node.name)
+		}
+		t := sieveAllOf{any: node.name == "anyof"}
+		for _, child := range node.tests {
+			test, err := c.test(child)
+			if err != nil {
+				return nil, err
+			}
+			t.tests = append(t.tests, test)
+		}
+		return t, nil
+	}
+
+	if len(node.tests) > 0 {
+		return nil, fmt.Errorf("%d: %s takes no tests", node.line, node.name)
+	}
+	switch node.name {
+	case "exists":
+		if len(node.args) != 1 || node.args[0].kind != sieveString {
+			return nil, fmt.Errorf("%d: exists expects a list of header names", node.line)
+		}
+		return sieveExists{names: node.args[0].strings}, nil
+	case "size":
+		if len(node.args) != 2 || node.args[0].kind != sieveTag || node.args[1].kind != sieveNumber ||
+			node.args[0].tag != "over" && node.args[0].tag != "under" {
+			return nil, fmt.Errorf("%d: size expects :over or :under and a number", node.line)
+		}
+		return sieveSize{over: node.args[0].tag == "over", limit: node.args[1].num}, nil
+	case "header", "address", "envelope":
+		return c.headerTest(node)
+	}
+	return nil, fmt.Errorf("%d: unsupported test %q", node.line, node.name)
+}
+
+// headerTest compiles the header, address and envelope tests:
+//
+//	header   [COMPARATOR] [MATCH-TYPE] <header-names> <keys>
+//	address  [COMPARATOR] [ADDRESS-PART] [MATCH-TYPE] <header-names> <keys>
+//	envelope [COMPARATOR] [ADDRESS-PART] [MATCH-TYPE] <envelope-parts> <keys>
+func (c *sieveCompiler) headerTest(node *sieveNode) (sieveTest, error) {
+	if node.name == "envelope" {
+		if err := c.needs(node, "envelope"); err != nil {
+			return nil, err
+		}
+	}
+	t := sieveHeader{kind: node.name}
+	matchType, comparator := "", "i;ascii-casemap"
+	var positional [][]string
+	args := node.args
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg.kind == sieveString:
+			positional = append(positional, arg.strings)
+		case arg.kind != sieveTag:
+			return nil, fmt.Errorf("%d: unexpected number %d in %s", arg.line, arg.num, node.name)
+		case len(positional) > 0:
+			return nil, fmt.Errorf("%d: tag :%s after the header names", arg.line, arg.tag)
+		case arg.tag == "comparator":
+			if i+1 == len(args) || args[i+1].kind != sieveString || len(args[i+1].strings) != 1 {
+				return nil, fmt.Errorf("%d: :comparator expects a comparator name", arg.line)
+			}
+			i++
+			comparator = args[i].strings[0]
+			if comparator != "i;ascii-casemap" && comparator != "i;octet" {
+				return nil, fmt.Errorf("%d: unsupported comparator %q", arg.line, comparator)
+			}
+		case arg.tag == "is" || arg.tag == "contains" || arg.tag == "matches":
+			if matchType != "" {
+				return nil, fmt.Errorf("%d: more than one match type", arg.line)
+			}
+			matchType = arg.tag
+		case (arg.tag == "all" || arg.tag == "localpart" || arg.tag == "domain") && node.name != "header":
+			if t.part != "" {
+				return nil, fmt.Errorf("%d: more than one address part", arg.line)
+			}
+			t.part = arg.tag
+		default:
+			return nil, fmt.Errorf("%d: unsupported tag :%s in %s", arg.line, arg.tag, node.name)
+		}
+	}
+	if len(positional) != 2 {
+		return nil, fmt.Errorf("%d: %s expects header names and keys", node.line, node.name)
+	}
+	if matchType == "" {
+		matchType = "is"
+	}
+	t.names = positional[0]
+	if node.name == "envelope" {
+		for i, part := range t.names {
+			t.names[i] = strings.ToLower(part)
+			if t.names[i] != "from" && t.names[i] != "to" {
+				return nil, fmt.Errorf("%d: unsupported envelope part %q (from or to)", node.line, part)
+			}
+		}
+	}
+	t.matcher = newSieveMatcher(matchType, comparator, positional[1])
+	return t, nil
+}
@@ -0,0 +1,234 @@
+package filter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const sieveHeaderBlock = "From: \"Alice\" <Alice@Corp.example.com>\r\n" +
+	"To: bob@example.org, carol@example.net\r\n" +
+	"Subject: =?UTF-8?Q?Rechnung_f=C3=BCr_M=C3=A4rz?=\r\n" +
+	"List-Id: <news.example.com>\r\n" +
+	"Delivered-To: archive@example.org\r\n"
+
+func sieveMessage() Message {
+	return Message{
+		Header:   []byte(sieveHeaderBlock),
+		Body:     []byte("hello\r\n"),
+		Size:     2048,
+		Envelope: "bounce+123@mailer.example.com Thu Nov 13 20:15:00 2025",
+	}
+}
+
+func TestSieve_Tests(t *testing.T) {
+	tests := []struct {
+		test string
+		want bool
+	}{
+		{`true`, true},
+		{`false`, false},
+		{`header :contains "subject" "rechnung"`, true},
+		{`header :is "Subject" "Rechnung für März"`, true},
+		{`header :comparator "i;octet" :contains "subject" "rechnung"`, false},
+		{`header :matches "subject" "Rech*M?rz"`, true},
+		{`header :matches "subject" "Rech*"`, true},
+		{`header :matches "subject" "Rech"`, false},
+		{`header :matches "x-literal" "a\\*b"`, false},
+		{`header :contains ["x-spam", "list-id"] "news"`, true},
+		{`address :is "from" "alice@corp.example.com"`, true},
+		{`address :domain :is "from" "corp.example.com"`, true},
+		{`address :localpart :is "to" "carol"`, true},
+		{`address :domain :matches "to" "*.org"`, true},
+		{`address :all :is "to" "dave@example.org"`, false},
+		{`envelope :domain :is "from" "mailer.example.com"`, true},
+		{`envelope :matches "from" "bounce+*@*"`, true},
+		{`envelope :is "to" "archive@example.org"`, true},
+		{`envelope :is "from" ""`, false},
+		{`exists "list-id"`, true},
+		{`exists ["list-id", "x-spam"]`, false},
+		{`size :over 1K`, true},
+		{`size :under 1K`, false},
+		{`size :over 2048`, false},
+		{`size :under 1024G`, true},
+		{`not exists "x-spam"`, true},
+		{`allof (exists "from", size :under 1M)`, true},
+		{`allof (exists "from", false)`, false},
+		{`anyof (false, header :contains "from" "alice")`, true},
+		{`anyof (false, false)`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.test, func(t *testing.T) {
+			script, err := ParseSieve(`require ["envelope", "fileinto"]; if ` + tt.test + ` { fileinto "Match"; }`)
+			if err != nil {
+				t.Fatalf("ParseSieve() error = %v", err)
+			}
+			outcome := script.run(&exprMessage{msg: sieveMessage()})
+			if got := outcome.folder == "Match"; got != tt.want {
+				t.Errorf("test matched = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSieve_Actions(t *testing.T) {
+	tests := []struct {
+		name       string
+		script     string
+		discarded  bool
+		wantFolder string
+		wantFlags  []string
+	}{
+		{"empty script", ``, false, "", nil},
+		{"implicit keep", `if false { discard; }`, false, "", nil},
+		{"discard", `discard;`, true, "", nil},
+		{"keep after discard", `discard; keep;`, false, "", nil},
+		{"fileinto", `require "fileinto"; fileinto "Lists/News";`, false, "Lists/News", nil},
+		{"first fileinto wins", `require "fileinto"; fileinto "A"; fileinto "B";`, false, "A", nil},
+		{"fileinto inbox", `require "fileinto"; fileinto "INBOX";`, false, "", nil},
+		{"fileinto after discard", `require "fileinto"; discard; fileinto "A";`, false, "A", nil},
+		{"stop", `stop; discard;`, false, "", nil},
+		{
+			"elsif and else",
+			`require "fileinto";
+			if header :contains "subject" "nothing" { fileinto "A"; }
+			elsif exists "list-id" { fileinto "Lists"; stop; }
+			else { discard; }
+			discard;`,
+			false, "Lists", nil,
+		},
+		{"else", `if false { keep; } else { discard; }`, true, "", nil},
+		{
+			"flags",
+			`require "imap4flags";
+			addflag "\\Seen";
+			addflag ["\\Flagged $Work", "\\seen"];
+			removeflag "$Work";`,
+			false, "", []string{`\Seen`, `\Flagged`},
+		},
+		{"setflag", `require "imap4flags"; addflag "\\Seen"; setflag "\\Answered";`, false, "", []string{`\Answered`}},
+		{
+			"comments and text",
+			"# filing\r\nrequire \"fileinto\"; /* multi\r\nline */\r\nif header :is \"list-id\" text:\r\n<news.example.com>\r\n.\r\n{ fileinto \"News\"; }",
+			false, "News", nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script, err := ParseSieve(tt.script)
+			if err != nil {
+				t.Fatalf("ParseSieve() error = %v", err)
+			}
+			var outcome sieveOutcome
+			if script == nil {
+				outcome = sieveOutcome{keep: true}
+			} else {
+				outcome = script.run(&exprMessage{msg: sieveMessage()})
+			}
+			if outcome.discarded() != tt.discarded || outcome.folder != tt.wantFolder || !reflect.DeepEqual(outcome.flags, tt.wantFlags) {
+				t.Errorf("run() = %+v, want discarded %v, folder %q, flags %q", outcome, tt.discarded, tt.wantFolder, tt.wantFlags)
+			}
+		})
+	}
+}
+
+func TestSieve_NullSender(t *testing.T) {
+	script, err := ParseSieve(`require "envelope"; if envelope :is "from" "" { discard; }`)
+	if err != nil {
+		t.Fatalf("ParseSieve() error = %v", err)
+	}
+	for _, envelope := range []string{"MAILER-DAEMON Thu Nov 13 20:15:00 2025", "<> Thu Nov 13 20:15:00 2025", ""} {
+		msg := sieveMessage()
+		msg.Envelope = envelope
+		if !script.run(&exprMessage{msg: msg}).discarded() {
+			t.Errorf("envelope %q was not taken as the null sender", envelope)
+		}
+	}
+}
+
+func TestParseSieve_Errors(t *testing.T) {
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{`fileinto "A";`, `1: fileinto needs require "fileinto"`},
+		{"require \"imap4flags\";\naddflag \"bad flag(\";", `2: invalid flag "flag("`},
+		{`require "vacation";`, `1: unsupported extension "vacation"`},
+		{"keep;\nrequire \"fileinto\";", "2: require must come before the other commands"},
+		{"if true {\n  reject \"no\";\n}", `2: unsupported command "reject"`},
+		{`if header :regex "subject" "x" { keep; }`, "1: unsupported tag :regex in header"},
+		{`if header :is :contains "subject" "x" { keep; }`, "1: more than one match type"},
+		{`if header "subject" { keep; }`, "1: header expects header names and keys"},
+		{`if envelope "from" "x" { keep; }`, `1: envelope needs require "envelope"`},
+		{`require "envelope"; if envelope "auth" "x" { keep; }`, `1: unsupported envelope part "auth"`},
+		{`if size 10 { keep; }`, "1: size expects :over or :under and a number"},
+		{`if header :comparator "i;unicode" :is "a" "b" { keep; }`, `1: unsupported comparator "i;unicode"`},
+		{`if { keep; }`, "1: if needs a single test"},
+		{`else { keep; }`, "1: else without if"},
+		{"if true { keep; }\nkeep\n", "3: unexpected end of script"},
+		{`keep`, "1: unexpected end of script"},
+		{`if true { keep; `, "1: unexpected end of script"},
+		{"\n\"unterminated", "2: unterminated string"},
+		{"/* open", "1: unterminated comment"},
+		{`require "fileinto"; fileinto "../outside";`, `1: invalid folder "../outside"`},
+		{`keep "x";`, "1: keep takes no arguments"},
+		{`if anyof () { keep; }`, `1: unexpected ")"`},
+		{`if size :over 2000000000G { keep; }`, "1: number 2000000000G is too large"},
+		{`if size :over 99999999999999 { keep; }`, "1: number 999999999999... is too large"},
+	}
+	for _, tt := range tests {
+		_, err := ParseSieve(tt.script)
+		if err == nil {
+			t.Errorf("ParseSieve(%q) error = nil, want %q", tt.script, tt.want)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("ParseSieve(%q) error = %q, want %q", tt.script, err, tt.want)
+		}
+	}
+}
+
+func TestFilter_Sieve(t *testing.T) {
+	f, err := New(Options{
+		Sieve: `require ["fileinto", "imap4flags"];
+			if exists "list-id" { fileinto "Lists"; addflag "\\Seen"; }
+			elsif header :contains "subject" "spam" { discard; }`,
+		Rules: []Rule{{Name: "corp", Type: RuleHeader, Field: "From", Pattern: `(?i)corp\.example\.com`, Action: RuleRoute, Folder: "Corp"}},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		header     string
+		allowed    bool
+		wantFolder string
+		wantFlags  []string
+	}{
+		{"route rule wins over fileinto", sieveHeaderBlock, true, "Corp", []string{`\Seen`}},
+		{"fileinto", "List-Id: <x>\r\n", true, "Lists", []string{`\Seen`}},
+		{"discard", "Subject: spam offer\r\n", false, "", nil},
+		{"keep", "Subject: hello\r\n", true, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := f.Evaluate(Message{Header: []byte(tt.header)})
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if got.Allowed != tt.allowed || got.Folder != tt.wantFolder || !reflect.DeepEqual(got.Flags, tt.wantFlags) {
+				t.Errorf("Evaluate() = %+v, want allowed %v, folder %q, flags %q", got, tt.allowed, tt.wantFolder, tt.wantFlags)
+			}
+		})
+	}
+
+	stats := f.GetStats()
+	if !stats.Sieve || stats.SieveKept != 1 || stats.SieveDiscarded != 1 || stats.SieveFiled["Lists"] != 2 {
+		t.Errorf("stats = kept %d, discarded %d, filed %v", stats.SieveKept, stats.SieveDiscarded, stats.SieveFiled)
+	}
+
+	if _, err := New(Options{Sieve: `discard`}); err == nil {
+		t.Error("New() accepted an invalid sieve script")
+	}
+}
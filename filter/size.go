@@ -0,0 +1,41 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseSize parses a byte size such as "512", "64KB", "8MiB" or "1G". Decimal
+// (KB, MB, GB) and binary (KiB, MiB, GiB) suffixes are accepted, a bare K, M
+// or G is binary.
+func ParseSize(value string) (int64, error) {
+	original := value
+	value = strings.TrimSpace(value)
+	upper := strings.ToUpper(value)
+
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30},
+		{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+		{"B", 1},
+	}
+
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(upper, unit.suffix) {
+			multiplier = unit.multiplier
+			value = strings.TrimSpace(value[:len(value)-len(unit.suffix)])
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a byte size", original)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,218 @@
+package filter
+
+import (
+	"strings"
+	"sync"
+)
+
+// ThreadSet implements thread closure: messages are grouped into threads by
+// their Message-ID, In-Reply-To and References fields, and every message of
+// a thread is allowed when any of its messages passes the filter. Closure
+// only extends the includes: a message of a selected thread is still
+// dropped by the ranges, the exclude labels, patterns and rules and a Sieve
+// discard. It is filled by a first pass over the source with Add and, after
+// Finish, applied by a second pass with Apply.
+type ThreadSet struct {
+	mu sync.Mutex
+	// excludes is the filter without its includes, see Options.exclusions.
+	excludes *Filter
+	parent   map[string]string
+	// messages holds the Message-IDs seen by Add, picks the first allowed
+	// message of each Message-ID and, after Finish, of each thread root.
+	messages map[string]bool
+	picks    map[string]threadPick
+	threads  map[string]threadPick
+	added    int
+}
+
+// threadPick is the allowed message a thread follows: the first one in the
+// source and the folder the filter routed it to.
+type threadPick struct {
+	index  int
+	folder string
+}
+
+// ThreadStats describes the threads of a ThreadSet.
+type ThreadStats struct {
+	// Messages and Threads count the Message-IDs and the threads they
+	// form, Selected the threads with a message that passed the filter.
+	Messages int
+	Threads  int
+	Selected int
+	// Added counts the messages Apply allowed for their thread only.
+	Added int
+}
+
+// NewThreadSet returns an empty ThreadSet for the filter options opts.
+func NewThreadSet(opts Options) (*ThreadSet, error) {
+	excludes, err := New(opts.exclusions())
+	if err != nil {
+		return nil, err
+	}
+	return &ThreadSet{
+		excludes: excludes,
+		parent:   make(map[string]string),
+		messages: make(map[string]bool),
+		picks:    make(map[string]threadPick),
+	}, nil
+}
+
+// Add records the message at index with the header block header and the
+// filter result for it. Messages without a Message-ID are left out.
+func (t *ThreadSet) Add(index int, header []byte, result Result) {
+	id, refs := threadIDs(header)
+	if id == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages[id] = true
+	for _, ref := range refs {
+		t.union(id, ref)
+	}
+	if pick, ok := t.picks[id]; result.Allowed && (!ok || index < pick.index) {
+		t.picks[id] = threadPick{index: index, folder: result.Folder}
+	}
+}
+
+// Finish ends the first pass and selects the threads with an allowed
+// message.
+func (t *ThreadSet) Finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.threads = make(map[string]threadPick)
+	for id, pick := range t.picks {
+		root := t.find(id)
+		if current, ok := t.threads[root]; !ok || pick.index < current.index {
+			t.threads[root] = pick
+		}
+	}
+}
+
+// Apply returns result, or, for a message the filter dropped whose thread
+// was selected and which passes the filter without its includes, an
+// allowed result with the folder of the thread's first allowed message and
+// "thread" added to the rules.
+func (t *ThreadSet) Apply(msg Message, result Result) (Result, error) {
+	if result.Allowed {
+		return result, nil
+	}
+	id, _ := threadIDs(msg.Header)
+	if id == "" {
+		return result, nil
+	}
+
+	t.mu.Lock()
+	var pick threadPick
+	_, ok := t.parent[id]
+	if ok {
+		pick, ok = t.threads[t.find(id)]
+	}
+	t.mu.Unlock()
+	if !ok {
+		return result, nil
+	}
+	excluded, err := t.excludes.Evaluate(msg)
+	if err != nil {
+		return Result{}, err
+	}
+	if !excluded.Allowed {
+		return result, nil
+	}
+	t.mu.Lock()
+	t.added++
+	t.mu.Unlock()
+	return Result{Allowed: true, Folder: pick.folder, Flags: excluded.Flags, Rules: append(result.Rules, "thread")}, nil
+}
+
+// Stats returns the statistics of the threads.
+func (t *ThreadSet) Stats() ThreadStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	roots := make(map[string]bool)
+	for id := range t.messages {
+		roots[t.find(id)] = true
+	}
+	return ThreadStats{Messages: len(t.messages), Threads: len(roots), Selected: len(t.threads), Added: t.added}
+}
+
+// find returns the root of the thread of id, halving the path on the way.
+func (t *ThreadSet) find(id string) string {
+	if _, ok := t.parent[id]; !ok {
+		t.parent[id] = id
+		return id
+	}
+	for t.parent[id] != id {
+		t.parent[id] = t.parent[t.parent[id]]
+		id = t.parent[id]
+	}
+	return id
+}
+
+func (t *ThreadSet) union(a, b string) {
+	ra, rb := t.find(a), t.find(b)
+	if ra != rb {
+		t.parent[rb] = ra
+	}
+}
+
+// exclusions returns o without the includes: the include labels, patterns
+// and rules and the expression. The ranges, the exclude labels, patterns and
+// rules and the Sieve script remain.
+func (o Options) exclusions() Options {
+	o.IncludeHeader, o.IncludeBody, o.IncludeLabels = nil, nil, nil
+	o.Expression = ""
+	var rules []Rule
+	for _, rule := range o.Rules {
+		if rule.Action == RuleExclude {
+			rules = append(rules, rule)
+		}
+	}
+	o.Rules = rules
+	return o
+}
+
+// threadIDs returns the Message-ID of the header block and the Message-IDs
+// it refers to in In-Reply-To and References.
+func threadIDs(header []byte) (string, []string) {
+	h := parseHeaderBlock(header)
+	ids := messageIDs(h.Get("Message-Id"))
+	if len(ids) == 0 {
+		return "", nil
+	}
+	var refs []string
+	for _, field := range []string{"In-Reply-To", "References"} {
+		for _, value := range h.Values(field) {
+			refs = append(refs, messageIDs(value)...)
+		}
+	}
+	return ids[0], refs
+}
+
+// messageIDs returns the <...> message identifiers in value, without the
+// angle brackets. A value without brackets is taken as a single
+// identifier.
+func messageIDs(value string) []string {
+	var ids []string
+	for {
+		start := strings.IndexByte(value, '<')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			break
+		}
+		if id := strings.TrimSpace(value[start+1 : start+end]); id != "" {
+			ids = append(ids, id)
+		}
+		value = value[start+end+1:]
+	}
+	if len(ids) == 0 {
+		if id := strings.TrimSpace(value); id != "" && !strings.ContainsAny(id, " \t<>") {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
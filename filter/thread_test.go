@@ -0,0 +1,95 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMessageIDs(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"<a@test>", []string{"a@test"}},
+		{"<a@test> <b@test>\r\n <c@test>", []string{"a@test", "b@test", "c@test"}},
+		{"Your message <a@test> of Monday", []string{"a@test"}},
+		{"bare@test", []string{"bare@test"}},
+		{"", nil},
+		{"<>", nil},
+	}
+	for _, tt := range tests {
+		if got := messageIDs(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("messageIDs(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestThreadSet(t *testing.T) {
+	opts := Options{
+		IncludeHeader: []string{`Subject: Project X`},
+		ExcludeHeader: []string{`Subject: .*spam`},
+		Rules:         []Rule{{Name: "x", Type: RuleHeader, Field: "Subject", Pattern: "Project X", Action: RuleRoute, Folder: "X"}},
+		Sieve:         `if header :contains "subject" "junk" { discard; }`,
+	}
+	f, err := New(opts)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	headers := []string{
+		"Message-ID: <reply@test>\r\nIn-Reply-To: <root@test>\r\nSubject: Re: status\r\n",
+		"Message-ID: <root@test>\r\nSubject: Project X kickoff\r\n",
+		// Refers to the root through a message missing from the source.
+		"Message-ID: <late@test>\r\nReferences: <root@test> <lost@test>\r\n <other@test>\r\nSubject: Re: Re: status\r\n",
+		"Message-ID: <other@test>\r\nSubject: unrelated\r\n",
+		"Message-ID: <alone@test>\r\nIn-Reply-To: <elsewhere@test>\r\nSubject: Re: lunch\r\n",
+		"Subject: no message-id\r\nIn-Reply-To: <root@test>\r\n",
+		// Closure only extends the includes, the excludes still drop.
+		"Message-ID: <spam@test>\r\nIn-Reply-To: <root@test>\r\nSubject: Re: spam\r\n",
+		"Message-ID: <junk@test>\r\nIn-Reply-To: <root@test>\r\nSubject: Re: junk\r\n",
+	}
+	threads, err := NewThreadSet(opts)
+	if err != nil {
+		t.Fatalf("NewThreadSet() error = %v", err)
+	}
+	for i, header := range headers {
+		result, err := f.Evaluate(Message{Header: []byte(header)})
+		if err != nil {
+			t.Fatalf("Evaluate() error = %v", err)
+		}
+		threads.Add(i, []byte(header), result)
+	}
+	threads.Finish()
+
+	dropped := []string{"no include pattern"}
+	added := []string{"no include pattern", "thread"}
+	want := []Result{
+		{Allowed: true, Folder: "X", Rules: added},
+		{Allowed: true, Folder: "X", Route: "x", Rules: []string{"include-header:Subject: Project X", "rule:x"}},
+		{Allowed: true, Folder: "X", Rules: added},
+		{Allowed: true, Folder: "X", Rules: added},
+		{Rules: dropped},
+		{Rules: dropped},
+		{Rules: dropped},
+		{Rules: dropped},
+	}
+	for i, header := range headers {
+		result, err := f.Evaluate(Message{Header: []byte(header)})
+		if err != nil {
+			t.Fatalf("Evaluate() error = %v", err)
+		}
+		got, err := threads.Apply(Message{Header: []byte(header)}, result)
+		if err != nil {
+			t.Fatalf("Apply() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("Apply(message %d) = %+v, want %+v", i, got, want[i])
+		}
+	}
+
+	stats := threads.Stats()
+	wantStats := ThreadStats{Messages: 7, Threads: 2, Selected: 1, Added: 3}
+	if stats != wantStats {
+		t.Errorf("Stats() = %+v, want %+v", stats, wantStats)
+	}
+}
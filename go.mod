@@ -4,9 +4,10 @@ go 1.24.5
 
 require (
 	github.com/emersion/go-imap/v2 v2.0.0-beta.7
-	github.com/emersion/go-mbox v1.0.4
+	github.com/emersion/go-message v0.18.1
 	github.com/pterm/pterm v0.12.82
 	github.com/spf13/cobra v1.10.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -14,7 +15,6 @@ require (
 	atomicgo.dev/keyboard v0.2.9 // indirect
 	atomicgo.dev/schedule v0.1.0 // indirect
 	github.com/containerd/console v1.0.5 // indirect
-	github.com/emersion/go-message v0.18.1 // indirect
 	github.com/emersion/go-sasl v0.0.0-20231106173351-e73c9f7bad43 // indirect
 	github.com/gookit/color v1.5.4 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
@@ -0,0 +1,476 @@
+package imap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+	"unicode/utf8"
+)
+
+// Changes recorded in the alteration report.
+const (
+	changeHeaders         = "headers-rfc2047"
+	changeQuotedPrintable = "body-quoted-printable"
+	changeBase64          = "body-base64"
+	changeRemaining       = "8bit-remaining"
+)
+
+// foldLength is the line length encoded header fields are folded at.
+const foldLength = 76
+
+// has8bit reports whether data contains octets outside of US-ASCII.
+func has8bit(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// changeSet collects the changes made to a message in the order they were
+// first seen.
+type changeSet []string
+
+func (c *changeSet) add(change string) {
+	for _, existing := range *c {
+		if existing == change {
+			return
+		}
+	}
+	*c = append(*c, change)
+}
+
+// reencode rewrites a message with CRLF line endings so it only contains
+// 7-bit data: header fields with 8-bit octets get RFC 2047 encoded words and
+// leaf parts with an 8-bit body are transfer-encoded, text parts that are
+// mostly ASCII as quoted-printable and all others as base64. Multipart
+// bodies and embedded messages are rewritten part by part; everything that
+// needs no change is copied verbatim. It returns raw and no changes when
+// there is nothing to do. 8-bit octets that cannot be encoded, such as in
+// addresses, are left alone and reported as changeRemaining.
+func reencode(raw []byte) ([]byte, []string) {
+	if !has8bit(raw) {
+		return raw, nil
+	}
+	var changes changeSet
+	out := reencodeEntity(raw, true, &changes)
+	if has8bit(out) {
+		changes.add(changeRemaining)
+	}
+	return out, changes
+}
+
+// headerField is a header field including its continuation lines and the
+// final CRLF.
+type headerField struct {
+	name string
+	raw  []byte
+}
+
+func (f headerField) value() string {
+	_, value, _ := strings.Cut(string(f.raw), ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.TrimSpace(value)
+}
+
+// splitEntity splits an entity into its header fields and body. hasBody is
+// false when the entity has no blank line ending the header.
+func splitEntity(entity []byte) (fields []headerField, body []byte, hasBody bool) {
+	header := entity
+	switch {
+	case bytes.HasPrefix(entity, []byte("\r\n")):
+		header, body, hasBody = nil, entity[2:], true
+	default:
+		if idx := bytes.Index(entity, []byte("\r\n\r\n")); idx >= 0 {
+			header, body, hasBody = entity[:idx+2], entity[idx+4:], true
+		}
+	}
+
+	for len(header) > 0 {
+		line := header
+		if idx := bytes.Index(header, []byte("\r\n")); idx >= 0 {
+			line = header[:idx+2]
+		}
+		header = header[len(line):]
+
+		if len(fields) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			last := &fields[len(fields)-1]
+			last.raw = append(last.raw, line...)
+			continue
+		}
+		name, _, _ := bytes.Cut(line, []byte(":"))
+		fields = append(fields, headerField{
+			name: strings.ToLower(strings.TrimSpace(string(name))),
+			raw:  append([]byte(nil), line...),
+		})
+	}
+	return fields, body, hasBody
+}
+
+func fieldValue(fields []headerField, name string) (string, bool) {
+	for _, f := range fields {
+		if f.name == name {
+			return f.value(), true
+		}
+	}
+	return "", false
+}
+
+// reencodeEntity rewrites a single MIME entity, see reencode.
+func reencodeEntity(entity []byte, top bool, changes *changeSet) []byte {
+	if !has8bit(entity) {
+		return entity
+	}
+
+	fields, body, hasBody := splitEntity(entity)
+	contentType, hasContentType := fieldValue(fields, "content-type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if !hasContentType || err != nil {
+		mediaType, params = "text/plain", nil
+	}
+	cte, _ := fieldValue(fields, "content-transfer-encoding")
+	cte = strings.ToLower(cte)
+	identity := cte == "" || cte == "7bit" || cte == "8bit" || cte == "binary"
+
+	newCTE := ""
+	addContentType := ""
+	switch {
+	case !hasBody || !identity:
+		// Already transfer-encoded bodies are left alone.
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		body = reencodeMultipart(body, params["boundary"], changes)
+		if cte != "" && cte != "7bit" && !has8bit(body) {
+			newCTE = "7bit"
+		}
+	case mediaType == "message/rfc822":
+		body = reencodeEntity(body, false, changes)
+		if cte != "" && cte != "7bit" && !has8bit(body) {
+			newCTE = "7bit"
+		}
+	case has8bit(body):
+		if !hasContentType {
+			addContentType = "text/plain; charset=" + charsetFor(body)
+		}
+		newCTE = "base64"
+		if strings.HasPrefix(mediaType, "text/") && countHighBytes(body) <= len(body)/2 {
+			newCTE = "quoted-printable"
+			body = encodeQuotedPrintable(body)
+			changes.add(changeQuotedPrintable)
+		} else {
+			body = encodeBase64(body)
+			changes.add(changeBase64)
+		}
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(entity) + len(entity)/3)
+	hasMIMEVersion := false
+	for _, f := range fields {
+		switch {
+		case f.name == "mime-version":
+			hasMIMEVersion = true
+		case f.name == "content-transfer-encoding" && newCTE != "":
+			out.WriteString("Content-Transfer-Encoding: " + newCTE + "\r\n")
+			newCTE = ""
+			continue
+		}
+		if has8bit(f.raw) {
+			if encoded, ok := encodeField(f); ok {
+				out.WriteString(encoded)
+				changes.add(changeHeaders)
+				continue
+			}
+		}
+		out.Write(f.raw)
+	}
+	if top && !hasMIMEVersion && (addContentType != "" || newCTE != "") {
+		out.WriteString("MIME-Version: 1.0\r\n")
+	}
+	if addContentType != "" {
+		out.WriteString("Content-Type: " + addContentType + "\r\n")
+	}
+	if newCTE != "" {
+		out.WriteString("Content-Transfer-Encoding: " + newCTE + "\r\n")
+	}
+	if hasBody {
+		out.WriteString("\r\n")
+		out.Write(body)
+	}
+	return out.Bytes()
+}
+
+// reencodeMultipart rewrites every part of a multipart body. The preamble,
+// the delimiter lines and the epilogue are copied verbatim.
+func reencodeMultipart(body []byte, boundary string, changes *changeSet) []byte {
+	delimiter := []byte("--" + boundary)
+
+	var out bytes.Buffer
+	partStart := -1
+	for offset := 0; offset < len(body); {
+		lineEnd := len(body)
+		next := len(body)
+		if idx := bytes.Index(body[offset:], []byte("\r\n")); idx >= 0 {
+			lineEnd = offset + idx
+			next = lineEnd + 2
+		}
+		line := body[offset:lineEnd]
+
+		rest, isDelimiter := bytes.CutPrefix(line, delimiter)
+		closing := false
+		if isDelimiter {
+			rest, closing = bytes.CutPrefix(rest, []byte("--"))
+			isDelimiter = len(bytes.Trim(rest, " \t")) == 0
+		}
+		if !isDelimiter {
+			offset = next
+			continue
+		}
+
+		if partStart < 0 {
+			out.Write(body[:next])
+		} else {
+			// The CRLF before a delimiter belongs to the delimiter.
+			partEnd := offset
+			if partEnd-2 >= partStart && bytes.Equal(body[partEnd-2:partEnd], []byte("\r\n")) {
+				partEnd -= 2
+			}
+			out.Write(reencodeEntity(body[partStart:partEnd], false, changes))
+			out.Write(body[partEnd:next])
+		}
+		partStart = next
+		offset = next
+
+		if closing {
+			out.Write(body[next:])
+			return out.Bytes()
+		}
+	}
+
+	if partStart < 0 {
+		return body
+	}
+	// Without a closing delimiter the last part runs to the end.
+	out.Write(reencodeEntity(body[partStart:], false, changes))
+	return out.Bytes()
+}
+
+func countHighBytes(data []byte) int {
+	n := 0
+	for _, b := range data {
+		if b >= 0x80 {
+			n++
+		}
+	}
+	return n
+}
+
+// charsetFor names the charset of 8-bit data without a declared one:
+// UTF-8 if it is valid UTF-8, otherwise unknown-8bit (RFC 1428).
+func charsetFor(data []byte) string {
+	if utf8.Valid(data) {
+		return "utf-8"
+	}
+	return "unknown-8bit"
+}
+
+func encodeQuotedPrintable(body []byte) []byte {
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	_, _ = w.Write(body)
+	_ = w.Close()
+	if bytes.HasSuffix(body, []byte("\r\n")) && !bytes.HasSuffix(buf.Bytes(), []byte("\r\n")) {
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+// encodeBase64 encodes body in lines of foldLength characters. Like
+// encodeQuotedPrintable it ends with a line break only if body did, as a
+// part's final CRLF belongs to the following delimiter.
+func encodeBase64(body []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(body)
+	var buf bytes.Buffer
+	buf.Grow(len(encoded) + len(encoded)/foldLength*2 + 2)
+	for len(encoded) > foldLength {
+		buf.WriteString(encoded[:foldLength])
+		buf.WriteString("\r\n")
+		encoded = encoded[foldLength:]
+	}
+	buf.WriteString(encoded)
+	if bytes.HasSuffix(body, []byte("\r\n")) {
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+// headerSpecials are the RFC 5322 specials that may not appear inside an
+// encoded word in a phrase.
+const headerSpecials = `()<>@,;:\".[]`
+
+// encodeField RFC 2047 encodes the 8-bit words of a header field and folds
+// the result. It returns false when no word could be encoded.
+func encodeField(f headerField) (string, bool) {
+	name, value, found := strings.Cut(string(f.raw), ":")
+	if !found {
+		return "", false
+	}
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.TrimLeft(value, " \t")
+
+	charset := "utf-8"
+	if !utf8.ValidString(value) {
+		charset = "unknown-8bit"
+	}
+	encoded := encodeQuotedStrings(value, charset)
+	encoded = encodeWords(encoded, charset)
+	if encoded == value {
+		return "", false
+	}
+	return foldHeader(name+": "+encoded) + "\r\n", true
+}
+
+// encodeQuotedStrings replaces quoted strings holding 8-bit octets by an
+// encoded word, as encoded words must not appear within quotes. The Q
+// encoding leaves specials such as "," or "." literal, which would split
+// the phrase, so content with specials is B encoded.
+func encodeQuotedStrings(value, charset string) string {
+	var out strings.Builder
+	for {
+		start := strings.IndexByte(value, '"')
+		if start < 0 {
+			break
+		}
+		end := start + 1
+		var content strings.Builder
+		for ; end < len(value) && value[end] != '"'; end++ {
+			if value[end] == '\\' && end+1 < len(value) {
+				end++
+			}
+			content.WriteByte(value[end])
+		}
+		if end >= len(value) {
+			break
+		}
+		out.WriteString(value[:start])
+		if has8bit([]byte(content.String())) {
+			encoder := mime.QEncoding
+			if strings.ContainsAny(content.String(), headerSpecials) {
+				encoder = mime.BEncoding
+			}
+			out.WriteString(encoder.Encode(charset, content.String()))
+		} else {
+			out.WriteString(value[start : end+1])
+		}
+		value = value[end+1:]
+	}
+	out.WriteString(value)
+	return out.String()
+}
+
+// encodeWords encodes runs of words with 8-bit octets. A run may span plain
+// ASCII words, so the whitespace between the words survives decoding, but
+// never specials; words whose 8-bit octets sit next to specials inside the
+// word, such as addresses, are left alone.
+func encodeWords(value, charset string) string {
+	tokens := splitWords(value)
+
+	var out strings.Builder
+	for i := 0; i < len(tokens); {
+		tok := tokens[i]
+		prefix, core, suffix := splitSpecials(tok)
+		if isSpace(tok) || !has8bit([]byte(tok)) || !plainWord(core) {
+			out.WriteString(tok)
+			i++
+			continue
+		}
+
+		// Extend the run over following words while no specials separate
+		// them, remembering the last word with 8-bit octets.
+		run := []string{core}
+		last, lastSuffix := 0, suffix
+		for j := i + 2; lastSuffix == "" && j < len(tokens); j += 2 {
+			p, c, s := splitSpecials(tokens[j])
+			if p != "" || !plainWord(c) {
+				break
+			}
+			run = append(run, tokens[j-1], c)
+			if has8bit([]byte(c)) {
+				last, lastSuffix = len(run)-1, s
+			}
+			if s != "" {
+				break
+			}
+		}
+
+		out.WriteString(prefix)
+		out.WriteString(mime.QEncoding.Encode(charset, strings.Join(run[:last+1], "")))
+		out.WriteString(lastSuffix)
+		i += last + 1
+	}
+	return out.String()
+}
+
+// splitWords splits value into alternating runs of non-whitespace and
+// whitespace.
+func splitWords(value string) []string {
+	var tokens []string
+	for len(value) > 0 {
+		space := isSpaceByte(value[0])
+		end := 1
+		for end < len(value) && isSpaceByte(value[end]) == space {
+			end++
+		}
+		tokens = append(tokens, value[:end])
+		value = value[end:]
+	}
+	return tokens
+}
+
+func isSpaceByte(b byte) bool {
+	return b == ' ' || b == '\t'
+}
+
+func isSpace(tok string) bool {
+	return tok != "" && isSpaceByte(tok[0])
+}
+
+// splitSpecials splits leading and trailing specials off a word.
+func splitSpecials(word string) (prefix, core, suffix string) {
+	start := 0
+	for start < len(word) && strings.IndexByte(headerSpecials, word[start]) >= 0 {
+		start++
+	}
+	end := len(word)
+	for end > start && strings.IndexByte(headerSpecials, word[end-1]) >= 0 {
+		end--
+	}
+	return word[:start], word[start:end], word[end:]
+}
+
+func plainWord(word string) bool {
+	return word != "" && !isSpace(word) && !strings.ContainsAny(word, headerSpecials)
+}
+
+// foldHeader folds a header line at whitespace so lines stay within
+// foldLength where possible.
+func foldHeader(line string) string {
+	var out strings.Builder
+	for len(line) > foldLength {
+		cut := strings.LastIndexAny(line[:foldLength], " \t")
+		if cut <= 0 {
+			cut = strings.IndexAny(line[foldLength:], " \t")
+			if cut < 0 {
+				break
+			}
+			cut += foldLength
+		}
+		out.WriteString(line[:cut])
+		out.WriteString("\r\n")
+		line = line[cut:]
+	}
+	out.WriteString(line)
+	return out.String()
+}
@@ -0,0 +1,209 @@
+package imap
+
+import (
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dhcgn/mbox-to-imap/model"
+)
+
+func TestReencode(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		changes []string
+		check   func(t *testing.T, out string)
+	}{
+		{
+			name: "7-bit unchanged",
+			in:   "Subject: hi\r\n\r\nbody\r\n",
+		},
+		{
+			name:    "subject encoded",
+			in:      "Subject: Grüße aus Köln, Alice\r\n\r\nbody\r\n",
+			changes: []string{changeHeaders},
+			check: func(t *testing.T, out string) {
+				expectDecodedHeader(t, out, "Subject", "Grüße aus Köln, Alice")
+			},
+		},
+		{
+			name:    "quoted display name with specials stays one phrase",
+			in:      "From: \"Müller, Hans J.\" <h@x.test>, other@x.test\r\n\r\nbody\r\n",
+			changes: []string{changeHeaders},
+			check: func(t *testing.T, out string) {
+				msg, err := mail.ReadMessage(strings.NewReader(out))
+				if err != nil {
+					t.Fatalf("parse message: %v", err)
+				}
+				addrs, err := msg.Header.AddressList("From")
+				if err != nil {
+					t.Fatalf("parse From: %v", err)
+				}
+				if len(addrs) != 2 || addrs[0].Name != "Müller, Hans J." || addrs[0].Address != "h@x.test" {
+					t.Errorf("From = %v, want Müller, Hans J. <h@x.test> first", addrs)
+				}
+			},
+		},
+		{
+			name:    "display name encoded, address kept",
+			in:      "From: \"Jörg Müller\" <joerg@example.com>\r\nTo: Zoë <zoe@exämple.com>\r\n\r\nbody\r\n",
+			changes: []string{changeHeaders, changeRemaining},
+			check: func(t *testing.T, out string) {
+				expectDecodedHeader(t, out, "From", "Jörg Müller <joerg@example.com>")
+				if !strings.Contains(out, "zoe@exämple.com") {
+					t.Errorf("address altered: %q", out)
+				}
+			},
+		},
+		{
+			name:    "text body quoted-printable",
+			in:      "Subject: hi\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nSchöne Grüße\r\n",
+			changes: []string{changeQuotedPrintable},
+			check: func(t *testing.T, out string) {
+				expectBody(t, out, "quoted-printable", "Schöne Grüße\r\n")
+			},
+		},
+		{
+			name:    "binary body base64",
+			in:      "Subject: hi\r\nContent-Type: application/octet-stream\r\n\r\n\xff\xfe\x01\x02\r\n",
+			changes: []string{changeBase64},
+			check: func(t *testing.T, out string) {
+				expectBody(t, out, "base64", "\xff\xfe\x01\x02\r\n")
+			},
+		},
+		{
+			name:    "missing content type added",
+			in:      "Subject: hi\r\n\r\nGrüße\r\n",
+			changes: []string{changeQuotedPrintable},
+			check: func(t *testing.T, out string) {
+				for _, want := range []string{"MIME-Version: 1.0\r\n", "Content-Type: text/plain; charset=utf-8\r\n"} {
+					if !strings.Contains(out, want) {
+						t.Errorf("missing %q in %q", want, out)
+					}
+				}
+				expectBody(t, out, "quoted-printable", "Grüße\r\n")
+			},
+		},
+		{
+			name: "multipart part rewritten",
+			in: "Subject: hi\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b1\r\n\r\n" +
+				"preamble\r\n--b1\r\nContent-Type: text/plain\r\n\r\nplain\r\n" +
+				"--b1\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\nÄrger\r\n" +
+				"--b1--\r\nepilogue\r\n",
+			changes: []string{changeQuotedPrintable},
+			check: func(t *testing.T, out string) {
+				want := "Subject: hi\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b1\r\n\r\n" +
+					"preamble\r\n--b1\r\nContent-Type: text/plain\r\n\r\nplain\r\n" +
+					"--b1\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n=C3=84rger\r\n" +
+					"--b1--\r\nepilogue\r\n"
+				if out != want {
+					t.Errorf("reencode() = %q, want %q", out, want)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, changes := reencode([]byte(tt.in))
+			if !slices.Equal(changes, tt.changes) {
+				t.Errorf("changes = %v, want %v", changes, tt.changes)
+			}
+			if tt.check == nil {
+				if string(out) != tt.in {
+					t.Errorf("reencode() = %q, want unchanged", out)
+				}
+				return
+			}
+			if has8bit(out) != slices.Contains(tt.changes, changeRemaining) {
+				t.Errorf("8-bit octets left in %q", out)
+			}
+			tt.check(t, string(out))
+		})
+	}
+}
+
+func TestPrepare_EightBit(t *testing.T) {
+	raw := "Subject: Gr\xc3\xbc\xc3\x9fe\r\n\r\nbody\r\n"
+	tests := []struct {
+		eightBit string
+		encoded  bool
+	}{
+		// APPEND is a plain literal, so auto re-encodes whatever the
+		// server offers.
+		{EightBitAuto, true},
+		{EightBitKeep, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.eightBit, func(t *testing.T) {
+			u := &Uploader{opts: Options{EightBit: tt.eightBit}}
+			msg, changes, err := u.prepare(model.Message{Raw: []byte(raw)})
+			if err != nil {
+				t.Fatalf("prepare() error = %v", err)
+			}
+			if got := string(msg.Raw) != raw; got != tt.encoded || len(changes) > 0 != tt.encoded {
+				t.Errorf("prepare() = %q, changes %q, want re-encoded %v", msg.Raw, changes, tt.encoded)
+			}
+		})
+	}
+}
+
+func TestParseEightBit(t *testing.T) {
+	for value, want := range map[string]string{"": EightBitAuto, "AUTO": EightBitAuto, " keep ": EightBitKeep} {
+		if got, err := ParseEightBit(value); err != nil || got != want {
+			t.Errorf("ParseEightBit(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	if _, err := ParseEightBit("encode"); err == nil {
+		t.Error("ParseEightBit(\"encode\") succeeded")
+	}
+}
+
+func expectDecodedHeader(t *testing.T, raw, name, want string) {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	got, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get(name))
+	if err != nil {
+		t.Fatalf("decode %s: %v", name, err)
+	}
+	got = strings.ReplaceAll(got, `"`, "")
+	if got != want {
+		t.Errorf("%s = %q, want %q", name, got, want)
+	}
+}
+
+func expectBody(t *testing.T, raw, cte, want string) {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	if got := msg.Header.Get("Content-Transfer-Encoding"); got != cte {
+		t.Errorf("Content-Transfer-Encoding = %q, want %q", got, cte)
+	}
+	body, err := io.ReadAll(decodeTransfer(cte, msg.Body))
+	if err != nil {
+		t.Fatalf("decode body: %v", err)
+	}
+	if string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func decodeTransfer(cte string, r io.Reader) io.Reader {
+	switch cte {
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	}
+	return r
+}
@@ -1,13 +1,16 @@
 package imap
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"strconv"
+	"strings"
 
 	imapv2 "github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
@@ -30,7 +33,46 @@ type Options struct {
 	UseTLS             bool
 	InsecureSkipVerify bool
 	TargetFolder       string
-	DryRun             bool
+	SpecialUseFolders  bool
+	// Normalize converts messages to CRLF, drops NUL bytes and folds
+	// over-long header lines before they are appended. The state file keeps
+	// the hash of the original message.
+	Normalize bool
+	// EightBit selects how messages with 8-bit octets are handled: "keep"
+	// uploads them unchanged, "auto" re-encodes them. go-imap sends APPEND
+	// as a plain literal, without literal8 or the UTF8 data item, so "auto"
+	// re-encodes even for servers offering BINARY or UTF8=ACCEPT; it only
+	// logs those capabilities. See ParseEightBit.
+	EightBit string
+	// ReportPath is the CSV file listing messages that were altered before
+	// upload. Empty disables the report.
+	ReportPath string
+	// Provenance prepends X-Envelope-From, X-Mbox-Source and X-Imported-By
+	// (with Version) to every message. ReturnPath adds a Return-Path taken
+	// from the mbox envelope sender to messages without one.
+	Provenance bool
+	ReturnPath bool
+	Version    string
+	DryRun     bool
+}
+
+// Values for Options.EightBit.
+const (
+	EightBitAuto = "auto"
+	EightBitKeep = "keep"
+)
+
+// ParseEightBit validates an Options.EightBit value. An empty value selects
+// EightBitAuto.
+func ParseEightBit(value string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(value)); mode {
+	case "", EightBitAuto:
+		return EightBitAuto, nil
+	case EightBitKeep:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown eight-bit mode %q", value)
+	}
 }
 
 type Uploader struct {
@@ -39,6 +81,18 @@ type Uploader struct {
 	tracker state.Tracker
 	uploads <-chan model.Message
 	logger  *slog.Logger
+
+	// client is dialed on the first upload. delim is the server's hierarchy
+	// delimiter, ensured caches the mailboxes known to exist on the current
+	// connection and specialUse maps special-use attributes to the server's
+	// mailbox names.
+	client     *imapclient.Client
+	cleanup    func()
+	delim      rune
+	ensured    map[string]bool
+	specialUse map[string]string
+
+	report *alterationReport
 }
 
 func NewUploader(opts Options, r *runner.Runner, logger *slog.Logger) (*Uploader, error) {
@@ -58,19 +112,22 @@ func NewUploader(opts Options, r *runner.Runner, logger *slog.Logger) (*Uploader
 		tracker: tracker,
 		uploads: r.Uploads(),
 		logger:  logger,
+		report:  &alterationReport{path: opts.ReportPath},
 	}
 	r.AddStage("imap", uploader.run)
 	return uploader, nil
 }
 
 func (u *Uploader) run(ctx context.Context) error {
-	var (
-		client  *imapclient.Client
-		cleanup func()
-	)
 	defer func() {
-		if cleanup != nil {
-			cleanup()
+		if u.cleanup != nil {
+			u.cleanup()
+		}
+		if err := u.report.close(); err != nil && u.logger != nil {
+			u.logger.Warn("close alteration report failed", "path", u.report.path, "err", err)
+		}
+		if u.report.count > 0 && u.logger != nil {
+			u.logger.Info("messages altered before upload", "count", u.report.count, "report", u.report.path)
 		}
 	}()
 
@@ -82,54 +139,66 @@ func (u *Uploader) run(ctx context.Context) error {
 			if !ok {
 				return nil
 			}
-			if msg.ID == "" {
-				u.runner.EmitEvent(stats.Event{Stage: stats.StageIMAP, Type: stats.EventTypeError, Err: ErrMissingMessageID})
-				continue
-			}
-			if msg.Hash == "" {
-				err := fmt.Errorf("message %s missing hash", msg.ID)
-				u.runner.EmitEvent(stats.Event{Stage: stats.StageIMAP, Type: stats.EventTypeError, MessageID: msg.ID, Err: err})
+			err := u.upload(ctx, msg)
+			u.runner.Done(msg)
+			if err != nil {
 				return err
 			}
+		}
+	}
+}
 
-			if u.opts.DryRun {
-				if err := u.tracker.MarkProcessed(msg.Hash, msg.ID); err != nil {
-					u.runner.EmitEvent(stats.Event{Stage: stats.StageIMAP, Type: stats.EventTypeError, MessageID: msg.ID, Err: err})
-					return err
-				}
-				u.runner.EmitEvent(stats.Event{Stage: stats.StageIMAP, Type: stats.EventTypeDryRunUpload, MessageID: msg.ID})
-				if u.logger != nil {
-					u.logger.Debug("dry-run upload", "messageID", msg.ID, "target", u.targetFolder(), "hash", msg.Hash)
-				}
-				continue
-			}
+// upload appends a single message, dialing the server on first use.
+func (u *Uploader) upload(ctx context.Context, msg model.Message) error {
+	if msg.ID == "" {
+		u.runner.EmitEvent(stats.Event{Stage: stats.StageIMAP, Type: stats.EventTypeError, Err: ErrMissingMessageID})
+		return nil
+	}
+	if msg.Hash == "" {
+		err := fmt.Errorf("message %s missing hash", msg.ID)
+		u.runner.EmitEvent(stats.Event{Stage: stats.StageIMAP, Type: stats.EventTypeError, MessageID: msg.ID, Err: err})
+		return err
+	}
 
-			if client == nil {
-				var err error
-				client, cleanup, err = u.dial(ctx)
-				if err != nil {
-					u.runner.EmitEvent(stats.Event{Stage: stats.StageIMAP, Type: stats.EventTypeError, MessageID: msg.ID, Err: err})
-					return err
-				}
-			}
+	if u.opts.DryRun {
+		if err := u.tracker.MarkProcessed(msg.Hash, msg.ID); err != nil {
+			u.runner.EmitEvent(stats.Event{Stage: stats.StageIMAP, Type: stats.EventTypeError, MessageID: msg.ID, Err: err})
+			return err
+		}
+		u.runner.Checkpoints().Commit(msg)
+		u.runner.EmitEvent(stats.Event{Stage: stats.StageIMAP, Type: stats.EventTypeDryRunUpload, MessageID: msg.ID})
+		if u.logger != nil {
+			u.logger.Debug("dry-run upload", "messageID", msg.ID, "target", u.mailboxFor(msg), "hash", msg.Hash)
+		}
+		return nil
+	}
 
-			if err := u.appendMessage(client, msg); err != nil {
-				err = fmt.Errorf("upload message %s: %w", msg.ID, err)
-				u.runner.EmitEvent(stats.Event{Stage: stats.StageIMAP, Type: stats.EventTypeError, MessageID: msg.ID, Err: err})
-				return err
-			}
+	if u.client == nil {
+		var err error
+		u.client, u.cleanup, err = u.dial(ctx)
+		if err != nil {
+			u.runner.EmitEvent(stats.Event{Stage: stats.StageIMAP, Type: stats.EventTypeError, MessageID: msg.ID, Err: err})
+			return err
+		}
+	}
 
-			if err := u.tracker.MarkProcessed(msg.Hash, msg.ID); err != nil {
-				u.runner.EmitEvent(stats.Event{Stage: stats.StageIMAP, Type: stats.EventTypeError, MessageID: msg.ID, Err: err})
-				return err
-			}
+	if err := u.appendMessage(u.client, msg); err != nil {
+		err = fmt.Errorf("upload message %s: %w", msg.ID, err)
+		u.runner.EmitEvent(stats.Event{Stage: stats.StageIMAP, Type: stats.EventTypeError, MessageID: msg.ID, Err: err})
+		return err
+	}
 
-			u.runner.EmitEvent(stats.Event{Stage: stats.StageIMAP, Type: stats.EventTypeUploaded, MessageID: msg.ID})
-			if u.logger != nil {
-				u.logger.Debug("uploaded message", "messageID", msg.ID, "target", u.targetFolder(), "hash", msg.Hash)
-			}
-		}
+	if err := u.tracker.MarkProcessed(msg.Hash, msg.ID); err != nil {
+		u.runner.EmitEvent(stats.Event{Stage: stats.StageIMAP, Type: stats.EventTypeError, MessageID: msg.ID, Err: err})
+		return err
 	}
+
+	u.runner.Checkpoints().Commit(msg)
+	u.runner.EmitEvent(stats.Event{Stage: stats.StageIMAP, Type: stats.EventTypeUploaded, MessageID: msg.ID})
+	if u.logger != nil {
+		u.logger.Debug("uploaded message", "messageID", msg.ID, "target", u.mailboxFor(msg), "hash", msg.Hash, "size", msg.Size, "spooled", msg.Spooled)
+	}
+	return nil
 }
 
 func (u *Uploader) dial(ctx context.Context) (*imapclient.Client, func(), error) {
@@ -162,7 +231,20 @@ func (u *Uploader) dial(ctx context.Context) (*imapclient.Client, func(), error)
 		return nil, nil, fmt.Errorf("imap login failed: %w", err)
 	}
 
-	if err := u.ensureMailbox(client); err != nil {
+	u.delim = '/'
+	u.ensured = make(map[string]bool)
+	if list, err := client.List("", "", nil).Collect(); err == nil && len(list) > 0 && list[0].Delim != 0 {
+		u.delim = list[0].Delim
+	}
+
+	if u.opts.SpecialUseFolders {
+		u.specialUse = u.listSpecialUse(client)
+	}
+	if u.opts.EightBit == EightBitAuto {
+		u.log8bitCaps(client)
+	}
+
+	if err := u.ensureMailbox(client, u.targetFolder(), ""); err != nil {
 		_ = client.Close()
 		return nil, nil, err
 	}
@@ -196,28 +278,67 @@ func (u *Uploader) dial(ctx context.Context) (*imapclient.Client, func(), error)
 }
 
 func (u *Uploader) appendMessage(client *imapclient.Client, msg model.Message) error {
-	target := u.targetFolder()
-	size := int64(len(msg.Raw))
-
-	var opts *imapv2.AppendOptions
-	if !msg.ReceivedAt.IsZero() {
-		opts = &imapv2.AppendOptions{Time: msg.ReceivedAt}
+	target := u.mailboxFor(msg)
+	specialUse := msg.SpecialUse
+	if msg.Route != "" {
+		specialUse = ""
+	}
+	if err := u.ensureMailbox(client, target, specialUse); err != nil {
+		return err
+	}
+	msg, changes, err := u.prepare(msg)
+	if err != nil {
+		return err
+	}
+	header, err := u.provenanceHeader(msg)
+	if err != nil {
+		return err
 	}
 
-	cmd := client.Append(target, size, opts)
+	size := msg.Size
+	if msg.Raw != nil {
+		size = int64(len(msg.Raw))
+	}
 
-	remaining := msg.Raw
-	for len(remaining) > 0 {
-		n, err := cmd.Write(remaining)
+	copyBody := func(dst io.Writer, src io.Reader) (int64, error) {
+		return io.Copy(dst, src)
+	}
+	if u.opts.Normalize && msg.Raw == nil {
+		// Messages on disk are read twice: once to size the literal and
+		// once to send it.
+		normalized, err := u.normalizedSize(msg)
 		if err != nil {
-			_ = cmd.Close()
-			return fmt.Errorf("append write: %w", err)
-		}
-		if n == 0 {
-			_ = cmd.Close()
-			return fmt.Errorf("append write: wrote 0 bytes")
+			return err
 		}
-		remaining = remaining[n:]
+		size = normalized
+		copyBody = normalize
+	}
+
+	body, err := msg.Open()
+	if err != nil {
+		return fmt.Errorf("open message: %w", err)
+	}
+	defer body.Close()
+	var src io.Reader = body
+	if header != nil {
+		src = io.MultiReader(bytes.NewReader(header), body)
+		size += int64(len(header))
+	}
+
+	opts := &imapv2.AppendOptions{Time: msg.ReceivedAt}
+	for _, flag := range msg.Flags {
+		opts.Flags = append(opts.Flags, imapv2.Flag(flag))
+	}
+
+	// The literal is streamed, so spooled messages are never loaded whole.
+	cmd := client.Append(target, size, opts)
+	written, err := copyBody(cmd, src)
+	if err == nil && written != size {
+		err = fmt.Errorf("wrote %d of %d bytes", written, size)
+	}
+	if err != nil {
+		_ = cmd.Close()
+		return fmt.Errorf("append write: %w", err)
 	}
 
 	if err := cmd.Close(); err != nil {
@@ -228,9 +349,130 @@ func (u *Uploader) appendMessage(client *imapclient.Client, msg model.Message) e
 		return fmt.Errorf("append wait: %w", err)
 	}
 
+	if len(changes) > 0 {
+		if err := u.report.add(msg, target, changes); err != nil && u.logger != nil {
+			u.logger.Warn("alteration report failed", "messageID", msg.ID, "err", err)
+		}
+	}
 	return nil
 }
 
+// prepare applies the rewrites that need the whole message in memory and
+// returns the changes made by re-encoding; normalization is not reported.
+// Messages with 8-bit octets are re-encoded unless EightBit is "keep"; a
+// message on disk is then loaded, one at a time, outside of the memory
+// budget. Re-encoding implies normalization, as it relies on CRLF line
+// endings.
+func (u *Uploader) prepare(msg model.Message) (model.Message, []string, error) {
+	encode := u.opts.EightBit != EightBitKeep
+
+	if msg.Raw == nil {
+		if !encode {
+			return msg, nil, nil
+		}
+		raw, err := readIf8bit(msg)
+		if err != nil || raw == nil {
+			return msg, nil, err
+		}
+		msg.Raw = raw
+	}
+
+	if (u.opts.Normalize || encode && has8bit(msg.Raw)) && needsNormalize(msg.Raw) {
+		raw := normalizeBytes(msg.Raw)
+		if u.logger != nil {
+			u.logger.Debug("normalized message", "messageID", msg.ID, "size", len(msg.Raw), "normalizedSize", len(raw))
+		}
+		msg.Raw = raw
+	}
+	if encode {
+		raw, encoded := reencode(msg.Raw)
+		if len(encoded) > 0 && u.logger != nil {
+			u.logger.Debug("re-encoded 8-bit message", "messageID", msg.ID, "changes", encoded, "size", len(msg.Raw), "encodedSize", len(raw))
+		}
+		msg.Raw = raw
+		return msg, encoded, nil
+	}
+	return msg, nil, nil
+}
+
+// log8bitCaps logs the 8-bit APPEND extensions the server offers. They are
+// not used yet, as go-imap cannot send a literal8 or the UTF8 data item.
+func (u *Uploader) log8bitCaps(client *imapclient.Client) {
+	if u.logger == nil {
+		return
+	}
+	var offered []string
+	for _, c := range []imapv2.Cap{imapv2.CapBinary, imapv2.CapUTF8Accept} {
+		if client.Caps().Has(c) {
+			offered = append(offered, string(c))
+		}
+	}
+	if len(offered) > 0 {
+		u.logger.Info("server offers 8-bit APPEND extensions, still re-encoding 8-bit messages", "caps", offered)
+	}
+}
+
+// readIf8bit returns the content of a message on disk if it contains 8-bit
+// octets and nil otherwise. The file is scanned before it is loaded, so
+// 7-bit messages stay on disk.
+func readIf8bit(msg model.Message) ([]byte, error) {
+	found, err := scan8bit(msg)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	body, err := msg.Open()
+	if err != nil {
+		return nil, fmt.Errorf("open message: %w", err)
+	}
+	defer body.Close()
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("read message: %w", err)
+	}
+	return raw, nil
+}
+
+func scan8bit(msg model.Message) (bool, error) {
+	body, err := msg.Open()
+	if err != nil {
+		return false, fmt.Errorf("open message: %w", err)
+	}
+	defer body.Close()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if has8bit(buf[:n]) {
+			return true, nil
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("read message: %w", err)
+		}
+	}
+}
+
+// normalizedSize returns the size of msg after normalization.
+func (u *Uploader) normalizedSize(msg model.Message) (int64, error) {
+	body, err := msg.Open()
+	if err != nil {
+		return 0, fmt.Errorf("open message: %w", err)
+	}
+	defer body.Close()
+
+	size, err := normalize(io.Discard, body)
+	if err != nil {
+		return 0, fmt.Errorf("normalize message: %w", err)
+	}
+	if size != msg.Size && u.logger != nil {
+		u.logger.Debug("normalized message", "messageID", msg.ID, "size", msg.Size, "normalizedSize", size)
+	}
+	return size, nil
+}
+
 func (u *Uploader) targetFolder() string {
 	if u.opts.TargetFolder == "" {
 		return "INBOX"
@@ -238,9 +480,44 @@ func (u *Uploader) targetFolder() string {
 	return u.opts.TargetFolder
 }
 
-func (u *Uploader) ensureMailbox(client *imapclient.Client) error {
-	target := u.targetFolder()
-	cmd := client.Create(target, nil)
+// mailboxFor returns the mailbox name for a message. Routed messages go
+// into their route folder, messages from a special-use folder into the
+// server's matching mailbox when one exists, all others are nested below the
+// target folder using the server's hierarchy delimiter.
+func (u *Uploader) mailboxFor(msg model.Message) string {
+	folder := msg.Folder
+	if msg.Route != "" {
+		folder = msg.Route
+	} else if msg.SpecialUse != "" {
+		if mailbox, ok := u.specialUse[msg.SpecialUse]; ok {
+			return mailbox
+		}
+	}
+
+	if folder == "" {
+		return u.targetFolder()
+	}
+	delim := u.delim
+	if delim == 0 {
+		delim = '/'
+	}
+	return u.targetFolder() + string(delim) + strings.ReplaceAll(folder, "/", string(delim))
+}
+
+// ensureMailbox creates target unless it already exists. A mailbox created
+// for a special-use source folder gets that attribute if the server supports
+// CREATE-SPECIAL-USE.
+func (u *Uploader) ensureMailbox(client *imapclient.Client, target, specialUse string) error {
+	if u.ensured[target] {
+		return nil
+	}
+
+	var opts *imapv2.CreateOptions
+	if specialUse != "" && u.opts.SpecialUseFolders && client.Caps().Has(imapv2.CapCreateSpecialUse) {
+		opts = &imapv2.CreateOptions{SpecialUse: []imapv2.MailboxAttr{imapv2.MailboxAttr(specialUse)}}
+	}
+
+	cmd := client.Create(target, opts)
 	if err := cmd.Wait(); err != nil {
 		var respErr *imapv2.Error
 		if errors.As(err, &respErr) {
@@ -248,6 +525,7 @@ func (u *Uploader) ensureMailbox(client *imapclient.Client) error {
 				if u.logger != nil {
 					u.logger.Debug("imap mailbox already exists", "mailbox", target)
 				}
+				u.ensured[target] = true
 				return nil
 			}
 		}
@@ -257,6 +535,44 @@ func (u *Uploader) ensureMailbox(client *imapclient.Client) error {
 	if u.logger != nil {
 		u.logger.Info("imap mailbox created", "mailbox", target)
 	}
+	u.ensured[target] = true
 
 	return nil
 }
+
+// listSpecialUse returns the server's mailboxes by special-use attribute.
+// Errors are logged and result in an empty map, which makes every message
+// fall back to the folder below the target.
+func (u *Uploader) listSpecialUse(client *imapclient.Client) map[string]string {
+	mailboxes := make(map[string]string)
+
+	caps := client.Caps()
+	var opts *imapv2.ListOptions
+	if caps.Has(imapv2.CapSpecialUse) && (caps.Has(imapv2.CapListExtended) || caps.Has(imapv2.CapIMAP4rev2)) {
+		opts = &imapv2.ListOptions{ReturnSpecialUse: true}
+	}
+
+	list, err := client.List("", "*", opts).Collect()
+	if err != nil {
+		if u.logger != nil {
+			u.logger.Warn("imap list special-use mailboxes failed", "err", err)
+		}
+		return mailboxes
+	}
+
+	for _, data := range list {
+		for _, attr := range data.Attrs {
+			switch attr {
+			case imapv2.MailboxAttrSent, imapv2.MailboxAttrDrafts, imapv2.MailboxAttrTrash:
+				if _, exists := mailboxes[string(attr)]; !exists {
+					mailboxes[string(attr)] = data.Mailbox
+				}
+			}
+		}
+	}
+
+	if u.logger != nil {
+		u.logger.Debug("imap special-use mailboxes", "mailboxes", mailboxes)
+	}
+	return mailboxes
+}
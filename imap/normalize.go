@@ -0,0 +1,167 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// maxLineLength is the RFC 5322 limit for a line without its CRLF.
+const maxLineLength = 998
+
+// needsNormalize reports whether raw contains anything normalize would
+// change: NUL bytes, line breaks other than CRLF or header lines longer than
+// maxLineLength.
+func needsNormalize(raw []byte) bool {
+	if bytes.IndexByte(raw, 0) >= 0 {
+		return true
+	}
+	header := true
+	for len(raw) > 0 {
+		line := raw
+		idx := bytes.IndexByte(raw, '\n')
+		if idx >= 0 {
+			line, raw = raw[:idx], raw[idx+1:]
+		} else {
+			raw = nil
+		}
+
+		if idx >= 0 {
+			if len(line) == 0 || line[len(line)-1] != '\r' {
+				return true
+			}
+			line = line[:len(line)-1]
+		}
+		if bytes.IndexByte(line, '\r') >= 0 {
+			return true
+		}
+		if header {
+			if len(line) == 0 {
+				header = false
+			} else if len(line) > maxLineLength {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// normalizeBytes returns a copy of raw prepared for an IMAP literal, see
+// normalize.
+func normalizeBytes(raw []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(len(raw) + len(raw)/32)
+	_, _ = normalize(&buf, bytes.NewReader(raw))
+	return buf.Bytes()
+}
+
+// normalize copies a message from src to dst and returns the number of
+// bytes written. Line breaks are converted to CRLF, NUL bytes are dropped
+// and header lines longer than maxLineLength are folded, preferably before
+// existing whitespace so unfolding restores the original value. A stray CR
+// in a header line is replaced by a space, in the body it ends the line.
+// Body lines are not folded.
+func normalize(dst io.Writer, src io.Reader) (int64, error) {
+	cw := &countingWriter{w: dst}
+	w := bufio.NewWriter(cw)
+	r := bufio.NewReader(src)
+
+	header := true
+	cr := false
+	var line []byte
+	endLine := func() {
+		switch {
+		case !header:
+			_, _ = w.WriteString("\r\n")
+		case len(line) == 0:
+			header = false
+			_, _ = w.WriteString("\r\n")
+		default:
+			writeFolded(w, line)
+			line = line[:0]
+		}
+	}
+
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return cw.n, err
+		}
+		if b == 0 {
+			continue
+		}
+
+		if cr {
+			cr = false
+			if b == '\n' {
+				endLine()
+				continue
+			}
+			if header {
+				line = append(line, ' ')
+			} else {
+				endLine()
+			}
+		}
+
+		switch {
+		case b == '\r':
+			cr = true
+		case b == '\n':
+			endLine()
+		case header:
+			line = append(line, b)
+		default:
+			_ = w.WriteByte(b)
+		}
+	}
+
+	if cr {
+		if header {
+			line = append(line, ' ')
+		} else {
+			endLine()
+		}
+	}
+	if header && len(line) > 0 {
+		writeFolded(w, line)
+	}
+	if err := w.Flush(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, nil
+}
+
+// writeFolded writes a header line with CRLF, folded into lines of at most
+// maxLineLength octets. A line is broken before the last space or tab that
+// fits; a run without whitespace is broken with an inserted space.
+func writeFolded(w *bufio.Writer, line []byte) {
+	for len(line) > maxLineLength {
+		cut := bytes.LastIndexAny(line[1:maxLineLength+1], " \t") + 1
+		if cut > 0 {
+			_, _ = w.Write(line[:cut])
+			_, _ = w.WriteString("\r\n")
+			line = line[cut:]
+			continue
+		}
+		_, _ = w.Write(line[:maxLineLength])
+		_, _ = w.WriteString("\r\n")
+		line = append([]byte{' '}, line[maxLineLength:]...)
+	}
+	_, _ = w.Write(line)
+	_, _ = w.WriteString("\r\n")
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
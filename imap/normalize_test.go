@@ -0,0 +1,91 @@
+package imap
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	longValue := strings.Repeat("word ", 300)
+	longToken := strings.Repeat("x", 1500)
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "crlf unchanged",
+			in:   "Subject: hi\r\n\r\nbody\r\n",
+			want: "Subject: hi\r\n\r\nbody\r\n",
+		},
+		{
+			name: "lf to crlf",
+			in:   "Subject: hi\nTo: a@b\n\nline 1\nline 2\n",
+			want: "Subject: hi\r\nTo: a@b\r\n\r\nline 1\r\nline 2\r\n",
+		},
+		{
+			name: "nul bytes dropped",
+			in:   "Subject: h\x00i\r\n\r\nbo\x00dy\r\n",
+			want: "Subject: hi\r\n\r\nbody\r\n",
+		},
+		{
+			name: "bare cr",
+			in:   "Subject: a\rb\r\n\r\none\rtwo\r",
+			want: "Subject: a b\r\n\r\none\r\ntwo\r\n",
+		},
+		{
+			name: "long body line kept",
+			in:   "Subject: hi\n\n" + longToken + "\n",
+			want: "Subject: hi\r\n\r\n" + longToken + "\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := normalizeBytes([]byte(tt.in))
+			if string(got) != tt.want {
+				t.Errorf("normalizeBytes() = %q, want %q", got, tt.want)
+			}
+			if needsNormalize([]byte(tt.in)) != (tt.in != tt.want) {
+				t.Errorf("needsNormalize() = %v, want %v", !(tt.in != tt.want), tt.in != tt.want)
+			}
+
+			var buf bytes.Buffer
+			n, err := normalize(&buf, strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatalf("normalize() error = %v", err)
+			}
+			if n != int64(buf.Len()) || buf.String() != tt.want {
+				t.Errorf("normalize() = %d, %q, want %q", n, buf.String(), tt.want)
+			}
+		})
+	}
+
+	t.Run("long header lines folded", func(t *testing.T) {
+		// unfold reverses the folding: a fold before existing whitespace only
+		// added the CRLF, a fold inside a token added CRLF and a space.
+		for _, tt := range []struct {
+			line   string
+			unfold func(string) string
+		}{
+			{"X-Test: " + longValue, func(s string) string { return strings.ReplaceAll(s, "\r\n", "") }},
+			{"X-Test:" + longToken, func(s string) string { return strings.ReplaceAll(s, "\r\n ", "") }},
+		} {
+			got := string(normalizeBytes([]byte(tt.line + "\n\nbody\n")))
+
+			header, body, _ := strings.Cut(got, "\r\n\r\n")
+			if body != "body\r\n" {
+				t.Errorf("body = %q", body)
+			}
+			for _, line := range strings.Split(header, "\r\n") {
+				if len(line) > maxLineLength {
+					t.Errorf("line of %d octets not folded", len(line))
+				}
+			}
+			if unfolded := tt.unfold(header); unfolded != tt.line {
+				t.Errorf("unfolded header = %q", unfolded)
+			}
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/dhcgn/mbox-to-imap/model"
+)
+
+// provenanceHeader returns the header fields prepended to msg on upload:
+// the provenance fields when Options.Provenance is set and a Return-Path
+// taken from the mbox envelope when Options.ReturnPath is set and msg has
+// none. It returns nil when there is nothing to add.
+func (u *Uploader) provenanceHeader(msg model.Message) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if sender, ok := envelopeSender(msg.Envelope); ok && u.opts.ReturnPath {
+		hasReturnPath, err := hasField(msg, "Return-Path")
+		if err != nil {
+			return nil, err
+		}
+		if !hasReturnPath {
+			writeField(&buf, "Return-Path", "<"+sender+">")
+		}
+	}
+
+	if u.opts.Provenance {
+		if msg.Envelope != "" {
+			writeField(&buf, "X-Envelope-From", msg.Envelope)
+		}
+		if msg.Source != "" {
+			writeField(&buf, "X-Mbox-Source", "file="+strconv.Quote(msg.Source)+"; index="+strconv.Itoa(msg.Index))
+		}
+		version := u.opts.Version
+		if version == "" {
+			version = "dev"
+		}
+		writeField(&buf, "X-Imported-By", "mbox-to-imap "+version)
+	}
+
+	if buf.Len() == 0 {
+		return nil, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// writeField writes a header field, RFC 2047 encoding a value with 8-bit
+// octets and folding long lines.
+func writeField(buf *bytes.Buffer, name, value string) {
+	if has8bit([]byte(value)) {
+		value = mime.QEncoding.Encode("utf-8", value)
+	}
+	buf.WriteString(foldHeader(name + ": " + value))
+	buf.WriteString("\r\n")
+}
+
+// envelopeSender returns the sender address of a separator line envelope
+// if it looks like a real address. Placeholders such as MAILER-DAEMON or the
+// "<id>@xxx" senders of Google Takeout are rejected.
+func envelopeSender(envelope string) (string, bool) {
+	fields := strings.Fields(envelope)
+	if len(fields) == 0 {
+		return "", false
+	}
+	sender := strings.Trim(fields[0], "<>")
+	at := strings.LastIndexByte(sender, '@')
+	if at <= 0 || !strings.Contains(sender[at+1:], ".") {
+		return "", false
+	}
+	return sender, true
+}
+
+// hasField reports whether the header of msg contains a field called name.
+func hasField(msg model.Message, name string) (bool, error) {
+	body, err := msg.Open()
+	if err != nil {
+		return false, fmt.Errorf("open message: %w", err)
+	}
+	defer body.Close()
+
+	header, err := textproto.NewReader(bufio.NewReader(body)).ReadMIMEHeader()
+	if err != nil && err != io.EOF && len(header) == 0 {
+		// An unparsable header has no usable fields either.
+		return false, nil
+	}
+	_, ok := header[textproto.CanonicalMIMEHeaderKey(name)]
+	return ok, nil
+}
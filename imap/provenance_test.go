@@ -0,0 +1,77 @@
+package imap
+
+import (
+	"testing"
+
+	"github.com/dhcgn/mbox-to-imap/model"
+)
+
+func TestProvenanceHeader(t *testing.T) {
+	msg := model.Message{
+		Raw:      []byte("From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n"),
+		Source:   "All mail.mbox",
+		Index:    41,
+		Envelope: "alice@example.com Fri Jul  8 12:08:34 2011",
+	}
+
+	tests := []struct {
+		name string
+		opts Options
+		msg  model.Message
+		want string
+	}{
+		{
+			name: "disabled",
+			msg:  msg,
+		},
+		{
+			name: "provenance",
+			opts: Options{Provenance: true, Version: "v1.2.3"},
+			msg:  msg,
+			want: "X-Envelope-From: alice@example.com Fri Jul  8 12:08:34 2011\r\n" +
+				"X-Mbox-Source: file=\"All mail.mbox\"; index=41\r\n" +
+				"X-Imported-By: mbox-to-imap v1.2.3\r\n",
+		},
+		{
+			name: "return path",
+			opts: Options{ReturnPath: true},
+			msg:  msg,
+			want: "Return-Path: <alice@example.com>\r\n",
+		},
+		{
+			name: "return path kept",
+			opts: Options{ReturnPath: true},
+			msg: model.Message{
+				Raw:      []byte("Return-Path: <bob@example.com>\r\nSubject: hi\r\n\r\nbody\r\n"),
+				Envelope: msg.Envelope,
+			},
+		},
+		{
+			name: "takeout placeholder sender",
+			opts: Options{ReturnPath: true},
+			msg: model.Message{
+				Raw:      msg.Raw,
+				Envelope: "1372185012787613429@xxx Fri Jul 08 12:08:34 +0000 2011",
+			},
+		},
+		{
+			name: "without envelope",
+			opts: Options{Provenance: true, ReturnPath: true},
+			msg:  model.Message{Raw: msg.Raw, Source: "cur/1.eml"},
+			want: "X-Mbox-Source: file=\"cur/1.eml\"; index=0\r\n" +
+				"X-Imported-By: mbox-to-imap dev\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &Uploader{opts: tt.opts}
+			got, err := u.provenanceHeader(tt.msg)
+			if err != nil {
+				t.Fatalf("provenanceHeader() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("provenanceHeader() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
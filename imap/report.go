@@ -0,0 +1,61 @@
+package imap
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dhcgn/mbox-to-imap/model"
+)
+
+// alterationReport appends one CSV row per message that was re-encoded
+// before it was appended. The file is created on the first row, so runs that
+// upload every message unchanged leave no file behind.
+type alterationReport struct {
+	path  string
+	file  *os.File
+	w     *csv.Writer
+	count int
+}
+
+func (r *alterationReport) add(msg model.Message, mailbox string, changes []string) error {
+	if r.path == "" {
+		return nil
+	}
+	if r.w == nil {
+		_, statErr := os.Stat(r.path)
+		file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("open alteration report: %w", err)
+		}
+		r.file = file
+		r.w = csv.NewWriter(file)
+		if errors.Is(statErr, os.ErrNotExist) {
+			_ = r.w.Write([]string{"time", "message_id", "hash", "mailbox", "changes"})
+		}
+	}
+
+	r.count++
+	record := []string{time.Now().Format(time.RFC3339), msg.ID, msg.Hash, mailbox, strings.Join(changes, ";")}
+	if err := r.w.Write(record); err != nil {
+		return fmt.Errorf("write alteration report: %w", err)
+	}
+	r.w.Flush()
+	return r.w.Error()
+}
+
+func (r *alterationReport) close() error {
+	if r.file == nil {
+		return nil
+	}
+	r.w.Flush()
+	err := r.w.Error()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file, r.w = nil, nil
+	return err
+}
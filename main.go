@@ -15,7 +15,8 @@ var (
 )
 
 func main() {
-	fmt.Println("mbox-to-imap version:", Version, "commit:", CommitID, "built at:", BuildTime)
+	fmt.Fprintln(os.Stderr, "mbox-to-imap version:", Version, "commit:", CommitID, "built at:", BuildTime)
+	cmd.SetVersion(Version)
 	if err := cmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
@@ -0,0 +1,152 @@
+package mbox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dhcgn/mbox-to-imap/runner"
+	"github.com/dhcgn/mbox-to-imap/state"
+)
+
+func checkpointMessages(from, to int) []*rawMessage {
+	var messages []*rawMessage
+	for i := from; i < to; i++ {
+		raw := fmt.Sprintf("Message-ID: <%d@test>\r\nSubject: message %d\r\n\r\nbody %d\r\n", i, i, i)
+		messages = append(messages, &rawMessage{From: "sender@test Mon Jan  2 15:04:05 2006", Raw: []byte(raw)})
+	}
+	return messages
+}
+
+func TestCheckpointResume(t *testing.T) {
+	dir := t.TempDir()
+	stateDir := filepath.Join(dir, "state")
+	path := filepath.Join(dir, "archive.mbox")
+	if err := os.WriteFile(path, writeMbox(t, FormatMboxo, checkpointMessages(0, 5)), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// run streams the mbox with a fresh checkpointer, commits the messages
+	// accepted by commit and flushes the checkpoint like the runner does.
+	run := func(opts Options, commit func(idx int) bool) []string {
+		t.Helper()
+		store, err := state.NewCheckpointStore(stateDir, true)
+		if err != nil {
+			t.Fatalf("NewCheckpointStore() error = %v", err)
+		}
+		opts.Path = path
+		opts.Checkpoints = runner.NewCheckpointer(store)
+
+		messages := streamAll(t, opts)
+		var ids []string
+		for _, msg := range messages {
+			opts.Checkpoints.Register(msg)
+		}
+		// Commit in reverse so later messages finish first.
+		for i := len(messages) - 1; i >= 0; i-- {
+			if commit(messages[i].Index) {
+				opts.Checkpoints.Commit(messages[i])
+			}
+		}
+		for _, msg := range messages {
+			ids = append(ids, msg.ID)
+		}
+		if err := opts.Checkpoints.Flush(); err != nil {
+			t.Fatalf("Flush() error = %v", err)
+		}
+		return ids
+	}
+	all := func(int) bool { return true }
+
+	// Message 2 fails, so only 0 and 1 are contiguous.
+	if got := run(Options{}, func(idx int) bool { return idx != 2 }); len(got) != 5 {
+		t.Fatalf("first run: got %v", got)
+	}
+	if got := run(Options{}, all); fmt.Sprint(got) != "[2@test 3@test 4@test]" {
+		t.Fatalf("resume: got %v, want messages 2-4", got)
+	}
+	if got := run(Options{}, all); len(got) != 0 {
+		t.Fatalf("complete: got %v, want nothing", got)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := file.Write(writeMbox(t, FormatMboxo, checkpointMessages(5, 6))); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	file.Close()
+
+	if got := run(Options{}, all); fmt.Sprint(got) != "[5@test]" {
+		t.Fatalf("appended: got %v, want message 5", got)
+	}
+
+	if got := run(Options{ExcludeHeader: []string{"message 3"}}, all); len(got) != 5 {
+		t.Fatalf("changed options: got %v, want a full read", got)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	data[len("From ")] = 'X'
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := run(Options{ExcludeHeader: []string{"message 3"}}, all); len(got) != 5 {
+		t.Fatalf("changed prefix: got %v, want a full read", got)
+	}
+}
+
+func TestCheckpointOptions_DateOrder(t *testing.T) {
+	if checkpointOptions(Options{}) != checkpointOptions(Options{DateOrder: DefaultDateOrder}) {
+		t.Error("the default date order changed the fingerprint")
+	}
+	order := []string{DateSourceFromLine, DateSourceHeader}
+	if checkpointOptions(Options{}) == checkpointOptions(Options{DateOrder: order}) {
+		t.Error("another date order kept the fingerprint")
+	}
+}
+
+func TestCheckpointResume_SameLengthEdit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "archive.mbox")
+	var messages []*rawMessage
+	for i := range 90 {
+		raw := fmt.Sprintf("Message-ID: <%d@test>\r\nSubject: message %d\r\n\r\n%s\r\n", i, i, strings.Repeat("a", 4000))
+		messages = append(messages, &rawMessage{From: "sender@test Mon Jan  2 15:04:05 2006", Raw: []byte(raw)})
+	}
+	data := writeMbox(t, FormatMboxo, messages)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	store, err := state.NewCheckpointStore(filepath.Join(dir, "state"), false)
+	if err != nil {
+		t.Fatalf("NewCheckpointStore() error = %v", err)
+	}
+	checkpoints := runner.NewCheckpointer(store)
+	opts := Options{Path: path, Checkpoints: checkpoints}
+	for _, msg := range streamAll(t, opts) {
+		checkpoints.Register(msg)
+		checkpoints.Commit(msg)
+	}
+	if err := checkpoints.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	// A re-export may change a single byte of an old message, such as a
+	// status flag, here between the 4 KiB samples an older checksum read.
+	pos := (len(data)-4096)/3 + 4096 + 100
+	pos += strings.IndexByte(string(data[pos:]), 'a')
+	data[pos] = 'b'
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := streamAll(t, opts); len(got) != len(messages) {
+		t.Fatalf("edited prefix: got %d messages, want a full read of %d", len(got), len(messages))
+	}
+}
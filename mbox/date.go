@@ -0,0 +1,130 @@
+package mbox
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Sources of a message's INTERNALDATE, see Options.DateOrder.
+const (
+	// DateSourceHeader is the Date: header.
+	DateSourceHeader = "date"
+	// DateSourceReceived is the earliest timestamp of the Received: headers.
+	DateSourceReceived = "received"
+	// DateSourceFromLine is the date of the mbox "From " separator line.
+	DateSourceFromLine = "from-line"
+	// DateSourceFile is the modification time of an .eml file, used when no
+	// source in the order yields a date.
+	DateSourceFile = "file"
+)
+
+// DefaultDateOrder is the precedence used when Options.DateOrder is empty.
+var DefaultDateOrder = []string{DateSourceHeader, DateSourceReceived, DateSourceFromLine}
+
+// ParseDateOrder parses a comma-separated precedence list such as
+// "date,received,from-line". An empty value selects DefaultDateOrder.
+func ParseDateOrder(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return DefaultDateOrder, nil
+	}
+
+	var order []string
+	seen := make(map[string]bool)
+	for _, source := range strings.Split(value, ",") {
+		source = strings.ToLower(strings.TrimSpace(source))
+		switch source {
+		case DateSourceHeader, DateSourceReceived, DateSourceFromLine:
+		default:
+			return nil, fmt.Errorf("unknown date source %q", source)
+		}
+		if seen[source] {
+			return nil, fmt.Errorf("date source %q listed twice", source)
+		}
+		seen[source] = true
+		order = append(order, source)
+	}
+	return order, nil
+}
+
+// messageDate returns the date of the first source in order that yields one
+// and the name of that source. from is the envelope of the mbox separator
+// line, empty for other sources.
+func messageDate(header mail.Header, from string, order []string) (time.Time, string) {
+	if order == nil {
+		order = DefaultDateOrder
+	}
+	for _, source := range order {
+		var (
+			t  time.Time
+			ok bool
+		)
+		switch source {
+		case DateSourceHeader:
+			t, ok = headerDate(header.Get("Date"))
+		case DateSourceReceived:
+			t, ok = receivedDate(header["Received"])
+		case DateSourceFromLine:
+			t, ok = fromLineDate(from)
+		}
+		if ok {
+			return t, source
+		}
+	}
+	return time.Time{}, ""
+}
+
+func headerDate(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	t, err := mail.ParseDate(value)
+	return t, err == nil
+}
+
+// receivedDate returns the earliest timestamp of the Received: fields. The
+// timestamp follows the last semicolon of a field (RFC 5322 section 3.6.7);
+// fields without a parseable one are skipped.
+func receivedDate(values []string) (time.Time, bool) {
+	var earliest time.Time
+	for _, value := range values {
+		idx := strings.LastIndexByte(value, ';')
+		if idx < 0 {
+			continue
+		}
+		t, ok := headerDate(strings.TrimSpace(value[idx+1:]))
+		if ok && (earliest.IsZero() || t.Before(earliest)) {
+			earliest = t
+		}
+	}
+	return earliest, !earliest.IsZero()
+}
+
+// fromLineLayouts are the asctime variants found after the sender of a
+// "From " line, with whitespace collapsed. Dates without a zone are UTC.
+var fromLineLayouts = []string{
+	"Mon Jan 2 15:04:05 2006",
+	"Mon Jan 2 15:04:05 -0700 2006",
+	"Mon Jan 2 15:04:05 MST 2006",
+	"Mon Jan 2 15:04:05 2006 -0700",
+	"Mon Jan 2 15:04:05 2006 MST",
+	"Mon Jan 2 15:04 2006",
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+}
+
+// fromLineDate parses the date of a separator line envelope such as
+// "MAILER-DAEMON Fri Jul  8 12:08:34 2011".
+func fromLineDate(from string) (time.Time, bool) {
+	fields := strings.Fields(from)
+	if len(fields) < 2 {
+		return time.Time{}, false
+	}
+	date := strings.Join(fields[1:], " ")
+	for _, layout := range fromLineLayouts {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,111 @@
+package mbox
+
+import (
+	"net/mail"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDateOrder(t *testing.T) {
+	order, err := ParseDateOrder("")
+	if err != nil || !slices.Equal(order, DefaultDateOrder) {
+		t.Errorf("ParseDateOrder(\"\") = %v, %v", order, err)
+	}
+	order, err = ParseDateOrder(" From-Line, date ")
+	if err != nil || !slices.Equal(order, []string{DateSourceFromLine, DateSourceHeader}) {
+		t.Errorf("ParseDateOrder() = %v, %v", order, err)
+	}
+	for _, value := range []string{"date,mtime", "date,date", "date,"} {
+		if _, err := ParseDateOrder(value); err == nil {
+			t.Errorf("ParseDateOrder(%q) succeeded", value)
+		}
+	}
+}
+
+func TestMessageDate(t *testing.T) {
+	header := func(lines ...string) mail.Header {
+		msg, err := mail.ReadMessage(strings.NewReader(strings.Join(lines, "\r\n") + "\r\n\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg.Header
+	}
+	received := []string{
+		"Received: from b.example by c.example; Tue, 2 Jan 2024 10:00:00 +0000",
+		"Received: from a.example by b.example; Tue, 2 Jan 2024 09:00:00 +0000",
+		"Received: from x.example by a.example; garbage",
+	}
+	from := "MAILER-DAEMON Wed Jan  3 08:00:00 2024"
+
+	tests := []struct {
+		name       string
+		header     mail.Header
+		from       string
+		order      []string
+		want       time.Time
+		wantSource string
+	}{
+		{
+			name:       "date header",
+			header:     header(append([]string{"Date: Mon, 1 Jan 2024 12:00:00 +0100"}, received...)...),
+			from:       from,
+			want:       time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC),
+			wantSource: DateSourceHeader,
+		},
+		{
+			name:       "earliest received",
+			header:     header(append([]string{"Date: yesterday"}, received...)...),
+			from:       from,
+			want:       time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC),
+			wantSource: DateSourceReceived,
+		},
+		{
+			name:       "from line",
+			header:     header("Subject: no dates"),
+			from:       from,
+			want:       time.Date(2024, 1, 3, 8, 0, 0, 0, time.UTC),
+			wantSource: DateSourceFromLine,
+		},
+		{
+			name:       "order",
+			header:     header("Date: Mon, 1 Jan 2024 12:00:00 +0100"),
+			from:       from,
+			order:      []string{DateSourceFromLine, DateSourceHeader},
+			want:       time.Date(2024, 1, 3, 8, 0, 0, 0, time.UTC),
+			wantSource: DateSourceFromLine,
+		},
+		{
+			name:   "none",
+			header: header("Subject: no dates"),
+			from:   "MAILER-DAEMON",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, source := messageDate(tt.header, tt.from, tt.order)
+			if !got.Equal(tt.want) || source != tt.wantSource {
+				t.Errorf("messageDate() = %v, %q, want %v, %q", got, source, tt.want, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestFromLineDate(t *testing.T) {
+	want := time.Date(2011, 7, 8, 12, 8, 34, 0, time.UTC)
+	for _, from := range []string{
+		"MAILER-DAEMON Fri Jul  8 12:08:34 2011",
+		"1372185012787613429@xxx Fri Jul 08 12:08:34 +0000 2011",
+		"user@example.com Fri Jul 8 14:08:34 2011 +0200",
+		"user@example.com Fri Jul  8 12:08:34 UTC 2011",
+	} {
+		got, ok := fromLineDate(from)
+		if !ok || !got.Equal(want) {
+			t.Errorf("fromLineDate(%q) = %v, %v", from, got, ok)
+		}
+	}
+	if _, ok := fromLineDate("user@example.com sometime"); ok {
+		t.Error("fromLineDate() parsed an invalid date")
+	}
+}
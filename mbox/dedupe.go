@@ -0,0 +1,289 @@
+package mbox
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dhcgn/mbox-to-imap/model"
+)
+
+// Dedupe policies select which of several messages sharing a Message-ID but
+// differing in content is imported.
+const (
+	// DedupeOff imports every variant.
+	DedupeOff = "off"
+	// DedupeFirst keeps the variant found first in the source.
+	DedupeFirst = "first"
+	// DedupeLargest keeps the largest variant.
+	DedupeLargest = "largest"
+	// DedupeNewest keeps the variant with the latest date.
+	DedupeNewest = "newest"
+)
+
+// ParseDedupePolicy validates a dedupe policy. An empty value selects
+// DedupeOff.
+func ParseDedupePolicy(value string) (string, error) {
+	switch policy := strings.ToLower(strings.TrimSpace(value)); policy {
+	case "", DedupeOff:
+		return DedupeOff, nil
+	case DedupeFirst, DedupeLargest, DedupeNewest:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown message-id dedupe policy %q", value)
+	}
+}
+
+// dedupeVariant is one distinct content, by hash, of a Message-ID.
+type dedupeVariant struct {
+	hash   string
+	msg    model.Message
+	copies int
+}
+
+// dedupeGroup holds the variants of a Message-ID in source order and the
+// one chosen by the policy.
+type dedupeGroup struct {
+	variants []*dedupeVariant
+	winner   *dedupeVariant
+}
+
+// dedupeSet picks one variant per Message-ID from a pre-scan of the source
+// and rejects the others while the source is streamed again.
+type dedupeSet struct {
+	policy string
+	// superseded, if set, is called for every rejected message.
+	superseded func(msg model.Message)
+
+	mu     sync.Mutex
+	groups map[string]*dedupeGroup
+}
+
+func newDedupeSet(policy string, superseded func(msg model.Message)) *dedupeSet {
+	return &dedupeSet{policy: policy, superseded: superseded, groups: make(map[string]*dedupeGroup)}
+}
+
+// add records msg as seen by the pre-scan. Only the fields the policies
+// look at are kept.
+func (d *dedupeSet) add(msg model.Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	group := d.groups[msg.ID]
+	if group == nil {
+		group = &dedupeGroup{}
+		d.groups[msg.ID] = group
+	}
+	for _, v := range group.variants {
+		if v.hash == msg.Hash {
+			v.copies++
+			return
+		}
+	}
+	v := &dedupeVariant{
+		hash:   msg.Hash,
+		copies: 1,
+		msg: model.Message{
+			ID:         msg.ID,
+			ReceivedAt: msg.ReceivedAt,
+			Size:       msg.Size,
+			Index:      msg.Index,
+			Source:     msg.Source,
+		},
+	}
+	group.variants = append(group.variants, v)
+	if group.winner == nil || d.better(v, group.winner) {
+		group.winner = v
+	}
+}
+
+// better reports whether v beats the current winner. Ties go to the
+// variant found first.
+func (d *dedupeSet) better(v, winner *dedupeVariant) bool {
+	switch d.policy {
+	case DedupeLargest:
+		return v.msg.Size > winner.msg.Size
+	case DedupeNewest:
+		return v.msg.ReceivedAt.After(winner.msg.ReceivedAt)
+	default:
+		return false
+	}
+}
+
+// keep reports whether msg is to be imported. A nil set keeps everything.
+func (d *dedupeSet) keep(msg model.Message) bool {
+	if d == nil {
+		return true
+	}
+	if !d.rejects(msg) {
+		return true
+	}
+	if d.superseded != nil {
+		d.superseded(msg)
+	}
+	return false
+}
+
+// rejects reports whether another variant of its Message-ID supersedes
+// msg, without calling superseded.
+func (d *dedupeSet) rejects(msg model.Message) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	group := d.groups[msg.ID]
+	d.mu.Unlock()
+	return group != nil && len(group.variants) >= 2 && group.winner.hash != msg.Hash
+}
+
+// conflicts returns the number of Message-IDs with more than one variant.
+func (d *dedupeSet) conflicts() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, group := range d.groups {
+		if len(group.variants) > 1 {
+			n++
+		}
+	}
+	return n
+}
+
+// logConflicts logs every Message-ID with more than one variant and the
+// variant kept.
+func (d *dedupeSet) logConflicts(logger *slog.Logger) {
+	if logger == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, group := range d.groups {
+		if len(group.variants) < 2 {
+			continue
+		}
+		kept := group.winner.msg
+		logger.Debug("message-id conflict", "messageID", id, "variants", len(group.variants), "policy", d.policy,
+			"keptSource", kept.Source, "keptIndex", kept.Index, "keptSize", kept.Size, "keptDate", kept.ReceivedAt)
+	}
+}
+
+// writeConflicts writes one CSV row per variant of every Message-ID with
+// more than one variant to path, replacing an earlier report. Groups are
+// ordered by Message-ID, their variants by source order.
+func (d *dedupeSet) writeConflicts(path string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ids := make([]string, 0, len(d.groups))
+	for id, group := range d.groups {
+		if len(group.variants) > 1 {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create conflict report: %w", err)
+	}
+	w := csv.NewWriter(file)
+	_ = w.Write([]string{"message_id", "variant", "source", "index", "size", "date", "hash", "copies", "status"})
+	for _, id := range ids {
+		group := d.groups[id]
+		for i, v := range group.variants {
+			status := "superseded"
+			if v == group.winner {
+				status = "kept"
+			}
+			date := ""
+			if !v.msg.ReceivedAt.IsZero() {
+				date = v.msg.ReceivedAt.Format(time.RFC3339)
+			}
+			_ = w.Write([]string{id, strconv.Itoa(i + 1), v.msg.Source, strconv.Itoa(v.msg.Index),
+				strconv.FormatInt(v.msg.Size, 10), date, v.hash, strconv.Itoa(v.copies), status})
+		}
+	}
+	w.Flush()
+	err = w.Error()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write conflict report: %w", err)
+	}
+	return nil
+}
+
+// dedupeReader pre-scans the source with prescan to fill set, then streams
+// it with reader, whose streamer rejects the superseded variants. The
+// conflicts found are written to report unless it is empty.
+type dedupeReader struct {
+	reader  Reader
+	prescan Reader
+	set     *dedupeSet
+	report  string
+	logger  *slog.Logger
+}
+
+func (d *dedupeReader) Stream(ctx context.Context, out chan<- model.Envelope) error {
+	if err := d.scan(ctx); err != nil {
+		return err
+	}
+	return d.reader.Stream(ctx, out)
+}
+
+// scan runs the pre-scan. A read error ends it, as it would end the import.
+func (d *dedupeReader) scan(ctx context.Context) error {
+	if d.logger != nil {
+		d.logger.Info("pre-scanning source for message-id conflicts", "policy", d.set.policy)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	envelopes := make(chan model.Envelope, 32)
+	done := make(chan error, 1)
+	go func() {
+		defer close(envelopes)
+		done <- d.prescan.Stream(ctx, envelopes)
+	}()
+
+	var scanErr error
+	for env := range envelopes {
+		if env.Err != nil {
+			if scanErr == nil {
+				scanErr = env.Err
+				cancel()
+			}
+			continue
+		}
+		if scanErr == nil {
+			d.set.add(env.Message)
+		}
+		_ = env.Message.Release()
+	}
+	if err := <-done; scanErr == nil && err != nil {
+		scanErr = err
+	}
+	if scanErr != nil {
+		return fmt.Errorf("message-id pre-scan: %w", scanErr)
+	}
+
+	d.set.logConflicts(d.logger)
+	if d.report != "" {
+		if err := d.set.writeConflicts(d.report); err != nil && d.logger != nil {
+			d.logger.Warn("message-id conflict report failed", "path", d.report, "err", err)
+		}
+	}
+	if d.logger != nil {
+		d.logger.Info("message-id pre-scan finished", "messageIDs", len(d.set.groups), "conflicts", d.set.conflicts(), "report", d.report)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package mbox
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dhcgn/mbox-to-imap/model"
+)
+
+func TestMessageIDDedupe(t *testing.T) {
+	message := func(id, date, body string) *rawMessage {
+		raw := fmt.Sprintf("Message-ID: <%s>\r\nDate: %s\r\nSubject: variant\r\n\r\n%s\r\n", id, date, body)
+		return &rawMessage{From: "sender@test Mon Jan  2 15:04:05 2006", Raw: []byte(raw)}
+	}
+	messages := []*rawMessage{
+		message("a@test", "Mon, 1 Jan 2024 10:00:00 +0000", "first"),
+		message("b@test", "Mon, 1 Jan 2024 10:00:00 +0000", "unique"),
+		message("a@test", "Wed, 3 Jan 2024 10:00:00 +0000", "newest"),
+		message("a@test", "Tue, 2 Jan 2024 10:00:00 +0000", "the largest variant"),
+		message("a@test", "Mon, 1 Jan 2024 10:00:00 +0000", "first"),
+	}
+	path := filepath.Join(t.TempDir(), "archive.mbox")
+	if err := os.WriteFile(path, writeMbox(t, FormatMboxo, messages), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	tests := []struct {
+		policy         string
+		want           string
+		wantSuperseded int
+		wantKept       string
+	}{
+		{policy: DedupeOff, want: "[0 1 2 3 4]"},
+		{policy: DedupeFirst, want: "[0 1 4]", wantSuperseded: 2, wantKept: "[0]"},
+		{policy: DedupeLargest, want: "[1 3]", wantSuperseded: 3, wantKept: "[3]"},
+		{policy: DedupeNewest, want: "[1 2]", wantSuperseded: 3, wantKept: "[2]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			var superseded []string
+			report := filepath.Join(t.TempDir(), "conflicts.csv")
+			opts := Options{
+				Path:            path,
+				MessageIDDedupe: tt.policy,
+				ConflictReport:  report,
+				Superseded:      func(msg model.Message) { superseded = append(superseded, msg.ID) },
+			}
+			var got []int
+			for _, msg := range streamAll(t, opts) {
+				got = append(got, msg.Index)
+			}
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("indexes = %v, want %s", got, tt.want)
+			}
+			if len(superseded) != tt.wantSuperseded || strings.Count(strings.Join(superseded, " "), "a@test") != len(superseded) {
+				t.Errorf("superseded = %v, want %d times a@test", superseded, tt.wantSuperseded)
+			}
+
+			file, err := os.Open(report)
+			if tt.policy == DedupeOff {
+				if err == nil {
+					file.Close()
+					t.Error("conflict report written without a dedupe policy")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("open conflict report: %v", err)
+			}
+			defer file.Close()
+			rows, err := csv.NewReader(file).ReadAll()
+			if err != nil {
+				t.Fatalf("read conflict report: %v", err)
+			}
+			var kept []string
+			for _, row := range rows[1:] {
+				if row[0] != "a@test" {
+					t.Errorf("conflict report lists %s", row[0])
+				}
+				if row[8] == "kept" {
+					kept = append(kept, row[3])
+				}
+			}
+			if len(rows) != 4 || fmt.Sprint(kept) != tt.wantKept {
+				t.Errorf("conflict report = %v, want 3 variants with index %s kept", rows, tt.wantKept)
+			}
+		})
+	}
+
+	if _, err := ParseDedupePolicy("oldest"); err == nil {
+		t.Error("ParseDedupePolicy(\"oldest\") succeeded")
+	}
+}
@@ -0,0 +1,111 @@
+package mbox
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dhcgn/mbox-to-imap/model"
+)
+
+// emlReader streams messages from a directory tree holding one .eml file per
+// message. Subdirectories map to folders below the target folder.
+type emlReader struct {
+	streamer
+}
+
+// emlEntry is a single .eml file found below the source directory.
+type emlEntry struct {
+	path    string
+	folder  string
+	modTime time.Time
+}
+
+func (e *emlReader) Stream(ctx context.Context, out chan<- model.Envelope) error {
+	entries, err := listEML(e.path)
+	if err != nil {
+		return err
+	}
+
+	for idx, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		raw, err := readMessageFile(entry.path, e.spoolThreshold, e.hashMode)
+		if err != nil {
+			return e.emitError(ctx, out, fmt.Errorf("message %d read: %w", idx, err))
+		}
+
+		raw.fileDate = entry.modTime
+		msg, ok, err := e.buildMessage(idx, raw)
+		if err != nil {
+			return e.emitError(ctx, out, fmt.Errorf("%s: %w", entry.path, err))
+		}
+		if !ok {
+			continue
+		}
+
+		msg.Index = idx
+		msg.Folder = entry.folder
+		msg.Source = relativeSource(e.path, entry.path)
+
+		if err := e.emitEnvelope(ctx, out, model.Envelope{Message: msg}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listEML walks root in lexical order and returns every .eml file. The
+// folder of an entry is its directory relative to root, "/" separated.
+func listEML(root string) ([]emlEntry, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("open eml directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	var entries []emlEntry
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(d.Name()), ".eml") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		folder := filepath.ToSlash(rel)
+		if folder == "." {
+			folder = ""
+		}
+
+		entries = append(entries, emlEntry{
+			path:    path,
+			folder:  folder,
+			modTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk eml directory: %w", err)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,79 @@
+package mbox
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dhcgn/mbox-to-imap/model"
+)
+
+func TestEMLReader(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"b.eml":                  "Message-ID: <b@test>\nDate: Mon, 02 Jan 2006 15:04:05 +0000\n\nbody\n",
+		"a.EML":                  "Message-ID: <a@test>\n\nno date\n",
+		"notes.txt":              "not a message",
+		"Projects/X/c.eml":       "Message-ID: <c@test>\n\nbody\n",
+		"Projects/readme.md":     "ignored",
+		"Archive/2019/d.eml":     "Message-ID: <d@test>\n\nbody\n",
+		"Archive/2019/e.eml.bak": "ignored",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	mtime := time.Date(2010, 5, 6, 7, 8, 9, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(root, "a.EML"), mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	reader, err := NewReader(Options{Type: SourceEML, Path: root}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+
+	out := make(chan model.Envelope, 10)
+	if err := reader.Stream(context.Background(), out); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	close(out)
+
+	var got []model.Message
+	for env := range out {
+		if env.Err != nil {
+			t.Fatalf("unexpected error: %v", env.Err)
+		}
+		got = append(got, env.Message)
+	}
+
+	wantIDs := []string{"d@test", "c@test", "a@test", "b@test"}
+	wantFolders := []string{"Archive/2019", "Projects/X", "", ""}
+	if len(got) != len(wantIDs) {
+		t.Fatalf("Stream() returned %d messages, want %d", len(got), len(wantIDs))
+	}
+	for i, msg := range got {
+		if msg.ID != wantIDs[i] || msg.Folder != wantFolders[i] {
+			t.Errorf("message %d = (%s, %q), want (%s, %q)", i, msg.ID, msg.Folder, wantIDs[i], wantFolders[i])
+		}
+	}
+
+	if !got[2].ReceivedAt.Equal(mtime) {
+		t.Errorf("a@test ReceivedAt = %v, want file mtime %v", got[2].ReceivedAt, mtime)
+	}
+	if want := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC); !got[3].ReceivedAt.Equal(want) {
+		t.Errorf("b@test ReceivedAt = %v, want Date header %v", got[3].ReceivedAt, want)
+	}
+
+	count, err := Count(Options{Type: SourceEML, Path: root}, nil)
+	if err != nil || count != 4 {
+		t.Errorf("Count() = %d, %v, want 4", count, err)
+	}
+}
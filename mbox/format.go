@@ -0,0 +1,459 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is an mbox variant, see https://en.wikipedia.org/wiki/Mbox.
+type Format string
+
+const (
+	// FormatAuto detects the variant from the start of the file.
+	FormatAuto Format = "auto"
+	// FormatMboxo quotes "From " body lines as ">From ", which is lossy.
+	FormatMboxo Format = "mboxo"
+	// FormatMboxrd quotes every ">*From " body line with one extra ">".
+	FormatMboxrd Format = "mboxrd"
+	// FormatMboxcl is mboxo quoting plus a Content-Length header.
+	FormatMboxcl Format = "mboxcl"
+	// FormatMboxcl2 delimits bodies by Content-Length and does not quote.
+	FormatMboxcl2 Format = "mboxcl2"
+)
+
+// ErrInvalidFormat is returned when the data does not start with a "From "
+// separator line.
+var ErrInvalidFormat = errors.New("invalid mbox format")
+
+// detectSampleSize is the amount of data FormatAuto inspects.
+const detectSampleSize = 1 << 20
+
+var (
+	separatorPrefix = []byte("From ")
+	rdQuotedFrom    = regexp.MustCompile(`^>+From `)
+	rdDoubleQuoted  = regexp.MustCompile(`(?m)^>>+From `)
+)
+
+// ParseFormat validates a --mbox-format value. An empty value means auto.
+func ParseFormat(value string) (Format, error) {
+	format := Format(strings.ToLower(strings.TrimSpace(value)))
+	switch format {
+	case "":
+		return FormatAuto, nil
+	case FormatAuto, FormatMboxo, FormatMboxrd, FormatMboxcl, FormatMboxcl2:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown mbox format %q", value)
+	}
+}
+
+// rawMessage is a single message as split from an mbox stream. Raw always
+// uses CRLF line endings with the variant's "From " quoting removed.
+//
+// Messages larger than the spool threshold have no Raw. They are stored in
+// the file at Path instead, with their header block and hash precomputed.
+type rawMessage struct {
+	// From is the envelope of the separator line without the "From " prefix.
+	From    string
+	Raw     []byte
+	Size    int64
+	Path    string
+	Spooled bool
+	Header  []byte
+	// Hash and RawHash are set for spooled messages, see messageHasher.sums.
+	Hash    string
+	RawHash string
+	// Offset is the byte offset of the separator line, Length the number of
+	// bytes up to the next separator (or the end of the data).
+	Offset int64
+	Length int64
+	// contentLength reports whether the body was delimited by Content-Length.
+	contentLength bool
+	// fileDate is the modification time of an .eml file, the date of a
+	// message whose date sources yield none.
+	fileDate time.Time
+}
+
+// scanner splits an mbox stream into messages.
+//
+// For the line based variants a single blank line directly before a "From "
+// separator belongs to the separator. Runs of blank lines are consumed in
+// pairs, so only an odd run loses its last line. This matches the parser used
+// by earlier releases and keeps the hashes in existing state files valid.
+type scanner struct {
+	r      *bufio.Reader
+	format Format
+	pos    int64
+
+	// Messages larger than spoolThreshold bytes are spooled to spoolDir.
+	spoolDir       string
+	spoolThreshold int64
+	// hashMode selects the hash of spooled messages.
+	hashMode string
+
+	started     bool
+	eof         bool
+	from        []byte
+	startOffset int64
+}
+
+// newScanner returns a scanner for r. FormatAuto is resolved by peeking at the
+// first detectSampleSize bytes without consuming them.
+func newScanner(r io.Reader, format Format) (*scanner, error) {
+	if format == "" {
+		format = FormatAuto
+	}
+
+	br := bufio.NewReaderSize(r, detectSampleSize)
+	if format == FormatAuto {
+		sample, err := br.Peek(detectSampleSize)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+		format = detectFormat(sample, errors.Is(err, io.EOF))
+	}
+
+	return &scanner{r: br, format: format}, nil
+}
+
+// Format returns the resolved variant.
+func (s *scanner) Format() Format {
+	return s.format
+}
+
+// Next returns the next message or io.EOF.
+func (s *scanner) Next() (*rawMessage, error) {
+	if !s.started {
+		s.started = true
+		if err := s.readFirstSeparator(); err != nil {
+			return nil, err
+		}
+	}
+	if s.from == nil {
+		return nil, io.EOF
+	}
+
+	msg := &rawMessage{
+		From:   string(bytes.TrimPrefix(s.from, separatorPrefix)),
+		Offset: s.startOffset,
+	}
+	s.from = nil
+
+	buf := &spoolBuffer{dir: s.spoolDir, threshold: s.spoolThreshold, hashMode: s.hashMode}
+	var err error
+	if s.format == FormatMboxcl || s.format == FormatMboxcl2 {
+		err = s.readContentLength(msg, buf)
+	} else {
+		err = s.readLines(buf)
+	}
+	if err == nil {
+		err = buf.finish(msg)
+	}
+	if err != nil {
+		buf.discard()
+		return nil, err
+	}
+
+	msg.Length = s.startOffset - msg.Offset
+	if s.from == nil {
+		msg.Length = s.pos - msg.Offset
+	}
+	return msg, nil
+}
+
+// readFirstSeparator skips leading blank lines up to the first separator.
+func (s *scanner) readFirstSeparator() error {
+	for {
+		offset := s.pos
+		line, ok, err := s.readLine()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return io.EOF
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if !bytes.HasPrefix(line, separatorPrefix) {
+			return ErrInvalidFormat
+		}
+		s.from = line
+		s.startOffset = offset
+		return nil
+	}
+}
+
+// readLines copies lines into buf until the next separator or the end of
+// the data.
+func (s *scanner) readLines(buf *spoolBuffer) error {
+	for {
+		offset := s.pos
+		line, ok, err := s.readLine()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if s.isSeparator(line, offset) {
+			return nil
+		}
+
+		if len(line) == 0 {
+			offset = s.pos
+			line, ok, err = s.readLine()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return nil
+			}
+			if s.isSeparator(line, offset) {
+				return nil
+			}
+			buf.WriteString("\r\n")
+		}
+
+		buf.Write(s.unquote(line))
+		buf.WriteString("\r\n")
+	}
+}
+
+// readContentLength reads the header block and, if it carries a usable
+// Content-Length, exactly that many body bytes. When the length does not end
+// at a separator the body is read line by line instead and
+// msg.contentLength stays false.
+func (s *scanner) readContentLength(msg *rawMessage, buf *spoolBuffer) error {
+	length := int64(-1)
+	for {
+		offset := s.pos
+		line, ok, err := s.readLine()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if s.isSeparator(line, offset) {
+			return nil
+		}
+
+		buf.Write(line)
+		buf.WriteString("\r\n")
+		if len(line) == 0 {
+			break
+		}
+
+		name, value, found := bytes.Cut(line, []byte(":"))
+		if found && strings.EqualFold(string(name), "Content-Length") {
+			if n, err := strconv.ParseInt(strings.TrimSpace(string(value)), 10, 64); err == nil && n >= 0 {
+				length = n
+			}
+		}
+	}
+	if length < 0 {
+		return s.readLines(buf)
+	}
+
+	// Bodies that fit the read buffer are checked without consuming them.
+	window := length + int64(len(separatorPrefix)) + 2
+	if window <= int64(s.r.Size()) {
+		data, err := s.r.Peek(int(window))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if int64(len(data)) < length || !followedBySeparator(data[length:]) {
+			return s.readLines(buf)
+		}
+		body := data[:length]
+		msg.contentLength = true
+		writeBodyLines(buf, body, s.format == FormatMboxcl)
+		if _, err := s.r.Discard(int(length)); err != nil {
+			return err
+		}
+		s.pos += length
+		return s.consumeSeparatorAfterBody()
+	}
+
+	body := make([]byte, length)
+	n, err := io.ReadFull(s.r, body)
+	body = body[:n]
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	s.pos += int64(n)
+
+	if err == nil {
+		next, _ := s.r.Peek(len(separatorPrefix) + 2)
+		if followedBySeparator(next) {
+			msg.contentLength = true
+			writeBodyLines(buf, body, s.format == FormatMboxcl)
+			return s.consumeSeparatorAfterBody()
+		}
+	}
+
+	// The Content-Length is wrong, re-read the body line by line.
+	s.pos -= int64(n)
+	s.r = bufio.NewReaderSize(io.MultiReader(bytes.NewReader(body), s.r), detectSampleSize)
+	return s.readLines(buf)
+}
+
+// followedBySeparator reports whether next, the data following a body,
+// continues with an optional blank line and a "From " separator, or is empty
+// because the data ends.
+func followedBySeparator(next []byte) bool {
+	next = bytes.TrimPrefix(next, []byte("\r"))
+	next = bytes.TrimPrefix(next, []byte("\n"))
+	return len(next) == 0 || bytes.HasPrefix(next, separatorPrefix)
+}
+
+// consumeSeparatorAfterBody reads the blank line and separator following a
+// Content-Length delimited body.
+func (s *scanner) consumeSeparatorAfterBody() error {
+	for {
+		offset := s.pos
+		line, ok, err := s.readLine()
+		if err != nil || !ok {
+			return err
+		}
+		if bytes.HasPrefix(line, separatorPrefix) {
+			s.from = line
+			s.startOffset = offset
+			return nil
+		}
+	}
+}
+
+func (s *scanner) isSeparator(line []byte, offset int64) bool {
+	if !bytes.HasPrefix(line, separatorPrefix) {
+		return false
+	}
+	s.from = line
+	s.startOffset = offset
+	return true
+}
+
+// unquote removes the variant's "From " quoting from a body line.
+func (s *scanner) unquote(line []byte) []byte {
+	switch s.format {
+	case FormatMboxrd:
+		if rdQuotedFrom.Match(line) {
+			return line[1:]
+		}
+	case FormatMboxcl2:
+	default:
+		if bytes.HasPrefix(line, []byte(">From ")) {
+			return line[1:]
+		}
+	}
+	return line
+}
+
+// readLine returns the next line without its LF or CRLF terminator. ok is
+// false at the end of the data.
+func (s *scanner) readLine() ([]byte, bool, error) {
+	if s.eof {
+		return nil, false, nil
+	}
+	line, err := s.r.ReadBytes('\n')
+	s.pos += int64(len(line))
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			return nil, false, err
+		}
+		s.eof = true
+		if len(line) == 0 {
+			return nil, false, nil
+		}
+		return line, true, nil
+	}
+	line = line[:len(line)-1]
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return line, true, nil
+}
+
+// writeBodyLines appends body to buf with CRLF line endings, removing mboxo
+// quoting when unquote is set.
+func writeBodyLines(buf *spoolBuffer, body []byte, unquote bool) {
+	for len(body) > 0 {
+		line := body
+		if idx := bytes.IndexByte(body, '\n'); idx >= 0 {
+			line, body = body[:idx], body[idx+1:]
+		} else {
+			body = nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if unquote && bytes.HasPrefix(line, []byte(">From ")) {
+			line = line[1:]
+		}
+		buf.Write(line)
+		buf.WriteString("\r\n")
+	}
+}
+
+// detectFormat guesses the variant from the start of an mbox file. complete
+// is set when sample holds the whole file.
+//
+// If every complete message in the sample is correctly delimited by its
+// Content-Length header the file is mboxcl2, or mboxcl when bodies contain
+// quoted but no unquoted "From " lines. Otherwise ">>From " lines, which
+// only mboxrd writers produce, select mboxrd. Everything else is read as
+// mboxo, the behaviour of earlier releases.
+func detectFormat(sample []byte, complete bool) Format {
+	if format, ok := detectContentLength(sample, complete); ok {
+		return format
+	}
+	if bytes.Contains(sample, []byte(">>")) && rdDoubleQuoted.Match(sample) {
+		return FormatMboxrd
+	}
+	return FormatMboxo
+}
+
+func detectContentLength(sample []byte, complete bool) (Format, bool) {
+	sc := &scanner{r: bufio.NewReader(bytes.NewReader(sample)), format: FormatMboxcl2}
+
+	var messages []*rawMessage
+	for {
+		msg, err := sc.Next()
+		if err != nil {
+			break
+		}
+		messages = append(messages, msg)
+	}
+	if !complete && len(messages) > 0 {
+		// The last message may be cut off by the sample size.
+		messages = messages[:len(messages)-1]
+	}
+	if len(messages) == 0 {
+		return "", false
+	}
+
+	quoted, unquoted := false, false
+	for _, msg := range messages {
+		if !msg.contentLength {
+			return "", false
+		}
+		_, body, _ := bytes.Cut(msg.Raw, []byte("\r\n\r\n"))
+		for _, line := range bytes.Split(body, []byte("\r\n")) {
+			switch {
+			case bytes.HasPrefix(line, separatorPrefix):
+				unquoted = true
+			case bytes.HasPrefix(line, []byte(">From ")):
+				quoted = true
+			}
+		}
+	}
+
+	if quoted && !unquoted {
+		return FormatMboxcl, true
+	}
+	return FormatMboxcl2, true
+}
@@ -0,0 +1,169 @@
+package mbox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"testing"
+)
+
+var (
+	mboxoQuote  = regexp.MustCompile(`(?m)^From `)
+	mboxrdQuote = regexp.MustCompile(`(?m)^(>*From )`)
+	clHeader    = regexp.MustCompile(`(?im)^Content-Length:.*\r\n`)
+)
+
+// writeMbox serialises messages in the given variant, the inverse of scanner.
+func writeMbox(t *testing.T, format Format, messages []*rawMessage) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, msg := range messages {
+		text := bytes.ReplaceAll(msg.Raw, []byte("\r\n"), []byte("\n"))
+		header, body, _ := bytes.Cut(text, []byte("\n\n"))
+
+		switch format {
+		case FormatMboxo, FormatMboxcl:
+			body = mboxoQuote.ReplaceAll(body, []byte(">From "))
+		case FormatMboxrd:
+			body = mboxrdQuote.ReplaceAll(body, []byte(">$1"))
+		}
+
+		fmt.Fprintf(&buf, "From %s\n", msg.From)
+		switch format {
+		case FormatMboxcl, FormatMboxcl2:
+			header = clHeader.ReplaceAll(append(header, '\n'), nil)
+			fmt.Fprintf(&buf, "%sContent-Length: %d\n\n", header, len(body))
+		default:
+			buf.Write(header)
+			buf.WriteString("\n\n")
+		}
+		buf.Write(body)
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+func scanAll(t *testing.T, data []byte, format Format) ([]*rawMessage, Format) {
+	t.Helper()
+	sc, err := newScanner(bytes.NewReader(data), format)
+	if err != nil {
+		t.Fatalf("newScanner() error = %v", err)
+	}
+	var messages []*rawMessage
+	for {
+		msg, err := sc.Next()
+		if errors.Is(err, io.EOF) {
+			return messages, sc.Format()
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		messages = append(messages, msg)
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	fixtures := map[string][]byte{"corrupted.mbox": corruptedMboxData}
+	if data, err := os.ReadFile("../test_data/All mail Including Spam and Trash.mbox"); err == nil {
+		fixtures["All mail Including Spam and Trash.mbox"] = data
+	}
+
+	for name, data := range fixtures {
+		original, detected := scanAll(t, data, FormatAuto)
+		if detected != FormatMboxo {
+			t.Errorf("%s: detected %s, want mboxo", name, detected)
+		}
+
+		for _, format := range []Format{FormatMboxo, FormatMboxrd, FormatMboxcl, FormatMboxcl2} {
+			t.Run(name+"/"+string(format), func(t *testing.T) {
+				written := writeMbox(t, format, original)
+				for _, readAs := range []Format{format, FormatAuto} {
+					got, _ := scanAll(t, written, readAs)
+					if len(got) != len(original) {
+						t.Fatalf("read as %s: %d messages, want %d", readAs, len(got), len(original))
+					}
+					for i := range got {
+						want, have := original[i].Raw, got[i].Raw
+						if format == FormatMboxcl || format == FormatMboxcl2 {
+							want = clHeader.ReplaceAll(want, nil)
+							have = clHeader.ReplaceAll(have, nil)
+						}
+						if !bytes.Equal(have, want) || got[i].From != original[i].From {
+							t.Fatalf("read as %s: message %d differs after round trip", readAs, i)
+						}
+						if !bytes.HasPrefix(written[got[i].Offset:], []byte("From ")) {
+							t.Fatalf("read as %s: message %d offset %d is not a separator", readAs, i, got[i].Offset)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestFormatQuoting(t *testing.T) {
+	body := "From the start\r\n>From quoted\r\n>>From twice\r\n"
+	original := []*rawMessage{
+		{From: "a@example.com Mon Jan  2 15:04:05 2006", Raw: []byte("Message-ID: <1@test>\r\n\r\n" + body)},
+		{From: "b@example.com Mon Jan  2 15:04:06 2006", Raw: []byte("Message-ID: <2@test>\r\n\r\nplain\r\n")},
+	}
+
+	tests := []struct {
+		format   Format
+		detected Format
+		wantBody string
+	}{
+		{FormatMboxrd, FormatMboxrd, body},
+		{FormatMboxcl2, FormatMboxcl2, body},
+		// mboxo and mboxcl cannot tell an original ">From " from a quoted one.
+		{FormatMboxo, FormatMboxrd, "From the start\r\nFrom quoted\r\n>>From twice\r\n"},
+		{FormatMboxcl, FormatMboxcl, "From the start\r\nFrom quoted\r\n>>From twice\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			written := writeMbox(t, tt.format, original)
+			if detected := detectFormat(written, true); detected != tt.detected {
+				t.Errorf("detectFormat() = %s, want %s", detected, tt.detected)
+			}
+
+			got, _ := scanAll(t, written, tt.format)
+			if len(got) != 2 {
+				t.Fatalf("got %d messages, want 2", len(got))
+			}
+			_, gotBody, _ := bytes.Cut(got[0].Raw, []byte("\r\n\r\n"))
+			if string(gotBody) != tt.wantBody {
+				t.Errorf("body = %q, want %q", gotBody, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestFormatContentLengthFallback(t *testing.T) {
+	data := "From a\nMessage-ID: <1@test>\nContent-Length: 3\n\nline one\nline two\n\nFrom b\nMessage-ID: <2@test>\n\nbody\n"
+	got, _ := scanAll(t, []byte(data), FormatMboxcl2)
+	if len(got) != 2 {
+		t.Fatalf("got %d messages, want 2", len(got))
+	}
+	want := "Message-ID: <1@test>\r\nContent-Length: 3\r\n\r\nline one\r\nline two\r\n"
+	if string(got[0].Raw) != want {
+		t.Errorf("message 0 = %q, want %q", got[0].Raw, want)
+	}
+	if got[1].Offset != int64(len("From a\nMessage-ID: <1@test>\nContent-Length: 3\n\nline one\nline two\n\n")) {
+		t.Errorf("message 1 offset = %d", got[1].Offset)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, value := range []string{"", "auto", "MBOXRD", "mboxcl2"} {
+		if _, err := ParseFormat(value); err != nil {
+			t.Errorf("ParseFormat(%q) error = %v", value, err)
+		}
+	}
+	if _, err := ParseFormat("maildir"); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
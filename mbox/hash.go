@@ -0,0 +1,223 @@
+package mbox
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+)
+
+// Hash modes select how the hash recorded in the state file is computed.
+const (
+	// HashModeRaw hashes the raw message bytes.
+	HashModeRaw = "raw"
+	// HashModeCanonical hashes the canonical header set and the body with
+	// normalized line endings, so re-exports that only change volatile
+	// headers or line endings keep their hash.
+	HashModeCanonical = "canonical"
+)
+
+// ParseHashMode validates a hash mode. An empty value selects HashModeRaw.
+func ParseHashMode(value string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(value)); mode {
+	case "", HashModeRaw:
+		return HashModeRaw, nil
+	case HashModeCanonical:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown hash mode %q", value)
+	}
+}
+
+// canonicalFields is the header set hashed in HashModeCanonical. Everything
+// else, such as X-Gmail-Labels, X-GM-THRID, Status or Content-Length, is
+// volatile across exports and left out.
+var canonicalFields = map[string]bool{
+	"from":                      true,
+	"sender":                    true,
+	"reply-to":                  true,
+	"to":                        true,
+	"cc":                        true,
+	"bcc":                       true,
+	"subject":                   true,
+	"date":                      true,
+	"message-id":                true,
+	"in-reply-to":               true,
+	"references":                true,
+	"mime-version":              true,
+	"content-type":              true,
+	"content-transfer-encoding": true,
+	"content-disposition":       true,
+}
+
+// messageHasher computes the state hash of a message while it is written.
+// In a mode other than HashModeRaw the raw hash is computed as well, so
+// records written in raw mode still match.
+type messageHasher struct {
+	raw       hash.Hash
+	canonical *canonicalHasher
+}
+
+func newMessageHasher(mode string) *messageHasher {
+	h := &messageHasher{raw: sha256.New()}
+	if mode == HashModeCanonical {
+		h.canonical = &canonicalHasher{sum: sha256.New()}
+	}
+	return h
+}
+
+func (h *messageHasher) Write(p []byte) (int, error) {
+	h.raw.Write(p)
+	if h.canonical != nil {
+		h.canonical.Write(p)
+	}
+	return len(p), nil
+}
+
+// sums returns the hash in the hasher's mode and, outside of raw mode, the
+// raw hash.
+func (h *messageHasher) sums() (sum, rawSum string) {
+	rawSum = base64.StdEncoding.EncodeToString(h.raw.Sum(nil))
+	if h.canonical == nil {
+		return rawSum, ""
+	}
+	return h.canonical.Sum(), rawSum
+}
+
+// hashMessage returns the hashes of raw, see messageHasher.sums.
+func hashMessage(raw []byte, mode string) (sum, rawSum string) {
+	h := newMessageHasher(mode)
+	_, _ = h.Write(raw)
+	return h.sums()
+}
+
+// canonicalHasher hashes the canonical form of a message: the fields of
+// canonicalFields with lowercase names and unfolded values with collapsed
+// whitespace, sorted by name, a blank line, and the body with every line
+// ending as CRLF and trailing line breaks removed.
+type canonicalHasher struct {
+	sum hash.Hash
+
+	inBody     bool
+	line       []byte
+	fields     [][]byte
+	headerSize int
+
+	cr       bool
+	newlines int
+	buf      []byte
+}
+
+func (c *canonicalHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for !c.inBody && len(p) > 0 {
+		idx := bytes.IndexByte(p, '\n')
+		if idx < 0 {
+			c.line = append(c.line, p...)
+			c.headerSize += len(p)
+			p = nil
+			if c.headerSize > maxHeaderSize {
+				c.endHeader()
+			}
+			break
+		}
+		c.line = append(c.line, p[:idx]...)
+		c.headerSize += idx + 1
+		p = p[idx+1:]
+		c.headerLine()
+	}
+	if c.inBody {
+		c.writeBody(p)
+	}
+	return n, nil
+}
+
+// headerLine consumes the complete header line in c.line.
+func (c *canonicalHasher) headerLine() {
+	line := bytes.TrimRight(c.line, "\r")
+	switch {
+	case len(line) == 0:
+		c.line = c.line[:0]
+		c.endHeader()
+		return
+	case (line[0] == ' ' || line[0] == '\t') && len(c.fields) > 0:
+		last := len(c.fields) - 1
+		c.fields[last] = append(append(c.fields[last], ' '), line...)
+	default:
+		c.fields = append(c.fields, bytes.Clone(line))
+	}
+	c.line = c.line[:0]
+}
+
+// endHeader hashes the canonical header set. Data of an unfinished line, as
+// when the header exceeds maxHeaderSize, becomes the start of the body.
+func (c *canonicalHasher) endHeader() {
+	type field struct{ name, value string }
+	var fields []field
+	for _, raw := range c.fields {
+		name, value, ok := bytes.Cut(raw, []byte(":"))
+		key := strings.ToLower(strings.TrimSpace(string(name)))
+		if !ok || !canonicalFields[key] {
+			continue
+		}
+		fields = append(fields, field{key, strings.Join(strings.Fields(string(value)), " ")})
+	}
+	sort.SliceStable(fields, func(i, j int) bool { return fields[i].name < fields[j].name })
+
+	for _, f := range fields {
+		c.sum.Write([]byte(f.name + ":" + f.value + "\r\n"))
+	}
+	c.sum.Write([]byte("\r\n"))
+
+	c.inBody = true
+	c.fields = nil
+	rest := c.line
+	c.line = nil
+	c.writeBody(rest)
+}
+
+// writeBody hashes body data with CR, LF and CRLF line endings as CRLF.
+// Line breaks are held back until more data follows, which drops trailing
+// ones.
+func (c *canonicalHasher) writeBody(p []byte) {
+	buf := c.buf[:0]
+	for _, b := range p {
+		switch b {
+		case '\r':
+			if c.cr {
+				c.newlines++
+			}
+			c.cr = true
+		case '\n':
+			c.newlines++
+			c.cr = false
+		default:
+			if c.cr {
+				c.newlines++
+				c.cr = false
+			}
+			for ; c.newlines > 0; c.newlines-- {
+				buf = append(buf, '\r', '\n')
+			}
+			buf = append(buf, b)
+		}
+	}
+	c.sum.Write(buf)
+	c.buf = buf
+}
+
+// Sum returns the canonical hash of the data written so far.
+func (c *canonicalHasher) Sum() string {
+	if !c.inBody {
+		if len(c.line) > 0 {
+			c.headerLine()
+		}
+		if !c.inBody {
+			c.endHeader()
+		}
+	}
+	return base64.StdEncoding.EncodeToString(c.sum.Sum(nil))
+}
@@ -0,0 +1,81 @@
+package mbox
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalHash(t *testing.T) {
+	base := "X-GM-THRID: 1234\r\nX-Gmail-Labels: Inbox,Opened\r\nFrom: a@example.com\r\nSubject: hello\r\n  world\r\nMessage-ID: <1@example.com>\r\n\r\nline 1\r\nline 2\r\n"
+	sum, _ := hashMessage([]byte(base), HashModeCanonical)
+
+	same := map[string]string{
+		"labels changed":      strings.Replace(base, "Inbox,Opened", "Archived", 1),
+		"thread id dropped":   strings.Replace(base, "X-GM-THRID: 1234\r\n", "", 1),
+		"lf line endings":     strings.ReplaceAll(base, "\r\n", "\n"),
+		"trailing blank line": base + "\r\n",
+		"header order":        "Subject: hello world\r\nFrom: a@example.com\r\nMessage-ID: <1@example.com>\r\n\r\nline 1\r\nline 2\r\n",
+		"status added":        "Status: RO\r\n" + base,
+	}
+	for name, raw := range same {
+		if got, _ := hashMessage([]byte(raw), HashModeCanonical); got != sum {
+			t.Errorf("%s: canonical hash changed", name)
+		}
+	}
+
+	different := map[string]string{
+		"subject changed": strings.Replace(base, "hello", "Hello", 1),
+		"body changed":    strings.Replace(base, "line 2", "line 3", 1),
+		"line added":      strings.Replace(base, "line 2", "line 2\r\n\r\nline 3", 1),
+	}
+	for name, raw := range different {
+		if got, _ := hashMessage([]byte(raw), HashModeCanonical); got == sum {
+			t.Errorf("%s: canonical hash unchanged", name)
+		}
+	}
+
+	// Writing in small chunks must not change the result.
+	h := newMessageHasher(HashModeCanonical)
+	for i := 0; i < len(base); i += 3 {
+		_, _ = h.Write([]byte(base[i:min(i+3, len(base))]))
+	}
+	chunked, rawSum := h.sums()
+	if chunked != sum {
+		t.Error("chunked canonical hash differs")
+	}
+	if want, _ := hashMessage([]byte(base), HashModeRaw); rawSum != want {
+		t.Errorf("raw hash = %q, want %q", rawSum, want)
+	}
+}
+
+func TestHashModeSpooled(t *testing.T) {
+	raw := "From: a@example.com\nSubject: big\nMessage-ID: <big@example.com>\n\n" + strings.Repeat("some body text\n", 200)
+	path := filepath.Join(t.TempDir(), "big.eml")
+	if err := os.WriteFile(path, []byte(raw), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []string{HashModeRaw, HashModeCanonical} {
+		msg, err := readMessageFile(path, 64, mode)
+		if err != nil {
+			t.Fatalf("readMessageFile() error = %v", err)
+		}
+		sum, rawSum := hashMessage([]byte(raw), mode)
+		if msg.Raw != nil || msg.Hash != sum || msg.RawHash != rawSum {
+			t.Errorf("%s: spooled hashes = %q, %q, want %q, %q", mode, msg.Hash, msg.RawHash, sum, rawSum)
+		}
+	}
+}
+
+func TestParseHashMode(t *testing.T) {
+	for value, want := range map[string]string{"": HashModeRaw, "raw": HashModeRaw, " Canonical ": HashModeCanonical} {
+		if got, err := ParseHashMode(value); err != nil || got != want {
+			t.Errorf("ParseHashMode(%q) = %q, %v", value, got, err)
+		}
+	}
+	if _, err := ParseHashMode("sha1"); err == nil {
+		t.Error("ParseHashMode(\"sha1\") succeeded")
+	}
+}
@@ -0,0 +1,635 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dhcgn/mbox-to-imap/model"
+	"github.com/dhcgn/mbox-to-imap/state"
+)
+
+// indexVersion is the version of the sidecar index format. Indexes written
+// by another version are ignored. Version 2 checksums the whole indexed
+// prefix instead of samples of it.
+const indexVersion = 2
+
+// indexSpoolThreshold bounds the memory BuildIndex holds per worker; larger
+// messages are hashed through a temporary spool file.
+const indexSpoolThreshold = 8 << 20
+
+// Batches handed to a parse worker hold at most this many messages or
+// bytes, whichever limit is reached first.
+const (
+	indexBatchMessages = 256
+	indexBatchBytes    = 4 << 20
+)
+
+// ErrIndexStale is returned by Index.Validate when the mbox file no longer
+// matches the index.
+var ErrIndexStale = errors.New("mbox index is stale")
+
+// IndexEntry describes a single message of an indexed mbox file. Offset and
+// Length are the byte range from its separator line up to the next one, Hash
+// is the hash the importer records for the message.
+type IndexEntry struct {
+	Offset    int64     `json:"offset"`
+	Length    int64     `json:"length"`
+	MessageID string    `json:"message_id,omitempty"`
+	Date      time.Time `json:"date,omitzero"`
+	Hash      string    `json:"hash"`
+	// RawHash is the hash of the raw bytes for indexes built in another
+	// hash mode, so state records written in raw mode still match.
+	RawHash string `json:"raw_hash,omitempty"`
+}
+
+// End returns the byte offset just past the message.
+func (e IndexEntry) End() int64 {
+	return e.Offset + e.Length
+}
+
+// Index is the sidecar index of an mbox file, stored next to it as
+// <mbox>.idx. The file holds one JSON line with the index header followed by
+// one line per entry.
+type Index struct {
+	Version int    `json:"version"`
+	Format  Format `json:"format"`
+	// HashMode is the mode the entry hashes were computed in; empty for
+	// indexes written before hash modes existed, which hash raw bytes.
+	HashMode string `json:"hash_mode,omitempty"`
+	// Size is the size of the mbox file when it was indexed and Prefix the
+	// state.PrefixChecksum of those bytes. Messages appended later are not
+	// indexed but do not invalidate the index.
+	Size    int64        `json:"size"`
+	Prefix  string       `json:"prefix"`
+	Entries []IndexEntry `json:"-"`
+}
+
+// hashMode returns the mode of the entry hashes.
+func (x *Index) hashMode() string {
+	if x.HashMode == "" {
+		return HashModeRaw
+	}
+	return x.HashMode
+}
+
+// IndexPath returns the path of the sidecar index for the mbox file at path.
+func IndexPath(path string) string {
+	return path + ".idx"
+}
+
+// BuildIndex reads the mbox file at path and indexes every message. Line
+// based variants are split at separator lines into up to workers byte
+// ranges that are parsed concurrently; Content-Length delimited variants are
+// read in one pass because their bodies may contain unquoted separators.
+// Entries are hashed in hashMode, see ParseHashMode.
+func BuildIndex(ctx context.Context, path string, format Format, workers int, hashMode string) (*Index, error) {
+	hashMode, err := ParseHashMode(hashMode)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open mbox: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat mbox: %w", err)
+	}
+	size := info.Size()
+
+	sc, err := newScanner(io.NewSectionReader(file, 0, size), format)
+	if err != nil {
+		return nil, fmt.Errorf("read mbox: %w", err)
+	}
+	format = sc.Format()
+
+	bounds := []int64{0, size}
+	if workers > 1 && format != FormatMboxcl && format != FormatMboxcl2 {
+		if bounds, err = shardBounds(file, size, workers); err != nil {
+			return nil, fmt.Errorf("split mbox: %w", err)
+		}
+	}
+
+	shards := make([][]IndexEntry, len(bounds)-1)
+	errs := make([]error, len(bounds)-1)
+	var wg sync.WaitGroup
+	for i := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shards[i], errs[i] = indexRange(ctx, file, format, hashMode, bounds[i], bounds[i+1])
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	prefix, err := state.PrefixChecksum(path, size)
+	if err != nil {
+		return nil, fmt.Errorf("checksum mbox: %w", err)
+	}
+
+	index := &Index{Version: indexVersion, Format: format, HashMode: hashMode, Size: size, Prefix: prefix}
+	for _, entries := range shards {
+		index.Entries = append(index.Entries, entries...)
+	}
+	return index, nil
+}
+
+// shardBounds splits the first size bytes of r into up to n ranges that each
+// start at a separator line.
+func shardBounds(r io.ReaderAt, size int64, n int) ([]int64, error) {
+	bounds := []int64{0}
+	for i := 1; i < n; i++ {
+		next, err := nextSeparator(r, size*int64(i)/int64(n), size)
+		if err != nil {
+			return nil, err
+		}
+		if next > bounds[len(bounds)-1] && next < size {
+			bounds = append(bounds, next)
+		}
+	}
+	return append(bounds, size), nil
+}
+
+// nextSeparator returns the offset of the first separator line starting at
+// or after from, or size if there is none.
+func nextSeparator(r io.ReaderAt, from, size int64) (int64, error) {
+	if from <= 0 {
+		return 0, nil
+	}
+	// Start one byte early so a line starting exactly at from is found.
+	pos := from - 1
+	br := bufio.NewReader(io.NewSectionReader(r, pos, size-pos))
+	for first := true; ; first = false {
+		line, err := br.ReadBytes('\n')
+		if !first && bytes.HasPrefix(line, separatorPrefix) {
+			return pos, nil
+		}
+		pos += int64(len(line))
+		if errors.Is(err, io.EOF) {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// indexRange indexes the messages in the byte range [start, end) of r,
+// which must begin at a separator line.
+func indexRange(ctx context.Context, r io.ReaderAt, format Format, hashMode string, start, end int64) ([]IndexEntry, error) {
+	sc, err := newScanner(io.NewSectionReader(r, start, end-start), format)
+	if err != nil {
+		return nil, fmt.Errorf("read mbox: %w", err)
+	}
+	sc.pos = start
+	sc.spoolThreshold = indexSpoolThreshold
+	sc.hashMode = hashMode
+
+	var entries []IndexEntry
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		raw, err := sc.Next()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("message at offset %d: %w", sc.pos, err)
+		}
+		entries = append(entries, newIndexEntry(raw, hashMode))
+		if raw.Spooled {
+			_ = os.Remove(raw.Path)
+		}
+	}
+}
+
+// newIndexEntry describes raw. Messages without a Message-ID or with an
+// unparsable header are indexed all the same, only without those fields.
+func newIndexEntry(raw *rawMessage, hashMode string) IndexEntry {
+	entry := IndexEntry{Offset: raw.Offset, Length: raw.Length, Hash: raw.Hash, RawHash: raw.RawHash}
+	header := raw.Header
+	if raw.Raw != nil {
+		header = raw.Raw
+		entry.Hash, entry.RawHash = hashMessage(raw.Raw, hashMode)
+	}
+	if msg, err := parseHeader(header, raw.From, nil); err == nil {
+		entry.MessageID = msg.ID
+		entry.Date = msg.ReceivedAt
+	}
+	return entry
+}
+
+// SaveIndex writes index as the sidecar index of the mbox file at path. The
+// file is replaced atomically.
+func SaveIndex(path string, index *Index) error {
+	target := IndexPath(path)
+	tmp, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create index file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(index)
+	for i := 0; err == nil && i < len(index.Entries); i++ {
+		err = enc.Encode(index.Entries[i])
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write index file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return fmt.Errorf("replace index file: %w", err)
+	}
+	return nil
+}
+
+// LoadIndex reads the sidecar index of the mbox file at path. The error
+// wraps os.ErrNotExist when there is none.
+func LoadIndex(path string) (*Index, error) {
+	file, err := os.Open(IndexPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(file))
+	var index Index
+	if err := dec.Decode(&index); err != nil {
+		return nil, fmt.Errorf("parse index header: %w", err)
+	}
+	if index.Version != indexVersion {
+		return nil, fmt.Errorf("unsupported index version %d", index.Version)
+	}
+	for {
+		var entry IndexEntry
+		err := dec.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			return &index, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse index entry %d: %w", len(index.Entries), err)
+		}
+		index.Entries = append(index.Entries, entry)
+	}
+}
+
+// Validate checks that the indexed bytes of the mbox file at path are
+// unchanged. The file may have grown if the appended data starts with a
+// separator.
+func (x *Index) Validate(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat mbox: %w", err)
+	}
+	if info.Size() < x.Size {
+		return fmt.Errorf("%w: file shrank", ErrIndexStale)
+	}
+	prefix, err := state.PrefixChecksum(path, x.Size)
+	if err != nil {
+		return fmt.Errorf("checksum mbox: %w", err)
+	}
+	if prefix != x.Prefix {
+		return fmt.Errorf("%w: file changed", ErrIndexStale)
+	}
+	if info.Size() > x.Size {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("open mbox: %w", err)
+		}
+		defer file.Close()
+		if !separatorAt(file, x.Size) {
+			return fmt.Errorf("%w: appended data does not start a message", ErrIndexStale)
+		}
+	}
+	return nil
+}
+
+// Find returns the position of the first entry with the given Message-ID.
+func (x *Index) Find(messageID string) (int, bool) {
+	for i, entry := range x.Entries {
+		if entry.MessageID == messageID {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// ReadIndexed returns entry i of index as read from the mbox file at path,
+// with CRLF line endings and the variant's quoting removed.
+func ReadIndexed(path string, index *Index, i int) ([]byte, error) {
+	if i < 0 || i >= len(index.Entries) {
+		return nil, fmt.Errorf("message %d not in index (%d messages)", i, len(index.Entries))
+	}
+	entry := index.Entries[i]
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open mbox: %w", err)
+	}
+	defer file.Close()
+
+	sc, err := newScanner(io.NewSectionReader(file, entry.Offset, entry.Length), index.Format)
+	if err != nil {
+		return nil, fmt.Errorf("read mbox: %w", err)
+	}
+	raw, err := sc.Next()
+	if err != nil {
+		return nil, fmt.Errorf("message %d: %w", i, err)
+	}
+	return raw.Raw, nil
+}
+
+// separatorAt reports whether a message separator, optionally preceded by
+// blank lines, starts at offset or whether the data ends there.
+func separatorAt(r io.ReaderAt, offset int64) bool {
+	next := make([]byte, 64)
+	n, err := r.ReadAt(next, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false
+	}
+	next = bytes.TrimLeft(next[:n], "\r\n")
+	return len(next) == 0 || bytes.HasPrefix(next, separatorPrefix)
+}
+
+// indexBatch is a run of consecutive index entries. Batches of entries that
+// were already processed are not read; all others are parsed by a worker
+// that sends one result per entry.
+type indexBatch struct {
+	first, count int
+	skip         bool
+	results      chan indexResult
+}
+
+type indexResult struct {
+	msg model.Message
+	ok  bool
+	err error
+}
+
+// loadIndex returns the sidecar index if the reader may use it for a
+// stream starting at offset.
+func (f *fileReader) loadIndex(format Format, offset int64) *Index {
+	if !f.useIndex {
+		return nil
+	}
+	index, err := LoadIndex(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	reason := ""
+	switch {
+	case err != nil:
+		reason = err.Error()
+	case format != FormatAuto && format != index.Format:
+		reason = fmt.Sprintf("index was built for %s", index.Format)
+	case index.hashMode() != f.hashMode:
+		reason = fmt.Sprintf("index was built with hash mode %s", index.hashMode())
+	case offset >= index.Size && offset > 0:
+		// The checkpoint is past the indexed part already.
+		return nil
+	default:
+		if err := index.Validate(f.path); err != nil {
+			reason = err.Error()
+		}
+	}
+	if reason != "" {
+		if f.logger != nil {
+			f.logger.Info("ignoring mbox index", "path", f.path, "reason", reason)
+		}
+		return nil
+	}
+	return index
+}
+
+// streamIndex emits the messages of an indexed mbox file from the first
+// entry at or after offset. Batches of entries are parsed by several
+// workers and emitted in file order. Entries whose hash or raw hash was
+// already processed are not read; they are emitted as messages without
+// content so the pipeline counts them as duplicates. As their header is not
+// read, they are neither filtered nor explained. Data appended after the
+// indexed part is read sequentially.
+func (f *fileReader) streamIndex(ctx context.Context, out chan<- model.Envelope, file *os.File, index *Index, offset int64) error {
+	first := sort.Search(len(index.Entries), func(i int) bool { return index.Entries[i].Offset >= offset })
+	if f.logger != nil {
+		f.logger.Debug("streaming mbox from index", "path", f.path, "messages", len(index.Entries)-first, "workers", f.workers)
+	}
+
+	parseCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := max(f.workers, 1)
+	batches := make(chan *indexBatch, 2*workers)
+	jobs := make(chan *indexBatch)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(batches)
+		defer close(jobs)
+		f.planBatches(parseCtx, index, first, batches, jobs)
+	}()
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range jobs {
+				f.parseBatch(parseCtx, file, index, batch)
+			}
+		}()
+	}
+
+	ok, err := f.emitBatches(parseCtx, out, index, batches)
+
+	// Release whatever the workers parsed ahead of a failed or cancelled
+	// stream.
+	cancel()
+	for batch := range batches {
+		for result := range batch.results {
+			_ = result.msg.Release()
+		}
+	}
+	wg.Wait()
+
+	if !ok || err != nil {
+		return err
+	}
+	return f.streamTail(ctx, out, file, index)
+}
+
+// planBatches splits the entries from first on into batches. Every batch is
+// queued on batches in order before it is handed to a worker on jobs.
+func (f *fileReader) planBatches(ctx context.Context, index *Index, first int, batches, jobs chan<- *indexBatch) {
+	processed := func(i int) bool {
+		entry := index.Entries[i]
+		return f.processed != nil && (f.processed(entry.Hash) || entry.RawHash != "" && f.processed(entry.RawHash))
+	}
+
+	for i := first; i < len(index.Entries); {
+		batch := &indexBatch{first: i, skip: processed(i)}
+		var size int64
+		for i < len(index.Entries) && processed(i) == batch.skip {
+			if !batch.skip && (batch.count == indexBatchMessages || batch.count > 0 && size+index.Entries[i].Length > indexBatchBytes) {
+				break
+			}
+			size += index.Entries[i].Length
+			batch.count++
+			i++
+		}
+		if !batch.skip {
+			batch.results = make(chan indexResult, batch.count)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case batches <- batch:
+		}
+		if batch.skip {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			close(batch.results)
+			return
+		case jobs <- batch:
+		}
+	}
+}
+
+// parseBatch reads and parses the byte range of batch and closes its
+// results.
+func (f *fileReader) parseBatch(ctx context.Context, file *os.File, index *Index, batch *indexBatch) {
+	defer close(batch.results)
+
+	start := index.Entries[batch.first].Offset
+	end := index.Entries[batch.first+batch.count-1].End()
+	sc, err := newScanner(io.NewSectionReader(file, start, end-start), index.Format)
+	if err != nil {
+		batch.results <- indexResult{err: fmt.Errorf("read mbox: %w", err)}
+		return
+	}
+	f.configure(sc)
+	sc.pos = start
+
+	for idx := batch.first; idx < batch.first+batch.count; idx++ {
+		if ctx.Err() != nil {
+			return
+		}
+		raw, err := sc.Next()
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			batch.results <- indexResult{err: fmt.Errorf("message %d: %w", idx, err)}
+			return
+		}
+
+		msg, ok, err := f.buildMessage(idx, raw)
+		if ok {
+			msg.Index = idx
+			msg.End = raw.Offset + raw.Length
+			msg.Progress = msg.End
+		}
+		batch.results <- indexResult{msg: msg, ok: ok, err: err}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// emitBatches emits the results of batches in order. The returned bool is
+// false when streaming stopped early.
+func (f *fileReader) emitBatches(ctx context.Context, out chan<- model.Envelope, index *Index, batches <-chan *indexBatch) (bool, error) {
+	for batch := range batches {
+		if batch.skip {
+			for idx := batch.first; idx < batch.first+batch.count; idx++ {
+				entry := index.Entries[idx]
+				msg := model.Message{
+					ID:         entry.MessageID,
+					Hash:       entry.Hash,
+					RawHash:    entry.RawHash,
+					ReceivedAt: entry.Date,
+					Index:      idx,
+					End:        entry.End(),
+					Progress:   entry.End(),
+				}
+				if err := f.emitEnvelope(ctx, out, model.Envelope{Message: msg}); err != nil {
+					return false, err
+				}
+			}
+			continue
+		}
+
+		received := 0
+		for result := range batch.results {
+			received++
+			if result.err != nil {
+				return false, f.emitError(ctx, out, result.err)
+			}
+			if !result.ok {
+				continue
+			}
+			if err := f.emitEnvelope(ctx, out, model.Envelope{Message: result.msg}); err != nil {
+				return false, err
+			}
+		}
+		if received < batch.count {
+			// The worker stopped because the stream was cancelled.
+			return false, ctx.Err()
+		}
+	}
+	return true, ctx.Err()
+}
+
+// streamTail reads the messages appended after the indexed part of the
+// file.
+func (f *fileReader) streamTail(ctx context.Context, out chan<- model.Envelope, file *os.File, index *Index) error {
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat mbox: %w", err)
+	}
+	if info.Size() <= index.Size {
+		return nil
+	}
+	if f.logger != nil {
+		f.logger.Info("reading messages appended after the mbox index", "path", f.path, "offset", index.Size)
+	}
+
+	sc, err := newScanner(io.NewSectionReader(file, index.Size, info.Size()-index.Size), index.Format)
+	if err != nil {
+		return fmt.Errorf("read mbox: %w", err)
+	}
+	f.configure(sc)
+	sc.pos = index.Size
+
+	idx := len(index.Entries)
+	_, err = f.streamScanner(ctx, out, sc, &idx, nil, nil)
+	return err
+}
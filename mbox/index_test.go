@@ -0,0 +1,193 @@
+package mbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// indexMessages returns messages with From lines in the body and trailing
+// blank line runs of varying length, which the scanner treats specially.
+func indexMessages(from, to int) []*rawMessage {
+	var messages []*rawMessage
+	for i := from; i < to; i++ {
+		body := fmt.Sprintf("body %d\r\nFrom the start of a line\r\n>From a quoted line\r\n", i) + strings.Repeat("\r\n", i%4)
+		raw := fmt.Sprintf("Message-ID: <%d@test>\r\nDate: Mon, 2 Jan 2006 15:04:%02d +0000\r\n\r\n%s", i, i%60, body)
+		messages = append(messages, &rawMessage{From: "sender@test Mon Jan  2 15:04:05 2006", Raw: []byte(raw)})
+	}
+	return messages
+}
+
+func writeIndexMbox(t *testing.T, format Format, count int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "archive.mbox")
+	if err := os.WriteFile(path, writeMbox(t, format, indexMessages(0, count)), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return path
+}
+
+func TestBuildIndexSharded(t *testing.T) {
+	for _, format := range []Format{FormatMboxo, FormatMboxrd, FormatMboxcl2} {
+		t.Run(string(format), func(t *testing.T) {
+			path := writeIndexMbox(t, format, 40)
+
+			sequential, err := BuildIndex(context.Background(), path, FormatAuto, 1, HashModeRaw)
+			if err != nil {
+				t.Fatalf("BuildIndex() error = %v", err)
+			}
+			sharded, err := BuildIndex(context.Background(), path, FormatAuto, 7, HashModeRaw)
+			if err != nil {
+				t.Fatalf("BuildIndex() error = %v", err)
+			}
+			if !reflect.DeepEqual(sequential, sharded) {
+				t.Fatalf("sharded index differs from sequential index")
+			}
+			if sequential.Format != format {
+				t.Errorf("Format = %s, want %s", sequential.Format, format)
+			}
+
+			messages := streamAll(t, Options{Path: path})
+			if len(messages) != len(sequential.Entries) {
+				t.Fatalf("indexed %d messages, want %d", len(sequential.Entries), len(messages))
+			}
+			for i, msg := range messages {
+				entry := sequential.Entries[i]
+				if entry.MessageID != msg.ID || entry.Hash != msg.Hash || entry.End() != msg.End || !entry.Date.Equal(msg.ReceivedAt) {
+					t.Errorf("entry %d = %+v, want message %s ending at %d", i, entry, msg.ID, msg.End)
+				}
+			}
+		})
+	}
+}
+
+func TestIndexRoundTrip(t *testing.T) {
+	path := writeIndexMbox(t, FormatMboxrd, 5)
+	index, err := BuildIndex(context.Background(), path, FormatAuto, 2, HashModeRaw)
+	if err != nil {
+		t.Fatalf("BuildIndex() error = %v", err)
+	}
+	if err := SaveIndex(path, index); err != nil {
+		t.Fatalf("SaveIndex() error = %v", err)
+	}
+
+	loaded, err := LoadIndex(path)
+	if err != nil {
+		t.Fatalf("LoadIndex() error = %v", err)
+	}
+	// Dates are compared separately, their locations differ after a round trip.
+	for i := range loaded.Entries {
+		if !loaded.Entries[i].Date.Equal(index.Entries[i].Date) {
+			t.Errorf("entry %d date = %v, want %v", i, loaded.Entries[i].Date, index.Entries[i].Date)
+		}
+		loaded.Entries[i].Date = index.Entries[i].Date
+	}
+	if !reflect.DeepEqual(index, loaded) {
+		t.Fatalf("loaded index differs from saved index")
+	}
+	if err := loaded.Validate(path); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	position, ok := loaded.Find("3@test")
+	if !ok || position != 3 {
+		t.Fatalf("Find() = %d, %v, want 3, true", position, ok)
+	}
+	raw, err := ReadIndexed(path, loaded, position)
+	if err != nil {
+		t.Fatalf("ReadIndexed() error = %v", err)
+	}
+	if want := streamAll(t, Options{Path: path})[3].Raw; string(raw) != string(want) {
+		t.Errorf("ReadIndexed() = %q, want %q", raw, want)
+	}
+
+	// Overwriting a message invalidates the index.
+	data, _ := os.ReadFile(path)
+	copy(data[len(data)-10:], "xxxxxxxxxx")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := loaded.Validate(path); err == nil {
+		t.Errorf("Validate() accepted a changed file")
+	}
+}
+
+func TestStreamIndex(t *testing.T) {
+	path := writeIndexMbox(t, FormatMboxo, 30)
+	want := streamAll(t, Options{Path: path})
+
+	index, err := BuildIndex(context.Background(), path, FormatAuto, 3, HashModeRaw)
+	if err != nil {
+		t.Fatalf("BuildIndex() error = %v", err)
+	}
+	if err := SaveIndex(path, index); err != nil {
+		t.Fatalf("SaveIndex() error = %v", err)
+	}
+
+	// Append messages the index does not know about.
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := file.Write(writeMbox(t, FormatMboxo, indexMessages(30, 33))); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	file.Close()
+	want = append(want, streamAll(t, Options{Path: path})[30:]...)
+
+	processed := map[string]bool{want[4].Hash: true, want[5].Hash: true, want[17].Hash: true}
+	got := streamAll(t, Options{
+		Path:      path,
+		UseIndex:  true,
+		Workers:   4,
+		Processed: func(hash string) bool { return processed[hash] },
+	})
+	if len(got) != len(want) {
+		t.Fatalf("streamed %d messages, want %d", len(got), len(want))
+	}
+	for i, msg := range got {
+		if msg.ID != want[i].ID || msg.Hash != want[i].Hash || msg.Index != want[i].Index || msg.End != want[i].End {
+			t.Errorf("message %d = %s (%d, end %d), want %s (%d, end %d)", i, msg.ID, msg.Index, msg.End, want[i].ID, want[i].Index, want[i].End)
+		}
+		if skipped := msg.Raw == nil; skipped != processed[msg.Hash] {
+			t.Errorf("message %d read = %v, want %v", i, !skipped, !processed[msg.Hash])
+		}
+	}
+}
+
+func TestStreamIndexCanonicalRawHash(t *testing.T) {
+	path := writeIndexMbox(t, FormatMboxo, 10)
+	raw := streamAll(t, Options{Path: path})
+
+	index, err := BuildIndex(context.Background(), path, FormatAuto, 2, HashModeCanonical)
+	if err != nil {
+		t.Fatalf("BuildIndex() error = %v", err)
+	}
+	if err := SaveIndex(path, index); err != nil {
+		t.Fatalf("SaveIndex() error = %v", err)
+	}
+
+	// A state written in raw mode skips the entry by its raw hash.
+	processed := map[string]bool{raw[3].Hash: true}
+	got := streamAll(t, Options{
+		Path:      path,
+		UseIndex:  true,
+		HashMode:  HashModeCanonical,
+		Processed: func(hash string) bool { return processed[hash] },
+	})
+	if len(got) != len(raw) {
+		t.Fatalf("streamed %d messages, want %d", len(got), len(raw))
+	}
+	for i, msg := range got {
+		if msg.RawHash != raw[i].Hash {
+			t.Errorf("message %d raw hash = %s, want %s", i, msg.RawHash, raw[i].Hash)
+		}
+		if skipped := msg.Raw == nil; skipped != (i == 3) {
+			t.Errorf("message %d read = %v, want %v", i, !skipped, i != 3)
+		}
+	}
+}
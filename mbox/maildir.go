@@ -0,0 +1,163 @@
+package mbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dhcgn/mbox-to-imap/model"
+)
+
+// maildirReader streams messages from a Maildir or Maildir++ tree. The root
+// maildir maps to the target folder itself, every ".Name.Sub" folder maps to
+// the "Name/Sub" subfolder below it.
+type maildirReader struct {
+	streamer
+}
+
+// maildirEntry is a single message file inside a maildir folder.
+type maildirEntry struct {
+	path   string
+	folder string
+	flags  []string
+}
+
+func (m *maildirReader) Stream(ctx context.Context, out chan<- model.Envelope) error {
+	entries, err := listMaildir(m.path)
+	if err != nil {
+		return err
+	}
+
+	for idx, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		raw, err := readMessageFile(entry.path, m.spoolThreshold, m.hashMode)
+		if err != nil {
+			return m.emitError(ctx, out, fmt.Errorf("message %d read: %w", idx, err))
+		}
+
+		msg, ok, err := m.buildMessage(idx, raw)
+		if err != nil {
+			return m.emitError(ctx, out, fmt.Errorf("%s: %w", entry.path, err))
+		}
+		if !ok {
+			continue
+		}
+
+		msg.Index = idx
+		msg.Folder = entry.folder
+		msg.Flags = mergeFlags(entry.flags, msg.Flags)
+		msg.Source = relativeSource(m.path, entry.path)
+
+		if err := m.emitEnvelope(ctx, out, model.Envelope{Message: msg}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listMaildir returns all messages below root in a deterministic order:
+// folders sorted by name, then "cur" before "new", then file names sorted.
+// Files in "tmp" are skipped because they are deliveries still in progress.
+func listMaildir(root string) ([]maildirEntry, error) {
+	if !isMaildir(root) {
+		return nil, fmt.Errorf("%s is not a maildir (missing cur/new)", root)
+	}
+
+	folders := map[string]string{"": root}
+	dirEntries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("read maildir: %w", err)
+	}
+	for _, de := range dirEntries {
+		name := de.Name()
+		if !de.IsDir() || !strings.HasPrefix(name, ".") || name == "." || name == ".." {
+			continue
+		}
+		dir := filepath.Join(root, name)
+		if !isMaildir(dir) {
+			continue
+		}
+		folders[maildirFolderName(name)] = dir
+	}
+
+	names := make([]string, 0, len(folders))
+	for name := range folders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var entries []maildirEntry
+	for _, folder := range names {
+		for _, sub := range []string{"cur", "new"} {
+			dir := filepath.Join(folders[folder], sub)
+			files, err := os.ReadDir(dir)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, fmt.Errorf("read maildir folder: %w", err)
+			}
+			for _, file := range files {
+				if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+					continue
+				}
+				entries = append(entries, maildirEntry{
+					path:   filepath.Join(dir, file.Name()),
+					folder: folder,
+					flags:  maildirFlags(file.Name()),
+				})
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+func isMaildir(dir string) bool {
+	for _, sub := range []string{"cur", "new"} {
+		info, err := os.Stat(filepath.Join(dir, sub))
+		if err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// maildirFolderName converts a Maildir++ folder directory such as
+// ".Archive.2019" into the slash separated folder "Archive/2019".
+func maildirFolderName(dir string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(dir, "."), ".", "/")
+}
+
+// maildirFlags maps the info part of a maildir file name ("...:2,FRS") to
+// IMAP system flags. Unknown and experimental (lowercase) flags are ignored.
+func maildirFlags(name string) []string {
+	idx := strings.LastIndex(name, ":2,")
+	if idx < 0 {
+		return nil
+	}
+
+	var flags []string
+	for _, c := range name[idx+3:] {
+		switch c {
+		case 'S':
+			flags = append(flags, `\Seen`)
+		case 'R':
+			flags = append(flags, `\Answered`)
+		case 'F':
+			flags = append(flags, `\Flagged`)
+		case 'T':
+			flags = append(flags, `\Deleted`)
+		case 'D':
+			flags = append(flags, `\Draft`)
+		}
+	}
+	return flags
+}
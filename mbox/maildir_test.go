@@ -0,0 +1,122 @@
+package mbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dhcgn/mbox-to-imap/model"
+)
+
+func writeMaildirMessage(t *testing.T, dir, name, id string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	raw := fmt.Sprintf("Message-ID: <%s>\nSubject: %s\n\nbody\n", id, id)
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(raw), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func TestMaildirReader(t *testing.T) {
+	root := t.TempDir()
+	writeMaildirMessage(t, filepath.Join(root, "cur"), "1000.a.host:2,SR", "inbox-1@test")
+	writeMaildirMessage(t, filepath.Join(root, "new"), "1001.b.host", "inbox-2@test")
+	writeMaildirMessage(t, filepath.Join(root, "tmp"), "1002.c.host", "tmp@test")
+	writeMaildirMessage(t, filepath.Join(root, ".Archive.2019", "cur"), "1003.d.host:2,FT", "archive@test")
+	writeMaildirMessage(t, filepath.Join(root, ".Sent", "cur"), "1004.e.host:2,SD", "sent@test")
+
+	count, err := Count(Options{Type: SourceMaildir, Path: root}, nil)
+	if err != nil {
+		t.Fatalf("Count() error = %v", err)
+	}
+	if count != 4 {
+		t.Fatalf("Count() = %d, want 4", count)
+	}
+
+	reader, err := NewReader(Options{Type: SourceMaildir, Path: root}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+
+	out := make(chan model.Envelope, 10)
+	if err := reader.Stream(context.Background(), out); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	close(out)
+
+	type result struct {
+		ID     string
+		Folder string
+		Flags  []string
+	}
+	var got []result
+	for env := range out {
+		if env.Err != nil {
+			t.Fatalf("unexpected error: %v", env.Err)
+		}
+		got = append(got, result{env.Message.ID, env.Message.Folder, env.Message.Flags})
+	}
+
+	want := []result{
+		{"inbox-1@test", "", []string{`\Seen`, `\Answered`}},
+		{"inbox-2@test", "", nil},
+		{"archive@test", "Archive/2019", []string{`\Flagged`, `\Deleted`}},
+		{"sent@test", "Sent", []string{`\Seen`, `\Draft`}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Stream() = %+v, want %+v", got, want)
+	}
+}
+
+func TestMaildirReader_Sieve(t *testing.T) {
+	root := t.TempDir()
+	writeMaildirMessage(t, filepath.Join(root, "cur"), "1000.a.host:2,SR", "inbox-1@test")
+	writeMaildirMessage(t, filepath.Join(root, "cur"), "1001.b.host:2,F", "spam@test")
+	writeMaildirMessage(t, filepath.Join(root, ".Archive", "cur"), "1002.c.host", "archive@test")
+
+	script := `require ["fileinto", "imap4flags"];
+		if header :is "subject" "spam@test" { discard; stop; }
+		addflag "\\Seen";
+		if header :contains "subject" "archive" { fileinto "Old/Archive"; }`
+	reader, err := NewReader(Options{Type: SourceMaildir, Path: root, Sieve: script}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	out := make(chan model.Envelope, 10)
+	if err := reader.Stream(context.Background(), out); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	close(out)
+
+	type result struct {
+		ID     string
+		Folder string
+		Route  string
+		Flags  []string
+	}
+	var got []result
+	for env := range out {
+		if env.Err != nil {
+			t.Fatalf("unexpected error: %v", env.Err)
+		}
+		got = append(got, result{env.Message.ID, env.Message.Folder, env.Message.Route, env.Message.Flags})
+	}
+	want := []result{
+		{"inbox-1@test", "", "", []string{`\Seen`, `\Answered`}},
+		{"archive@test", "Archive", "Old/Archive", []string{`\Seen`}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Stream() = %+v, want %+v", got, want)
+	}
+}
+
+func TestMaildirReader_NotAMaildir(t *testing.T) {
+	if _, err := Count(Options{Type: SourceMaildir, Path: t.TempDir()}, nil); err == nil {
+		t.Error("Expected error for a directory without cur/new")
+	}
+}
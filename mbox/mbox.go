@@ -5,32 +5,119 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"net/mail"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
-	mboxlib "github.com/emersion/go-mbox"
-
 	"github.com/dhcgn/mbox-to-imap/filter"
 	"github.com/dhcgn/mbox-to-imap/model"
 	"github.com/dhcgn/mbox-to-imap/runner"
+	"github.com/dhcgn/mbox-to-imap/state"
+	"github.com/dhcgn/mbox-to-imap/stats"
 )
 
 var (
 	ErrMessageIDMissing = errors.New("mbox message missing Message-Id header")
 )
 
+// Supported source types, selected with --source <type>:<path>.
+const (
+	SourceMbox        = "mbox"
+	SourceMaildir     = "maildir"
+	SourceEML         = "eml"
+	SourceThunderbird = "thunderbird"
+)
+
 type Options struct {
+	Type          string
 	Path          string
+	Format        string
 	IncludeHeader []string
 	IncludeBody   []string
 	ExcludeHeader []string
 	ExcludeBody   []string
+	// Filter is a filter expression, see filter.ParseExpression.
+	Filter string
+	// DecodeBody matches body filters against the decoded text parts of
+	// BodyTypes, see filter.Options.
+	DecodeBody bool     `json:",omitempty"`
+	BodyTypes  []string `json:",omitempty"`
+	// Since, Until, MinSize and MaxSize bound the message date and size,
+	// see filter.Options. The date is the one DateOrder selects.
+	Since   time.Time `json:",omitzero"`
+	Until   time.Time `json:",omitzero"`
+	MinSize int64     `json:",omitempty"`
+	MaxSize int64     `json:",omitempty"`
+	// IncludeLabels and ExcludeLabels select messages by their Gmail labels,
+	// see filter.Options.
+	IncludeLabels []string `json:",omitempty"`
+	ExcludeLabels []string `json:",omitempty"`
+	// Rules are named include, exclude and route rules, see
+	// filter.LoadRules. A route rule sets model.Message.Route.
+	Rules []filter.Rule `json:",omitempty"`
+	// Sieve is the source of a Sieve script, see filter.SieveScript. Its
+	// fileinto sets model.Message.Route like a route rule, its flags are
+	// added to model.Message.Flags.
+	Sieve string `json:",omitempty"`
+	// Messages larger than SpoolThreshold bytes are not kept in memory but
+	// spooled to SpoolDir (mbox sources) or read from their file later
+	// (maildir and eml sources). Zero keeps every message in memory.
+	SpoolThreshold int64
+	SpoolDir       string
+	// Budget, if set, is acquired for the in-memory size of every emitted
+	// message. The consumer releases it, see runner.Runner.Done.
+	Budget *runner.Budget
+	// Checkpoints, if set, lets mbox files resume from the byte offset of the
+	// last committed message of an earlier run.
+	Checkpoints *runner.Checkpointer
+	// UseIndex reads mbox files through their sidecar index, see BuildIndex,
+	// when one exists and is still valid. The indexed messages are parsed by
+	// Workers goroutines, and those whose hash Processed reports are not read
+	// at all.
+	UseIndex  bool
+	Workers   int
+	Processed func(hash string) bool `json:"-"`
+	// HashMode selects the hash recorded in the state file, see
+	// ParseHashMode. Empty selects HashModeRaw. A change invalidates resume
+	// checkpoints, so messages recorded under the old mode are read again
+	// and recorded with their new hash.
+	HashMode string `json:",omitempty"`
+	// MessageIDDedupe selects which of several messages sharing a Message-ID
+	// but differing in content is imported, see ParseDedupePolicy. Empty or
+	// DedupeOff imports all of them; any other policy pre-scans the source.
+	MessageIDDedupe string `json:",omitempty"`
+	// ConflictReport is the CSV file the Message-ID pre-scan writes every
+	// variant of the conflicting Message-IDs to, marked kept or superseded.
+	// Empty disables the report.
+	ConflictReport string `json:"-"`
+	// ThreadClosure imports whole threads: every message of a thread the
+	// excludes do not drop is imported when any of its messages passes the
+	// filter, see filter.ThreadSet. It pre-scans the source.
+	ThreadClosure bool `json:",omitempty"`
+	// Superseded, if set, is called for every message dropped by
+	// MessageIDDedupe.
+	Superseded func(msg model.Message) `json:"-"`
+	// Filtered, if set, is called for every message the filter drops, with
+	// the Message-ID, if any, and the rules that dropped it.
+	Filtered func(id string, rules []string) `json:"-"`
+	// Explain, if set, is called with the filter decision about every
+	// message of the source, see filter.Explain. Messages superseded by
+	// MessageIDDedupe are explained as dropped by "message-id-dedupe".
+	Explain func(filter.Explanation) `json:"-"`
+	// DateOrder is the precedence of the sources a message's date is taken
+	// from, see ParseDateOrder. Nil selects DefaultDateOrder. The date range
+	// and the newest dedupe policy use it, so it is part of the checkpoint
+	// fingerprint.
+	DateOrder []string `json:",omitempty"`
 }
 
 type Reader interface {
@@ -38,114 +125,658 @@ type Reader interface {
 }
 
 func NewReader(opts Options, logger *slog.Logger) (Reader, error) {
-	path := strings.TrimSpace(opts.Path)
-	if path == "" {
-		return nil, fmt.Errorf("mbox path is empty")
+	policy, err := ParseDedupePolicy(opts.MessageIDDedupe)
+	if err != nil {
+		return nil, err
+	}
+	if policy == DedupeOff && !opts.ThreadClosure {
+		return newReader(opts, logger, passes{})
 	}
 
-	filterOpts := filter.Options{
+	// The pre-scans read the whole source, regardless of checkpoints and the
+	// state, without holding on to the memory budget.
+	scanOpts := opts
+	scanOpts.Budget = nil
+	scanOpts.Checkpoints = nil
+	scanOpts.Processed = nil
+	scanOpts.Filtered = nil
+	scanOpts.Explain = nil
+
+	// The thread pre-scan runs first, so the Message-ID pre-scan sees the
+	// messages thread closure adds.
+	var p passes
+	if opts.ThreadClosure {
+		if p.threads, err = filter.NewThreadSet(filterOptions(opts)); err != nil {
+			return nil, err
+		}
+	}
+	if policy != DedupeOff {
+		p.dedupe = newDedupeSet(policy, opts.Superseded)
+	}
+	reader, err := newReader(opts, logger, p)
+	if err != nil {
+		return nil, err
+	}
+	if p.dedupe != nil {
+		prescan, err := newReader(scanOpts, nil, passes{threads: p.threads})
+		if err != nil {
+			return nil, err
+		}
+		reader = &dedupeReader{reader: reader, prescan: prescan, set: p.dedupe, report: opts.ConflictReport, logger: logger}
+	}
+	if p.threads != nil {
+		prescan, err := newReader(scanOpts, nil, passes{scanThreads: p.threads})
+		if err != nil {
+			return nil, err
+		}
+		reader = &threadReader{reader: reader, prescan: prescan, set: p.threads, logger: logger}
+	}
+	return reader, nil
+}
+
+// passes are the results of the pre-scans a reader applies or, for the
+// thread pre-scan itself, collects.
+type passes struct {
+	// dedupe drops the messages superseded by another variant of their
+	// Message-ID.
+	dedupe *dedupeSet
+	// threads allows the messages of the selected threads. scanThreads
+	// collects the threads instead, emitting no messages.
+	threads     *filter.ThreadSet
+	scanThreads *filter.ThreadSet
+}
+
+// filterOptions returns the filter options of opts.
+func filterOptions(opts Options) filter.Options {
+	return filter.Options{
 		IncludeHeader: opts.IncludeHeader,
 		IncludeBody:   opts.IncludeBody,
 		ExcludeHeader: opts.ExcludeHeader,
 		ExcludeBody:   opts.ExcludeBody,
+		Expression:    opts.Filter,
+		DecodeBody:    opts.DecodeBody,
+		BodyTypes:     opts.BodyTypes,
+		Since:         opts.Since,
+		Until:         opts.Until,
+		MinSize:       opts.MinSize,
+		MaxSize:       opts.MaxSize,
+		IncludeLabels: opts.IncludeLabels,
+		ExcludeLabels: opts.ExcludeLabels,
+		Rules:         opts.Rules,
+		Sieve:         opts.Sieve,
 	}
+}
 
-	f, err := filter.New(filterOpts)
+// newReader is NewReader without the pre-scans, applying the passes they
+// made.
+func newReader(opts Options, logger *slog.Logger, p passes) (Reader, error) {
+	path := strings.TrimSpace(opts.Path)
+	if path == "" {
+		return nil, fmt.Errorf("mbox path is empty")
+	}
+
+	f, err := filter.New(filterOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := ParseFormat(opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	hashMode, err := ParseHashMode(opts.HashMode)
 	if err != nil {
 		return nil, err
 	}
 
-	reader := &fileReader{
-		path:   path,
-		logger: logger,
-		filter: f,
+	base := streamer{
+		path:           path,
+		format:         format,
+		logger:         logger,
+		filter:         f,
+		spoolDir:       opts.SpoolDir,
+		spoolThreshold: opts.SpoolThreshold,
+		budget:         opts.Budget,
+		dateOrder:      opts.DateOrder,
+		hashMode:       hashMode,
+		dedupe:         p.dedupe,
+		threads:        p.threads,
+		scanThreads:    p.scanThreads,
+		filtered:       opts.Filtered,
+		explain:        opts.Explain,
 	}
 
+	var reader Reader
+	switch opts.Type {
+	case "", SourceMbox:
+		reader = &fileReader{
+			streamer:    base,
+			checkpoints: opts.Checkpoints,
+			options:     checkpointOptions(opts),
+			useIndex:    opts.UseIndex,
+			workers:     opts.Workers,
+			processed:   opts.Processed,
+		}
+	case SourceMaildir:
+		reader = &maildirReader{streamer: base}
+	case SourceEML:
+		reader = &emlReader{streamer: base}
+	case SourceThunderbird:
+		reader = &thunderbirdReader{streamer: base}
+	default:
+		return nil, fmt.Errorf("unsupported source type %q", opts.Type)
+	}
+	if logger != nil && (len(opts.Rules) > 0 || opts.Sieve != "") {
+		reader = &ruleReporter{reader: reader, filter: f, logger: logger}
+	}
 	return reader, nil
 }
 
+// ruleReporter logs the hits of every filter rule and the decisions of the
+// Sieve script once the source has been streamed.
+type ruleReporter struct {
+	reader Reader
+	filter *filter.Filter
+	logger *slog.Logger
+}
+
+func (r *ruleReporter) Stream(ctx context.Context, out chan<- model.Envelope) error {
+	err := r.reader.Stream(ctx, out)
+	stats := r.filter.GetStats()
+	for _, rule := range stats.Rules {
+		attrs := []any{"rule", rule.Name, "action", rule.Action, "hits", stats.RuleHits[rule.Name]}
+		if rule.Folder != "" {
+			attrs = append(attrs, "folder", rule.Folder)
+		}
+		r.logger.Info("filter rule hits", attrs...)
+	}
+	if stats.Sieve {
+		r.logger.Info("sieve decisions", "kept", stats.SieveKept, "discarded", stats.SieveDiscarded)
+		for _, folder := range slices.Sorted(maps.Keys(stats.SieveFiled)) {
+			r.logger.Info("sieve fileinto", "folder", folder, "messages", stats.SieveFiled[folder])
+		}
+	}
+	return err
+}
+
+// Count returns the number of messages the source described by opts holds.
+// progressCallback is only used for mbox files, see CountMessages.
+func Count(opts Options, progressCallback func(bytesRead, totalSize int64)) (int, error) {
+	format, err := ParseFormat(opts.Format)
+	if err != nil {
+		return 0, err
+	}
+
+	switch opts.Type {
+	case "", SourceMbox:
+		return CountMessages(opts.Path, format, progressCallback)
+	case SourceMaildir:
+		entries, err := listMaildir(opts.Path)
+		if err != nil {
+			return 0, err
+		}
+		return len(entries), nil
+	case SourceEML:
+		entries, err := listEML(opts.Path)
+		if err != nil {
+			return 0, err
+		}
+		return len(entries), nil
+	case SourceThunderbird:
+		// Expunged and partial messages are left out, as streaming skips
+		// them without an event.
+		folders, err := listThunderbird(opts.Path)
+		if err != nil {
+			return 0, err
+		}
+		total := 0
+		for _, folder := range folders {
+			count, err := countMessages(folder.path, format, nil, thunderbirdSkipped)
+			if err != nil {
+				return 0, fmt.Errorf("count %s: %w", folder.path, err)
+			}
+			total += count
+		}
+		return total, nil
+	default:
+		return 0, fmt.Errorf("unsupported source type %q", opts.Type)
+	}
+}
+
+// SourceSize returns the number of bytes a byte based progress display
+// should expect for the source described by opts. It returns false for
+// sources that are not made of mbox files.
+func SourceSize(opts Options) (int64, bool, error) {
+	switch opts.Type {
+	case "", SourceMbox:
+		info, err := os.Stat(opts.Path)
+		if err != nil {
+			return 0, false, fmt.Errorf("stat mbox: %w", err)
+		}
+		return info.Size(), true, nil
+	case SourceThunderbird:
+		folders, err := listThunderbird(opts.Path)
+		if err != nil {
+			return 0, false, err
+		}
+		var total int64
+		for _, folder := range folders {
+			info, err := os.Stat(folder.path)
+			if err != nil {
+				return 0, false, fmt.Errorf("stat thunderbird folder: %w", err)
+			}
+			total += info.Size()
+		}
+		return total, true, nil
+	default:
+		return 0, false, nil
+	}
+}
+
 type fileReader struct {
+	streamer
+	checkpoints *runner.Checkpointer
+	options     string
+
+	useIndex  bool
+	workers   int
+	processed func(hash string) bool
+}
+
+func (f *fileReader) Stream(ctx context.Context, out chan<- model.Envelope) error {
+	if mbox_test_data_using {
+		idx := 0
+		_, err := f.streamMbox(ctx, out, bytes.NewReader(mbox_test_data), &idx, nil, nil)
+		return err
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return fmt.Errorf("open mbox: %w", err)
+	}
+	defer file.Close()
+
+	start := state.Checkpoint{Options: f.options}
+	if f.checkpoints != nil {
+		if start.Source, err = filepath.Abs(f.path); err != nil {
+			return fmt.Errorf("resolve mbox path: %w", err)
+		}
+		if cp, ok := f.checkpoints.Load(start.Source); ok && f.resumable(file, &cp) {
+			start = cp
+			if f.logger != nil {
+				f.logger.Info("resuming mbox from checkpoint", "path", f.path, "offset", cp.Offset, "index", cp.Index)
+			}
+		}
+	}
+
+	format := f.format
+	if start.Format != "" {
+		format = Format(start.Format)
+	}
+
+	if index := f.loadIndex(format, start.Offset); index != nil {
+		start.Format = string(index.Format)
+		f.checkpoints.Start(start)
+		return f.streamIndex(ctx, out, file, index, start.Offset)
+	}
+
+	if _, err := file.Seek(start.Offset, io.SeekStart); err != nil {
+		return fmt.Errorf("seek mbox: %w", err)
+	}
+	sc, err := newScanner(file, format)
+	if err != nil {
+		return fmt.Errorf("read mbox: %w", err)
+	}
+	f.configure(sc)
+	sc.pos = start.Offset
+
+	start.Format = string(sc.Format())
+	f.checkpoints.Start(start)
+
+	idx := start.Index
+	_, err = f.streamScanner(ctx, out, sc, &idx, nil, nil)
+	return err
+}
+
+// resumable reports whether cp still describes file: same reader options,
+// an unchanged prefix and a message separator at the checkpoint offset. The
+// prefix hash is kept in cp.Hash for the checkpoints written from there.
+func (f *fileReader) resumable(file *os.File, cp *state.Checkpoint) bool {
+	reason := ""
+	switch {
+	case cp.Offset <= 0:
+		return false
+	case cp.Options != f.options:
+		reason = "reader options changed"
+	default:
+		prefix := state.NewPrefixHash(cp.Source)
+		if err := prefix.Extend(cp.Offset); err != nil || prefix.Sum() != cp.Prefix {
+			reason = "file changed"
+			break
+		}
+		cp.Hash = prefix
+		// Blank lines may precede the separator when messages were appended.
+		if !separatorAt(file, cp.Offset) {
+			reason = "no message at checkpoint offset"
+		}
+	}
+
+	if reason != "" {
+		if f.logger != nil {
+			f.logger.Info("ignoring mbox checkpoint", "path", f.path, "reason", reason)
+		}
+		return false
+	}
+	return true
+}
+
+// checkpointOptions fingerprints the options that decide which messages a
+// reader emits and how they are split.
+func checkpointOptions(opts Options) string {
+	opts.Path = ""
+	opts.SpoolThreshold = 0
+	opts.SpoolDir = ""
+	opts.Budget = nil
+	opts.Checkpoints = nil
+	opts.UseIndex = false
+	opts.Workers = 0
+	opts.Superseded = nil
+	opts.Filtered = nil
+	opts.Explain = nil
+	if opts.MessageIDDedupe == DedupeOff {
+		opts.MessageIDDedupe = ""
+	}
+	if slices.Equal(opts.DateOrder, DefaultDateOrder) {
+		// Keeps the fingerprints of checkpoints written with the default
+		// order.
+		opts.DateOrder = nil
+	}
+	if opts.HashMode == HashModeRaw {
+		// Keeps the fingerprints of checkpoints written before hash modes.
+		opts.HashMode = ""
+	}
+
+	data, _ := json.Marshal(opts)
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// streamer holds the state shared by all Reader implementations: the source
+// path for log output, the mbox variant for mbox files, the filter every
+// raw message is checked against and the spooling settings.
+type streamer struct {
 	path   string
+	format Format
 	logger *slog.Logger
 	filter *filter.Filter
+
+	spoolDir       string
+	spoolThreshold int64
+	budget         *runner.Budget
+	dateOrder      []string
+	hashMode       string
+	// dedupe, if set, drops the messages superseded by another variant of
+	// their Message-ID.
+	dedupe *dedupeSet
+	// threads, if set, allows the messages of the threads selected by
+	// thread closure; scanThreads, if set, collects those threads.
+	threads     *filter.ThreadSet
+	scanThreads *filter.ThreadSet
+	// filtered, if set, is called for every message the filter drops;
+	// explain, if set, is called with every filter decision.
+	filtered func(id string, rules []string)
+	explain  func(filter.Explanation)
 }
 
-func (f *fileReader) Stream(ctx context.Context, out chan<- model.Envelope) error {
-	var reader *mboxlib.Reader
+// configure applies the spooling settings to sc.
+func (s *streamer) configure(sc *scanner) {
+	sc.spoolDir = s.spoolDir
+	sc.spoolThreshold = s.spoolThreshold
+	sc.hashMode = s.hashMode
+}
 
-	if mbox_test_data_using {
-		reader = mboxlib.NewReader(bytes.NewReader(mbox_test_data))
+// buildMessage applies the filter to raw and parses it into a model.Message.
+// It returns false without an error when the filter rejects the message. A
+// spool file of a rejected message is removed.
+func (s *streamer) buildMessage(idx int, raw *rawMessage) (model.Message, bool, error) {
+	msg, ok, err := s.parseRaw(idx, raw)
+	if (err != nil || !ok) && raw.Spooled {
+		_ = os.Remove(raw.Path)
+	}
+	return msg, ok, err
+}
+
+func (s *streamer) parseRaw(idx int, raw *rawMessage) (model.Message, bool, error) {
+	// The header is parsed first as the date range needs the message date,
+	// but a parse error only counts for messages that pass the filter.
+	var (
+		msg      model.Message
+		parseErr error
+		message  filter.Message
+		result   filter.Result
+		err      error
+	)
+	if raw.Raw != nil {
+		msg, parseErr = parseHeader(raw.Raw, raw.From, s.dateOrder)
 	} else {
-		file, err := os.Open(f.path)
-		if err != nil {
-			return fmt.Errorf("open mbox: %w", err)
+		msg, parseErr = parseHeader(raw.Header, raw.From, s.dateOrder)
+	}
+	if msg.ReceivedAt.IsZero() && !raw.fileDate.IsZero() {
+		msg.ReceivedAt, msg.DateSource = raw.fileDate, DateSourceFile
+	}
+
+	message = filter.Message{Size: raw.Size, Date: msg.ReceivedAt, Envelope: raw.From}
+	if raw.Raw != nil {
+		message.Header, message.Body = filter.SplitRawMessage(raw.Raw)
+	} else {
+		message.Header, _ = filter.SplitRawMessage(raw.Header)
+		message.OpenBody = func() (io.ReadCloser, error) {
+			return openBody(raw.Path, int64(len(raw.Header)))
 		}
-		defer file.Close()
-		reader = mboxlib.NewReader(file)
 	}
+	result, err = s.filter.Evaluate(message)
+	if err == nil && s.threads != nil {
+		result, err = s.threads.Apply(message, result)
+	}
+	if err != nil {
+		return model.Message{}, false, fmt.Errorf("message %d filter: %w", idx, err)
+	}
+	if s.scanThreads != nil {
+		s.scanThreads.Add(idx, message.Header, result)
+		return model.Message{}, false, nil
+	}
+	header := message.Header
+	if !result.Allowed {
+		if s.explain != nil {
+			s.explain(filter.Explain(idx, header, result))
+		}
+		if s.filtered != nil {
+			s.filtered(msg.ID, result.Rules)
+		}
+		return model.Message{}, false, nil
+	}
+
+	if err = parseErr; err != nil {
+		if s.explain != nil {
+			s.explain(filter.Explain(idx, header, result))
+		}
+		if errors.Is(err, ErrMessageIDMissing) {
+			err = fmt.Errorf("message %d: %w", idx, err)
+		} else {
+			err = fmt.Errorf("message %d parse: %w", idx, err)
+		}
+		return model.Message{}, false, err
+	}
+	if raw.Raw != nil {
+		msg.Hash, msg.RawHash = hashMessage(raw.Raw, s.hashMode)
+	} else {
+		msg.Hash, msg.RawHash = raw.Hash, raw.RawHash
+	}
+	if s.explain != nil {
+		// emitEnvelope drops the superseded variants after the filter.
+		decision := result
+		if s.dedupe.rejects(msg) {
+			decision.Allowed = false
+			decision.Rules = append(slices.Clip(result.Rules), "message-id-dedupe")
+		}
+		s.explain(filter.Explain(idx, header, decision))
+	}
+
+	msg.Size = raw.Size
+	msg.Raw = raw.Raw
+	msg.Path = raw.Path
+	msg.Spooled = raw.Spooled
+	msg.Source = filepath.Base(s.path)
+	msg.Envelope = raw.From
+	msg.Route = result.Folder
+	msg.Flags = result.Flags
+	return msg, true, nil
+}
+
+// mergeFlags returns the flags of a source followed by those in added it
+// does not carry yet, such as the flags set by a Sieve script.
+func mergeFlags(source, added []string) []string {
+	flags := slices.Clone(source)
+	for _, flag := range added {
+		if !slices.ContainsFunc(flags, func(f string) bool { return strings.EqualFold(f, flag) }) {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+// relativeSource returns path relative to the source directory root, "/"
+// separated, for model.Message.Source.
+func relativeSource(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return filepath.Base(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// openBody opens the message file at path positioned at the body.
+func openBody(path string, offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// streamMbox emits every message of a single mbox stream. idx is the running
+// message index and is advanced past the messages read, so several files can
+// share one numbering. skip, if set, is called with the header block of each
+// message before the filter and drops it by returning true, so the filter,
+// its explanation and the pre-scans never see it. apply, if set, is called
+// with the header block of each message that passed the filter and may
+// decorate it. The returned bool is false when streaming stopped because an
+// error was emitted.
+func (s *streamer) streamMbox(ctx context.Context, out chan<- model.Envelope, source io.Reader, idx *int, skip func(header []byte) bool, apply func(header []byte, msg *model.Message)) (bool, error) {
+	sc, err := newScanner(source, s.format)
+	if err != nil {
+		return false, fmt.Errorf("read mbox: %w", err)
+	}
+	s.configure(sc)
+	return s.streamScanner(ctx, out, sc, idx, skip, apply)
+}
 
-	for idx := 0; ; idx++ {
+// streamScanner is streamMbox for an already configured scanner.
+func (s *streamer) streamScanner(ctx context.Context, out chan<- model.Envelope, sc *scanner, idx *int, skip func(header []byte) bool, apply func(header []byte, msg *model.Message)) (bool, error) {
+	if s.logger != nil {
+		s.logger.Debug("mbox format", "path", s.path, "format", sc.Format())
+	}
+
+	for ; ; *idx++ {
 		if err := ctx.Err(); err != nil {
-			return err
+			return false, err
 		}
 
-		msgReader, err := reader.NextMessage()
+		next, err := sc.Next()
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				return nil
+				return true, nil
 			}
-			return f.emitError(ctx, out, fmt.Errorf("message %d: %w", idx, err))
+			return false, s.emitError(ctx, out, fmt.Errorf("message %d: %w", *idx, err))
 		}
 
-		raw, err := io.ReadAll(msgReader)
-		if err != nil {
-			return f.emitError(ctx, out, fmt.Errorf("message %d read: %w", idx, err))
+		header := next.Header
+		if next.Raw != nil {
+			header, _ = filter.SplitRawMessage(next.Raw)
 		}
-
-		header, body := filter.SplitRawMessage(raw)
-		if !f.filter.Allows(header, body) {
+		if skip != nil && skip(header) {
+			if next.Spooled {
+				_ = os.Remove(next.Path)
+			}
 			continue
 		}
 
-		msg, err := parseMail(raw)
+		msg, ok, err := s.buildMessage(*idx, next)
 		if err != nil {
-			if errors.Is(err, ErrMessageIDMissing) {
-				err = fmt.Errorf("message %d: %w", idx, err)
-			} else {
-				err = fmt.Errorf("message %d parse: %w", idx, err)
-			}
-			return f.emitError(ctx, out, err)
+			return false, s.emitError(ctx, out, err)
+		}
+		if !ok {
+			continue
+		}
+		msg.Index = *idx
+		msg.End = next.Offset + next.Length
+		msg.Progress = msg.End
+		if apply != nil {
+			apply(header, &msg)
 		}
 
-		msg.Size = int64(len(raw))
-		msg.Raw = raw
-
-		if err := f.emitEnvelope(ctx, out, model.Envelope{Message: msg}); err != nil {
-			return err
+		if err := s.emitEnvelope(ctx, out, model.Envelope{Message: msg}); err != nil {
+			return false, err
 		}
 	}
 }
 
-func (f *fileReader) emitError(ctx context.Context, out chan<- model.Envelope, err error) error {
-	if f.logger != nil {
-		f.logger.Error("mbox stream error", "path", f.path, "err", err)
+func (s *streamer) emitError(ctx context.Context, out chan<- model.Envelope, err error) error {
+	if s.logger != nil {
+		s.logger.Error("mbox stream error", "path", s.path, "err", err)
 	}
-	if err := f.emitEnvelope(ctx, out, model.Envelope{Err: err}); err != nil {
+	if err := s.emitEnvelope(ctx, out, model.Envelope{Err: err}); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (f *fileReader) emitEnvelope(ctx context.Context, out chan<- model.Envelope, env model.Envelope) error {
+// emitEnvelope sends env to out. The in-memory size of a message is
+// acquired from the budget first, which blocks while the pipeline already
+// holds too many message bytes. A message superseded by another variant of
+// its Message-ID is dropped instead.
+func (s *streamer) emitEnvelope(ctx context.Context, out chan<- model.Envelope, env model.Envelope) error {
+	if env.Err == nil && !s.dedupe.keep(env.Message) {
+		_ = env.Message.Release()
+		return nil
+	}
+	if env.Err == nil && s.logger != nil {
+		s.logger.Debug("message date", "messageID", env.Message.ID, "date", env.Message.ReceivedAt, "source", env.Message.DateSource)
+	}
+	size := env.Message.MemorySize()
+	if err := s.budget.Acquire(ctx, size); err != nil {
+		_ = env.Message.Release()
+		return err
+	}
+
 	select {
 	case <-ctx.Done():
+		s.budget.Release(size)
+		_ = env.Message.Release()
 		return ctx.Err()
 	case out <- env:
 		return nil
 	}
 }
 
-func parseMail(raw []byte) (model.Message, error) {
+// parseHeader extracts the Message-Id and date from raw, which may also be
+// just the header block of a message. The date is taken from the sources in
+// dateOrder, from being the envelope of the mbox separator line.
+func parseHeader(raw []byte, from string, dateOrder []string) (model.Message, error) {
 	msg, err := mail.ReadMessage(bytes.NewReader(raw))
 	if err != nil {
 		return model.Message{}, err
@@ -156,25 +787,18 @@ func parseMail(raw []byte) (model.Message, error) {
 		id = strings.TrimSpace(msg.Header.Get("Message-ID"))
 	}
 	id = strings.Trim(id, " <>")
-	if id == "" {
-		return model.Message{}, ErrMessageIDMissing
-	}
 
-	var receivedAt time.Time
-	if date := msg.Header.Get("Date"); date != "" {
-		if t, err := mail.ParseDate(date); err == nil {
-			receivedAt = t
-		}
-	}
-
-	sum := sha256.Sum256(raw)
-	hash := base64.StdEncoding.EncodeToString(sum[:])
-
-	return model.Message{
+	receivedAt, dateSource := messageDate(msg.Header, from, dateOrder)
+	parsed := model.Message{
 		ID:         id,
-		Hash:       hash,
 		ReceivedAt: receivedAt,
-	}, nil
+		DateSource: dateSource,
+	}
+	if id == "" {
+		// The date is still returned for the filter.
+		return parsed, ErrMessageIDMissing
+	}
+	return parsed, nil
 }
 
 type Producer struct {
@@ -183,6 +807,33 @@ type Producer struct {
 }
 
 func NewProducer(opts Options, r *runner.Runner, logger *slog.Logger) (*Producer, error) {
+	if opts.SpoolThreshold > 0 && opts.SpoolDir == "" {
+		dir, err := r.SpoolDir()
+		if err != nil {
+			return nil, fmt.Errorf("spool directory: %w", err)
+		}
+		opts.SpoolDir = dir
+	}
+	if opts.Budget == nil {
+		opts.Budget = r.Budget()
+	}
+	if opts.Checkpoints == nil {
+		opts.Checkpoints = r.Checkpoints()
+	}
+	if opts.UseIndex && opts.Processed == nil {
+		opts.Processed = r.Tracker().AlreadyProcessed
+	}
+	if opts.Superseded == nil {
+		opts.Superseded = func(msg model.Message) {
+			r.EmitEvent(stats.Event{Stage: stats.StageMbox, Type: stats.EventTypeSuperseded, MessageID: msg.ID})
+		}
+	}
+	if opts.Filtered == nil {
+		opts.Filtered = func(id string, rules []string) {
+			r.EmitEvent(stats.Event{Stage: stats.StageMbox, Type: stats.EventTypeFiltered, MessageID: id, Detail: strings.Join(rules, "; ")})
+		}
+	}
+
 	reader, err := NewReader(opts, logger)
 	if err != nil {
 		return nil, err
@@ -201,6 +852,15 @@ func (p *Producer) run(ctx context.Context) error {
 type MboxMessage struct {
 	Headers mail.Header
 	Body    []byte
+	// Size is the length of the raw message in bytes.
+	Size int64
+	// Date is the message date by DefaultDateOrder, zero when there is none.
+	Date time.Time
+	// Envelope is the envelope of the "From " separator line.
+	Envelope string
+	// Index is the position of the message in the file, counting messages
+	// that could not be parsed, as the import numbers them.
+	Index int
 }
 
 var (
@@ -210,22 +870,27 @@ var (
 
 // Read opens an mbox file and iterates through its messages,
 // calling the provided callback for each message.
-func Read(path string, callback func(m *MboxMessage) error) error {
-	var reader *mboxlib.Reader
+func Read(path string, format Format, callback func(m *MboxMessage) error) error {
+	var source io.Reader
 
 	if mbox_test_data_using {
-		reader = mboxlib.NewReader(bytes.NewReader(mbox_test_data))
+		source = bytes.NewReader(mbox_test_data)
 	} else {
 		file, err := os.Open(path)
 		if err != nil {
 			return fmt.Errorf("open mbox: %w", err)
 		}
 		defer file.Close()
-		reader = mboxlib.NewReader(file)
+		source = file
 	}
 
-	for {
-		msgReader, err := reader.NextMessage()
+	sc, err := newScanner(source, format)
+	if err != nil {
+		return fmt.Errorf("read mbox: %w", err)
+	}
+
+	for index := 0; ; index++ {
+		raw, err := sc.Next()
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				return nil
@@ -233,7 +898,7 @@ func Read(path string, callback func(m *MboxMessage) error) error {
 			return err
 		}
 
-		msg, err := mail.ReadMessage(msgReader)
+		msg, err := mail.ReadMessage(bytes.NewReader(raw.Raw))
 		if err != nil {
 			// try to continue
 			continue
@@ -245,9 +910,14 @@ func Read(path string, callback func(m *MboxMessage) error) error {
 			continue
 		}
 
+		date, _ := messageDate(msg.Header, raw.From, nil)
 		mboxMsg := &MboxMessage{
-			Headers: msg.Header,
-			Body:    body,
+			Headers:  msg.Header,
+			Body:     body,
+			Size:     raw.Size,
+			Date:     date,
+			Envelope: raw.From,
+			Index:    index,
 		}
 
 		if err := callback(mboxMsg); err != nil {
@@ -258,63 +928,62 @@ func Read(path string, callback func(m *MboxMessage) error) error {
 
 // CountMessages counts the total number of messages in an mbox file.
 // If progressCallback is provided, it will be called with (bytesRead, totalSize) during counting.
-func CountMessages(path string, progressCallback func(bytesRead, totalSize int64)) (int, error) {
-	var reader *mboxlib.Reader
-	var fileSize int64
-	var progressReader io.Reader
+func CountMessages(path string, format Format, progressCallback func(bytesRead, totalSize int64)) (int, error) {
+	return countMessages(path, format, progressCallback, nil)
+}
+
+// countMessages is CountMessages leaving out the messages skip reports, if
+// set. skip is called with the raw message.
+func countMessages(path string, format Format, progressCallback func(bytesRead, totalSize int64), skip func(raw []byte) bool) (int, error) {
+	var source io.Reader
 
 	if mbox_test_data_using {
-		reader = mboxlib.NewReader(bytes.NewReader(mbox_test_data))
+		source = bytes.NewReader(mbox_test_data)
 	} else {
 		file, err := os.Open(path)
 		if err != nil {
 			return 0, fmt.Errorf("open mbox: %w", err)
 		}
 		defer file.Close()
-
-		// Get file size for progress tracking
-		stat, err := file.Stat()
-		if err != nil {
-			return 0, fmt.Errorf("stat mbox: %w", err)
-		}
-		fileSize = stat.Size()
+		source = file
 
 		// Wrap file reader with progress tracking if callback provided
 		if progressCallback != nil {
-			progressReader = &progressTrackingReader{
+			stat, err := file.Stat()
+			if err != nil {
+				return 0, fmt.Errorf("stat mbox: %w", err)
+			}
+			source = &progressTrackingReader{
 				r:        file,
-				total:    fileSize,
+				total:    stat.Size(),
 				callback: progressCallback,
 			}
-			reader = mboxlib.NewReader(progressReader)
-		} else {
-			reader = mboxlib.NewReader(file)
 		}
 	}
 
+	sc, err := newScanner(source, format)
+	if err != nil {
+		return 0, fmt.Errorf("read mbox: %w", err)
+	}
+
 	count := 0
 	for {
-		msgReader, err := reader.NextMessage()
+		raw, err := sc.Next()
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				return count, nil
 			}
 			return 0, err
 		}
-
-		// Just consume the message without parsing
-		_, err = io.Copy(io.Discard, msgReader)
-		if err != nil {
-			// Continue counting even if we can't read this message
-			count++
+		if skip != nil && skip(raw.Raw) {
 			continue
 		}
-
 		count++
 	}
 }
 
 // progressTrackingReader wraps an io.Reader and reports progress via callback.
+// The callback runs every 100 reads and at the end of the data.
 type progressTrackingReader struct {
 	r         io.Reader
 	total     int64
@@ -327,7 +996,7 @@ func (p *progressTrackingReader) Read(buf []byte) (int, error) {
 	n, err := p.r.Read(buf)
 	p.read += int64(n)
 	p.readCount++
-	if p.callback != nil && p.readCount%100 == 0 {
+	if p.callback != nil && (p.readCount%100 == 0 || err == io.EOF) {
 		p.callback(p.read, p.total)
 	}
 	return n, err
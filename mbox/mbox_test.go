@@ -3,7 +3,11 @@ package mbox
 import (
 	"context"
 	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/dhcgn/mbox-to-imap/model"
 )
@@ -97,6 +101,24 @@ func TestStreamWithFilters(t *testing.T) {
 			},
 			expectedCount: 6,
 		},
+		{
+			name: "date range",
+			opts: Options{
+				Path:  "test_data/corrupted.mbox",
+				Since: time.Date(2025, 11, 13, 20, 15, 0, 0, time.UTC),
+				Until: time.Date(2025, 11, 13, 23, 59, 59, 0, time.UTC),
+			},
+			expectedCount: 3,
+		},
+		{
+			name: "size range",
+			opts: Options{
+				Path:    "test_data/corrupted.mbox",
+				MinSize: 15000,
+				MaxSize: 20000,
+			},
+			expectedCount: 1,
+		},
 	}
 
 	for _, tt := range tests {
@@ -138,3 +160,27 @@ func TestStreamWithFilters(t *testing.T) {
 		})
 	}
 }
+
+func TestReadIndexCountsUnparsable(t *testing.T) {
+	messages := []*rawMessage{
+		{From: "a@test Mon Jan  2 15:04:05 2006", Raw: []byte("Message-ID: <0@test>\r\n\r\nbody\r\n")},
+		{From: "a@test Mon Jan  2 15:04:05 2006", Raw: []byte("not a header line\r\n\r\nbody\r\n")},
+		{From: "a@test Mon Jan  2 15:04:05 2006", Raw: []byte("Message-ID: <2@test>\r\n\r\nbody\r\n")},
+	}
+	path := filepath.Join(t.TempDir(), "archive.mbox")
+	if err := os.WriteFile(path, writeMbox(t, FormatMboxo, messages), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var got []int
+	err := Read(path, FormatAuto, func(m *MboxMessage) error {
+		got = append(got, m.Index)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if fmt.Sprint(got) != "[0 2]" {
+		t.Errorf("indexes = %v, want [0 2]", got)
+	}
+}
@@ -0,0 +1,187 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// maxHeaderSize caps the header block kept in memory for a spooled message.
+const maxHeaderSize = 1 << 20
+
+// spoolBuffer collects a raw message in memory and moves it to a temporary
+// file in dir once it grows past threshold. The hash of a spooled message is
+// computed while writing, so it never has to be read back. A threshold of
+// zero keeps every message in memory.
+//
+// Write errors are sticky and reported by finish, which lets the scanner
+// write lines without checking every call.
+type spoolBuffer struct {
+	dir       string
+	threshold int64
+	hashMode  string
+
+	buf        bytes.Buffer
+	header     []byte
+	headerDone bool
+	file       *os.File
+	hash       *messageHasher
+	size       int64
+	err        error
+}
+
+func (b *spoolBuffer) Write(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	b.size += int64(len(p))
+
+	if b.file == nil {
+		b.buf.Write(p)
+		if b.threshold > 0 && int64(b.buf.Len()) > b.threshold {
+			b.spill()
+		}
+		return len(p), b.err
+	}
+
+	if !b.headerDone {
+		b.collectHeader(p)
+	}
+	b.hash.Write(p)
+	if _, err := b.file.Write(p); err != nil {
+		b.err = fmt.Errorf("write spool file: %w", err)
+	}
+	return len(p), b.err
+}
+
+func (b *spoolBuffer) WriteString(s string) (int, error) {
+	return b.Write([]byte(s))
+}
+
+// spill moves the buffered data to a new spool file. The header block is
+// kept in memory for parsing and filtering.
+func (b *spoolBuffer) spill() {
+	file, err := os.CreateTemp(b.dir, "message-*.eml")
+	if err != nil {
+		b.err = fmt.Errorf("create spool file: %w", err)
+		return
+	}
+	b.file = file
+
+	data := b.buf.Bytes()
+	b.collectHeader(data)
+	b.hash = newMessageHasher(b.hashMode)
+	b.hash.Write(data)
+	if _, err := file.Write(data); err != nil {
+		b.err = fmt.Errorf("write spool file: %w", err)
+	}
+	b.buf = bytes.Buffer{}
+}
+
+// collectHeader appends p to the header block until the blank line ending
+// the header has been seen.
+func (b *spoolBuffer) collectHeader(p []byte) {
+	b.header = append(b.header, p...)
+	block := headerBlock(b.header)
+	if len(block) < len(b.header) || len(b.header) >= maxHeaderSize {
+		b.header = bytes.Clone(block)
+		b.headerDone = true
+	}
+}
+
+// finish stores the collected message in msg, either as Raw or as a spool
+// file with its header and hash.
+func (b *spoolBuffer) finish(msg *rawMessage) error {
+	if b.file == nil {
+		msg.Raw = b.buf.Bytes()
+		msg.Size = b.size
+		return nil
+	}
+
+	if err := b.file.Close(); err != nil && b.err == nil {
+		b.err = fmt.Errorf("close spool file: %w", err)
+	}
+	if b.err != nil {
+		_ = os.Remove(b.file.Name())
+		return b.err
+	}
+
+	msg.Path = b.file.Name()
+	msg.Spooled = true
+	msg.Header = b.header
+	msg.Hash, msg.RawHash = b.hash.sums()
+	msg.Size = b.size
+	return nil
+}
+
+// discard removes the spool file, if any, after a failed read.
+func (b *spoolBuffer) discard() {
+	if b.file == nil {
+		return
+	}
+	_ = b.file.Close()
+	_ = os.Remove(b.file.Name())
+}
+
+// headerBlock returns the header of a raw message including the blank line
+// that ends it, or all of data if the header does not end within it.
+func headerBlock(data []byte) []byte {
+	if idx := bytes.Index(data, []byte("\r\n\r\n")); idx >= 0 {
+		return data[:idx+4]
+	}
+	if idx := bytes.Index(data, []byte("\n\n")); idx >= 0 {
+		return data[:idx+2]
+	}
+	return data
+}
+
+// readMessageFile reads a single message file. Files larger than threshold
+// stay on disk: only their header is read, and the hash in hashMode is
+// computed while streaming the file.
+func readMessageFile(path string, threshold int64, hashMode string) (*rawMessage, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if threshold <= 0 || info.Size() <= threshold {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return &rawMessage{Raw: raw, Size: int64(len(raw))}, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sum := newMessageHasher(hashMode)
+	r := bufio.NewReader(io.TeeReader(file, sum))
+
+	var header bytes.Buffer
+	for header.Len() < maxHeaderSize {
+		line, err := r.ReadBytes('\n')
+		header.Write(line)
+		if err != nil || len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+
+	size, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, rawHash := sum.sums()
+	return &rawMessage{
+		Path:    path,
+		Header:  header.Bytes(),
+		Hash:    hash,
+		RawHash: rawHash,
+		Size:    int64(header.Len()) + size,
+	}, nil
+}
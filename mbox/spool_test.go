@@ -0,0 +1,186 @@
+package mbox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dhcgn/mbox-to-imap/model"
+)
+
+func streamAll(t *testing.T, opts Options) []model.Message {
+	t.Helper()
+	reader, err := NewReader(opts, nil)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+
+	out := make(chan model.Envelope, 100)
+	if err := reader.Stream(context.Background(), out); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	close(out)
+
+	var messages []model.Message
+	for env := range out {
+		if env.Err != nil {
+			t.Fatalf("unexpected error: %v", env.Err)
+		}
+		messages = append(messages, env.Message)
+	}
+	return messages
+}
+
+func readMessage(t *testing.T, msg model.Message) []byte {
+	t.Helper()
+	body, err := msg.Open()
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("read message: %v", err)
+	}
+	return data
+}
+
+// writeSpoolMbox writes an mbox with messages on both sides of a 1 KiB
+// threshold, every second one mentioning "unsubscribe" in its body.
+func writeSpoolMbox(t *testing.T) string {
+	t.Helper()
+	var messages []*rawMessage
+	for i, lines := range []int{1, 200, 3, 500, 80, 2} {
+		body := strings.Repeat("line of body text\r\n", lines)
+		if i%2 == 1 {
+			body += "click here to unsubscribe\r\n"
+		}
+		// The first message has a header longer than the threshold.
+		received := ""
+		if i == 0 {
+			received = strings.Repeat("Received: from relay.example.com by mx.example.com\r\n", 40)
+		}
+		raw := fmt.Sprintf("%sMessage-ID: <%d@test>\r\nDate: Mon, 2 Jan 2006 15:04:0%d +0000\r\n\r\n%s", received, i, i, body)
+		messages = append(messages, &rawMessage{From: "sender@test Mon Jan  2 15:04:05 2006", Raw: []byte(raw)})
+	}
+
+	path := filepath.Join(t.TempDir(), "spool.mbox")
+	if err := os.WriteFile(path, writeMbox(t, FormatMboxrd, messages), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return path
+}
+
+func TestSpoolLargeMessages(t *testing.T) {
+	path := writeSpoolMbox(t)
+
+	inMemory := streamAll(t, Options{Path: path})
+
+	spoolDir := t.TempDir()
+	spooled := streamAll(t, Options{Path: path, SpoolThreshold: 1024, SpoolDir: spoolDir})
+
+	if len(spooled) != len(inMemory) {
+		t.Fatalf("got %d messages, want %d", len(spooled), len(inMemory))
+	}
+
+	spoolCount := 0
+	for i, msg := range spooled {
+		want := inMemory[i]
+		if msg.ID != want.ID || msg.Hash != want.Hash || msg.Size != want.Size || !msg.ReceivedAt.Equal(want.ReceivedAt) {
+			t.Errorf("message %d = %s/%s/%d, want %s/%s/%d", i, msg.ID, msg.Hash, msg.Size, want.ID, want.Hash, want.Size)
+		}
+		if !bytes.Equal(readMessage(t, msg), want.Raw) {
+			t.Errorf("message %d content differs from in-memory read", i)
+		}
+
+		if msg.Size > 1024 {
+			spoolCount++
+			if !msg.Spooled || msg.Raw != nil || filepath.Dir(msg.Path) != spoolDir {
+				t.Errorf("message %d of %d bytes was not spooled", i, msg.Size)
+			}
+		} else if msg.Spooled || msg.MemorySize() != msg.Size {
+			t.Errorf("message %d of %d bytes was spooled", i, msg.Size)
+		}
+
+		if err := msg.Release(); err != nil {
+			t.Errorf("Release() error = %v", err)
+		}
+	}
+	if spoolCount == 0 {
+		t.Fatal("fixture has no message above the threshold")
+	}
+
+	left, _ := os.ReadDir(spoolDir)
+	if len(left) != 0 {
+		t.Errorf("%d spool files left after Release", len(left))
+	}
+}
+
+func TestSpoolFilteredMessagesRemoved(t *testing.T) {
+	path := writeSpoolMbox(t)
+
+	inMemory := streamAll(t, Options{Path: path, ExcludeBody: []string{"(?i)unsubscribe"}})
+
+	spoolDir := t.TempDir()
+	spooled := streamAll(t, Options{Path: path, ExcludeBody: []string{"(?i)unsubscribe"}, SpoolThreshold: 1024, SpoolDir: spoolDir})
+
+	if len(inMemory) != 3 || len(spooled) != len(inMemory) {
+		t.Fatalf("got %d messages, want %d (body filter must see spooled bodies)", len(spooled), len(inMemory))
+	}
+
+	kept := 0
+	for _, msg := range spooled {
+		if msg.Spooled {
+			kept++
+		}
+	}
+	if kept == 0 {
+		t.Fatal("no kept message was spooled")
+	}
+	left, _ := os.ReadDir(spoolDir)
+	if len(left) != kept {
+		t.Errorf("%d spool files, want %d for the messages passed on", len(left), kept)
+	}
+}
+
+func TestMaildirLargeMessageStaysOnDisk(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "cur")
+	if err := os.MkdirAll(filepath.Join(root, "new"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	raw := "Message-ID: <large@test>\nSubject: large\n\n" + strings.Repeat("attachment data\n", 512)
+	file := filepath.Join(dir, "1000.a.host:2,S")
+	if err := os.WriteFile(file, []byte(raw), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	want := streamAll(t, Options{Type: SourceMaildir, Path: root})
+	got := streamAll(t, Options{Type: SourceMaildir, Path: root, SpoolThreshold: 1024})
+	if len(got) != 1 || len(want) != 1 {
+		t.Fatalf("got %d messages, want 1", len(got))
+	}
+
+	msg := got[0]
+	if msg.Raw != nil || msg.Path != file || msg.Spooled {
+		t.Errorf("message = raw %d bytes, path %q, spooled %v; want read from source file", len(msg.Raw), msg.Path, msg.Spooled)
+	}
+	if msg.ID != "large@test" || msg.Hash != want[0].Hash || msg.Size != int64(len(raw)) {
+		t.Errorf("message = %s/%s/%d, want large@test/%s/%d", msg.ID, msg.Hash, msg.Size, want[0].Hash, len(raw))
+	}
+	if err := msg.Release(); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("Release() removed the source file: %v", err)
+	}
+}
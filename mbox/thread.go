@@ -0,0 +1,71 @@
+package mbox
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/dhcgn/mbox-to-imap/filter"
+	"github.com/dhcgn/mbox-to-imap/model"
+)
+
+// threadReader pre-scans the source with prescan to collect the threads in
+// set, then streams it with reader, whose streamer allows the messages of
+// the selected threads.
+type threadReader struct {
+	reader  Reader
+	prescan Reader
+	set     *filter.ThreadSet
+	logger  *slog.Logger
+}
+
+func (t *threadReader) Stream(ctx context.Context, out chan<- model.Envelope) error {
+	if err := t.scan(ctx); err != nil {
+		return err
+	}
+	err := t.reader.Stream(ctx, out)
+	if t.logger != nil {
+		t.logger.Info("thread closure", "added", t.set.Stats().Added)
+	}
+	return err
+}
+
+// scan runs the pre-scan, which emits no messages. A read error ends it, as
+// it would end the import.
+func (t *threadReader) scan(ctx context.Context) error {
+	if t.logger != nil {
+		t.logger.Info("pre-scanning source for threads")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	envelopes := make(chan model.Envelope, 32)
+	done := make(chan error, 1)
+	go func() {
+		defer close(envelopes)
+		done <- t.prescan.Stream(ctx, envelopes)
+	}()
+
+	var scanErr error
+	for env := range envelopes {
+		if env.Err != nil && scanErr == nil {
+			scanErr = env.Err
+			cancel()
+		}
+		_ = env.Message.Release()
+	}
+	if err := <-done; scanErr == nil && err != nil {
+		scanErr = err
+	}
+	if scanErr != nil {
+		return fmt.Errorf("thread pre-scan: %w", scanErr)
+	}
+
+	t.set.Finish()
+	if t.logger != nil {
+		stats := t.set.Stats()
+		t.logger.Info("thread pre-scan finished", "messages", stats.Messages, "threads", stats.Threads, "selected", stats.Selected)
+	}
+	return nil
+}
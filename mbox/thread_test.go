@@ -0,0 +1,91 @@
+package mbox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dhcgn/mbox-to-imap/filter"
+)
+
+func TestThreadClosure(t *testing.T) {
+	message := func(id, refs, subject, body string) *rawMessage {
+		raw := fmt.Sprintf("Message-ID: <%s>\r\n%sSubject: %s\r\n\r\n%s\r\n", id, refs, subject, body)
+		return &rawMessage{From: "sender@test Mon Jan  2 15:04:05 2006", Raw: []byte(raw)}
+	}
+	messages := []*rawMessage{
+		message("reply@test", "In-Reply-To: <root@test>\r\n", "Re: status", "early reply"),
+		message("root@test", "", "Project X kickoff", "root"),
+		message("other@test", "", "lunch", "unrelated"),
+		message("late@test", "References: <root@test> <reply@test>\r\n", "Re: Re: status", "late reply"),
+		message("late@test", "References: <root@test> <reply@test>\r\n", "Re: Re: status", "late reply, edited"),
+	}
+	path := filepath.Join(t.TempDir(), "archive.mbox")
+	if err := os.WriteFile(path, writeMbox(t, FormatMboxo, messages), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"per message", Options{IncludeHeader: []string{`Subject: Project X`}}, "[1]"},
+		{"thread closure", Options{IncludeHeader: []string{`Subject: Project X`}, ThreadClosure: true}, "[0 1 3 4]"},
+		{"with dedupe", Options{IncludeHeader: []string{`Subject: Project X`}, ThreadClosure: true, MessageIDDedupe: DedupeLargest}, "[0 1 4]"},
+		{"excludes still apply", Options{IncludeHeader: []string{`Subject: Project X`}, ExcludeBody: []string{`edited`}, ThreadClosure: true}, "[0 1 3]"},
+		{"no thread selected", Options{IncludeHeader: []string{`Subject: nothing`}, ThreadClosure: true}, "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Path = path
+			var got []int
+			for _, msg := range streamAll(t, tt.opts) {
+				got = append(got, msg.Index)
+			}
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("indexes = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThreadClosure_Explain(t *testing.T) {
+	messages := []*rawMessage{
+		{From: "a@test Mon Jan  2 15:04:05 2006", Raw: []byte("Message-ID: <reply@test>\r\nIn-Reply-To: <root@test>\r\nSubject: Re: status\r\n\r\nreply\r\n")},
+		{From: "a@test Mon Jan  2 15:04:05 2006", Raw: []byte("Message-ID: <root@test>\r\nSubject: Project X\r\n\r\nroot\r\n")},
+		{From: "a@test Mon Jan  2 15:04:05 2006", Raw: []byte("Message-ID: <other@test>\r\nSubject: lunch\r\n\r\nother\r\n")},
+		{From: "a@test Mon Jan  2 15:04:05 2006", Raw: []byte("Message-ID: <root@test>\r\nSubject: Project X\r\n\r\nedited root\r\n")},
+	}
+	path := filepath.Join(t.TempDir(), "archive.mbox")
+	if err := os.WriteFile(path, writeMbox(t, FormatMboxo, messages), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// The pre-scans explain nothing, so every message is explained once.
+	var got, filtered []string
+	opts := Options{Path: path, IncludeHeader: []string{`Subject: Project X`}, ThreadClosure: true, MessageIDDedupe: DedupeFirst}
+	opts.Explain = func(e filter.Explanation) {
+		got = append(got, fmt.Sprintf("%d %s %s %s", e.Index, e.MessageID, e.Decision(), e.Detail()))
+	}
+	opts.Filtered = func(id string, rules []string) {
+		filtered = append(filtered, fmt.Sprintf("%s %q", id, rules))
+	}
+	streamAll(t, opts)
+
+	want := []string{
+		"0 reply@test allowed no include pattern; thread",
+		"1 root@test allowed include-header:Subject: Project X",
+		"2 other@test dropped no include pattern",
+		"3 root@test dropped include-header:Subject: Project X; message-id-dedupe",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("explanations = %q, want %q", got, want)
+	}
+	// The superseded variant is reported by Superseded instead.
+	if want := []string{`other@test ["no include pattern"]`}; !reflect.DeepEqual(filtered, want) {
+		t.Errorf("filtered = %q, want %q", filtered, want)
+	}
+}
@@ -0,0 +1,322 @@
+package mbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dhcgn/mbox-to-imap/filter"
+	"github.com/dhcgn/mbox-to-imap/model"
+)
+
+// X-Mozilla-Status bits, see nsMsgMessageFlags.
+const (
+	mozillaStatusRead     = 0x0001
+	mozillaStatusReplied  = 0x0002
+	mozillaStatusMarked   = 0x0004
+	mozillaStatusExpunged = 0x0008
+	mozillaStatusPartial  = 0x0400
+)
+
+// thunderbirdSpecialUse maps Thunderbird's default top-level folder names to
+// the IMAP special-use attribute of the matching server mailbox.
+var thunderbirdSpecialUse = map[string]string{
+	"Sent":   `\Sent`,
+	"Drafts": `\Drafts`,
+	"Trash":  `\Trash`,
+}
+
+// thunderbirdReader streams all folders of a Thunderbird profile, Mail
+// directory or single account directory. Each folder is an mbox file, its
+// subfolders live in a sibling "<name>.sbd" directory.
+type thunderbirdReader struct {
+	streamer
+}
+
+// thunderbirdFolder is a single folder mbox file.
+type thunderbirdFolder struct {
+	path       string
+	folder     string
+	specialUse string
+}
+
+func (t *thunderbirdReader) Stream(ctx context.Context, out chan<- model.Envelope) error {
+	folders, err := listThunderbird(t.path)
+	if err != nil {
+		return err
+	}
+
+	idx := 0
+	var consumed int64
+	for _, folder := range folders {
+		file, err := os.Open(folder.path)
+		if err != nil {
+			return fmt.Errorf("open thunderbird folder: %w", err)
+		}
+		base := consumed
+		if info, err := file.Stat(); err == nil {
+			consumed += info.Size()
+		}
+
+		// Expunged and partial messages are skipped before the filter, which
+		// would count them and fail on those without a Message-ID.
+		skip := func(header []byte) bool {
+			reason := thunderbirdSkipReason(header)
+			if reason != "" && t.logger != nil {
+				t.logger.Debug("skipping "+reason+" thunderbird message", "index", idx, "folder", folder.folder)
+			}
+			return reason != ""
+		}
+		apply := func(header []byte, msg *model.Message) {
+			status, _ := mozillaStatus(header)
+			msg.Folder = folder.folder
+			msg.SpecialUse = folder.specialUse
+			msg.Flags = mergeFlags(mozillaFlags(status), msg.Flags)
+			msg.Source = relativeSource(t.path, folder.path)
+			// Offsets are per folder file, so they only feed the progress
+			// display and never a resume checkpoint.
+			msg.Progress = base + msg.End
+			msg.End = 0
+		}
+
+		cont, err := t.streamMbox(ctx, out, file, &idx, skip, apply)
+		file.Close()
+		if err != nil || !cont {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listThunderbird resolves the account directories below root and returns
+// their folders in a deterministic order. For a profile or Mail directory
+// with more than one account the account name becomes the top-level folder,
+// and special-use folders are not mapped, so each account's Sent, Drafts and
+// Trash keep their own place in the hierarchy.
+func listThunderbird(root string) ([]thunderbirdFolder, error) {
+	accounts, err := thunderbirdAccounts(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var folders []thunderbirdFolder
+	for _, account := range accounts {
+		prefix := ""
+		if len(accounts) > 1 {
+			prefix = filepath.Base(account)
+		}
+		found, err := walkThunderbirdFolder(account, prefix, len(accounts) == 1)
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, found...)
+	}
+
+	return folders, nil
+}
+
+// thunderbirdAccounts returns the account directories for root, which may be
+// a profile directory (containing Mail/ and ImapMail/), a Mail directory or an
+// account directory holding folder mbox files itself.
+func thunderbirdAccounts(root string) ([]string, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("open thunderbird directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	var mailDirs []string
+	for _, name := range []string{"Mail", "ImapMail"} {
+		dir := filepath.Join(root, name)
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			mailDirs = append(mailDirs, dir)
+		}
+	}
+
+	if len(mailDirs) == 0 {
+		hasFolders, err := containsMboxFiles(root)
+		if err != nil {
+			return nil, err
+		}
+		if hasFolders {
+			return []string{root}, nil
+		}
+		mailDirs = []string{root}
+	}
+
+	var accounts []string
+	for _, dir := range mailDirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("read thunderbird mail directory: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && !strings.HasSuffix(entry.Name(), ".sbd") {
+				accounts = append(accounts, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	if len(accounts) == 0 {
+		return nil, fmt.Errorf("no thunderbird accounts found in %s", root)
+	}
+
+	return accounts, nil
+}
+
+// walkThunderbirdFolder collects the folder mbox files in dir and recurses
+// into their ".sbd" subfolder directories. top marks the top level of a
+// single account, the only place where special-use folder names are
+// recognised.
+func walkThunderbirdFolder(dir, parent string, top bool) ([]thunderbirdFolder, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read thunderbird folder: %w", err)
+	}
+
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			if strings.HasSuffix(name, ".sbd") {
+				names[strings.TrimSuffix(name, ".sbd")] = true
+			}
+			continue
+		}
+		if isMbox, err := isMboxFile(filepath.Join(dir, name)); err != nil {
+			return nil, err
+		} else if isMbox {
+			names[name] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var folders []thunderbirdFolder
+	for _, name := range sorted {
+		folder := name
+		if parent != "" {
+			folder = parent + "/" + name
+		}
+
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			specialUse := ""
+			if top {
+				specialUse = thunderbirdSpecialUse[name]
+			}
+			folders = append(folders, thunderbirdFolder{path: path, folder: folder, specialUse: specialUse})
+		}
+
+		sbd := path + ".sbd"
+		if info, err := os.Stat(sbd); err == nil && info.IsDir() {
+			children, err := walkThunderbirdFolder(sbd, folder, false)
+			if err != nil {
+				return nil, err
+			}
+			folders = append(folders, children...)
+		}
+	}
+
+	return folders, nil
+}
+
+// containsMboxFiles reports whether dir directly holds folder mbox files.
+func containsMboxFiles(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, fmt.Errorf("read thunderbird directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		isMbox, err := isMboxFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return false, err
+		}
+		if isMbox {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isMboxFile reports whether path starts with an mbox "From " separator.
+// This skips the .msf summary files and other profile data next to folders.
+func isMboxFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("open thunderbird folder: %w", err)
+	}
+	defer file.Close()
+
+	prefix := make([]byte, 5)
+	n, _ := file.Read(prefix)
+	return string(prefix[:n]) == "From ", nil
+}
+
+// mozillaStatus returns the value of the X-Mozilla-Status header of raw.
+func mozillaStatus(raw []byte) (int64, bool) {
+	header, _ := filter.SplitRawMessage(raw)
+	for _, line := range strings.Split(string(header), "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(name, "X-Mozilla-Status") {
+			continue
+		}
+		status, err := strconv.ParseInt(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		return status, true
+	}
+	return 0, false
+}
+
+// thunderbirdSkipReason returns why the message or header raw is not
+// imported, or "" to import it. Expunged messages were deleted but not yet
+// compacted; partial ones are offline copies of IMAP messages whose body was
+// never downloaded.
+func thunderbirdSkipReason(raw []byte) string {
+	status, ok := mozillaStatus(raw)
+	switch {
+	case !ok:
+		return ""
+	case status&mozillaStatusExpunged != 0:
+		return "expunged"
+	case status&mozillaStatusPartial != 0:
+		return "partial"
+	default:
+		return ""
+	}
+}
+
+// thunderbirdSkipped reports whether thunderbirdSkipReason is not empty.
+func thunderbirdSkipped(raw []byte) bool {
+	return thunderbirdSkipReason(raw) != ""
+}
+
+// mozillaFlags maps X-Mozilla-Status bits to IMAP system flags.
+func mozillaFlags(status int64) []string {
+	var flags []string
+	if status&mozillaStatusRead != 0 {
+		flags = append(flags, `\Seen`)
+	}
+	if status&mozillaStatusReplied != 0 {
+		flags = append(flags, `\Answered`)
+	}
+	if status&mozillaStatusMarked != 0 {
+		flags = append(flags, `\Flagged`)
+	}
+	return flags
+}
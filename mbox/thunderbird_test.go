@@ -0,0 +1,116 @@
+package mbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dhcgn/mbox-to-imap/filter"
+	"github.com/dhcgn/mbox-to-imap/model"
+)
+
+func thunderbirdMessage(id, status string) string {
+	return fmt.Sprintf("From - Mon Jan  2 15:04:05 2006\nX-Mozilla-Status: %s\nMessage-ID: <%s>\nSubject: %s\n\nbody\n\n", status, id, id)
+}
+
+func TestThunderbirdReader(t *testing.T) {
+	profile := t.TempDir()
+	files := map[string]string{
+		"prefs.js": "user_pref();",
+		"Mail/Local Folders/Inbox": thunderbirdMessage("inbox-1@test", "0001") + thunderbirdMessage("deleted@test", "0009") +
+			"From - Mon Jan  2 15:04:05 2006\nX-Mozilla-Status: 0008\nSubject: no id\n\nbody\n\n",
+		"Mail/Local Folders/Inbox.msf":                 "// <!-- <mdb:mork:z v=\"1.4\"/> -->",
+		"Mail/Local Folders/Sent":                      thunderbirdMessage("sent@test", "0003"),
+		"Mail/Local Folders/Archives":                  "",
+		"Mail/Local Folders/Archives.sbd/2019":         thunderbirdMessage("archive@test", "0004"),
+		"Mail/Local Folders/Archives.sbd/Sent":         thunderbirdMessage("nested-sent@test", "0000"),
+		"ImapMail/imap.example.com/INBOX":              thunderbirdMessage("imap@test", "0000") + thunderbirdMessage("partial@test", "0401"),
+		"ImapMail/imap.example.com/msgFilterRules.dat": "version=\"9\"",
+	}
+	for name, content := range files {
+		path := filepath.Join(profile, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	// Expunged and partial messages are skipped before the filter, so they
+	// are neither explained nor rejected for a missing Message-ID.
+	var explained []string
+	opts := Options{Type: SourceThunderbird, Path: profile, Explain: func(e filter.Explanation) {
+		explained = append(explained, e.MessageID)
+	}}
+	reader, err := NewReader(opts, nil)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+
+	out := make(chan model.Envelope, 10)
+	if err := reader.Stream(context.Background(), out); err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	close(out)
+
+	type result struct {
+		ID         string
+		Folder     string
+		SpecialUse string
+		Flags      []string
+	}
+	var got []result
+	for env := range out {
+		if env.Err != nil {
+			t.Fatalf("unexpected error: %v", env.Err)
+		}
+		msg := env.Message
+		got = append(got, result{msg.ID, msg.Folder, msg.SpecialUse, msg.Flags})
+	}
+
+	want := []result{
+		{"archive@test", "Local Folders/Archives/2019", "", []string{`\Flagged`}},
+		{"nested-sent@test", "Local Folders/Archives/Sent", "", nil},
+		{"inbox-1@test", "Local Folders/Inbox", "", []string{`\Seen`}},
+		// With several accounts each Sent keeps its own folder.
+		{"sent@test", "Local Folders/Sent", "", []string{`\Seen`, `\Answered`}},
+		{"imap@test", "imap.example.com/INBOX", "", nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Stream() =\n%+v\nwant\n%+v", got, want)
+	}
+	if len(explained) != len(want) {
+		t.Errorf("explained = %q, want the %d imported messages", explained, len(want))
+	}
+	// Count leaves out the expunged messages too, so a count based progress
+	// bar reaches its total.
+	if count, err := Count(opts, nil); err != nil || count != len(want) {
+		t.Errorf("Count() = %d, %v, want %d", count, err, len(want))
+	}
+
+	// A single account directory is imported without the account prefix.
+	folders, err := listThunderbird(filepath.Join(profile, "ImapMail", "imap.example.com"))
+	if err != nil {
+		t.Fatalf("listThunderbird() error = %v", err)
+	}
+	if len(folders) != 1 || folders[0].folder != "INBOX" {
+		t.Errorf("listThunderbird(account) = %+v, want single INBOX folder", folders)
+	}
+
+	// A single account maps its top-level Sent to the special-use mailbox.
+	folders, err = listThunderbird(filepath.Join(profile, "Mail", "Local Folders"))
+	if err != nil {
+		t.Fatalf("listThunderbird() error = %v", err)
+	}
+	specialUse := make(map[string]string)
+	for _, f := range folders {
+		specialUse[f.folder] = f.specialUse
+	}
+	if specialUse["Sent"] != `\Sent` || specialUse["Archives/Sent"] != "" {
+		t.Errorf("listThunderbird(account) special use = %v, want only Sent as \\Sent", specialUse)
+	}
+}
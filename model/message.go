@@ -1,14 +1,81 @@
 package model
 
-import "time"
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+)
 
 // Message represents a single email message extracted from an mbox archive.
 type Message struct {
 	ID         string
 	Hash       string
 	ReceivedAt time.Time
+	// DateSource names where ReceivedAt was taken from, such as "date" for
+	// the Date: header. It is empty when no date was found.
+	DateSource string
 	Size       int64
-	Raw        []byte
+	// RawHash is the hash of the raw bytes when Hash was computed in another
+	// mode, so state records written in raw mode still match.
+	RawHash string
+	// Raw holds the message in memory. It is nil for messages larger than the
+	// spool threshold, which are read from Path instead.
+	Raw []byte
+	// Path names the file holding the raw message when Raw is nil. Spooled
+	// marks it as a temporary file owned by the pipeline, see Release.
+	Path    string
+	Spooled bool
+	// Index is the position of the message in its source. For mbox files End
+	// is the byte offset just past the message, used for resume checkpoints;
+	// it is zero for other sources.
+	Index int
+	End   int64
+	// Progress is the number of source bytes consumed once the message was
+	// read, used for byte based progress. It is zero when unknown.
+	Progress int64
+	// Folder is the source folder relative to the target folder, using "/" as
+	// separator. It is empty for messages that go straight into the target.
+	Folder string
+	// Route is the folder a route rule picked, relative to the target folder
+	// like Folder. When set it takes the place of Folder and SpecialUse.
+	Route string
+	// Flags holds IMAP system flags (e.g. \Seen) carried over from the source.
+	Flags []string
+	// SpecialUse names the special-use attribute (e.g. \Sent) of the source
+	// folder, so the uploader can pick the server's matching mailbox.
+	SpecialUse string
+	// Source names the file the message was read from, relative to the
+	// source directory for directory sources. Envelope is the envelope of
+	// the mbox "From " separator line (sender and delivery date), empty for
+	// other sources.
+	Source   string
+	Envelope string
+}
+
+// Open returns a reader for the raw message.
+func (m Message) Open() (io.ReadCloser, error) {
+	if m.Raw != nil || m.Path == "" {
+		return io.NopCloser(bytes.NewReader(m.Raw)), nil
+	}
+	return os.Open(m.Path)
+}
+
+// MemorySize returns the number of bytes the message holds in memory.
+func (m Message) MemorySize() int64 {
+	return int64(len(m.Raw))
+}
+
+// Release removes the spool file of a spooled message. It is a no-op for
+// messages held in memory or read from their source file.
+func (m Message) Release() error {
+	if !m.Spooled || m.Path == "" {
+		return nil
+	}
+	if err := os.Remove(m.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 // Envelope wraps a message alongside an optional error encountered while decoding.
@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,12 +15,14 @@ import (
 	"github.com/dhcgn/mbox-to-imap/stats"
 )
 
-// Bar manages a progress bar for tracking message processing.
+// Bar manages a progress bar for tracking message processing. It counts
+// either messages or, in byte mode, source bytes consumed.
 type Bar struct {
 	pb             *pterm.ProgressbarPrinter
 	total          int
 	alreadyDone    int
 	currentScanned int
+	bytes          bool
 	mu             sync.Mutex
 	enabled        bool
 }
@@ -54,6 +59,36 @@ func New(total int, alreadyDone int, logLevel string) *Bar {
 	return bar
 }
 
+// NewBytes creates a progress bar that follows the position in the source
+// instead of a message count, so the source does not have to be counted
+// upfront. alreadyDone is only reported.
+func NewBytes(totalBytes int64, alreadyDone int, logLevel string) *Bar {
+	enabled := logLevel == "info"
+
+	bar := &Bar{
+		total:       int(totalBytes),
+		alreadyDone: alreadyDone,
+		bytes:       true,
+		enabled:     enabled,
+	}
+
+	if enabled {
+		pb, _ := pterm.DefaultProgressbar.
+			WithTotal(bar.total).
+			WithShowCount(false).
+			WithTitle("Processing messages").
+			Start()
+
+		bar.pb = pb
+
+		pterm.Info.Printf("Source size: %.1f MB\n", float64(totalBytes)/1024/1024)
+		pterm.Info.Printf("Already processed: %d\n", alreadyDone)
+		pterm.Println()
+	}
+
+	return bar
+}
+
 // Update increments the progress bar based on the event type.
 func (b *Bar) Update(evt stats.Event) {
 	if !b.enabled || b.pb == nil {
@@ -67,7 +102,11 @@ func (b *Bar) Update(evt stats.Event) {
 	case stats.EventTypeScanned:
 		b.currentScanned++
 		// Update progress for each scanned message
-		b.pb.Increment()
+		if !b.bytes {
+			b.pb.Increment()
+		} else if evt.Position > 0 {
+			b.pb.Current = min(int(evt.Position), b.total)
+		}
 
 		// Update title with current message ID (truncated)
 		if evt.MessageID != "" {
@@ -80,6 +119,12 @@ func (b *Bar) Update(evt stats.Event) {
 	case stats.EventTypeUploaded, stats.EventTypeDryRunUpload:
 		// Don't print individual success messages - let progress bar handle it
 		// This keeps the output clean
+	case stats.EventTypeSuperseded, stats.EventTypeFiltered:
+		// Superseded and filtered messages are never scanned, count them
+		// here instead.
+		if !b.bytes {
+			b.pb.Increment()
+		}
 	case stats.EventTypeDuplicate:
 		// Don't print individual duplicate messages - let progress bar handle it
 		// The final stats will show total duplicates
@@ -169,6 +214,17 @@ func (pr *ProgressReporter) collectStats(ctx context.Context, events <-chan stat
 		pterm.Info.Printf("Dry-run uploaded: %d\n", summary.DryRunUploaded)
 		pterm.Info.Printf("Duplicates (skipped): %d\n", summary.Duplicates)
 		pterm.Info.Printf("Errors: %d\n", summary.Errors)
+		if summary.Superseded > 0 {
+			pterm.Info.Printf("Superseded (message-id dedupe): %d\n", summary.Superseded)
+			pterm.Info.Printf("Message-ID conflicts: %d (see %s in the state directory)\n", len(summary.Conflicts), stats.ConflictReportName)
+		}
+		if summary.Filtered > 0 {
+			pterm.Info.Printf("Filtered: %d\n", summary.Filtered)
+			pterm.Info.Printf("Filter rules: %s\n", formatCounts(summary.FilterRules))
+		}
+		if len(summary.DateSources) > 0 {
+			pterm.Info.Printf("Date sources: %s\n", formatCounts(summary.DateSources))
+		}
 		if summary.LastError != nil {
 			pterm.Error.Printf("Last error: %v\n", summary.LastError)
 		}
@@ -237,3 +293,13 @@ func (cp *CountProgress) Stop() {
 	cp.pb.Stop()
 	pterm.Success.Printf("Message counting complete in %v\n", duration)
 }
+
+// formatCounts renders counts as "key=n" pairs sorted by key.
+func formatCounts(counts map[string]int) string {
+	keys := slices.Sorted(maps.Keys(counts))
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = fmt.Sprintf("%s=%d", key, counts[key])
+	}
+	return strings.Join(parts, ", ")
+}
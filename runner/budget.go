@@ -0,0 +1,63 @@
+package runner
+
+import (
+	"context"
+	"sync"
+)
+
+// Budget bounds the number of message bytes held in memory across the
+// pipeline. Producers acquire a message's in-memory size before handing it
+// on, and whoever finishes with the message releases it again.
+type Budget struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	changed chan struct{}
+}
+
+// NewBudget returns a budget of limit bytes. A limit of zero or less
+// disables the bound.
+func NewBudget(limit int64) *Budget {
+	return &Budget{limit: limit, changed: make(chan struct{})}
+}
+
+// Acquire blocks until n bytes are available or ctx is done. A request
+// larger than the whole budget is granted once nothing else is held, so a
+// single oversized message cannot stall the pipeline.
+func (b *Budget) Acquire(ctx context.Context, n int64) error {
+	if b == nil || b.limit <= 0 || n <= 0 {
+		return nil
+	}
+	n = min(n, b.limit)
+
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Release returns n bytes acquired earlier.
+func (b *Budget) Release(n int64) {
+	if b == nil || b.limit <= 0 || n <= 0 {
+		return
+	}
+	n = min(n, b.limit)
+
+	b.mu.Lock()
+	b.used = max(b.used-n, 0)
+	close(b.changed)
+	b.changed = make(chan struct{})
+	b.mu.Unlock()
+}
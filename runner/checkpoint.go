@@ -0,0 +1,137 @@
+package runner
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dhcgn/mbox-to-imap/model"
+	"github.com/dhcgn/mbox-to-imap/state"
+)
+
+// checkpointInterval limits how often the checkpoint file is rewritten.
+const checkpointInterval = time.Second
+
+// Checkpointer advances the checkpoint of an mbox source as messages are
+// committed. Messages are registered in stream order by the bridge and
+// committed by whichever stage finishes them, so the checkpoint only moves
+// past a message once every message before it was committed as well.
+type Checkpointer struct {
+	store *state.CheckpointStore
+
+	mu      sync.Mutex
+	active  bool
+	current state.Checkpoint
+	// prefix is the hash of the file up to the last saved offset.
+	prefix  *state.PrefixHash
+	pending []*pendingMessage
+	byIndex map[int]*pendingMessage
+	saved   time.Time
+	err     error
+}
+
+type pendingMessage struct {
+	index int
+	end   int64
+	done  bool
+}
+
+func NewCheckpointer(store *state.CheckpointStore) *Checkpointer {
+	return &Checkpointer{store: store, byIndex: make(map[int]*pendingMessage)}
+}
+
+// Load returns the stored checkpoint for source.
+func (c *Checkpointer) Load(source string) (state.Checkpoint, bool) {
+	if c == nil {
+		return state.Checkpoint{}, false
+	}
+	return c.store.Get(source)
+}
+
+// Start begins tracking from cp, which describes where the reader starts.
+func (c *Checkpointer) Start(cp state.Checkpoint) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active = true
+	c.current = cp
+	c.current.Hash = nil
+	c.prefix = cp.Hash
+	if c.prefix == nil || c.prefix.Offset() != cp.Offset {
+		c.prefix = state.NewPrefixHash(cp.Source)
+	}
+	c.saved = time.Now()
+}
+
+// Register records msg as handed on by the reader. Messages without a byte
+// position are ignored.
+func (c *Checkpointer) Register(msg model.Message) {
+	if c == nil || msg.End == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &pendingMessage{index: msg.Index, end: msg.End}
+	c.pending = append(c.pending, entry)
+	c.byIndex[msg.Index] = entry
+}
+
+// Commit marks msg as finished, either uploaded or skipped as duplicate.
+func (c *Checkpointer) Commit(msg model.Message) {
+	if c == nil || msg.End == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.byIndex[msg.Index]
+	if !ok {
+		return
+	}
+	entry.done = true
+
+	advanced := false
+	for len(c.pending) > 0 && c.pending[0].done {
+		head := c.pending[0]
+		c.pending = c.pending[1:]
+		delete(c.byIndex, head.index)
+		c.current.Index = head.index + 1
+		c.current.Offset = head.end
+		advanced = true
+	}
+
+	if advanced && time.Since(c.saved) >= checkpointInterval {
+		c.saveLocked()
+	}
+}
+
+// Flush writes the current checkpoint and returns the first error seen
+// while saving.
+func (c *Checkpointer) Flush() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active {
+		c.saveLocked()
+	}
+	return c.err
+}
+
+func (c *Checkpointer) saveLocked() {
+	c.saved = time.Now()
+	cp := c.current
+	if c.prefix == nil {
+		c.prefix = state.NewPrefixHash(cp.Source)
+	}
+	err := c.prefix.Extend(cp.Offset)
+	if err == nil {
+		cp.Prefix = c.prefix.Sum()
+		err = c.store.Put(cp)
+	}
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+}
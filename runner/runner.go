@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"os"
 	"sync"
 	"time"
 
@@ -29,7 +30,13 @@ type Runner struct {
 	uploads  chan model.Message
 	events   chan stats.Event
 
-	tracker state.Tracker
+	tracker     state.Tracker
+	budget      *Budget
+	checkpoints *Checkpointer
+
+	spoolOnce sync.Once
+	spoolDir  string
+	spoolErr  error
 
 	workWG  sync.WaitGroup
 	statsWG sync.WaitGroup
@@ -46,12 +53,22 @@ type Runner struct {
 func New(cfg config.Config, logger *slog.Logger) (*Runner, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	tracker, err := state.NewFileTracker(cfg.StateDir, !cfg.DryRun)
+	tracker, err := state.NewFileTracker(cfg.StateDir, !cfg.DryRun, cfg.HashMode)
 	if err != nil {
 		cancel()
 		return nil, fmt.Errorf("state tracker: %w", err)
 	}
 
+	var checkpoints *Checkpointer
+	if cfg.Checkpoint {
+		store, err := state.NewCheckpointStore(cfg.StateDir, !cfg.DryRun)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("checkpoint store: %w", err)
+		}
+		checkpoints = NewCheckpointer(store)
+	}
+
 	r := &Runner{
 		cfg:      cfg,
 		logger:   logger,
@@ -61,6 +78,9 @@ func New(cfg config.Config, logger *slog.Logger) (*Runner, error) {
 		uploads:  make(chan model.Message, 32),
 		events:   make(chan stats.Event, 128),
 		tracker:  tracker,
+		budget:   NewBudget(cfg.MemoryBudget),
+
+		checkpoints: checkpoints,
 	}
 
 	r.AddStage("bridge", r.bridge)
@@ -83,6 +103,35 @@ func (r *Runner) Tracker() state.Tracker {
 	return r.tracker
 }
 
+// Budget returns the memory budget shared by all stages.
+func (r *Runner) Budget() *Budget {
+	return r.budget
+}
+
+// Checkpoints returns the checkpointer for mbox sources, nil when resume
+// checkpoints are disabled.
+func (r *Runner) Checkpoints() *Checkpointer {
+	return r.checkpoints
+}
+
+// SpoolDir returns the directory for spooled messages, creating it on first
+// use. It is removed with everything in it once the pipeline has finished.
+func (r *Runner) SpoolDir() (string, error) {
+	r.spoolOnce.Do(func() {
+		r.spoolDir, r.spoolErr = os.MkdirTemp("", "mbox-to-imap-spool-")
+	})
+	return r.spoolDir, r.spoolErr
+}
+
+// Done releases the memory budget held by msg and removes its spool file.
+// Every stage that drops a message or finishes with it must call Done.
+func (r *Runner) Done(msg model.Message) {
+	r.budget.Release(msg.MemorySize())
+	if err := msg.Release(); err != nil {
+		r.logger.Warn("remove spool file", "path", msg.Path, "err", err)
+	}
+}
+
 func (r *Runner) MailboxWriter() chan<- model.Envelope {
 	return r.messages
 }
@@ -133,6 +182,16 @@ func (r *Runner) Start() error {
 
 	r.cancel()
 
+	if err := r.checkpoints.Flush(); err != nil {
+		r.logger.Warn("save checkpoint", "err", err)
+	}
+
+	if r.spoolDir != "" {
+		if err := os.RemoveAll(r.spoolDir); err != nil {
+			r.logger.Warn("remove spool directory", "path", r.spoolDir, "err", err)
+		}
+	}
+
 	err := r.err
 	duration := time.Since(r.since)
 	if err != nil {
@@ -162,29 +221,50 @@ func (r *Runner) bridge(ctx context.Context) error {
 			}
 
 			msg := envelope.Message
-			r.EmitEvent(stats.Event{Stage: stats.StageMbox, Type: stats.EventTypeScanned, MessageID: msg.ID})
+			r.checkpoints.Register(msg)
+			r.EmitEvent(stats.Event{Stage: stats.StageMbox, Type: stats.EventTypeScanned, MessageID: msg.ID, Position: msg.Progress})
 
 			if msg.ID == "" {
 				r.EmitEvent(stats.Event{Stage: stats.StageMbox, Type: stats.EventTypeError, Err: ErrMessageIDMissing})
 				r.fail(ErrMessageIDMissing)
+				r.Done(msg)
 				continue
 			}
 
-			if msg.Hash != "" && r.tracker.AlreadyProcessed(msg.Hash) {
+			if msg.Hash != "" && r.alreadyProcessed(msg) {
 				r.EmitEvent(stats.Event{Stage: stats.StageMbox, Type: stats.EventTypeDuplicate, MessageID: msg.ID})
+				r.checkpoints.Commit(msg)
+				r.Done(msg)
 				continue
 			}
 
 			select {
 			case <-ctx.Done():
+				r.Done(msg)
 				return ctx.Err()
 			case r.uploads <- msg:
-				r.EmitEvent(stats.Event{Stage: stats.StageMbox, Type: stats.EventTypeEnqueued, MessageID: msg.ID})
+				r.EmitEvent(stats.Event{Stage: stats.StageMbox, Type: stats.EventTypeEnqueued, MessageID: msg.ID, DateSource: msg.DateSource})
 			}
 		}
 	}
 }
 
+// alreadyProcessed reports whether the state holds msg. A message only
+// found by its raw hash, recorded before the hash mode was changed, is
+// recorded with its current hash as well so the next run finds it directly.
+func (r *Runner) alreadyProcessed(msg model.Message) bool {
+	if r.tracker.AlreadyProcessed(msg.Hash) {
+		return true
+	}
+	if !r.tracker.AlreadyProcessed(msg.RawHash) {
+		return false
+	}
+	if err := r.tracker.MarkProcessed(msg.Hash, msg.ID); err != nil && r.logger != nil {
+		r.logger.Warn("record message hash failed", "messageID", msg.ID, "err", err)
+	}
+	return true
+}
+
 func (r *Runner) closeUploads() {
 	r.closeUploadsOnce.Do(func() {
 		close(r.uploads)
@@ -0,0 +1,162 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Checkpoint records how far an mbox file has been imported, so the next run
+// can seek past the messages already committed instead of re-reading them.
+type Checkpoint struct {
+	// Source is the absolute path of the mbox file.
+	Source string `json:"source"`
+	// Offset is the byte offset just past the last contiguous committed
+	// message and Index the number of messages before it.
+	Offset int64 `json:"offset"`
+	Index  int   `json:"index"`
+	// Format is the resolved mbox variant, Options a fingerprint of the
+	// reader options. A checkpoint is only valid for the same options,
+	// otherwise messages filtered out before could be skipped.
+	Format  string `json:"format"`
+	Options string `json:"options"`
+	// Prefix is the PrefixChecksum of the file up to Offset.
+	Prefix string `json:"prefix"`
+	// Hash, if set, is the PrefixHash of the file up to Offset, so the
+	// checkpoints written after resuming from it extend it instead of
+	// hashing the prefix again.
+	Hash *PrefixHash `json:"-"`
+}
+
+// CheckpointStore keeps one checkpoint per source in checkpoints.json below
+// the state directory.
+type CheckpointStore struct {
+	mu      sync.Mutex
+	path    string
+	persist bool
+	entries map[string]Checkpoint
+}
+
+func NewCheckpointStore(stateDir string, persist bool) (*CheckpointStore, error) {
+	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+		return nil, fmt.Errorf("create state directory: %w", err)
+	}
+
+	store := &CheckpointStore{
+		path:    filepath.Join(stateDir, "checkpoints.json"),
+		persist: persist,
+		entries: make(map[string]Checkpoint),
+	}
+
+	data, err := os.ReadFile(store.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read checkpoint file: %w", err)
+	}
+	if err := json.Unmarshal(data, &store.entries); err != nil {
+		return nil, fmt.Errorf("parse checkpoint file: %w", err)
+	}
+	return store, nil
+}
+
+// Get returns the checkpoint stored for source.
+func (s *CheckpointStore) Get(source string) (Checkpoint, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp, ok := s.entries[source]
+	return cp, ok
+}
+
+// Put stores cp and rewrites the checkpoint file.
+func (s *CheckpointStore) Put(cp Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[cp.Source] = cp
+	if !s.persist {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode checkpoints: %w", err)
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write checkpoint file: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("replace checkpoint file: %w", err)
+	}
+	return nil
+}
+
+// PrefixChecksum hashes the first offset bytes of the file at path, see
+// PrefixHash.
+func PrefixChecksum(path string, offset int64) (string, error) {
+	prefix := NewPrefixHash(path)
+	if err := prefix.Extend(offset); err != nil {
+		return "", err
+	}
+	return prefix.Sum(), nil
+}
+
+// PrefixHash is the checksum of a growing prefix of a file. A checkpoint
+// only moves forward, so extending the hash reads just the bytes it moved
+// past instead of the whole prefix again.
+type PrefixHash struct {
+	path   string
+	offset int64
+	sum    hash.Hash
+}
+
+// NewPrefixHash returns the hash of the empty prefix of the file at path.
+func NewPrefixHash(path string) *PrefixHash {
+	return &PrefixHash{path: path, sum: sha256.New()}
+}
+
+// Offset returns the length of the hashed prefix.
+func (p *PrefixHash) Offset() int64 {
+	return p.offset
+}
+
+// Extend hashes the bytes of the file up to offset. A file shorter than
+// offset is hashed to its end and fails with io.ErrUnexpectedEOF.
+func (p *PrefixHash) Extend(offset int64) error {
+	if offset < p.offset {
+		return fmt.Errorf("prefix hash at %d cannot shrink to %d", p.offset, offset)
+	}
+	if offset == p.offset {
+		return nil
+	}
+	file, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	n, err := io.Copy(p.sum, io.NewSectionReader(file, p.offset, offset-p.offset))
+	p.offset += n
+	if err != nil {
+		return err
+	}
+	if p.offset < offset {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// Sum returns the checksum of the hashed prefix.
+func (p *PrefixHash) Sum() string {
+	return base64.StdEncoding.EncodeToString(p.sum.Sum(nil))
+}
@@ -64,14 +64,21 @@ type FileTracker struct {
 	*MemoryTracker
 	path    string
 	persist bool
+	mode    string
 }
 
+// fileRecord is a line of processed.jsonl. Mode is the hash mode the hash
+// was computed in; records without one were written in raw mode.
 type fileRecord struct {
 	Hash      string `json:"hash"`
 	MessageID string `json:"message_id"`
+	Mode      string `json:"mode,omitempty"`
 }
 
-func NewFileTracker(stateDir string, persist bool) (*FileTracker, error) {
+// NewFileTracker loads processed.jsonl from stateDir. New records are tagged
+// with hashMode. Records of every mode are loaded, as hashes of different
+// modes never collide.
+func NewFileTracker(stateDir string, persist bool, hashMode string) (*FileTracker, error) {
 	if strings.TrimSpace(stateDir) == "" {
 		return nil, fmt.Errorf("state directory is empty")
 	}
@@ -84,6 +91,7 @@ func NewFileTracker(stateDir string, persist bool) (*FileTracker, error) {
 		MemoryTracker: NewMemoryTracker(),
 		path:          filepath.Join(stateDir, "processed.jsonl"),
 		persist:       persist,
+		mode:          hashMode,
 	}
 
 	if err := tracker.load(); err != nil {
@@ -153,7 +161,7 @@ func (f *FileTracker) MarkProcessed(hash, messageID string) error {
 	}
 	defer file.Close()
 
-	record := fileRecord{Hash: hash, MessageID: messageID}
+	record := fileRecord{Hash: hash, MessageID: messageID, Mode: f.mode}
 	data, err := json.Marshal(record)
 	if err != nil {
 		return fmt.Errorf("encode state record: %w", err)
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"maps"
 	"sort"
 	"sync"
 	"time"
@@ -24,6 +25,8 @@ const (
 	EventTypeUploaded     EventType = "uploaded"
 	EventTypeDryRunUpload EventType = "dry_run_uploaded"
 	EventTypeDuplicate    EventType = "duplicate"
+	EventTypeSuperseded   EventType = "superseded"
+	EventTypeFiltered     EventType = "filtered"
 	EventTypeError        EventType = "error"
 )
 
@@ -33,16 +36,37 @@ type Event struct {
 	MessageID string
 	Err       error
 	Detail    string
+	// Position is the number of source bytes consumed, set on scanned
+	// events when the source reports it.
+	Position int64
+	// DateSource names where the message's date was taken from, set on
+	// enqueued events. Empty means no date was found.
+	DateSource string
 }
 
+// ConflictReportName is the file in the state directory listing the
+// variants of every conflicting Message-ID.
+const ConflictReportName = "conflicts.csv"
+
 type Summary struct {
 	Scanned        int
 	Enqueued       int
 	Uploaded       int
 	DryRunUploaded int
 	Duplicates     int
+	Superseded     int
+	Filtered       int
 	Errors         int
 	LastError      error
+	// DateSources counts the enqueued messages by the source of their date,
+	// with "none" for messages without one.
+	DateSources map[string]int
+	// Conflicts counts the superseded variants by Message-ID, for messages
+	// dropped by the Message-ID dedupe policy.
+	Conflicts map[string]int
+	// FilterRules counts the messages dropped by the filters by the rules
+	// that decided it, the Detail of their filtered events.
+	FilterRules map[string]int
 }
 
 func (s Summary) LogAttrs() []any {
@@ -54,6 +78,16 @@ func (s Summary) LogAttrs() []any {
 		"duplicates", s.Duplicates,
 		"errors", s.Errors,
 	}
+	if s.Superseded > 0 {
+		// The groups are listed in conflicts.csv, which may hold thousands.
+		attrs = append(attrs, "superseded", s.Superseded, "conflicts", len(s.Conflicts), "conflictReport", ConflictReportName)
+	}
+	if s.Filtered > 0 {
+		attrs = append(attrs, "filtered", s.Filtered, "filterRules", s.FilterRules)
+	}
+	if len(s.DateSources) > 0 {
+		attrs = append(attrs, "dateSources", s.DateSources)
+	}
 	if s.LastError != nil {
 		attrs = append(attrs, "lastError", s.LastError.Error())
 	}
@@ -86,6 +120,9 @@ func (c *Collector) Run(ctx context.Context, events <-chan Event) {
 func (c *Collector) Snapshot() Summary {
 	c.mu.Lock()
 	summary := c.summary
+	summary.DateSources = maps.Clone(c.summary.DateSources)
+	summary.Conflicts = maps.Clone(c.summary.Conflicts)
+	summary.FilterRules = maps.Clone(c.summary.FilterRules)
 	c.mu.Unlock()
 	return summary
 }
@@ -98,12 +135,32 @@ func (c *Collector) apply(evt Event) {
 		c.summary.Scanned++
 	case EventTypeEnqueued:
 		c.summary.Enqueued++
+		source := evt.DateSource
+		if source == "" {
+			source = "none"
+		}
+		if c.summary.DateSources == nil {
+			c.summary.DateSources = make(map[string]int)
+		}
+		c.summary.DateSources[source]++
 	case EventTypeUploaded:
 		c.summary.Uploaded++
 	case EventTypeDryRunUpload:
 		c.summary.DryRunUploaded++
 	case EventTypeDuplicate:
 		c.summary.Duplicates++
+	case EventTypeSuperseded:
+		c.summary.Superseded++
+		if c.summary.Conflicts == nil {
+			c.summary.Conflicts = make(map[string]int)
+		}
+		c.summary.Conflicts[evt.MessageID]++
+	case EventTypeFiltered:
+		c.summary.Filtered++
+		if c.summary.FilterRules == nil {
+			c.summary.FilterRules = make(map[string]int)
+		}
+		c.summary.FilterRules[evt.Detail]++
 	case EventTypeError:
 		c.summary.Errors++
 		if evt.Err != nil {